@@ -0,0 +1,334 @@
+package adnl
+
+import (
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/netip"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/Gealber/dht/tl"
+)
+
+var (
+	ErrNoAddress          = errors.New("no known address for the peer")
+	ErrUnsupportedAddress = errors.New("unsupported address")
+)
+
+// addressEntry keeps the latest address lists received from a peer.
+type addressEntry struct {
+	list     *tl.AdnlAddressList
+	priority *tl.AdnlAddressList
+}
+
+// addressBook keeps the address lists advertised by the peers, indexed by peer id.
+type addressBook struct {
+	mu      sync.Mutex
+	entries map[string]*addressEntry
+}
+
+func newAddressBook() *addressBook {
+	return &addressBook{entries: make(map[string]*addressEntry)}
+}
+
+// update stores the address lists included in pkt, sent by the peer with id peerIDStr,
+// in case they are newer than the ones we already know. Reports if any list was stored.
+func (b *addressBook) update(peerIDStr string, pkt tl.AdnlPacketContent) bool {
+	if pkt.Flags&(flagAddress|flagPriorityAddress) == 0 {
+		return false
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	entry, ok := b.entries[peerIDStr]
+	if !ok {
+		entry = &addressEntry{}
+		b.entries[peerIDStr] = entry
+	}
+
+	updated := false
+	if pkt.Flags&flagAddress != 0 && newerAddressList(entry.list, pkt.AddressList) {
+		list := pkt.AddressList
+		entry.list = &list
+		updated = true
+	}
+
+	if pkt.Flags&flagPriorityAddress != 0 && newerAddressList(entry.priority, pkt.PriorityAddressList) {
+		list := pkt.PriorityAddressList
+		entry.priority = &list
+		updated = true
+	}
+
+	return updated
+}
+
+// restore stores the address lists of the peer with id peerIDStr loaded from a peer store,
+// lists already known are only replaced by newer ones.
+func (b *addressBook) restore(peerIDStr string, list, priority tl.AdnlAddressList) {
+	b.update(peerIDStr, tl.AdnlPacketContent{
+		Flags:               flagAddress | flagPriorityAddress,
+		AddressList:         list,
+		PriorityAddressList: priority,
+	})
+}
+
+// lists returns the address lists known of the peer with id peerIDStr, empty ones
+// in case we don't know them.
+func (b *addressBook) lists(peerIDStr string) (tl.AdnlAddressList, tl.AdnlAddressList) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	list := tl.AdnlAddressList{Addresses: []any{}}
+	priority := tl.AdnlAddressList{Addresses: []any{}}
+
+	entry, ok := b.entries[peerIDStr]
+	if !ok {
+		return list, priority
+	}
+
+	if entry.list != nil {
+		list = *entry.list
+	}
+
+	if entry.priority != nil {
+		priority = *entry.priority
+	}
+
+	return list, priority
+}
+
+// newerAddressList reports if list should replace current. Lists of a newer instance of the
+// peer, with a greater reinit date, are always preferred, otherwise the version is compared.
+func newerAddressList(current *tl.AdnlAddressList, list tl.AdnlAddressList) bool {
+	// an empty list doesn't tell us how to reach the peer
+	if len(list.Addresses) == 0 {
+		return false
+	}
+
+	if current == nil || list.ReinitDate > current.ReinitDate {
+		return true
+	}
+
+	return list.ReinitDate == current.ReinitDate && list.Version > current.Version
+}
+
+// versions returns the versions of the address lists we know of the peer with id peerIDStr,
+// which are advertised to the peer in recv_addr_list_version and recv_priority_addr_list_version.
+func (b *addressBook) versions(peerIDStr string) (int64, int64) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	entry, ok := b.entries[peerIDStr]
+	if !ok {
+		return 0, 0
+	}
+
+	var version, priorityVersion int64
+	if entry.list != nil {
+		version = entry.list.Version
+	}
+
+	if entry.priority != nil {
+		priorityVersion = entry.priority.Version
+	}
+
+	return version, priorityVersion
+}
+
+// best returns the address that should be used for reaching the peer with id peerIDStr, among
+// the ones reported as usable. Addresses of the priority list are preferred, expired lists are ignored.
+func (b *addressBook) best(peerIDStr string, now time.Time, usable func(netip.Addr) bool) (netip.AddrPort, error) {
+	addrs := b.candidates(peerIDStr, now, usable)
+	if len(addrs) == 0 {
+		return netip.AddrPort{}, ErrNoAddress
+	}
+
+	return addrs[0], nil
+}
+
+// candidates returns the addresses of the peer with id peerIDStr reported as usable, in the
+// order they should be tried. Addresses of the priority list go first, expired lists are ignored.
+func (b *addressBook) candidates(peerIDStr string, now time.Time, usable func(netip.Addr) bool) []netip.AddrPort {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	entry, ok := b.entries[peerIDStr]
+	if !ok {
+		return nil
+	}
+
+	var addrs []netip.AddrPort
+	for _, list := range []*tl.AdnlAddressList{entry.priority, entry.list} {
+		addrs = append(addrs, usableAddresses(list, now, usable)...)
+	}
+
+	return addrs
+}
+
+// usableAddresses returns the addresses of list reported as usable, none in case list expired.
+func usableAddresses(list *tl.AdnlAddressList, now time.Time, usable func(netip.Addr) bool) []netip.AddrPort {
+	if list == nil || (list.ExpireAt != 0 && list.ExpireAt < now.Unix()) {
+		return nil
+	}
+
+	var addrs []netip.AddrPort
+	for _, addr := range list.Addresses {
+		ap, err := AddrPortFromAddress(addr)
+		if err == nil && usable(ap.Addr()) && !slices.Contains(addrs, ap) {
+			addrs = append(addrs, ap)
+		}
+	}
+
+	return addrs
+}
+
+// tunnel returns the tunnel address advertised by the peer with id peerIDStr, if any. Addresses
+// of the priority list are preferred, expired lists are ignored.
+func (b *addressBook) tunnel(peerIDStr string, now time.Time) (tl.AdnlAddressTunnel, bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	entry, ok := b.entries[peerIDStr]
+	if !ok {
+		return tl.AdnlAddressTunnel{}, false
+	}
+
+	for _, list := range []*tl.AdnlAddressList{entry.priority, entry.list} {
+		if list == nil || (list.ExpireAt != 0 && list.ExpireAt < now.Unix()) {
+			continue
+		}
+
+		for _, addr := range list.Addresses {
+			if hop, ok := addr.(tl.AdnlAddressTunnel); ok {
+				return hop, true
+			}
+		}
+	}
+
+	return tl.AdnlAddressTunnel{}, false
+}
+
+// Address returns the best known address of the peer with id peerID, according to the address
+// lists the peer advertised to us. Only addresses of the families we are listening on are returned.
+func (p *Peer) Address(peerID []byte) (netip.AddrPort, error) {
+	return p.addrBook.best(hex.EncodeToString(peerID), time.Now(), p.canReach)
+}
+
+// canReach reports if addr can be reached from the connection we are listening on. A socket
+// bound to the IPv6 unspecified address is dual stack, reaching both IPv4 and IPv6 addresses.
+func (p *Peer) canReach(addr netip.Addr) bool {
+	if p.parent != nil {
+		return p.parent.canReach(addr)
+	}
+
+	p.mu.Lock()
+	conn := p.conn
+	p.mu.Unlock()
+	if conn == nil {
+		return true
+	}
+
+	local := conn.LocalAddr()
+	if !local.IsValid() {
+		return false
+	}
+
+	if local.Addr().Is6() && local.Addr().IsUnspecified() {
+		return true
+	}
+
+	return local.Addr().Is4() == addr.Unmap().Is4()
+}
+
+// SetAddressList sets the addresses we are reachable at, advertised to the peers in the packets
+// sent with the first packet format. Every call increments the version of our address list.
+func (p *Peer) SetAddressList(addrs ...netip.AddrPort) error {
+	tlAddrs := make([]any, 0, len(addrs))
+	for _, addr := range addrs {
+		tlAddr, err := AddressFromAddrPort(addr)
+		if err != nil {
+			return err
+		}
+
+		tlAddrs = append(tlAddrs, tlAddr)
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	// versions are usually dates, but they must grow even if the list changes twice in a second
+	p.addrListVersion = max(time.Now().Unix(), p.addrListVersion+1)
+	p.addrs = tlAddrs
+
+	return nil
+}
+
+// ourAddressList returns the address list advertised to the peers, false in case we don't have one.
+func (p *Peer) ourAddressList() (tl.AdnlAddressList, bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if len(p.addrs) == 0 {
+		return tl.AdnlAddressList{}, false
+	}
+
+	return tl.AdnlAddressList{
+		Addresses:  p.addrs,
+		Version:    p.addrListVersion,
+		ReinitDate: p.reinitDate,
+	}, true
+}
+
+// AddrPortFromAddress converts an adnl.Address, either tl.AdnlAddressUDP or
+// tl.AdnlAddressUDP6, into a netip.AddrPort.
+func AddrPortFromAddress(addr any) (netip.AddrPort, error) {
+	var ip netip.Addr
+	var port int32
+
+	switch a := addr.(type) {
+	case tl.AdnlAddressUDP:
+		var b [4]byte
+		binary.BigEndian.PutUint32(b[:], uint32(a.IP))
+		ip, port = netip.AddrFrom4(b), a.Port
+	case tl.AdnlAddressUDP6:
+		if len(a.IP) != 16 {
+			return netip.AddrPort{}, ErrUnsupportedAddress
+		}
+		ip, port = netip.AddrFrom16([16]byte(a.IP)), a.Port
+	default:
+		return netip.AddrPort{}, fmt.Errorf("%w: %T", ErrUnsupportedAddress, addr)
+	}
+
+	if port <= 0 || port > 0xFFFF {
+		return netip.AddrPort{}, ErrUnsupportedAddress
+	}
+
+	return netip.AddrPortFrom(ip, uint16(port)), nil
+}
+
+// AddressFromAddrPort converts ap into an adnl.Address, tl.AdnlAddressUDP for IPv4 and
+// IPv4 mapped addresses, tl.AdnlAddressUDP6 for IPv6 addresses.
+func AddressFromAddrPort(ap netip.AddrPort) (any, error) {
+	addr := ap.Addr().Unmap()
+	if !addr.IsValid() || ap.Port() == 0 {
+		return nil, ErrUnsupportedAddress
+	}
+
+	if addr.Is4() {
+		ip := addr.As4()
+		return tl.AdnlAddressUDP{
+			IP:   int64(binary.BigEndian.Uint32(ip[:])),
+			Port: int32(ap.Port()),
+		}, nil
+	}
+
+	ip := addr.As16()
+	return tl.AdnlAddressUDP6{
+		IP:   ip[:],
+		Port: int32(ap.Port()),
+	}, nil
+}
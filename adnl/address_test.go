@@ -0,0 +1,200 @@
+package adnl
+
+import (
+	"context"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net"
+	"net/netip"
+	"testing"
+	"time"
+
+	"github.com/Gealber/dht/tl"
+)
+
+func Test_addressBook(t *testing.T) {
+	now := time.Now()
+	addr := func(port int32) any {
+		// 127.0.0.1
+		return tl.AdnlAddressUDP{IP: 0x7F000001, Port: port}
+	}
+	allFamilies := func(netip.Addr) bool { return true }
+	pkt := func(flags uint32, list tl.AdnlAddressList) tl.AdnlPacketContent {
+		return tl.AdnlPacketContent{Flags: flags, AddressList: list, PriorityAddressList: list}
+	}
+
+	b := newAddressBook()
+	if _, err := b.best("a", now, allFamilies); !errors.Is(err, ErrNoAddress) {
+		t.Fatalf("expected no address, got: %v", err)
+	}
+
+	steps := []struct {
+		name     string
+		pkt      tl.AdnlPacketContent
+		expected uint16
+	}{
+		{
+			name:     "first list",
+			pkt:      pkt(flagAddress, tl.AdnlAddressList{Addresses: []any{addr(1)}, Version: 10, ReinitDate: 5}),
+			expected: 1,
+		},
+		{
+			name:     "older version",
+			pkt:      pkt(flagAddress, tl.AdnlAddressList{Addresses: []any{addr(2)}, Version: 9, ReinitDate: 5}),
+			expected: 1,
+		},
+		{
+			name:     "empty list",
+			pkt:      pkt(flagAddress, tl.AdnlAddressList{Version: 11, ReinitDate: 5}),
+			expected: 1,
+		},
+		{
+			name:     "newer instance of the peer",
+			pkt:      pkt(flagAddress, tl.AdnlAddressList{Addresses: []any{addr(3)}, Version: 1, ReinitDate: 6}),
+			expected: 3,
+		},
+		{
+			name:     "expired priority list",
+			pkt:      pkt(flagPriorityAddress, tl.AdnlAddressList{Addresses: []any{addr(4)}, Version: 1, ReinitDate: 6, ExpireAt: now.Unix() - 1}),
+			expected: 3,
+		},
+		{
+			name:     "priority list",
+			pkt:      pkt(flagPriorityAddress, tl.AdnlAddressList{Addresses: []any{addr(5)}, Version: 2, ReinitDate: 6}),
+			expected: 5,
+		},
+	}
+
+	for _, step := range steps {
+		b.update("a", step.pkt)
+		got, err := b.best("a", now, allFamilies)
+		if err != nil {
+			t.Fatalf("%s: %s", step.name, err)
+		}
+
+		if got.Port() != step.expected {
+			t.Fatalf("%s: expected port %d got %d", step.name, step.expected, got.Port())
+		}
+	}
+
+	version, priorityVersion := b.versions("a")
+	if version != 1 || priorityVersion != 2 {
+		t.Fatalf("unexpected versions %d %d", version, priorityVersion)
+	}
+
+	// IPv6 address preferred, unless we can only reach IPv4 addresses
+	ip6 := tl.AdnlAddressUDP6{IP: netip.IPv6Loopback().AsSlice(), Port: 6}
+	b.update("a", pkt(flagPriorityAddress, tl.AdnlAddressList{Addresses: []any{ip6, addr(7)}, Version: 3, ReinitDate: 6}))
+
+	got, err := b.best("a", now, allFamilies)
+	if err != nil || got.Port() != 6 {
+		t.Fatalf("expected IPv6 address, got %s err: %v", got, err)
+	}
+
+	got, err = b.best("a", now, netip.Addr.Is4)
+	if err != nil || got.Port() != 7 {
+		t.Fatalf("expected IPv4 address, got %s err: %v", got, err)
+	}
+}
+
+func TestAddressFromAddrPort(t *testing.T) {
+	tcs := []struct {
+		addr     string
+		expected any
+	}{
+		{addr: "10.1.2.3:30303", expected: tl.AdnlAddressUDP{}},
+		{addr: "[::ffff:10.1.2.3]:30303", expected: tl.AdnlAddressUDP{}},
+		{addr: "[2001:db8::1]:30303", expected: tl.AdnlAddressUDP6{}},
+	}
+
+	for _, tc := range tcs {
+		ap := netip.MustParseAddrPort(tc.addr)
+		tlAddr, err := AddressFromAddrPort(ap)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if fmt.Sprintf("%T", tlAddr) != fmt.Sprintf("%T", tc.expected) {
+			t.Fatalf("%s: expected %T got %T", tc.addr, tc.expected, tlAddr)
+		}
+
+		got, err := AddrPortFromAddress(tlAddr)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if got.Addr() != ap.Addr().Unmap() || got.Port() != ap.Port() {
+			t.Fatalf("expected %s got %s", ap, got)
+		}
+	}
+
+	_, err := AddrPortFromAddress(tl.AdnlAddressUDP6{IP: []byte{1}, Port: 1})
+	if !errors.Is(err, ErrUnsupportedAddress) {
+		t.Fatalf("expected unsupported address, got: %v", err)
+	}
+}
+
+func TestPeerAddressList(t *testing.T) {
+	a, aAddr := newTestPeer(t)
+	b, bAddr := newTestPeer(t)
+
+	err := a.SetAddressList(aAddr)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = a.SendMessage(context.Background(), b.pubKey, bAddr, tl.AdnlMessageNop{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	waitFor(t, 2*time.Second, func() bool {
+		got, err := b.Address(a.id)
+		return err == nil && got == aAddr
+	})
+
+	// b tells a the version of the list it knows in its packets
+	version, _ := b.addrBook.versions(hex.EncodeToString(a.id))
+	if version != a.addrListVersion {
+		t.Fatalf("expected version %d got %d", a.addrListVersion, version)
+	}
+}
+
+func TestPeerIPv6Loopback(t *testing.T) {
+	listen := func() net.PacketConn {
+		conn, err := net.ListenPacket("udp6", "[::1]:0")
+		if err != nil {
+			t.Skip("IPv6 not available:", err)
+		}
+
+		return conn
+	}
+
+	a, aAddr := newTestPeerOn(t, listen())
+	b, bAddr := newTestPeerOn(t, listen())
+
+	if !a.canReach(bAddr.Addr()) || a.canReach(netip.MustParseAddr("127.0.0.1")) {
+		t.Fatal("a peer listening on an IPv6 address should only reach IPv6 addresses")
+	}
+
+	err := a.SetAddressList(aAddr)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = a.SendMessage(context.Background(), b.pubKey, bAddr, tl.Ping{Value: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	waitFor(t, 2*time.Second, func() bool {
+		got, err := b.Address(a.id)
+		return err == nil && got == aAddr
+	})
+
+	// the PONG is sent back to a
+	waitFor(t, 2*time.Second, func() bool {
+		return confirmed(a, b)
+	})
+}
@@ -0,0 +1,357 @@
+package adnl
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net/netip"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/Gealber/dht/tl"
+	"github.com/Gealber/dht/utils"
+)
+
+// captureMagic starts the capture files, followed by the version of the format
+var captureMagic = []byte("ADNLCAP\x01")
+
+// maxCaptureRecordSize max size of a packet in a capture file, bigger ones mean the file is corrupted
+const maxCaptureRecordSize = 1 << 20
+
+var (
+	ErrCorruptedCapture = errors.New("corrupted capture file")
+	ErrReplayDirection  = errors.New("unknown capture record direction")
+)
+
+// Direction of a captured packet.
+type Direction uint8
+
+const (
+	// DirectionIn packet received from the peer
+	DirectionIn Direction = iota
+	// DirectionOut packet sent to the peer
+	DirectionOut
+)
+
+func (d Direction) String() string {
+	switch d {
+	case DirectionIn:
+		return "in"
+	case DirectionOut:
+		return "out"
+	default:
+		return fmt.Sprintf("direction(%d)", uint8(d))
+	}
+}
+
+// CaptureRecord is a packet exchanged with a peer, captured once decrypted.
+type CaptureRecord struct {
+	Time      time.Time
+	Direction Direction
+	// PeerID and PeerKey identify the peer on the other side
+	PeerID  []byte
+	PeerKey ed25519.PublicKey
+	// Addr the packet was received from or sent to
+	Addr netip.AddrPort
+	// Channel is set if the packet was exchanged through a channel, otherwise the first packet format was used
+	Channel bool
+	// Data the serialized adnl.packetContents
+	Data []byte
+}
+
+// CaptureHook is called with each packet received or sent by a peer, it's called from the goroutines
+// processing the packets so it must not block. The record is owned by the hook.
+type CaptureHook func(rec CaptureRecord)
+
+// CaptureHeader starts a capture file, identifying the peer which captured the packets.
+type CaptureHeader struct {
+	PubKey ed25519.PublicKey
+	// ReinitDate reinit date of the peer while capturing
+	ReinitDate int64
+}
+
+// SetCaptureHook sets the hook called with the packets received and sent by the peer, nil disables it.
+func (p *Peer) SetCaptureHook(hook CaptureHook) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.capture = hook
+}
+
+// Capture writes the packets received and sent by the peer to w, until the capture hook is replaced.
+// Errors writing the records are logged, the packets are processed anyway.
+func (p *Peer) Capture(w io.Writer) (*CaptureWriter, error) {
+	p.mu.Lock()
+	reinitDate := p.reinitDate
+	p.mu.Unlock()
+
+	cw, err := NewCaptureWriter(w, CaptureHeader{PubKey: p.pubKey, ReinitDate: reinitDate})
+	if err != nil {
+		return nil, err
+	}
+
+	p.SetCaptureHook(func(rec CaptureRecord) {
+		err := cw.Write(rec)
+		if err != nil {
+			p.logger.Error("failed writing capture record", "err", err)
+		}
+	})
+
+	return cw, nil
+}
+
+// captureHook returns the capture hook, nil in case the packets aren't captured.
+func (p *Peer) captureHook() CaptureHook {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	return p.capture
+}
+
+// capturePacket calls hook, if any, with the packet data exchanged with the peer with id peerID.
+func capturePacket(hook CaptureHook, dir Direction, peerID []byte, peerKey ed25519.PublicKey, addr netip.AddrPort, ch bool, data []byte) {
+	if hook == nil {
+		return
+	}
+
+	hook(CaptureRecord{
+		Time:      time.Now(),
+		Direction: dir,
+		PeerID:    slices.Clone(peerID),
+		PeerKey:   slices.Clone(peerKey),
+		Addr:      addr,
+		Channel:   ch,
+		Data:      slices.Clone(data),
+	})
+}
+
+// CaptureWriter writes capture records to a capture file. The file starts with the magic and the
+// header, followed by the records. Each record is stored as:
+// | TIME UNIX NANO(8 bytes) | DIRECTION(1 byte) | CHANNEL(1 byte) | PEER KEY(32 bytes) | ADDR SIZE(1 byte) | ADDR | DATA SIZE(4 bytes) | DATA |
+// Integers are little endian and the address is in netip.AddrPort binary format.
+type CaptureWriter struct {
+	w io.Writer
+	// mu serializes the records, written with a single call to w
+	mu sync.Mutex
+}
+
+// NewCaptureWriter writes the header of a capture file to w, returning the writer of its records.
+func NewCaptureWriter(w io.Writer, header CaptureHeader) (*CaptureWriter, error) {
+	if len(header.PubKey) != ed25519.PublicKeySize {
+		return nil, ErrInvalidPubKey
+	}
+
+	var buff bytes.Buffer
+	buff.Write(captureMagic)
+	buff.Write(header.PubKey)
+	binary.Write(&buff, binary.LittleEndian, header.ReinitDate)
+
+	_, err := w.Write(buff.Bytes())
+	if err != nil {
+		return nil, err
+	}
+
+	return &CaptureWriter{w: w}, nil
+}
+
+// Write appends rec to the capture file.
+func (c *CaptureWriter) Write(rec CaptureRecord) error {
+	if len(rec.PeerKey) != ed25519.PublicKeySize {
+		return ErrInvalidPubKey
+	}
+
+	addr, err := rec.Addr.MarshalBinary()
+	if err != nil {
+		return err
+	}
+
+	var ch uint8
+	if rec.Channel {
+		ch = 1
+	}
+
+	var buff bytes.Buffer
+	binary.Write(&buff, binary.LittleEndian, rec.Time.UnixNano())
+	buff.WriteByte(byte(rec.Direction))
+	buff.WriteByte(ch)
+	buff.Write(rec.PeerKey)
+	buff.WriteByte(byte(len(addr)))
+	buff.Write(addr)
+	binary.Write(&buff, binary.LittleEndian, uint32(len(rec.Data)))
+	buff.Write(rec.Data)
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	_, err = c.w.Write(buff.Bytes())
+	return err
+}
+
+// CaptureReader reads the records of a capture file.
+type CaptureReader struct {
+	r      io.Reader
+	header CaptureHeader
+}
+
+// NewCaptureReader reads the header of the capture file in r.
+func NewCaptureReader(r io.Reader) (*CaptureReader, error) {
+	buff := make([]byte, len(captureMagic)+ed25519.PublicKeySize+8)
+	_, err := io.ReadFull(r, buff)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %w", ErrCorruptedCapture, err)
+	}
+
+	if !bytes.Equal(buff[:len(captureMagic)], captureMagic) {
+		return nil, fmt.Errorf("%w: unknown magic %x", ErrCorruptedCapture, buff[:len(captureMagic)])
+	}
+	buff = buff[len(captureMagic):]
+
+	return &CaptureReader{
+		r: r,
+		header: CaptureHeader{
+			PubKey:     ed25519.PublicKey(buff[:ed25519.PublicKeySize]),
+			ReinitDate: int64(binary.LittleEndian.Uint64(buff[ed25519.PublicKeySize:])),
+		},
+	}, nil
+}
+
+// Header returns the header of the capture file.
+func (c *CaptureReader) Header() CaptureHeader {
+	return c.header
+}
+
+// Next returns the next record of the capture file, io.EOF once all of them were read.
+func (c *CaptureReader) Next() (CaptureRecord, error) {
+	var rec CaptureRecord
+
+	fixed := make([]byte, 8+1+1+ed25519.PublicKeySize+1)
+	_, err := io.ReadFull(c.r, fixed)
+	if errors.Is(err, io.EOF) {
+		return rec, io.EOF
+	}
+	if err != nil {
+		return rec, fmt.Errorf("%w: %w", ErrCorruptedCapture, err)
+	}
+
+	rec.Time = time.Unix(0, int64(binary.LittleEndian.Uint64(fixed)))
+	rec.Direction = Direction(fixed[8])
+	rec.Channel = fixed[9] == 1
+	rec.PeerKey = ed25519.PublicKey(fixed[10 : 10+ed25519.PublicKeySize])
+	rec.PeerID, err = utils.KeyIDEd25519(rec.PeerKey)
+	if err != nil {
+		return rec, err
+	}
+
+	addr := make([]byte, int(fixed[len(fixed)-1])+4)
+	_, err = io.ReadFull(c.r, addr)
+	if err != nil {
+		return rec, fmt.Errorf("%w: %w", ErrCorruptedCapture, err)
+	}
+
+	err = rec.Addr.UnmarshalBinary(addr[:len(addr)-4])
+	if err != nil {
+		return rec, fmt.Errorf("%w: %w", ErrCorruptedCapture, err)
+	}
+
+	size := binary.LittleEndian.Uint32(addr[len(addr)-4:])
+	if size > maxCaptureRecordSize {
+		return rec, fmt.Errorf("%w: record of %d bytes", ErrCorruptedCapture, size)
+	}
+
+	rec.Data = make([]byte, size)
+	_, err = io.ReadFull(c.r, rec.Data)
+	if err != nil {
+		return rec, fmt.Errorf("%w: %w", ErrCorruptedCapture, err)
+	}
+
+	return rec, nil
+}
+
+// Replay feeds the records read from r into the peer, returning the amount of records replayed.
+// The peer takes the reinit date of the captured peer, so the packets sent to it are accepted.
+// SetReinitDate should be called with it before the peer starts serving, otherwise the packets
+// sent meanwhile have a different reinit date. Records that fail are skipped, their errors are
+// joined in the returned error.
+func (p *Peer) Replay(r *CaptureReader) (int, error) {
+	p.SetReinitDate(r.Header().ReinitDate)
+
+	var errs []error
+	n := 0
+	for {
+		rec, err := r.Next()
+		if errors.Is(err, io.EOF) {
+			return n, errors.Join(errs...)
+		}
+		if err != nil {
+			return n, errors.Join(append(errs, err)...)
+		}
+
+		err = p.ReplayRecord(rec)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("record %d: %w", n, err))
+		}
+		n++
+	}
+}
+
+// ReplayRecord feeds a captured packet into the peer. Received packets are processed as if they
+// were received again from the captured address, answers included. Sent packets aren't sent
+// again, they restore the seqnos and pending queries of the peer, so the later packets confirming
+// them or answering them are accepted.
+func (p *Peer) ReplayRecord(rec CaptureRecord) error {
+	peerID, err := p.computePeerID(rec.PeerKey)
+	if err != nil {
+		return err
+	}
+	peerIDStr := hex.EncodeToString(peerID[:])
+
+	switch rec.Direction {
+	case DirectionIn:
+		var ch *channel
+		if rec.Channel {
+			p.mu.Lock()
+			ch, err = p.peerChannel(p.peerState(peerIDStr, rec.PeerKey))
+			p.mu.Unlock()
+			if err != nil {
+				return err
+			}
+		}
+
+		return p.processPacket(rec.Addr, rec.PeerKey, ch, rec.Data)
+	case DirectionOut:
+		var pkt tl.AdnlPacketContent
+		err = p.tlH.Parse(rec.Data, &pkt, true)
+		if err != nil {
+			return err
+		}
+
+		msgs := pkt.Messages
+		if pkt.Message != nil {
+			msgs = append([]any{pkt.Message}, msgs...)
+		}
+
+		p.mu.Lock()
+		defer p.mu.Unlock()
+
+		state := p.peerState(peerIDStr, rec.PeerKey)
+		if pkt.Flags&flagSeqno != 0 {
+			state.outSeqno = max(state.outSeqno, pkt.Seqno)
+		}
+
+		for _, msg := range msgs {
+			if query, ok := msg.(tl.AdnlMessageQuery); ok {
+				// nobody waits for the answer, the channel is buffered
+				p.queries[hex.EncodeToString(query.QueryID)] = make(chan []byte, 1)
+			}
+		}
+
+		return nil
+	default:
+		return fmt.Errorf("%w: %d", ErrReplayDirection, rec.Direction)
+	}
+}
@@ -0,0 +1,199 @@
+package adnl
+
+import (
+	"bytes"
+	"context"
+	"crypto/ed25519"
+	"errors"
+	"io"
+	"net/netip"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/Gealber/dht/adnl/memnet"
+	"github.com/Gealber/dht/tl"
+)
+
+// lockedBuffer is a bytes.Buffer safe for concurrent use.
+type lockedBuffer struct {
+	buff bytes.Buffer
+	mu   sync.Mutex
+}
+
+func (b *lockedBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	return b.buff.Write(p)
+}
+
+func (b *lockedBuffer) Bytes() []byte {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	return bytes.Clone(b.buff.Bytes())
+}
+
+func echoHandler(from ed25519.PublicKey, query []byte) ([]byte, error) {
+	return query, nil
+}
+
+func TestCaptureFile(t *testing.T) {
+	pubKey, _, _ := ed25519.GenerateKey(nil)
+	var buff bytes.Buffer
+	cw, err := NewCaptureWriter(&buff, CaptureHeader{PubKey: pubKey, ReinitDate: 1700000000})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	records := []CaptureRecord{
+		{Time: time.Unix(10, 5), Direction: DirectionIn, PeerKey: pubKey, Addr: netip.MustParseAddrPort("1.2.3.4:5"), Data: []byte{1, 2, 3}},
+		{Time: time.Unix(11, 0), Direction: DirectionOut, PeerKey: pubKey, Addr: netip.MustParseAddrPort("[::1]:6"), Channel: true, Data: []byte{}},
+		{Time: time.Unix(12, 0), Direction: DirectionOut, PeerKey: pubKey},
+	}
+	for _, rec := range records {
+		if err := cw.Write(rec); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	r, err := NewCaptureReader(bytes.NewReader(buff.Bytes()))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if h := r.Header(); !bytes.Equal(h.PubKey, pubKey) || h.ReinitDate != 1700000000 {
+		t.Fatalf("unexpected header %+v", h)
+	}
+
+	for _, want := range records {
+		got, err := r.Next()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if !got.Time.Equal(want.Time) || got.Direction != want.Direction || got.Addr != want.Addr ||
+			got.Channel != want.Channel || !bytes.Equal(got.Data, want.Data) || !bytes.Equal(got.PeerKey, want.PeerKey) {
+			t.Fatalf("got record %+v want %+v", got, want)
+		}
+
+		if len(got.PeerID) != 32 {
+			t.Fatalf("unexpected peer id %x", got.PeerID)
+		}
+	}
+
+	if _, err := r.Next(); !errors.Is(err, io.EOF) {
+		t.Fatalf("expected EOF got %v", err)
+	}
+
+	// truncated record
+	r, _ = NewCaptureReader(bytes.NewReader(buff.Bytes()[:buff.Len()-10]))
+	for err == nil {
+		_, err = r.Next()
+	}
+
+	if !errors.Is(err, ErrCorruptedCapture) {
+		t.Fatalf("expected corrupted capture got %v", err)
+	}
+
+	if _, err := NewCaptureReader(bytes.NewReader([]byte("not a capture file at all, not at all......"))); !errors.Is(err, ErrCorruptedCapture) {
+		t.Fatalf("expected corrupted capture got %v", err)
+	}
+}
+
+func TestCaptureReplay(t *testing.T) {
+	n := memnet.New(memnet.Config{}, 1)
+	a, _ := newMemPeer(t, n, "10.0.0.1:3000")
+	b, bAddr := newMemPeer(t, n, "10.0.0.2:3000")
+	b.SetQueryHandler(echoHandler)
+
+	var capture lockedBuffer
+	_, err := b.Capture(&capture)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	for i := range 5 {
+		_, err := a.Query(ctx, b.pubKey, bAddr, []byte{byte(i)})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	b.SetCaptureHook(nil)
+
+	r, err := NewCaptureReader(bytes.NewReader(capture.Bytes()))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dirs := make(map[Direction]int)
+	channels := 0
+	for {
+		rec, err := r.Next()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if !bytes.Equal(rec.PeerKey, a.pubKey) {
+			t.Fatalf("unexpected peer key %x", rec.PeerKey)
+		}
+
+		if _, err := b.tlH.Dissect(rec.Data); err != nil {
+			t.Fatal(err)
+		}
+
+		dirs[rec.Direction]++
+		if rec.Channel {
+			channels++
+		}
+	}
+
+	if dirs[DirectionIn] < 5 || dirs[DirectionOut] < 5 || channels == 0 {
+		t.Fatalf("unexpected records, directions %v and %d through channels", dirs, channels)
+	}
+
+	// a new peer answers the captured queries again, a doesn't need to receive them
+	a.Close()
+	c, _ := newMemPeer(t, n, "10.0.0.3:3000")
+	c.SetQueryHandler(echoHandler)
+
+	var answers int
+	var mu sync.Mutex
+	c.SetCaptureHook(func(rec CaptureRecord) {
+		var pkt tl.AdnlPacketContent
+		if err := c.tlH.Parse(rec.Data, &pkt, true); err != nil {
+			return
+		}
+
+		mu.Lock()
+		defer mu.Unlock()
+		for _, msg := range append([]any{pkt.Message}, pkt.Messages...) {
+			if _, ok := msg.(tl.AdnlMessageAnswer); ok && rec.Direction == DirectionOut {
+				answers++
+			}
+		}
+	})
+
+	r, _ = NewCaptureReader(bytes.NewReader(capture.Bytes()))
+	replayed, err := c.Replay(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if replayed != dirs[DirectionIn]+dirs[DirectionOut] {
+		t.Fatalf("replayed %d records want %d", replayed, dirs[DirectionIn]+dirs[DirectionOut])
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	if answers != 5 {
+		t.Fatalf("got %d answers want 5", answers)
+	}
+}
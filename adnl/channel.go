@@ -0,0 +1,299 @@
+package adnl
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"math/big"
+	"net/netip"
+	"slices"
+	"time"
+
+	"github.com/Gealber/dht/tl"
+	"github.com/Gealber/dht/utils"
+)
+
+var (
+	ErrChannelNotReady   = errors.New("adnl channel not ready")
+	ErrUnexpectedConfirm = errors.New("confirm channel received for an unknown channel key")
+)
+
+// channel in the context of adnl protocol, read doc/adnl/adnl-udp.md for more details.
+// A channel is created with temporary keys, one per side, and allows the peers
+// to exchange packets in a simpler format than the first packet format.
+type channel struct {
+	// id of the key used for decrypting incomming packets, datagrams sent
+	// to us through the channel start with this id
+	id []byte
+	// outID id of the key used for encrypting outgoing packets
+	outID []byte
+
+	// peerPubKey permanent public key of the peer on the other side of the channel
+	peerPubKey ed25519.PublicKey
+	// ourKey temporary private key, generated for this channel
+	ourKey ed25519.PrivateKey
+	// peerKey temporary public key of the peer, nil until the peer shares it with us
+	peerKey ed25519.PublicKey
+	// date of creation of the channel
+	date int64
+	// ready is set once we know the peer is able to decrypt packets sent through the channel
+	ready bool
+	// in tracks the seqnos received through the channel
+	in seqnoWindow
+	// created time the channel was created, it's renewed after the lifetime of the channels
+	created time.Time
+	// lastRecv time of the last packet received through the channel, from lastAddr
+	lastRecv time.Time
+	lastAddr netip.AddrPort
+	// lastKeepalive time of the last keepalive ping sent through the channel
+	lastKeepalive time.Time
+	// failures consecutive pings and queries sent through the channel without answer
+	failures int
+
+	outEncryptionKey []byte
+	inDecryptionKey  []byte
+}
+
+// lastActivity returns the time of the last packet received or keepalive sent through the channel.
+func (c *channel) lastActivity() time.Time {
+	if c.lastKeepalive.After(c.lastRecv) {
+		return c.lastKeepalive
+	}
+
+	return c.lastRecv
+}
+
+// ourPubKey returns the temporary public key of our side of the channel.
+func (c *channel) ourPubKey() ed25519.PublicKey {
+	return c.ourKey.Public().(ed25519.PublicKey)
+}
+
+// peerChannel returns the channel with the peer of the given state, creating
+// our side of it in case it doesn't exists. Should be used with p.mu locked.
+func (p *Peer) peerChannel(state *peerState) (*channel, error) {
+	if state.chn != nil {
+		return state.chn, nil
+	}
+
+	_, ourKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+	ch := &channel{
+		peerPubKey: state.pubKey,
+		ourKey:     ourKey,
+		date:       now.Unix(),
+		created:    now,
+	}
+	state.chn = ch
+
+	return ch, nil
+}
+
+// setupChannel derives the encryption and decryption keys of ch once the temporary
+// key of the peer is known, registering the channel for incomming packets.
+// Should be used with p.mu locked.
+func (p *Peer) setupChannel(ch *channel, peerKey ed25519.PublicKey) error {
+	secret, err := utils.GenerateSharedKey(ch.ourKey, peerKey)
+	if err != nil {
+		return err
+	}
+
+	peerID, err := p.computePeerID(ch.peerPubKey)
+	if err != nil {
+		return err
+	}
+
+	outKey, inKey := channelKeys(secret, p.id, peerID[:])
+
+	outID, err := p.aesKeyID(outKey)
+	if err != nil {
+		return err
+	}
+
+	inID, err := p.aesKeyID(inKey)
+	if err != nil {
+		return err
+	}
+
+	// the peer might be replacing a previous channel
+	if ch.id != nil {
+		delete(p.chns, hex.EncodeToString(ch.id))
+	}
+
+	ch.peerKey = slices.Clone(peerKey)
+	ch.outEncryptionKey = outKey
+	ch.inDecryptionKey = inKey
+	ch.outID = outID
+	ch.id = inID
+	ch.ready = false
+	ch.in = seqnoWindow{}
+	p.chns[hex.EncodeToString(inID)] = ch
+
+	return nil
+}
+
+// channelKeys given the shared secret of the channel, returns the keys for encrypting
+// outgoing packets and decrypting incomming packets. Both peers use the secret and the
+// reversed secret, which one is used for encryption is decided comparing their ids.
+func channelKeys(secret, ourID, peerID []byte) ([]byte, []byte) {
+	reversed := slices.Clone(secret)
+	slices.Reverse(reversed)
+
+	switch new(big.Int).SetBytes(ourID).Cmp(new(big.Int).SetBytes(peerID)) {
+	case -1:
+		return secret, reversed
+	case 1:
+		return reversed, secret
+	default:
+		return secret, secret
+	}
+}
+
+// aesKeyID computes the id of a channel key, which is the hash of the boxed pub.aes key.
+func (p *Peer) aesKeyID(key []byte) ([]byte, error) {
+	d, err := p.tlH.Serialize(tl.PublicKeyAES{Key: key}, true)
+	if err != nil {
+		return nil, err
+	}
+
+	id := sha256.Sum256(d)
+	return id[:], nil
+}
+
+// handleCreateChannel sets up our side of the channel requested by the peer,
+// returning the confirmation that should be sent back.
+func (p *Peer) handleCreateChannel(senderIDStr string, senderPubKey ed25519.PublicKey, msg tl.AdnlMessageCreateChannel) (any, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	ch, err := p.peerChannel(p.peerState(senderIDStr, senderPubKey))
+	if err != nil {
+		return nil, err
+	}
+
+	if !bytes.Equal(ch.peerKey, msg.Key) {
+		err = p.setupChannel(ch, msg.Key)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return tl.AdnlMessageConfirmChannel{
+		Key:      ch.ourPubKey(),
+		PeerKKey: msg.Key,
+		Date:     ch.date,
+	}, nil
+}
+
+// handleConfirmChannel finishes the set up of a channel previously requested by us.
+func (p *Peer) handleConfirmChannel(senderIDStr string, senderPubKey ed25519.PublicKey, msg tl.AdnlMessageConfirmChannel) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	ch := p.peerState(senderIDStr, senderPubKey).chn
+	if ch == nil || !bytes.Equal(ch.ourPubKey(), msg.PeerKKey) {
+		return ErrUnexpectedConfirm
+	}
+
+	if !bytes.Equal(ch.peerKey, msg.Key) {
+		err := p.setupChannel(ch, msg.Key)
+		if err != nil {
+			return err
+		}
+	}
+
+	// the peer confirmed it knows our key, from now on we can use the channel
+	ch.ready = true
+
+	return nil
+}
+
+// processMsgInChannel decrypts and process a packet received through a channel.
+// data is the datagram without the channel id: | SHA256 CONTENT HASH | ENCRYPTED CONTENT |
+func (p *Peer) processMsgInChannel(src netip.AddrPort, ch *channel, data []byte) {
+	checksum := data[:32]
+	encrypted := data[32:]
+
+	p.mu.Lock()
+	inKey := ch.inDecryptionKey
+	peerPubKey := ch.peerPubKey
+	p.mu.Unlock()
+
+	cipher, err := utils.BuildSharedCipher(inKey, checksum)
+	if err != nil {
+		p.logger.Error("failed building channel cipher", "err", err)
+		return
+	}
+
+	// decrypted into its own buffer, the datagram buffer is reused once processed
+	data = make([]byte, len(encrypted))
+	cipher.XORKeyStream(data, encrypted)
+	localChecksum := sha256.Sum256(data)
+	if !bytes.Equal(localChecksum[:], checksum) {
+		p.logger.Debug("failed checksum validation in channel", "addr", src)
+		return
+	}
+
+	// receiving a valid packet means the peer knows the channel keys, and that it's alive
+	p.mu.Lock()
+	ch.ready = true
+	ch.lastRecv, ch.lastAddr = time.Now(), src
+	ch.failures = 0
+	p.mu.Unlock()
+
+	p.handlePacket(src, peerPubKey, ch, data)
+}
+
+// buildChannelPacket builds an adnl.packetContents to be sent through a channel, which
+// doesn't need to include our public key neither a signature.
+func (p *Peer) buildChannelPacket(seqnos packetSeqnos, msg any, msgs []any) ([]byte, error) {
+	rand1, rand2 := utils.RandomBuff()
+
+	pkt := tl.AdnlPacketContent{
+		Rand1:        rand1,
+		Flags:        flagSeqno | flagConfirmSeqno,
+		Seqno:        seqnos.seqno,
+		ConfirmSeqno: seqnos.confirmSeqno,
+		Rand2:        rand2,
+	}
+
+	if msg != nil {
+		pkt.Flags |= flagMessage
+		pkt.Message = msg
+	}
+
+	if len(msgs) > 0 {
+		pkt.Flags |= flagMessages
+		pkt.Messages = msgs
+	}
+
+	return p.tlH.Serialize(pkt, true)
+}
+
+// encryptChannelPacket encrypts the serialized packet data with the channel outgoing key,
+// returning the datagram framed as:
+// | CHANNEL OUT KEY ID | SHA256 CONTENT HASH BEFORE ENCRYPTION | ENCRYPTED CONTENT OF THE PACKET |
+func encryptChannelPacket(ch *channel, data []byte) ([]byte, error) {
+	if !ch.ready {
+		return nil, ErrChannelNotReady
+	}
+
+	checksum := sha256.Sum256(data)
+	cipher, err := utils.BuildSharedCipher(ch.outEncryptionKey, checksum[:])
+	if err != nil {
+		return nil, err
+	}
+
+	payload := make([]byte, 64+len(data))
+	copy(payload, ch.outID)
+	copy(payload[32:], checksum[:])
+	cipher.XORKeyStream(payload[64:], data)
+
+	return payload, nil
+}
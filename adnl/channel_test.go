@@ -0,0 +1,99 @@
+package adnl
+
+import (
+	"bytes"
+	"context"
+	"encoding/hex"
+	"testing"
+	"time"
+
+	"github.com/Gealber/dht/tl"
+)
+
+func (p *Peer) channelWith(peerID []byte) (channel, bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	state, ok := p.peers[hex.EncodeToString(peerID)]
+	if !ok || state.chn == nil {
+		return channel{}, false
+	}
+	ch := state.chn
+
+	return *ch, true
+}
+
+func Test_channelKeys(t *testing.T) {
+	secret := []byte{1, 2, 3, 4}
+	lowID, highID := []byte{1}, []byte{2}
+
+	lowOut, lowIn := channelKeys(secret, lowID, highID)
+	highOut, highIn := channelKeys(secret, highID, lowID)
+
+	if !bytes.Equal(lowOut, []byte{1, 2, 3, 4}) || !bytes.Equal(lowIn, []byte{4, 3, 2, 1}) {
+		t.Fatalf("unexpected keys for lower id, out: %x in: %x", lowOut, lowIn)
+	}
+
+	if !bytes.Equal(lowOut, highIn) || !bytes.Equal(lowIn, highOut) {
+		t.Fatal("outgoing key of one side should be the incomming key of the other side")
+	}
+
+	sameOut, sameIn := channelKeys(secret, lowID, lowID)
+	if !bytes.Equal(sameOut, secret) || !bytes.Equal(sameIn, secret) {
+		t.Fatal("peers with same id should use the secret for both directions")
+	}
+}
+
+func TestPeerChannel(t *testing.T) {
+	a, aAddr := newTestPeer(t)
+	b, bAddr := newTestPeer(t)
+
+	ctx := context.Background()
+	err := a.SendMessage(ctx, b.pubKey, bAddr, tl.AdnlMessageNop{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// b answers the createChannel with a confirmChannel
+	waitFor(t, 2*time.Second, func() bool {
+		ch, ok := a.channelWith(b.id)
+		return ok && ch.ready
+	})
+
+	aCh, _ := a.channelWith(b.id)
+	bCh, ok := b.channelWith(a.id)
+	if !ok {
+		t.Fatal("b should have a channel with a")
+	}
+
+	if bCh.ready {
+		t.Fatal("b channel shouldn't be ready before receiving packets through it")
+	}
+
+	if !bytes.Equal(aCh.outID, bCh.id) || !bytes.Equal(aCh.id, bCh.outID) {
+		t.Fatal("channel key ids don't match")
+	}
+
+	if !bytes.Equal(aCh.outEncryptionKey, bCh.inDecryptionKey) || !bytes.Equal(aCh.inDecryptionKey, bCh.outEncryptionKey) {
+		t.Fatal("channel keys don't match")
+	}
+
+	// this time the PING goes through the channel, and so does the PONG
+	err = a.SendMessage(ctx, b.pubKey, bAddr, tl.Ping{Value: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	waitFor(t, 2*time.Second, func() bool {
+		ch, _ := b.channelWith(a.id)
+		return ch.ready && confirmed(a, b)
+	})
+
+	err = b.SendMessage(ctx, a.pubKey, aAddr, tl.AdnlMessageNop{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	waitFor(t, 2*time.Second, func() bool {
+		return confirmed(a, b)
+	})
+}
@@ -12,6 +12,7 @@ import (
 	"io"
 	"log"
 	"net"
+	"strconv"
 	"strings"
 	"time"
 
@@ -79,7 +80,7 @@ func example(dhtNodeKey []byte, ipDec, port int) error {
 	log.Println("IP: ", ip.String())
 
 	// shout to this IP and PORT using UDP
-	conn, err := net.Dial("udp", fmt.Sprintf("%s:%d", ip.String(), int32(port)))
+	conn, err := net.Dial("udp", net.JoinHostPort(ip.String(), strconv.Itoa(port)))
 	if err != nil {
 		return err
 	}
@@ -187,7 +188,7 @@ func buildExamplePayload(dhtNodeKey []byte, ourPub ed25519.PublicKey, ourPk ed25
 			msgQuery,
 		},
 		AddressList: tl.AdnlAddressList{
-			Addresses:  []tl.AdnlAddressUDP{},
+			Addresses:  []any{},
 			Version:    date,
 			ReinitDate: date,
 			Priority:   0,
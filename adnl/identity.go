@@ -0,0 +1,129 @@
+package adnl
+
+import (
+	"crypto/ed25519"
+	"encoding/hex"
+	"errors"
+	"net/netip"
+)
+
+var (
+	ErrIdentityExists  = errors.New("local identity already registered")
+	ErrUnknownIdentity = errors.New("unknown local identity")
+)
+
+// AddIdentity registers a local identity with key privKey on our socket, returning the peer
+// of the identity. Datagrams addressed to its id, or to its channels, are processed by the
+// returned peer, which has its own handlers, channels and known peers, and sends its packets
+// through our socket. The returned peer can't serve a connection by itself. Identities can be
+// added and removed while serving, they are closed when we are.
+func (p *Peer) AddIdentity(privKey ed25519.PrivateKey) (*Peer, error) {
+	if len(privKey) != ed25519.PrivateKeySize {
+		return nil, ErrInvalidPrivKey
+	}
+
+	local, err := New(privKey, privKey.Public().(ed25519.PublicKey), p.port)
+	if err != nil {
+		return nil, err
+	}
+	local.parent = p
+	idStr := hex.EncodeToString(local.id)
+	local.logger = p.logger.With("local_id", idStr)
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	select {
+	case <-p.closer:
+		return nil, ErrPeerClosed
+	default:
+	}
+
+	if _, ok := p.identities[idStr]; ok || idStr == hex.EncodeToString(p.id) {
+		return nil, ErrIdentityExists
+	}
+	p.identities[idStr] = local
+
+	return local, nil
+}
+
+// RemoveIdentity unregisters the local identity with id, closing its peer. Datagrams addressed
+// to it are dropped from now on.
+func (p *Peer) RemoveIdentity(id []byte) error {
+	idStr := hex.EncodeToString(id)
+
+	p.mu.Lock()
+	local, ok := p.identities[idStr]
+	delete(p.identities, idStr)
+	p.mu.Unlock()
+	if !ok {
+		return ErrUnknownIdentity
+	}
+
+	return local.Close()
+}
+
+// Identity returns the peer of the local identity with id registered on our socket.
+func (p *Peer) Identity(id []byte) (*Peer, bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	local, ok := p.identities[hex.EncodeToString(id)]
+	return local, ok
+}
+
+// Identities returns the ids of the local identities registered on our socket, ours excluded.
+func (p *Peer) Identities() [][]byte {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	ids := make([][]byte, 0, len(p.identities))
+	for _, local := range p.identities {
+		ids = append(ids, local.id)
+	}
+
+	return ids
+}
+
+// localIdentities returns the peers of the local identities registered on our socket.
+func (p *Peer) localIdentities() []*Peer {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	locals := make([]*Peer, 0, len(p.identities))
+	for _, local := range p.identities {
+		locals = append(locals, local)
+	}
+
+	return locals
+}
+
+// classifyLocal builds the datagram for packet in case it's addressed to one of the local
+// identities registered on our socket, or to one of their channels.
+func (p *Peer) classifyLocal(src netip.AddrPort, idStr string, data []byte) (datagram, []byte, bool) {
+	p.mu.Lock()
+	local, ok := p.identities[idStr]
+	p.mu.Unlock()
+	if ok {
+		if len(data) <= 64 {
+			return datagram{}, nil, false
+		}
+
+		return datagram{src: src, data: data, local: local}, data[:32], true
+	}
+
+	for _, local := range p.localIdentities() {
+		local.mu.Lock()
+		ch, ok := local.chns[idStr]
+		local.mu.Unlock()
+		if ok {
+			if len(data) <= 32 {
+				return datagram{}, nil, false
+			}
+
+			return datagram{src: src, data: data, ch: ch, local: local}, ch.peerPubKey, true
+		}
+	}
+
+	return datagram{}, nil, false
+}
@@ -0,0 +1,95 @@
+package adnl
+
+import (
+	"bytes"
+	"context"
+	"crypto/ed25519"
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestPeerIdentities(t *testing.T) {
+	a, aAddr := newTestPeer(t)
+	b, _ := newTestPeer(t)
+
+	_, privKey, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	local, err := a.AddIdentity(privKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = a.AddIdentity(privKey)
+	if !errors.Is(err, ErrIdentityExists) {
+		t.Fatalf("expected identity exists got %v", err)
+	}
+
+	_, err = a.AddIdentity(privKey[:32])
+	if !errors.Is(err, ErrInvalidPrivKey) {
+		t.Fatalf("expected invalid private key got %v", err)
+	}
+
+	// each identity answers with its own handler
+	for _, p := range []*Peer{a, local} {
+		p.SetQueryHandler(func(from ed25519.PublicKey, query []byte) ([]byte, error) {
+			return p.id, nil
+		})
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+
+	// the first queries go in the first packet format, the next ones through the channels
+	for i := 0; i < 2; i++ {
+		for _, dst := range []*Peer{a, local} {
+			answer, err := b.Query(ctx, dst.pubKey, aAddr, []byte{1})
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if !bytes.Equal(answer, dst.id) {
+				t.Fatalf("query to %x answered by %x", dst.id, answer)
+			}
+		}
+	}
+
+	ch, ok := local.channelWith(b.id)
+	if !ok || !ch.ready {
+		t.Fatal("local identity should have a ready channel with b")
+	}
+
+	if ids := a.Identities(); len(ids) != 1 || !bytes.Equal(ids[0], local.id) {
+		t.Fatalf("unexpected identities %x", ids)
+	}
+
+	err = a.RemoveIdentity(local.id)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, ok := a.Identity(local.id); ok {
+		t.Fatal("identity should be removed")
+	}
+
+	err = a.RemoveIdentity(local.id)
+	if !errors.Is(err, ErrUnknownIdentity) {
+		t.Fatalf("expected unknown identity got %v", err)
+	}
+
+	// datagrams to the removed identity are dropped
+	timeoutCtx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancel()
+	_, err = b.Query(timeoutCtx, local.pubKey, aAddr, []byte{1})
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("expected deadline exceeded got %v", err)
+	}
+
+	err = local.Start(context.Background())
+	if !errors.Is(err, ErrPeerClosed) {
+		t.Fatalf("unexpected error starting removed identity: %v", err)
+	}
+}
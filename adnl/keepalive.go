@@ -0,0 +1,190 @@
+package adnl
+
+import (
+	"context"
+	"crypto/ed25519"
+	"encoding/hex"
+	"net/netip"
+	"time"
+)
+
+// ChannelPolicy configures the maintenance of the channels with the peers. Peers may restart
+// and forget our channel, so channels without answers are dropped, and the channel keys are
+// replaced periodically. Once a channel is dropped the packets are sent with the first packet
+// format again, asking the peer for a new channel with new keys.
+type ChannelPolicy struct {
+	// KeepaliveInterval time without receiving packets through a channel after which a ping is
+	// sent through it. Zero disables the keepalives
+	KeepaliveInterval time.Duration
+	// MaxFailures consecutive pings and queries sent through a channel without answer after
+	// which the channel is considered dead and dropped. Zero disables the detection
+	MaxFailures int
+	// Lifetime time after which a channel is dropped and created again with new keys. Zero keeps
+	// the channels until the peer restarts
+	Lifetime time.Duration
+}
+
+// DefaultChannelPolicy is the policy used unless SetChannelPolicy is called.
+func DefaultChannelPolicy() ChannelPolicy {
+	return ChannelPolicy{
+		KeepaliveInterval: 10 * time.Second,
+		MaxFailures:       3,
+		Lifetime:          30 * time.Minute,
+	}
+}
+
+// SetChannelPolicy sets the policy applied to the channels, the interval the channels are
+// checked at is updated by the next call to Serve or Listen.
+func (p *Peer) SetChannelPolicy(policy ChannelPolicy) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.channelPolicy = policy
+}
+
+// maintenanceInterval returns the interval the peer runs its maintenance at, checking the
+// channels and dropping the expired reassemblies of message parts.
+func (p *Peer) maintenanceInterval() time.Duration {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	interval := partsTimeout
+	for _, d := range []time.Duration{p.channelPolicy.KeepaliveInterval, p.channelPolicy.Lifetime} {
+		if d > 0 && d < interval {
+			interval = d
+		}
+	}
+
+	return interval / 2
+}
+
+// maintain runs periodically the maintenance of the peer and its local identities, until
+// done is closed. The peers which address list changed are saved every peersSaveInterval,
+// and our registration in the proxy, if any, is kept alive.
+func (p *Peer) maintain(interval time.Duration, done <-chan struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	lastSave := time.Now()
+	for {
+		select {
+		case now := <-ticker.C:
+			err := p.keepProxy()
+			if err != nil {
+				p.logger.Warn("failed keeping proxy registration", "err", err)
+			}
+
+			save := now.Sub(lastSave) >= peersSaveInterval
+			if save {
+				lastSave = now
+			}
+
+			for _, local := range append([]*Peer{p}, p.localIdentities()...) {
+				local.sweepParts(now)
+
+				if save {
+					err := local.flushPeers()
+					if err != nil {
+						local.logger.Error("failed saving peers", "err", err)
+					}
+				}
+
+				for _, k := range local.checkChannels(now) {
+					// the ping is tracked as the serve loop, which waits for it
+					p.serving.Add(1)
+					go func() {
+						defer p.serving.Done()
+						local.Ping(context.Background(), k.pubKey, k.addr)
+					}()
+				}
+			}
+		case <-done:
+			return
+		}
+	}
+}
+
+// keepalive is a peer that should be pinged.
+type keepalive struct {
+	pubKey ed25519.PublicKey
+	addr   netip.AddrPort
+}
+
+// checkChannels expires the pings without pong and drops the channels older than their
+// lifetime, returning the peers that should be pinged. Peers with idle channels are pinged through them, while the peers which channel
+// was dropped are pinged with the first packet format, asking for a new channel.
+func (p *Peer) checkChannels(now time.Time) []keepalive {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	policy := p.channelPolicy
+	var pings []keepalive
+	for peerIDStr, state := range p.peers {
+		p.expirePings(state, now)
+
+		ch := state.chn
+		// channels are pinged once we received a packet through them
+		if ch == nil || !ch.lastAddr.IsValid() {
+			continue
+		}
+
+		switch {
+		case policy.Lifetime > 0 && now.Sub(ch.created) >= policy.Lifetime:
+			p.logger.Debug("renewing expired channel", "remote_id", peerIDStr)
+			p.dropChannel(state)
+		case policy.KeepaliveInterval > 0 && now.Sub(ch.lastActivity()) >= policy.KeepaliveInterval:
+			ch.lastKeepalive = now
+		default:
+			continue
+		}
+
+		pings = append(pings, keepalive{pubKey: state.pubKey, addr: ch.lastAddr})
+	}
+
+	return pings
+}
+
+// registerLoss registers a ping or query sent to the peer of state that was never answered,
+// counting it as a failure of its channel. Should be used with p.mu locked.
+func (p *Peer) registerLoss(state *peerState) {
+	state.rtt.loss()
+	p.channelFailure(state)
+}
+
+// expirePings counts as lost the pings sent to the peer of state without pong after the
+// timeout, as failures of its channel. Should be used with p.mu locked.
+func (p *Peer) expirePings(state *peerState, now time.Time) {
+	for range state.rtt.expirePings(now) {
+		p.channelFailure(state)
+	}
+}
+
+// channelFailure registers a ping or query sent through the channel with the peer of state
+// that was never answered, dropping the channel once it reaches the max failures. Should be
+// used with p.mu locked.
+func (p *Peer) channelFailure(state *peerState) {
+	ch := state.chn
+	if ch == nil || !ch.ready {
+		return
+	}
+
+	ch.failures++
+	if p.channelPolicy.MaxFailures > 0 && ch.failures >= p.channelPolicy.MaxFailures {
+		id, _ := p.computePeerID(state.pubKey)
+		p.logger.Debug("dropping dead channel", "remote_id", hex.EncodeToString(id[:]), "failures", ch.failures)
+		p.dropChannel(state)
+	}
+}
+
+// dropChannel forgets the channel with the peer of state, the next packet sent to the peer uses
+// the first packet format asking for a new channel. Should be used with p.mu locked.
+func (p *Peer) dropChannel(state *peerState) {
+	if state.chn == nil {
+		return
+	}
+
+	if state.chn.id != nil {
+		delete(p.chns, hex.EncodeToString(state.chn.id))
+	}
+	state.chn = nil
+}
@@ -0,0 +1,120 @@
+package adnl
+
+import (
+	"bytes"
+	"context"
+	"encoding/hex"
+	"net"
+	"net/netip"
+	"testing"
+	"time"
+)
+
+// newTestPeerWithPolicy is like newTestPeer, applying policy to the channels of the peer.
+func newTestPeerWithPolicy(t *testing.T, policy ChannelPolicy) (*Peer, netip.AddrPort) {
+	t.Helper()
+
+	p, err := New(nil, nil, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p.SetChannelPolicy(policy)
+
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return p, serveTestPeer(t, p, conn)
+}
+
+// openChannel pings b from a until the channel between them is ready, and a received a packet through it.
+func openChannel(t *testing.T, a, b *Peer, bAddr netip.AddrPort) channel {
+	t.Helper()
+
+	var ch channel
+	waitFor(t, 2*time.Second, func() bool {
+		_, err := a.Ping(context.Background(), b.pubKey, bAddr)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		var ok bool
+		ch, ok = a.channelWith(b.id)
+		return ok && ch.ready && ch.lastAddr.IsValid()
+	})
+
+	return ch
+}
+
+// samples returns the amount of answered pings and queries sent by p to the peer with id peerID.
+func (p *Peer) samples(peerID []byte) uint64 {
+	for _, s := range p.Stats() {
+		if bytes.Equal(s.ID, peerID) {
+			return s.Samples
+		}
+	}
+
+	return 0
+}
+
+func TestChannelKeepalive(t *testing.T) {
+	a, _ := newTestPeerWithPolicy(t, ChannelPolicy{KeepaliveInterval: 50 * time.Millisecond})
+	b, bAddr := newTestPeer(t)
+
+	openChannel(t, a, b, bAddr)
+	pinged := a.samples(b.id)
+
+	// idle channels are pinged
+	waitFor(t, 2*time.Second, func() bool {
+		return a.samples(b.id) >= pinged+3
+	})
+}
+
+func TestChannelDead(t *testing.T) {
+	a, _ := newTestPeerWithPolicy(t, ChannelPolicy{KeepaliveInterval: 50 * time.Millisecond, MaxFailures: 2})
+	b, bAddr := newTestPeer(t)
+
+	dead := openChannel(t, a, b, bAddr)
+
+	// the pings through the channel aren't answered anymore
+	err := b.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the channel is removed from the peer state, pings queued before dropping it might
+	// already have asked for a new one
+	waitFor(t, 5*time.Second, func() bool {
+		a.mu.Lock()
+		defer a.mu.Unlock()
+
+		_, registered := a.chns[hex.EncodeToString(dead.id)]
+		state, ok := a.peers[hex.EncodeToString(b.id)]
+		return ok && !registered && (state.chn == nil || !state.chn.ourKey.Equal(dead.ourKey))
+	})
+}
+
+func TestChannelLifetime(t *testing.T) {
+	a, _ := newTestPeerWithPolicy(t, ChannelPolicy{Lifetime: 200 * time.Millisecond})
+	b, bAddr := newTestPeer(t)
+
+	old := openChannel(t, a, b, bAddr)
+
+	// the channel is renewed with new keys, the ping sent after dropping it asks for its creation
+	waitFor(t, 2*time.Second, func() bool {
+		ch, ok := a.channelWith(b.id)
+		if !ok || !ch.ready || bytes.Equal(ch.outEncryptionKey, old.outEncryptionKey) {
+			return false
+		}
+
+		bCh, ok := b.channelWith(a.id)
+		return ok && bytes.Equal(bCh.inDecryptionKey, ch.outEncryptionKey)
+	})
+
+	// packets go through the renewed channel
+	_, err := a.Ping(context.Background(), b.pubKey, bAddr)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
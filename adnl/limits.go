@@ -0,0 +1,186 @@
+package adnl
+
+import (
+	"errors"
+	"net/netip"
+	"sync"
+	"time"
+
+	"github.com/Gealber/dht/utils"
+)
+
+// maxDatagramSize size of the buffers datagrams are read into
+const maxDatagramSize = 4096
+
+var (
+	ErrQueueFull         = errors.New("receive queue is full")
+	ErrSourceRateLimited = errors.New("source address exceeded its rate limit")
+	ErrPeerRateLimited   = errors.New("peer exceeded its rate limit")
+)
+
+// Limits bounds the resources used for processing the received datagrams.
+type Limits struct {
+	// Workers amount of goroutines processing the received datagrams, message handlers
+	// run in them so a blocked handler holds a worker
+	Workers int
+	// QueueSize max amount of datagrams waiting for a worker, datagrams received while the queue
+	// is full are dropped
+	QueueSize int
+	// SourceRate datagrams per second accepted from each source IP, with bursts of up to SourceBurst
+	// datagrams. Zero disables the limit
+	SourceRate  float64
+	SourceBurst int
+	// PeerRate datagrams per second accepted from each peer at each source address, with bursts
+	// of up to PeerBurst datagrams. The key of the peer in the datagrams isn't authenticated
+	// yet, so datagrams with the key of a peer sent from other addresses don't use its budget.
+	// Zero disables the limit
+	PeerRate  float64
+	PeerBurst int
+}
+
+// DefaultLimits are the limits used unless SetLimits is called.
+func DefaultLimits() Limits {
+	return Limits{
+		Workers:     64,
+		QueueSize:   1024,
+		SourceRate:  1000,
+		SourceBurst: 2000,
+		PeerRate:    500,
+		PeerBurst:   1000,
+	}
+}
+
+// datagram is a received datagram waiting for a worker. data is a slice of buff, which is
+// returned to the pool once processed.
+type datagram struct {
+	src  netip.AddrPort
+	buff *[]byte
+	data []byte
+	// ch channel the datagram was sent through, nil for the first packet format
+	ch *channel
+	// tunnel the datagram was sent through, nil unless it's a tunnel packet
+	tunnel *tunnel
+	// local identity the datagram is addressed to, nil in case it's for us
+	local *Peer
+}
+
+var datagramPool = sync.Pool{
+	New: func() any {
+		buff := make([]byte, maxDatagramSize)
+		return &buff
+	},
+}
+
+// SetLimits sets the limits applied by the next call to Serve or Listen.
+func (p *Peer) SetLimits(limits Limits) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.limits = limits
+}
+
+// Drops returns the amount of datagrams dropped because of the limits, indexed by
+// the reason, ErrQueueFull for example.
+func (p *Peer) Drops() map[error]uint64 {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	counters := make(map[error]uint64, len(p.drops))
+	for err, n := range p.drops {
+		counters[err] = n
+	}
+
+	return counters
+}
+
+// countDrop increments the counter of datagrams dropped for reason.
+func (p *Peer) countDrop(reason error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.drops[reason]++
+}
+
+// receiver applies the limits to the datagrams read by a Serve loop.
+type receiver struct {
+	queue   chan datagram
+	sources *utils.RateLimiter
+	peers   *utils.RateLimiter
+	workers sync.WaitGroup
+}
+
+// startReceiver starts the workers processing the datagrams queued in the returned receiver,
+// they run until stop is called.
+func (p *Peer) startReceiver() *receiver {
+	p.mu.Lock()
+	limits := p.limits
+	p.mu.Unlock()
+
+	r := &receiver{
+		queue:   make(chan datagram, max(limits.QueueSize, 0)),
+		sources: utils.NewRateLimiter(limits.SourceRate, limits.SourceBurst),
+		peers:   utils.NewRateLimiter(limits.PeerRate, limits.PeerBurst),
+	}
+
+	workers := max(limits.Workers, 1)
+	r.workers.Add(workers)
+	for range workers {
+		go func() {
+			defer r.workers.Done()
+			for d := range r.queue {
+				p.processDatagram(d)
+				datagramPool.Put(d.buff)
+			}
+		}()
+	}
+
+	return r
+}
+
+// processDatagram decrypts and handles d according to its format, by the local identity it's
+// addressed to.
+func (p *Peer) processDatagram(d datagram) {
+	local := p
+	if d.local != nil {
+		local = d.local
+	}
+
+	switch {
+	case d.ch != nil:
+		local.processMsgInChannel(d.src, d.ch, d.data)
+	case d.tunnel != nil:
+		local.processTunnelPacket(d.src, d.tunnel, d.data)
+	default:
+		local.processMsgIn(d.src, d.data)
+	}
+}
+
+// enqueue queues d for a worker unless a limit is exceeded, peerKey identifies the sender
+// along with the source address. Datagrams that are dropped are returned to the pool.
+func (p *Peer) enqueue(r *receiver, d datagram, peerKey []byte) {
+	now := time.Now()
+
+	var reason error
+	switch {
+	case !r.sources.Allow(d.src.Addr().String(), now):
+		reason = ErrSourceRateLimited
+	case !r.peers.Allow(d.src.String()+string(peerKey), now):
+		reason = ErrPeerRateLimited
+	default:
+		select {
+		case r.queue <- d:
+			return
+		default:
+			reason = ErrQueueFull
+		}
+	}
+
+	p.countDrop(reason)
+	datagramPool.Put(d.buff)
+}
+
+// stop waits for the workers to process the queued datagrams.
+func (r *receiver) stop() {
+	close(r.queue)
+	r.workers.Wait()
+}
@@ -0,0 +1,98 @@
+package adnl
+
+import (
+	"context"
+	"net"
+	"net/netip"
+	"testing"
+	"time"
+
+	"github.com/Gealber/dht/tl"
+	"github.com/Gealber/dht/utils"
+)
+
+func TestPeerLimits(t *testing.T) {
+	a, _ := newTestPeer(t)
+
+	b, err := New(nil, nil, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b.SetLimits(Limits{Workers: 2, QueueSize: 16, PeerRate: 1, PeerBurst: 2})
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	bAddr := serveTestPeer(t, b, conn)
+
+	for range 5 {
+		err := a.SendMessage(context.Background(), b.pubKey, bAddr, tl.AdnlMessageNop{})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	waitFor(t, 2*time.Second, func() bool {
+		return b.Drops()[ErrPeerRateLimited] == 3
+	})
+}
+
+func Test_enqueue(t *testing.T) {
+	p, err := New(nil, nil, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// without workers nobody takes datagrams from the queue
+	r := &receiver{
+		queue:   make(chan datagram, 1),
+		sources: utils.NewRateLimiter(1, 2),
+	}
+
+	src := netip.MustParseAddrPort("127.0.0.1:1000")
+	for range 3 {
+		buff := datagramPool.Get().(*[]byte)
+		p.enqueue(r, datagram{src: src, buff: buff, data: *buff}, []byte("peer"))
+	}
+
+	drops := p.Drops()
+	if drops[ErrQueueFull] != 1 || drops[ErrSourceRateLimited] != 1 {
+		t.Fatalf("unexpected drops: %v", drops)
+	}
+
+	if len(r.queue) != 1 {
+		t.Fatalf("expected 1 queued datagram got %d", len(r.queue))
+	}
+}
+
+func Test_enqueueSpoofedPeer(t *testing.T) {
+	p, err := New(nil, nil, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	r := &receiver{
+		queue: make(chan datagram, 4),
+		peers: utils.NewRateLimiter(1, 1),
+	}
+
+	enqueue := func(src netip.AddrPort) {
+		buff := datagramPool.Get().(*[]byte)
+		p.enqueue(r, datagram{src: src, buff: buff, data: *buff}, []byte("victim"))
+	}
+
+	// datagrams with the key of the victim sent from another address exhaust only their budget
+	spoofer := netip.MustParseAddrPort("127.0.0.1:1000")
+	for range 3 {
+		enqueue(spoofer)
+	}
+	enqueue(netip.MustParseAddrPort("127.0.0.1:2000"))
+
+	if drops := p.Drops(); drops[ErrPeerRateLimited] != 2 {
+		t.Fatalf("unexpected drops: %v", drops)
+	}
+
+	if len(r.queue) != 2 {
+		t.Fatalf("expected 2 queued datagrams got %d", len(r.queue))
+	}
+}
@@ -0,0 +1,370 @@
+// Package memnet implements an in-memory network of datagram transports, with configurable
+// latency, loss, duplication, reordering and partitions, for running ADNL peers in-process.
+package memnet
+
+import (
+	"errors"
+	"fmt"
+	"math/rand"
+	"net"
+	"net/netip"
+	"sync"
+	"time"
+)
+
+const (
+	// firstEphemeralPort is the first port assigned to the transports listening on port zero
+	firstEphemeralPort = 49152
+	// defaultQueueSize is the amount of datagrams a transport buffers until they are read
+	defaultQueueSize = 1024
+	// reorderTimeout is the max time a reordered datagram waits for the next one to its destination
+	reorderTimeout = 50 * time.Millisecond
+)
+
+var (
+	ErrAddressInUse   = errors.New("address already in use")
+	ErrInvalidAddress = errors.New("invalid address")
+)
+
+// Config describes how the datagrams are delivered. Probabilities are between 0 and 1.
+type Config struct {
+	// Latency time a datagram takes to be delivered, plus a random delay up to Jitter.
+	// Without latency and jitter datagrams are delivered before WriteTo returns
+	Latency time.Duration
+	Jitter  time.Duration
+	// Loss probability of dropping a datagram
+	Loss float64
+	// Duplicate probability of delivering a datagram twice
+	Duplicate float64
+	// Reorder probability of delivering a datagram after the next one sent to the same destination
+	Reorder float64
+	// QueueSize amount of datagrams a transport buffers until they are read, datagrams received
+	// while the queue is full are dropped. Zero means 1024
+	QueueSize int
+}
+
+// Stats counts what happened to the datagrams sent through the network.
+type Stats struct {
+	Sent       uint64
+	Delivered  uint64
+	Lost       uint64
+	Duplicated uint64
+	Reordered  uint64
+	// Partitioned datagrams dropped because of a partition, Unreachable the ones sent to an
+	// address nobody listens on, Overflowed the ones received with a full queue
+	Partitioned uint64
+	Unreachable uint64
+	Overflowed  uint64
+}
+
+// datagram is a datagram on its way to dst.
+type datagram struct {
+	src  netip.AddrPort
+	dst  netip.AddrPort
+	data []byte
+}
+
+// Network connects the transports listening on it. The random decisions are taken with a
+// seeded source, so a network with the same seed and traffic behaves in the same way.
+type Network struct {
+	mu  sync.Mutex
+	cfg Config
+	// nodeCfg overrides cfg for the datagrams sent to and from an address
+	nodeCfg map[netip.AddrPort]Config
+	rnd     *rand.Rand
+	conns   map[netip.AddrPort]*Conn
+	// group of each partitioned address, addresses in different groups can't reach each other
+	groups map[netip.AddrPort]int
+	// held datagrams delayed until the next one to the same destination, indexed by destination
+	held     map[netip.AddrPort]*datagram
+	nextPort uint16
+	stats    Stats
+}
+
+// New returns a network delivering the datagrams as described by cfg, random decisions are
+// taken with a source seeded with seed.
+func New(cfg Config, seed int64) *Network {
+	return &Network{
+		cfg:      cfg,
+		nodeCfg:  make(map[netip.AddrPort]Config),
+		rnd:      rand.New(rand.NewSource(seed)),
+		conns:    make(map[netip.AddrPort]*Conn),
+		groups:   make(map[netip.AddrPort]int),
+		held:     make(map[netip.AddrPort]*datagram),
+		nextPort: firstEphemeralPort,
+	}
+}
+
+// SetConfig replaces the config of the network, used by the next datagrams sent.
+func (n *Network) SetConfig(cfg Config) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	n.cfg = cfg
+}
+
+// SetNodeConfig overrides the config for the datagrams sent to and from addr, a slow node for
+// example. When both ends have their own config, the one of the destination is used.
+func (n *Network) SetNodeConfig(addr netip.AddrPort, cfg Config) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	n.nodeCfg[addr] = cfg
+}
+
+// ResetNodeConfig removes the config override of addr.
+func (n *Network) ResetNodeConfig(addr netip.AddrPort) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	delete(n.nodeCfg, addr)
+}
+
+// Partition splits the network, addresses in different groups can't reach each other.
+// Addresses not included in any group reach everyone. Replaces any previous partition.
+func (n *Network) Partition(groups ...[]netip.AddrPort) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	n.groups = make(map[netip.AddrPort]int)
+	for i, group := range groups {
+		for _, addr := range group {
+			n.groups[addr] = i
+		}
+	}
+}
+
+// Heal removes the partition of the network.
+func (n *Network) Heal() {
+	n.Partition()
+}
+
+// Stats returns the counters of the datagrams sent through the network.
+func (n *Network) Stats() Stats {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	return n.stats
+}
+
+// Listen returns a transport listening on addr, a port is assigned when the port of addr is zero.
+func (n *Network) Listen(addr netip.AddrPort) (*Conn, error) {
+	if !addr.Addr().IsValid() {
+		return nil, fmt.Errorf("%w: %s", ErrInvalidAddress, addr)
+	}
+	addr = netip.AddrPortFrom(addr.Addr().Unmap(), addr.Port())
+
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	if addr.Port() == 0 {
+		for {
+			candidate := netip.AddrPortFrom(addr.Addr(), n.nextPort)
+			n.nextPort++
+			if n.nextPort == 0 {
+				n.nextPort = firstEphemeralPort
+			}
+
+			if _, ok := n.conns[candidate]; !ok {
+				addr = candidate
+				break
+			}
+		}
+	}
+
+	if _, ok := n.conns[addr]; ok {
+		return nil, fmt.Errorf("%w: %s", ErrAddressInUse, addr)
+	}
+
+	conn := &Conn{
+		net:    n,
+		addr:   addr,
+		queue:  make(chan datagram, queueSize(n.configFor(addr, addr))),
+		closed: make(chan struct{}),
+	}
+	n.conns[addr] = conn
+
+	return conn, nil
+}
+
+// configFor returns the config for the datagrams sent from src to dst. Should be used with n.mu.
+func (n *Network) configFor(src, dst netip.AddrPort) Config {
+	if cfg, ok := n.nodeCfg[dst]; ok {
+		return cfg
+	}
+
+	if cfg, ok := n.nodeCfg[src]; ok {
+		return cfg
+	}
+
+	return n.cfg
+}
+
+// send takes the delivery decisions for the datagram d according to the config of its ends.
+func (n *Network) send(d datagram) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	n.stats.Sent++
+
+	srcGroup, srcOK := n.groups[d.src]
+	dstGroup, dstOK := n.groups[d.dst]
+	if srcOK && dstOK && srcGroup != dstGroup {
+		n.stats.Partitioned++
+		return
+	}
+
+	cfg := n.configFor(d.src, d.dst)
+	if n.rnd.Float64() < cfg.Loss {
+		n.stats.Lost++
+		return
+	}
+
+	copies := 1
+	if n.rnd.Float64() < cfg.Duplicate {
+		n.stats.Duplicated++
+		copies++
+	}
+
+	// a held datagram goes after this one
+	held := n.held[d.dst]
+	delete(n.held, d.dst)
+
+	if held == nil && n.rnd.Float64() < cfg.Reorder {
+		n.stats.Reordered++
+		n.held[d.dst] = &d
+		time.AfterFunc(reorderTimeout, func() {
+			n.mu.Lock()
+			defer n.mu.Unlock()
+
+			if n.held[d.dst] == &d {
+				delete(n.held, d.dst)
+				n.schedule(cfg, d)
+			}
+		})
+		return
+	}
+
+	for range copies {
+		n.schedule(cfg, d)
+	}
+
+	if held != nil {
+		n.schedule(cfg, *held)
+	}
+}
+
+// schedule delivers d after the latency of cfg. Should be used with n.mu.
+func (n *Network) schedule(cfg Config, d datagram) {
+	delay := cfg.Latency
+	if cfg.Jitter > 0 {
+		delay += time.Duration(n.rnd.Int63n(int64(cfg.Jitter)))
+	}
+
+	if delay <= 0 {
+		n.deliver(d)
+		return
+	}
+
+	time.AfterFunc(delay, func() {
+		n.mu.Lock()
+		defer n.mu.Unlock()
+
+		n.deliver(d)
+	})
+}
+
+// deliver queues d in the transport listening on its destination. Should be used with n.mu.
+func (n *Network) deliver(d datagram) {
+	conn, ok := n.conns[d.dst]
+	if !ok {
+		n.stats.Unreachable++
+		return
+	}
+
+	select {
+	case conn.queue <- d:
+		n.stats.Delivered++
+	default:
+		n.stats.Overflowed++
+	}
+}
+
+// remove stops delivering datagrams to conn.
+func (n *Network) remove(conn *Conn) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	if n.conns[conn.addr] == conn {
+		delete(n.conns, conn.addr)
+	}
+}
+
+func queueSize(cfg Config) int {
+	if cfg.QueueSize <= 0 {
+		return defaultQueueSize
+	}
+
+	return cfg.QueueSize
+}
+
+// Conn is a transport listening on a Network, it implements adnl.Transport.
+type Conn struct {
+	net    *Network
+	addr   netip.AddrPort
+	queue  chan datagram
+	closed chan struct{}
+	once   sync.Once
+}
+
+// ReadFrom waits for a datagram and copies it into b, the remaining of datagrams bigger than b
+// are discarded. Returns net.ErrClosed once the transport is closed.
+func (c *Conn) ReadFrom(b []byte) (int, netip.AddrPort, error) {
+	select {
+	case <-c.closed:
+		return 0, netip.AddrPort{}, net.ErrClosed
+	default:
+	}
+
+	select {
+	case d := <-c.queue:
+		return copy(b, d.data), d.src, nil
+	case <-c.closed:
+		return 0, netip.AddrPort{}, net.ErrClosed
+	}
+}
+
+// WriteTo sends b as a single datagram to addr. As with UDP, datagrams that can't be
+// delivered are silently dropped.
+func (c *Conn) WriteTo(b []byte, addr netip.AddrPort) (int, error) {
+	select {
+	case <-c.closed:
+		return 0, net.ErrClosed
+	default:
+	}
+
+	c.net.send(datagram{
+		src:  c.addr,
+		dst:  netip.AddrPortFrom(addr.Addr().Unmap(), addr.Port()),
+		data: append([]byte(nil), b...),
+	})
+
+	return len(b), nil
+}
+
+// LocalAddr returns the address the transport is listening on.
+func (c *Conn) LocalAddr() netip.AddrPort {
+	return c.addr
+}
+
+// Close stops the transport, pending and blocked reads return net.ErrClosed.
+func (c *Conn) Close() error {
+	err := net.ErrClosed
+	c.once.Do(func() {
+		close(c.closed)
+		c.net.remove(c)
+		err = nil
+	})
+
+	return err
+}
@@ -0,0 +1,221 @@
+package memnet
+
+import (
+	"errors"
+	"net"
+	"net/netip"
+	"testing"
+	"time"
+)
+
+// listen returns a transport listening on addr, closed once the test finishes.
+func listen(t *testing.T, n *Network, addr string) *Conn {
+	t.Helper()
+
+	conn, err := n.Listen(netip.MustParseAddrPort(addr))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+
+	return conn
+}
+
+// read reads the next datagram of conn, failing the test if none arrives within a second.
+func read(t *testing.T, conn *Conn) (string, netip.AddrPort) {
+	t.Helper()
+
+	type result struct {
+		data string
+		src  netip.AddrPort
+		err  error
+	}
+	resChn := make(chan result, 1)
+	go func() {
+		buff := make([]byte, 64)
+		n, src, err := conn.ReadFrom(buff)
+		resChn <- result{string(buff[:n]), src, err}
+	}()
+
+	select {
+	case res := <-resChn:
+		if res.err != nil {
+			t.Fatal(res.err)
+		}
+		return res.data, res.src
+	case <-time.After(time.Second):
+		t.Fatal("timeout reading datagram")
+	}
+
+	return "", netip.AddrPort{}
+}
+
+func TestNetwork(t *testing.T) {
+	n := New(Config{}, 1)
+	a := listen(t, n, "10.0.0.1:1000")
+	b := listen(t, n, "10.0.0.2:0")
+
+	if b.LocalAddr().Port() != firstEphemeralPort {
+		t.Errorf("got port %d want %d", b.LocalAddr().Port(), firstEphemeralPort)
+	}
+
+	_, err := n.Listen(a.LocalAddr())
+	if !errors.Is(err, ErrAddressInUse) {
+		t.Errorf("got err %v want %v", err, ErrAddressInUse)
+	}
+
+	_, err = a.WriteTo([]byte("hello"), b.LocalAddr())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	data, src := read(t, b)
+	if data != "hello" || src != a.LocalAddr() {
+		t.Errorf("got %q from %s want %q from %s", data, src, "hello", a.LocalAddr())
+	}
+
+	// nobody listens on this address
+	_, err = a.WriteTo([]byte("lost"), netip.MustParseAddrPort("10.0.0.3:1000"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = b.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, _, err = b.ReadFrom(make([]byte, 64))
+	if !errors.Is(err, net.ErrClosed) {
+		t.Errorf("got err %v want %v", err, net.ErrClosed)
+	}
+
+	_, err = b.WriteTo([]byte("closed"), a.LocalAddr())
+	if !errors.Is(err, net.ErrClosed) {
+		t.Errorf("got err %v want %v", err, net.ErrClosed)
+	}
+
+	stats := n.Stats()
+	if stats.Sent != 2 || stats.Delivered != 1 || stats.Unreachable != 1 {
+		t.Errorf("unexpected stats %+v", stats)
+	}
+}
+
+func TestNetworkLatency(t *testing.T) {
+	n := New(Config{Latency: 50 * time.Millisecond}, 1)
+	a := listen(t, n, "10.0.0.1:1000")
+	b := listen(t, n, "10.0.0.2:1000")
+
+	start := time.Now()
+	_, err := a.WriteTo([]byte("slow"), b.LocalAddr())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	read(t, b)
+	if elapsed := time.Since(start); elapsed < 50*time.Millisecond {
+		t.Errorf("datagram delivered after %s, before the latency", elapsed)
+	}
+}
+
+func TestNetworkFaults(t *testing.T) {
+	tests := []struct {
+		name  string
+		cfg   Config
+		sent  []string
+		want  []string
+		check func(Stats) bool
+	}{
+		{
+			name:  "loss",
+			cfg:   Config{Loss: 1},
+			sent:  []string{"1", "2"},
+			check: func(s Stats) bool { return s.Lost == 2 },
+		},
+		{
+			name:  "duplicate",
+			cfg:   Config{Duplicate: 1},
+			sent:  []string{"1", "2"},
+			want:  []string{"1", "1", "2", "2"},
+			check: func(s Stats) bool { return s.Duplicated == 2 },
+		},
+		{
+			name:  "reorder",
+			cfg:   Config{Reorder: 1},
+			sent:  []string{"1", "2", "3", "4"},
+			want:  []string{"2", "1", "4", "3"},
+			check: func(s Stats) bool { return s.Reordered == 2 },
+		},
+		{
+			name:  "overflow",
+			cfg:   Config{QueueSize: 1},
+			sent:  []string{"1", "2"},
+			want:  []string{"1"},
+			check: func(s Stats) bool { return s.Overflowed == 1 },
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			n := New(tt.cfg, 1)
+			a := listen(t, n, "10.0.0.1:1000")
+			b := listen(t, n, "10.0.0.2:1000")
+
+			for _, data := range tt.sent {
+				_, err := a.WriteTo([]byte(data), b.LocalAddr())
+				if err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			for _, want := range tt.want {
+				data, _ := read(t, b)
+				if data != want {
+					t.Errorf("got %q want %q", data, want)
+				}
+			}
+
+			if len(b.queue) != 0 {
+				t.Errorf("%d unexpected datagrams queued", len(b.queue))
+			}
+
+			if stats := n.Stats(); !tt.check(stats) {
+				t.Errorf("unexpected stats %+v", stats)
+			}
+		})
+	}
+}
+
+func TestNetworkPartition(t *testing.T) {
+	n := New(Config{}, 1)
+	a := listen(t, n, "10.0.0.1:1000")
+	b := listen(t, n, "10.0.0.2:1000")
+	c := listen(t, n, "10.0.0.3:1000")
+
+	n.Partition([]netip.AddrPort{a.LocalAddr()}, []netip.AddrPort{b.LocalAddr()})
+	for _, dst := range []*Conn{b, c} {
+		_, err := a.WriteTo([]byte("partitioned"), dst.LocalAddr())
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// c isn't in any group, so it's reachable
+	if data, _ := read(t, c); data != "partitioned" {
+		t.Errorf("got %q want %q", data, "partitioned")
+	}
+
+	if stats := n.Stats(); stats.Partitioned != 1 {
+		t.Errorf("got %d partitioned datagrams want 1", stats.Partitioned)
+	}
+
+	n.Heal()
+	_, err := a.WriteTo([]byte("healed"), b.LocalAddr())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if data, _ := read(t, b); data != "healed" {
+		t.Errorf("got %q want %q", data, "healed")
+	}
+}
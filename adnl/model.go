@@ -1 +1,18 @@
 package adnl
+
+// flags of adnl.packetContents, each one marks the presence of the
+// field with the same name, read doc/adnl/adnl-udp.md for more details
+const (
+	flagFrom uint32 = 1 << iota
+	flagFromShort
+	flagMessage
+	flagMessages
+	flagAddress
+	flagPriorityAddress
+	flagSeqno
+	flagConfirmSeqno
+	flagRecvAddrListVersion
+	flagRecvPriorityAddrListVersion
+	flagReinitDate
+	flagSignature
+)
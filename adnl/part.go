@@ -0,0 +1,301 @@
+package adnl
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"slices"
+	"sort"
+	"time"
+
+	"github.com/Gealber/dht/tl"
+)
+
+const (
+	// maxMessageSize is the max size of the serialized messages sent in a single packet,
+	// bigger messages are split in adnl.message.part messages
+	maxMessageSize = 1024
+	// maxPartsTotalSize is the max size of a message reassembled from parts
+	maxPartsTotalSize = 1 << 20
+	// maxReassemblies is the max amount of messages being reassembled at the same time, the
+	// oldest reassembly is dropped to make room for a new one
+	maxReassemblies = 64
+	// maxSenderReassemblies is the max amount of messages of the same sender being reassembled
+	// at the same time, so a single sender can't take the room of the others
+	maxSenderReassemblies = 4
+	// partsTimeout is the time we wait for all the parts of a message to arrive
+	partsTimeout = 10 * time.Second
+)
+
+var (
+	ErrPartsTotalSize   = errors.New("total size of message parts exceeds the limit")
+	ErrPartOutOfRange   = errors.New("message part out of range")
+	ErrPartsHash        = errors.New("reassembled message doesn't match its hash")
+	ErrNestedParts      = errors.New("reassembled message can't be a message part")
+	ErrPartsInconsisent = errors.New("message part total size differs from previous parts")
+	ErrPartsOverlap     = errors.New("message part overlaps with previous parts")
+)
+
+// partialMessage keeps the parts received of a message, until all of them arrive.
+type partialMessage struct {
+	// sender id of the peer sending the parts
+	sender    string
+	totalSize int
+	received  int
+	// parts received sorted by offset, they never overlap
+	parts     []messagePart
+	createdAt time.Time
+}
+
+// messagePart is the data of a message part starting at offset.
+type messagePart struct {
+	offset int
+	data   []byte
+}
+
+// add stores the data of the part starting at offset, returning false in case it was
+// already received. Parts overlapping with the previous ones are rejected.
+func (pm *partialMessage) add(offset int, data []byte) (bool, error) {
+	i := sort.Search(len(pm.parts), func(i int) bool {
+		return pm.parts[i].offset >= offset
+	})
+
+	if i < len(pm.parts) && pm.parts[i].offset == offset && len(pm.parts[i].data) == len(data) {
+		return false, nil
+	}
+
+	if i < len(pm.parts) && pm.parts[i].offset < offset+len(data) {
+		return false, ErrPartsOverlap
+	}
+
+	if i > 0 && pm.parts[i-1].offset+len(pm.parts[i-1].data) > offset {
+		return false, ErrPartsOverlap
+	}
+
+	pm.parts = slices.Insert(pm.parts, i, messagePart{offset: offset, data: data})
+	pm.received += len(data)
+
+	return true, nil
+}
+
+// splitMessage serializes msg, splitting it in adnl.message.part messages in case it doesn't
+// fit in a single packet. Messages small enough are returned as they are.
+func (p *Peer) splitMessage(msg any) ([]any, int, error) {
+	data, err := p.tlH.Serialize(msg, true)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	if len(data) <= maxMessageSize {
+		return []any{msg}, len(data), nil
+	}
+
+	if len(data) > maxPartsTotalSize {
+		return nil, 0, ErrPartsTotalSize
+	}
+
+	hash := sha256.Sum256(data)
+	parts := make([]any, 0, len(data)/maxMessageSize+1)
+	for offset := 0; offset < len(data); offset += maxMessageSize {
+		end := min(offset+maxMessageSize, len(data))
+		parts = append(parts, tl.AdnlMessagePart{
+			Hash:      hash[:],
+			TotalSize: len(data),
+			Offset:    offset,
+			Data:      data[offset:end],
+		})
+	}
+
+	return parts, maxMessageSize, nil
+}
+
+// packMessages groups msgs in the packets they should be sent, in a way that the
+// serialized messages of each packet don't exceed maxMessageSize. Messages
+// bigger than maxMessageSize are sent in parts, one part per packet.
+func (p *Peer) packMessages(msgs []any) ([][]any, error) {
+	packets := make([][]any, 0, 1)
+	current := make([]any, 0, len(msgs))
+	currentSize := 0
+
+	for _, msg := range msgs {
+		split, size, err := p.splitMessage(msg)
+		if err != nil {
+			return nil, err
+		}
+
+		if len(split) > 1 {
+			// keeping the order of the messages
+			if len(current) > 0 {
+				packets = append(packets, current)
+				current = make([]any, 0, len(msgs))
+				currentSize = 0
+			}
+
+			for _, part := range split {
+				packets = append(packets, []any{part})
+			}
+			continue
+		}
+
+		if currentSize+size > maxMessageSize && len(current) > 0 {
+			packets = append(packets, current)
+			current = make([]any, 0, len(msgs))
+			currentSize = 0
+		}
+
+		current = append(current, msg)
+		currentSize += size
+	}
+
+	if len(current) > 0 {
+		packets = append(packets, current)
+	}
+
+	return packets, nil
+}
+
+// handlePart stores the received part of a message, once all the parts of the message
+// are received the reassembled message is returned, otherwise nil is returned.
+func (p *Peer) handlePart(senderIDStr string, part tl.AdnlMessagePart) (any, error) {
+	if part.TotalSize <= 0 || part.TotalSize > maxPartsTotalSize {
+		return nil, ErrPartsTotalSize
+	}
+
+	if part.Offset < 0 || len(part.Data) == 0 || part.Offset+len(part.Data) > part.TotalSize {
+		return nil, ErrPartOutOfRange
+	}
+
+	// parts from different peers are never mixed
+	key := senderIDStr + hex.EncodeToString(part.Hash)
+
+	p.mu.Lock()
+	now := time.Now()
+	p.expireParts(now)
+
+	pm, ok := p.parts[key]
+	if !ok {
+		if p.senderReassemblies(senderIDStr) >= maxSenderReassemblies {
+			p.dropOldestPart(senderIDStr)
+		} else if len(p.parts) >= maxReassemblies {
+			p.dropOldestPart("")
+		}
+
+		pm = &partialMessage{
+			sender:    senderIDStr,
+			totalSize: part.TotalSize,
+			createdAt: now,
+		}
+		p.parts[key] = pm
+	}
+
+	if pm.totalSize != part.TotalSize {
+		p.mu.Unlock()
+		return nil, ErrPartsInconsisent
+	}
+
+	// duplicated parts are ignored
+	_, err := pm.add(part.Offset, part.Data)
+	if err != nil {
+		p.mu.Unlock()
+		return nil, err
+	}
+
+	if pm.received < pm.totalSize {
+		p.mu.Unlock()
+		return nil, nil
+	}
+	delete(p.parts, key)
+	p.mu.Unlock()
+
+	data, err := pm.assemble()
+	if err != nil {
+		return nil, err
+	}
+
+	hash := sha256.Sum256(data)
+	if !bytes.Equal(hash[:], part.Hash) {
+		return nil, ErrPartsHash
+	}
+
+	msg, err := p.tlH.ParseBoxed(data)
+	if err != nil {
+		return nil, err
+	}
+
+	if _, ok := msg.(tl.AdnlMessagePart); ok {
+		return nil, ErrNestedParts
+	}
+
+	return msg, nil
+}
+
+// assemble joins the parts of the message, making sure they don't leave gaps.
+func (pm *partialMessage) assemble() ([]byte, error) {
+	data := make([]byte, 0, pm.totalSize)
+	for _, part := range pm.parts {
+		if part.offset != len(data) {
+			return nil, fmt.Errorf("%w: missing part at offset %d", ErrPartOutOfRange, len(data))
+		}
+
+		data = append(data, part.data...)
+	}
+
+	if len(data) != pm.totalSize {
+		return nil, ErrPartOutOfRange
+	}
+
+	return data, nil
+}
+
+// expireParts drops the reassemblies of the messages which parts didn't arrive within
+// partsTimeout. Should be used with p.mu locked.
+func (p *Peer) expireParts(now time.Time) {
+	for k, pm := range p.parts {
+		if now.Sub(pm.createdAt) > partsTimeout {
+			delete(p.parts, k)
+		}
+	}
+}
+
+// senderReassemblies returns the amount of messages of the sender with id senderIDStr being
+// reassembled. Should be used with p.mu locked.
+func (p *Peer) senderReassemblies(senderIDStr string) int {
+	n := 0
+	for _, pm := range p.parts {
+		if pm.sender == senderIDStr {
+			n++
+		}
+	}
+
+	return n
+}
+
+// dropOldestPart drops the oldest reassembly of the sender with id senderIDStr, or the oldest
+// of any sender in case senderIDStr is empty. Should be used with p.mu locked.
+func (p *Peer) dropOldestPart(senderIDStr string) {
+	var oldestKey string
+	var oldest *partialMessage
+	for k, pm := range p.parts {
+		if senderIDStr != "" && pm.sender != senderIDStr {
+			continue
+		}
+
+		if oldest == nil || pm.createdAt.Before(oldest.createdAt) {
+			oldestKey, oldest = k, pm
+		}
+	}
+
+	if oldest != nil {
+		delete(p.parts, oldestKey)
+	}
+}
+
+// sweepParts drops the expired reassemblies, even when no new parts arrive.
+func (p *Peer) sweepParts(now time.Time) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.expireParts(now)
+}
@@ -0,0 +1,209 @@
+package adnl
+
+import (
+	"bytes"
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/Gealber/dht/tl"
+)
+
+func TestPeerQueryBigAnswer(t *testing.T) {
+	a, _ := newTestPeer(t)
+	b, bAddr := newTestPeer(t)
+
+	bigAnswer := make([]byte, 20*maxMessageSize+100)
+	rand.Read(bigAnswer)
+
+	b.SetQueryHandler(func(from ed25519.PublicKey, query []byte) ([]byte, error) {
+		return bigAnswer, nil
+	})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+
+	answer, err := a.Query(ctx, b.pubKey, bAddr, []byte{1, 2, 3, 4})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !bytes.Equal(answer, bigAnswer) {
+		t.Fatal("reassembled answer differs")
+	}
+}
+
+func Test_packMessages(t *testing.T) {
+	p, err := New(nil, nil, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	small := tl.AdnlMessageCustom{Data: make([]byte, 100)}
+	big := tl.AdnlMessageCustom{Data: make([]byte, 3*maxMessageSize)}
+
+	packets, err := p.packMessages([]any{small, small, big, small})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// small messages are packed together, each part of the big one in its own packet
+	// keeping the order of the messages
+	if len(packets) < 4 {
+		t.Fatalf("unexpected amount of packets: %d", len(packets))
+	}
+
+	if len(packets[0]) != 2 || len(packets[len(packets)-1]) != 1 {
+		t.Fatal("small messages should be packed together keeping the order")
+	}
+
+	for _, pkt := range packets[1 : len(packets)-1] {
+		if _, ok := pkt[0].(tl.AdnlMessagePart); !ok || len(pkt) != 1 {
+			t.Fatal("expected a single part per packet")
+		}
+	}
+}
+
+func Test_handlePart(t *testing.T) {
+	p, err := New(nil, nil, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	msg := tl.AdnlMessageCustom{Data: make([]byte, 3*maxMessageSize)}
+	rand.Read(msg.Data)
+	parts, _, err := p.splitMessage(msg)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// parts arriving out of order and duplicated
+	var got any
+	for i := len(parts) - 1; i > 0; i-- {
+		for j := 0; j < 2; j++ {
+			got, err = p.handlePart("a", parts[i].(tl.AdnlMessagePart))
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if got != nil {
+				t.Fatal("message reassembled before receiving all the parts")
+			}
+		}
+	}
+
+	got, err = p.handlePart("a", parts[0].(tl.AdnlMessagePart))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	custom, ok := got.(tl.AdnlMessageCustom)
+	if !ok || !bytes.Equal(custom.Data, msg.Data) {
+		t.Fatal("unexpected reassembled message")
+	}
+
+	tamperedHash := sha256.Sum256([]byte("tampered"))
+	tcs := []struct {
+		name string
+		part tl.AdnlMessagePart
+		err  error
+	}{
+		{
+			name: "total size over the limit",
+			part: tl.AdnlMessagePart{Hash: tamperedHash[:], TotalSize: maxPartsTotalSize + 1, Data: []byte{1}},
+			err:  ErrPartsTotalSize,
+		},
+		{
+			name: "part out of range",
+			part: tl.AdnlMessagePart{Hash: tamperedHash[:], TotalSize: 10, Offset: 8, Data: []byte{1, 2, 3}},
+			err:  ErrPartOutOfRange,
+		},
+		{
+			name: "hash doesn't match",
+			part: tl.AdnlMessagePart{Hash: tamperedHash[:], TotalSize: 3, Data: []byte{1, 2, 3}},
+			err:  ErrPartsHash,
+		},
+	}
+
+	for _, tc := range tcs {
+		t.Run(tc.name, func(t *testing.T) {
+			_, err := p.handlePart("a", tc.part)
+			if !errors.Is(err, tc.err) {
+				t.Fatalf("expected error %v got: %v", tc.err, err)
+			}
+		})
+	}
+
+	// parts overlapping at different offsets are rejected
+	hash := sha256.Sum256([]byte("overlapping"))
+	_, err = p.handlePart("a", tl.AdnlMessagePart{Hash: hash[:], TotalSize: 10, Offset: 4, Data: []byte{1, 2, 3, 4}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, offset := range []int{2, 6, 4} {
+		_, err = p.handlePart("a", tl.AdnlMessagePart{Hash: hash[:], TotalSize: 10, Offset: offset, Data: []byte{1, 2, 3}})
+		if !errors.Is(err, ErrPartsOverlap) {
+			t.Fatalf("expected parts overlap error at offset %d, got: %v", offset, err)
+		}
+	}
+
+	// expired reassemblies are swept without waiting for new parts
+	p.sweepParts(time.Now().Add(partsTimeout + time.Second))
+	if len(p.parts) != 0 {
+		t.Fatalf("expected expired reassemblies to be dropped, got %d", len(p.parts))
+	}
+
+	// a sender reassembling too many messages drops its oldest ones, without affecting others
+	p.parts = make(map[string]*partialMessage)
+	bHash := sha256.Sum256([]byte("b"))
+	_, err = p.handlePart("b", tl.AdnlMessagePart{Hash: bHash[:], TotalSize: 10, Data: []byte{1}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var first string
+	for i := 0; i < maxReassemblies; i++ {
+		hash := sha256.Sum256([]byte{byte(i)})
+		if i == 0 {
+			first = "a" + hex.EncodeToString(hash[:])
+		}
+
+		_, err := p.handlePart("a", tl.AdnlMessagePart{Hash: hash[:], TotalSize: 10, Data: []byte{1}})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if _, ok := p.parts[first]; ok {
+		t.Fatal("expected the oldest reassembly of the sender to be dropped")
+	}
+	if _, ok := p.parts["b"+hex.EncodeToString(bHash[:])]; !ok {
+		t.Fatal("expected the reassembly of another sender to be kept")
+	}
+	if n := p.senderReassemblies("a"); n != maxSenderReassemblies {
+		t.Fatalf("expected %d reassemblies of the sender got %d", maxSenderReassemblies, n)
+	}
+
+	// once full, new senders drop the oldest reassembly of all
+	for i := 0; i < maxReassemblies; i++ {
+		hash := sha256.Sum256([]byte{byte(i)})
+		_, err := p.handlePart(fmt.Sprint(i), tl.AdnlMessagePart{Hash: hash[:], TotalSize: 10, Data: []byte{1}})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if len(p.parts) != maxReassemblies {
+		t.Fatalf("expected %d reassemblies got %d", maxReassemblies, len(p.parts))
+	}
+	if _, ok := p.parts["b"+hex.EncodeToString(bHash[:])]; ok {
+		t.Fatal("expected the oldest reassembly to be dropped")
+	}
+}
@@ -2,54 +2,108 @@ package adnl
 
 import (
 	"bytes"
+	"context"
 	"crypto/ed25519"
 	"crypto/rand"
 	"crypto/sha256"
-	"encoding/binary"
 	"encoding/hex"
 	"errors"
 	"fmt"
-	"io"
-	"log"
+	"log/slog"
 	"net"
-	"os"
-	"sync/atomic"
+	"net/netip"
+	"slices"
+	"sync"
 	"time"
 
+	"github.com/Gealber/dht/adnl/proxy"
 	"github.com/Gealber/dht/tl"
 	"github.com/Gealber/dht/utils"
 )
 
-type PeerMetric struct {
-	id         []byte
-	delay      int64
-	lastPingTs int64
-}
+var (
+	ErrPeerClosed     = errors.New("adnl peer closed")
+	ErrNotListening   = errors.New("adnl peer is not listening yet")
+	ErrAlreadyServing = errors.New("adnl peer is already serving a connection")
+	ErrInvalidPubKey  = errors.New("invalid ed25519 public key size")
+	ErrInvalidPrivKey = errors.New("invalid ed25519 private key size")
+	ErrChecksum       = errors.New("failed checksum validation")
+
+	// errSendingAnswers wraps the errors sending the answers to a packet
+	errSendingAnswers = errors.New("sending answers")
+)
 
-// TODO: checkout access to fields on concurrency call, we might need to use some lock
 type Peer struct {
 	// peer id
 	id      []byte
 	pubKey  ed25519.PublicKey
 	privKey ed25519.PrivateKey
 	port    int
-	conn    net.Conn
+	conn    Transport
 	tlH     *tl.TLHandler
 
 	// channels in the context of adnl protocol, read doc/adnl/adnl-udp.md for more details
-	chns   map[string]channel
-	logger *log.Logger
-	// sorted array with known peer ids
-	peersMetric map[string]PeerMetric
-	// TODO: add a closer channel to handle close connection
-	seqno        atomic.Int64
-	confirmSeqno atomic.Int64
-}
-
-type channel struct {
-	id               []byte
-	outEncryptionKey []byte
-	inDecryptionKey  []byte
+	// indexed by the id of their incomming key
+	chns map[string]*channel
+	// state of the communication with each peer, indexed by peer id
+	peers  map[string]*peerState
+	logger *slog.Logger
+	// queries waiting for an answer, indexed by query id
+	queries      map[string]chan []byte
+	queryHandler QueryHandler
+	// handlers of custom messages and queries, indexed by the constructor id of their payload
+	handlers map[uint32]Handler
+	// messages being reassembled from its parts, indexed by sender id and hash
+	parts map[string]*partialMessage
+	// limits applied to the received datagrams, drops amount of datagrams dropped by each limit
+	limits Limits
+	drops  map[error]uint64
+	// validationErrs amount of packets dropped by each validation rule
+	validationErrs map[error]uint64
+	// addrBook address lists advertised by the peers
+	addrBook *addressBook
+	// addrs our address list, advertised to the peers with version addrListVersion
+	addrs           []any
+	addrListVersion int64
+	// store where the known peers are persisted, nil in case they aren't. dirty peers which
+	// address list changed since they were saved
+	store PeerStore
+	dirty map[string]struct{}
+	// tunnels we receive packets for, indexed by the id of their key
+	tunnels map[string]*tunnel
+	// proxy relaying our packets from proxyAddr, nil in case we aren't behind a proxy.
+	// proxyPing id of the last ping sent to the proxy, nil once it answers
+	proxy     *proxy.Fast
+	proxyAddr netip.AddrPort
+	proxyPing []byte
+	// capture hook called with the packets received and sent, nil in case they aren't captured
+	capture CaptureHook
+	// identities local identities sharing our socket, indexed by their id
+	identities map[string]*Peer
+	// parent peer serving the socket we share, nil unless we are a local identity of it
+	parent *Peer
+	// sendQueues messages waiting to be sent to each peer, indexed by peer id
+	sendQueues map[string]*sendQueue
+	batching   Batching
+	// channelPolicy keepalives, failures and lifetime of the channels
+	channelPolicy ChannelPolicy
+	// resolver finds the addresses of the peers, resolved caches them indexed by peer id
+	resolver AddressResolver
+	resolved map[string]ResolvedAddress
+	// mu protects conn, channels, peers, queries, queryHandler, handlers, parts, limits,
+	// drops, validationErrs, our address list, store, tunnels, proxy, capture, identities,
+	// send queues, batching, channel policy, resolver, resolved addresses and reinit date
+	mu sync.Mutex
+	// reinitDate date in which the peer was started, peers use it to detect our restarts
+	reinitDate int64
+
+	// closer is closed when the peer is shut down
+	closer    chan struct{}
+	closeOnce sync.Once
+	// serving tracks the serve loops and their goroutines, waited by Shutdown
+	serving serveGroup
+	// sending tracks the flushes of the send queues, waited before closing the connection
+	sending sync.WaitGroup
 }
 
 func New(privKey ed25519.PrivateKey, pubKey ed25519.PublicKey, port int) (*Peer, error) {
@@ -64,210 +118,797 @@ func New(privKey ed25519.PrivateKey, pubKey ed25519.PublicKey, port int) (*Peer,
 	tlH := tl.New()
 	tlH.Register(tl.DefaultTLModel)
 
-	// register defaults models
-	id, err := tlH.Serialize(tl.PublicKeyED25519{
-		Key: pubKey,
-	}, true)
-	if err != err {
+	// peer id is the hash of our boxed public key
+	id, err := utils.KeyIDEd25519(pubKey)
+	if err != nil {
 		return nil, err
 	}
 
-	return &Peer{
-		id:          id,
-		port:        port,
-		privKey:     privKey,
-		pubKey:      pubKey,
-		tlH:         tlH,
-		chns:        make(map[string]channel),
-		logger:      log.New(os.Stdout, "[adnl-peer]", log.LUTC),
-		peersMetric: make(map[string]PeerMetric),
-	}, nil
+	p := &Peer{
+		id:             id,
+		port:           port,
+		privKey:        privKey,
+		pubKey:         pubKey,
+		tlH:            tlH,
+		chns:           make(map[string]*channel),
+		peers:          make(map[string]*peerState),
+		queries:        make(map[string]chan []byte),
+		handlers:       make(map[uint32]Handler),
+		parts:          make(map[string]*partialMessage),
+		validationErrs: make(map[error]uint64),
+		limits:         DefaultLimits(),
+		drops:          make(map[error]uint64),
+		addrBook:       newAddressBook(),
+		dirty:          make(map[string]struct{}),
+		tunnels:        make(map[string]*tunnel),
+		identities:     make(map[string]*Peer),
+		sendQueues:     make(map[string]*sendQueue),
+		batching:       DefaultBatching(),
+		channelPolicy:  DefaultChannelPolicy(),
+		resolved:       make(map[string]ResolvedAddress),
+		closer:         make(chan struct{}),
+		serving:        serveGroup{done: make(chan struct{})},
+		reinitDate:     time.Now().Unix(),
+	}
+	p.SetLogger(utils.NewLogger())
+
+	return p, nil
+}
+
+// SetLogger sets the logger of the peer, its records include the component and our peer id. Per
+// packet events are logged with debug level, repeated warnings and errors are rate limited. It
+// should be called before the peer starts serving.
+func (p *Peer) SetLogger(logger *slog.Logger) {
+	p.logger = utils.ComponentLogger(logger, "adnl-peer").With("peer_id", hex.EncodeToString(p.id))
 }
 
-// Listen will read in loop for incomming data
-func (p *Peer) Listen() error {
-	addr := fmt.Sprintf(":%d", p.port)
-	conn, err := net.Dial("udp", addr)
+// SetReinitDate replaces the date the peer was started, peers seeing a newer date forget their
+// state with us. It should be called before the peer starts serving, replaying a capture for
+// example, as the packets captured were sent to the reinit date of the captured peer.
+func (p *Peer) SetReinitDate(date int64) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.reinitDate = date
+}
+
+// Listen opens an UDP socket on the peer port and serves incomming datagrams
+// until ctx is done or the peer is closed. The socket listens on both address
+// families when the system supports dual stack sockets, otherwise only on IPv4.
+func (p *Peer) Listen(ctx context.Context) error {
+	conn, err := net.ListenPacket("udp", fmt.Sprintf(":%d", p.port))
 	if err != nil {
 		return err
 	}
+
+	return p.Serve(ctx, conn)
+}
+
+// Serve will read in loop incomming datagrams from conn, replies are sent through the same conn.
+// Serve takes ownership of conn, which is closed once ctx is done or the peer is closed.
+func (p *Peer) Serve(ctx context.Context, conn net.PacketConn) error {
+	return p.ServeTransport(ctx, NewUDPTransport(conn))
+}
+
+// ServeTransport is like Serve, reading and writing the datagrams through the transport conn.
+func (p *Peer) ServeTransport(ctx context.Context, conn Transport) error {
+	err := p.attach(conn)
+	if err != nil {
+		return err
+	}
+
+	return p.serve(ctx, conn)
+}
+
+// Start is like Listen, but the socket is served in background. It returns once the socket
+// is opened, the peer is served until ctx is done or Shutdown is called.
+func (p *Peer) Start(ctx context.Context) error {
+	conn, err := net.ListenPacket("udp", fmt.Sprintf(":%d", p.port))
+	if err != nil {
+		return err
+	}
+
+	err = p.StartTransport(ctx, NewUDPTransport(conn))
+	if errors.Is(err, ErrAlreadyServing) {
+		conn.Close()
+	}
+
+	return err
+}
+
+// StartTransport is like Start, serving the transport conn in background.
+func (p *Peer) StartTransport(ctx context.Context, conn Transport) error {
+	err := p.attach(conn)
+	if err != nil {
+		return err
+	}
+
+	go func() {
+		err := p.serve(ctx, conn)
+		if err != nil {
+			p.logger.Error("serve loop failed", "err", err)
+		}
+	}()
+
+	return nil
+}
+
+// attach sets conn as the connection the peer serves, the serve loop must be
+// run afterwards. Fails in case the peer is closed or already serving.
+func (p *Peer) attach(conn Transport) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	select {
+	case <-p.closer:
+		conn.Close()
+		return ErrPeerClosed
+	default:
+	}
+	// local identities are served by the socket of their parent
+	if p.conn != nil || p.parent != nil {
+		return ErrAlreadyServing
+	}
 	p.conn = conn
+	// closer is closed under the lock, so the serve loop is tracked before Shutdown waits
+	p.serving.Add(1)
+
+	return nil
+}
+
+// serve reads in loop the datagrams of conn, attached to the peer, until ctx is done or
+// the peer is closed. The queued datagrams are processed before returning.
+func (p *Peer) serve(ctx context.Context, conn Transport) error {
+	defer p.serving.Done()
+
+	err := p.registerProxy()
+	if err != nil {
+		p.logger.Warn("failed registering in proxy", "err", err)
+	}
+
+	done := make(chan struct{})
+	defer close(done)
+
+	// closing conn is the only way to unblock a pending read, once the peer is closed conn
+	// is closed by stop, after sending the queued messages
+	p.serving.Add(1)
+	go func() {
+		defer p.serving.Done()
+		select {
+		case <-ctx.Done():
+		case <-done:
+		}
+		conn.Close()
+	}()
+
+	interval := p.maintenanceInterval()
+	p.serving.Add(1)
+	go func() {
+		defer p.serving.Done()
+		p.maintain(interval, done)
+	}()
+
+	r := p.startReceiver()
+	defer r.stop()
 
 	// read loop
 	for {
-		buff := make([]byte, 4096)
-		n, err := conn.Read(buff)
+		buff := datagramPool.Get().(*[]byte)
+		n, src, err := conn.ReadFrom(*buff)
+		if errors.Is(err, ErrUnexpectedAddress) {
+			datagramPool.Put(buff)
+			p.logger.Debug("ignoring datagram", "err", err)
+			continue
+		}
+
 		if err != nil {
-			if errors.Is(err, io.EOF) {
+			datagramPool.Put(buff)
+			if errors.Is(err, net.ErrClosed) {
 				return nil
 			}
 
 			return err
 		}
 
-		if n < 32 {
+		packet := (*buff)[:n]
+		// datagrams relayed by our proxy are unwrapped, their source is in the proxy header
+		src, packet, ok := p.unwrapProxy(src, packet)
+		if !ok || len(packet) < 32 {
 			// ignore datagrams less than 32 bytes
+			datagramPool.Put(buff)
 			continue
 		}
 
-		id := buff[:32]
-		idStr := hex.EncodeToString(id)
-		buff = buff[32:n]
-
-		// if id doesn't match our peer id, check if it's a registered channel id
-		if !bytes.Equal(id, p.id) {
-			chnInfo, ok := p.chns[idStr]
-			if !ok {
-				// not a registerd neither is for us
-				continue
-			}
-
-			// handle channel command
-			go p.processMsgInChannel(chnInfo, buff)
+		d, peerKey, ok := p.classify(src, packet)
+		if !ok {
+			datagramPool.Put(buff)
 			continue
 		}
+		d.buff = buff
 
+		p.enqueue(r, d, peerKey)
+	}
+}
+
+// classify builds the datagram for packet according to the id it starts with, our peer id, the id
+// of a channel or the id of a tunnel. Returns as well the key identifying the sender for the rate
+// limits. Reports false if packet isn't for us.
+func (p *Peer) classify(src netip.AddrPort, packet []byte) (datagram, []byte, bool) {
+	if len(packet) < 32 {
+		// ignore datagrams less than 32 bytes
+		return datagram{}, nil, false
+	}
+
+	id := packet[:32]
+	data := packet[32:]
+
+	if bytes.Equal(id, p.id) {
 		// message is not to a registered channel and is for the peer
 		// this messages needs to include the publick [key(32 bytes) | checksum(32 bytes) | encrypted data]
 		// at least needs to be bigger than 64
-		if len(buff) > 64 {
-			go p.processMsgIn(buff)
+		if len(data) <= 64 {
+			return datagram{}, nil, false
 		}
+
+		return datagram{src: src, data: data}, data[:32], true
 	}
+
+	// if id doesn't match our peer id, check if it's a registered channel id
+	idStr := hex.EncodeToString(id)
+	p.mu.Lock()
+	ch, isChn := p.chns[idStr]
+	t, isTunnel := p.tunnels[idStr]
+	p.mu.Unlock()
+
+	if isChn {
+		// handle channel command, which includes [checksum(32 bytes) | encrypted data]
+		if len(data) <= 32 {
+			return datagram{}, nil, false
+		}
+
+		return datagram{src: src, data: data, ch: ch}, ch.peerPubKey, true
+	}
+
+	if isTunnel {
+		// tunnel packets use the first packet format with a temporary key of the sender,
+		// so they are limited per tunnel
+		if len(data) <= 64 {
+			return datagram{}, nil, false
+		}
+
+		return datagram{src: src, data: data, tunnel: t}, id, true
+	}
+
+	// not a registerd neither is for us, it might be for one of the identities sharing our socket
+	return p.classifyLocal(src, idStr, data)
 }
 
-// TODO: implementation
-func (p *Peer) processMsgInChannel(chnInfo channel, data []byte) {
+// Close shuts down the peer, closing the underlaying connection and the local identities
+// sharing it. Known peers are saved in the peer store, if any. It doesn't wait for the
+// packets being processed, use Shutdown for that.
+func (p *Peer) Close() error {
+	closed, err := p.stop()
+	if closed {
+		saveErr := p.savePeers()
+		if saveErr != nil {
+			p.logger.Error("failed saving peers", "err", saveErr)
+		}
+	}
+
+	for _, local := range p.localIdentities() {
+		local.Close()
+	}
+
+	return err
 }
 
-// TODO: implementation
-func (p *Peer) processMsgIn(data []byte) {
-	// extract sender public key
-	senderPubKey := data[:32]
-	checksum := data[32:64]
-	data = data[64:]
+// Shutdown stops accepting packets, closing the underlaying connection, and waits for the
+// packets being processed and the serve loops to return. Then known peers are saved in the
+// peer store, if any, ours and the ones of the local identities. In case ctx is done first
+// the peers are saved without waiting for the packets being processed, and its error is
+// returned. Handlers must not call it, as it waits for them.
+func (p *Peer) Shutdown(ctx context.Context) error {
+	_, err := p.stop()
+
+	select {
+	case <-p.serving.done:
+	case <-ctx.Done():
+		err = errors.Join(err, ctx.Err())
+	}
 
-	senderID, err := p.computePeerID(senderPubKey)
-	if err != nil {
-		p.logger.Println("error generating shared key:", err)
+	errs := []error{err, p.savePeers()}
+	for _, local := range p.localIdentities() {
+		errs = append(errs, local.Shutdown(ctx))
+	}
+
+	return errors.Join(errs...)
+}
+
+// stop closes closer and the connection, unblocking the serve loops and the pending
+// queries. The messages already queued are sent before closing the connection.
+// Reports true the first time it's called.
+func (p *Peer) stop() (bool, error) {
+	var err error
+	closed := false
+	p.closeOnce.Do(func() {
+		closed = true
+
+		p.mu.Lock()
+		close(p.closer)
+		p.mu.Unlock()
+		p.serving.stop()
+
+		p.sending.Wait()
+
+		p.mu.Lock()
+		defer p.mu.Unlock()
+		if p.conn != nil {
+			err = p.conn.Close()
+			if errors.Is(err, net.ErrClosed) {
+				err = nil
+			}
+		}
+	})
+
+	return closed, err
+}
+
+// serveGroup tracks the serve loops and their goroutines like a sync.WaitGroup, done is closed
+// once the peer is stopped and none of them is left, so they can be waited until a deadline
+// without a goroutine waiting for them.
+type serveGroup struct {
+	mu      sync.Mutex
+	n       int
+	stopped bool
+	done    chan struct{}
+}
+
+// Add adds delta to the amount of goroutines tracked.
+func (g *serveGroup) Add(delta int) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	g.n += delta
+	g.release()
+}
+
+// Done removes a goroutine tracked.
+func (g *serveGroup) Done() {
+	g.Add(-1)
+}
+
+// stop marks the peer stopped, no goroutines are tracked afterwards unless one of them
+// is still running.
+func (g *serveGroup) stop() {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	g.stopped = true
+	g.release()
+}
+
+// release closes done once the peer is stopped and no goroutines are left.
+// Should be used with g.mu locked.
+func (g *serveGroup) release() {
+	if !g.stopped || g.n > 0 {
 		return
 	}
-	senderIDStr := hex.EncodeToString(senderID[:])
-	if _, ok := p.peersMetric[senderIDStr]; !ok {
-		p.peersMetric[senderIDStr] = PeerMetric{id: senderID[:], delay: -1}
+
+	select {
+	case <-g.done:
+	default:
+		close(g.done)
 	}
+}
 
-	// let's build our shared secret as explained in the documentation
-	sharedSecret, err := utils.GenerateSharedKey(p.privKey, senderPubKey)
+// LocalAddr returns the address the peer is listening on, the one of its parent for local identities.
+func (p *Peer) LocalAddr() (netip.AddrPort, error) {
+	if p.parent != nil {
+		return p.parent.LocalAddr()
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.conn == nil {
+		return netip.AddrPort{}, ErrNotListening
+	}
+
+	addr := p.conn.LocalAddr()
+	if !addr.IsValid() {
+		return netip.AddrPort{}, fmt.Errorf("%w: %s", ErrUnsupportedAddress, addr)
+	}
+
+	return addr, nil
+}
+
+// writeTo writes data as a single datagram to addr, through the connection we are listening on.
+// When we are behind a proxy the datagram is sent to the proxy, which forwards it to addr.
+// Local identities write through the connection of their parent.
+func (p *Peer) writeTo(addr netip.AddrPort, data []byte) error {
+	if p.parent != nil {
+		return p.parent.writeTo(addr, data)
+	}
+
+	p.mu.Lock()
+	conn := p.conn
+	fast, proxyAddr := p.proxy, p.proxyAddr
+	p.mu.Unlock()
+	if conn == nil {
+		return ErrNotListening
+	}
+
+	if fast != nil {
+		var err error
+		data, err = fast.Encode(addr, data, time.Now())
+		if err != nil {
+			return err
+		}
+		addr = proxyAddr
+	}
+
+	_, err := conn.WriteTo(data, addr)
+	return err
+}
+
+// addrPort converts addr into a netip.AddrPort, IPv4 mapped addresses are unmapped.
+func addrPort(addr net.Addr) (netip.AddrPort, error) {
+	var ap netip.AddrPort
+	if udpAddr, ok := addr.(*net.UDPAddr); ok {
+		ap = udpAddr.AddrPort()
+	} else {
+		var err error
+		ap, err = netip.ParseAddrPort(addr.String())
+		if err != nil {
+			return netip.AddrPort{}, err
+		}
+	}
+
+	if !ap.IsValid() {
+		return netip.AddrPort{}, fmt.Errorf("invalid address: %s", addr)
+	}
+
+	return netip.AddrPortFrom(ap.Addr().Unmap(), ap.Port()), nil
+}
+
+func (p *Peer) processMsgIn(src netip.AddrPort, data []byte) {
+	senderPubKey, data, err := openPacket(p.privKey, data)
 	if err != nil {
-		p.logger.Println("error generating shared key:", err)
+		p.logger.Debug("failed opening packet", "addr", src, "err", err)
 		return
 	}
 
+	p.handlePacket(src, senderPubKey, nil, data)
+}
+
+// openPacket decrypts data, in the first packet format [sender key(32 bytes) | checksum(32 bytes) | encrypted data],
+// sent to the key privKey. Returns the sender key and the decrypted data, which has its own buffer so the
+// datagram buffer can be reused once processed.
+func openPacket(privKey ed25519.PrivateKey, data []byte) (ed25519.PublicKey, []byte, error) {
+	// extract sender public key
+	senderPubKey := ed25519.PublicKey(slices.Clone(data[:32]))
+	checksum := data[32:64]
+	encrypted := data[64:]
+
+	// let's build our shared secret as explained in the documentation
+	sharedSecret, err := utils.GenerateSharedKey(privKey, senderPubKey)
+	if err != nil {
+		return nil, nil, err
+	}
+
 	cipher, err := utils.BuildSharedCipher(sharedSecret, checksum)
 	if err != nil {
-		p.logger.Println("error while building shared cipher:", err)
-		return
+		return nil, nil, err
 	}
 
 	// decrypt data first, and later perform integrity validation of data
-	cipher.XORKeyStream(data, data)
-	localChecksum := sha256.Sum256(data)
+	plain := make([]byte, len(encrypted))
+	cipher.XORKeyStream(plain, encrypted)
+	localChecksum := sha256.Sum256(plain)
 	if !bytes.Equal(localChecksum[:], checksum) {
-		p.logger.Println("failed checksum validation")
+		return nil, nil, ErrChecksum
+	}
+
+	return senderPubKey, plain, nil
+}
+
+// handlePacket process the decrypted adnl.packetContents sent by the peer with public key senderPubKey
+// from src, through the channel ch or nil in case of the first packet format. Answers to the
+// messages in the packet are sent back to src.
+func (p *Peer) handlePacket(src netip.AddrPort, senderPubKey ed25519.PublicKey, ch *channel, data []byte) {
+	err := p.processPacket(src, senderPubKey, ch, data)
+	if err == nil {
 		return
 	}
 
-	// TODO: parse unencrypted packet, packet should be an adnl.packetContent
-	err = p.parseMsgIn(senderIDStr, data)
+	level := slog.LevelDebug
+	if errors.Is(err, errSendingAnswers) {
+		level = slog.LevelWarn
+	}
+
+	senderID, _ := p.computePeerID(senderPubKey)
+	p.logger.Log(context.Background(), level, "failed processing packet",
+		"remote_id", hex.EncodeToString(senderID[:]), "addr", src, "err", err)
+}
+
+// processPacket is like handlePacket, returning the error processing the packet.
+func (p *Peer) processPacket(src netip.AddrPort, senderPubKey ed25519.PublicKey, ch *channel, data []byte) error {
+	senderID, err := p.computePeerID(senderPubKey)
 	if err != nil {
-		p.logger.Println("failed parsing of message err:", err)
-		return
+		return fmt.Errorf("computing sender id: %w", err)
 	}
+	senderIDStr := hex.EncodeToString(senderID[:])
+	capturePacket(p.captureHook(), DirectionIn, senderID[:], senderPubKey, src, ch != nil, data)
+
+	answers, err := p.parseMsgIn(senderIDStr, senderPubKey, ch, data)
+	if errors.Is(err, ErrDstReinitDateTooOld) {
+		// packet is dropped, but the peer needs to know our current reinit date
+		answers, err = []any{tl.AdnlMessageNop{}}, nil
+	}
+
+	if err != nil {
+		return fmt.Errorf("parsing message: %w", err)
+	}
+
+	if len(answers) == 0 {
+		return nil
+	}
+
+	// replies go back to the address the datagram came from
+	err = p.sendPacket(senderPubKey, src, answers...)
+	if err != nil {
+		return fmt.Errorf("%w: %w", errSendingAnswers, err)
+	}
+
+	return nil
 }
 
-func (p *Peer) parseMsgIn(senderIDStr string, data []byte) error {
+// parseMsgIn parses an adnl.packetContents and returns the answers to its messages, the
+// messages that fail are logged and skipped.
+func (p *Peer) parseMsgIn(senderIDStr string, senderPubKey ed25519.PublicKey, ch *channel, data []byte) ([]any, error) {
 	var obj tl.AdnlPacketContent
 	err := p.tlH.Parse(data, &obj, true)
 	if err != nil {
-		return err
+		return nil, err
 	}
 
 	// validate packet content
-	err = p.packetContentValidation(obj)
+	err = p.packetContentValidation(senderPubKey, ch, obj)
 	if err != nil {
-		return err
+		return nil, err
 	}
 
-	if obj.Message != nil {
-		msgAnswer, err := p.buildMessageAnswer(senderIDStr, obj.Message)
-		if err != nil {
-			return err
-		}
+	// drop replayed or stale packets
+	err = p.checkPacketState(senderIDStr, senderPubKey, ch, obj)
+	if err != nil {
+		return nil, err
+	}
 
-		if msgAnswer != nil {
-			// TODO: APPEND to answers in adnl.packetContent
-		}
+	if p.addrBook.update(senderIDStr, obj) {
+		p.markDirty(senderIDStr)
+	}
+
+	msgs := obj.Messages
+	if obj.Message != nil {
+		msgs = append([]any{obj.Message}, msgs...)
 	}
 
-	for _, msg := range obj.Messages {
-		msgAnswer, err := p.buildMessageAnswer(senderIDStr, msg)
+	// a failing message doesn't drop the other messages of the packet
+	answers := make([]any, 0)
+	for _, msg := range msgs {
+		msgAnswer, err := p.buildMessageAnswer(senderIDStr, senderPubKey, msg)
 		if err != nil {
-			return err
+			p.logger.Warn("failed processing message", "remote_id", senderIDStr, "type", fmt.Sprintf("%T", msg), "err", err)
+			continue
 		}
 
 		if msgAnswer != nil {
-			// TODO: APPEND to answers in adnl.packetContent
+			answers = append(answers, msgAnswer)
 		}
 	}
 
-	return nil
+	return answers, nil
 }
 
-// TODO: implement
-func (p *Peer) packetContentValidation(pkt tl.AdnlPacketContent) error {
-	return nil
-}
-
-func (p *Peer) buildMessageAnswer(senderIDStr string, msg any) (any, error) {
-	switch msg.(type) {
+func (p *Peer) buildMessageAnswer(senderIDStr string, senderPubKey ed25519.PublicKey, msg any) (any, error) {
+	switch m := msg.(type) {
 	case tl.AdnlMessageCreateChannel:
-		return nil, errors.New("not implemented message type")
+		return p.handleCreateChannel(senderIDStr, senderPubKey, m)
 	case tl.AdnlMessageConfirmChannel:
-		return nil, errors.New("not implemented message type")
+		return nil, p.handleConfirmChannel(senderIDStr, senderPubKey, m)
+	case tl.AdnlMessageQuery:
+		return p.handleQuery(senderPubKey, m)
 	case tl.AdnlMessageAnswer:
-		return nil, errors.New("not implemented message type")
+		return nil, p.handleAnswer(m)
 	case tl.Ping:
-		// answering with PONG
-		buff := make([]byte, 4)
-		rand.Read(buff)
-		value := binary.LittleEndian.Uint32(buff)
-		pongCmd := tl.Pong{
-			RandomID: int64(value),
-		}
-
-		return pongCmd, nil
+		// answering with PONG, including the value of the PING so it can be matched
+		return tl.Pong{RandomID: m.Value}, nil
 	case tl.Pong:
-		// update metric of node who sent the PONG response
-		peerInfo, ok := p.peersMetric[senderIDStr]
-		if !ok {
-			// unwanted PONG message
-			return nil, errors.New("unwanted PONG message received from unregistered peer")
+		return nil, p.handlePong(senderIDStr, m)
+	case tl.AdnlMessageCustom:
+		return nil, p.handleCustom(senderPubKey, m)
+	case tl.AdnlMessageNop:
+		return nil, nil
+	case tl.AdnlMessageReinit:
+		p.handleReinit(senderIDStr, senderPubKey, m)
+		return nil, nil
+	case tl.AdnlMessagePart:
+		reassembled, err := p.handlePart(senderIDStr, m)
+		if err != nil || reassembled == nil {
+			return nil, err
 		}
 
-		peerInfo.delay = time.Now().Unix() - peerInfo.lastPingTs
-		log.Printf("PEER: %s DELAY: %d\n", senderIDStr, peerInfo.delay)
-		return nil, nil
-	case tl.AdnlMessageCustom:
-		return nil, errors.New("not implemented message type")
+		return p.buildMessageAnswer(senderIDStr, senderPubKey, reassembled)
 	default:
 		return nil, errors.New("unsupported message type")
 	}
 }
 
+// SendMessage sends msg to the peer with public key dst listening on addr. The message is
+// queued, being packed with the other messages sent to dst within the batching window, and
+// SendMessage returns once it's sent. It blocks while the queue of dst is full, until ctx is
+// done. The packet is signed and encrypted with the key shared with dst, using the first packet
+// format until the channel with dst is ready.
+func (p *Peer) SendMessage(ctx context.Context, dst ed25519.PublicKey, addr netip.AddrPort, msg any) error {
+	_, err := p.sendMessage(ctx, dst, addr, msg)
+	return err
+}
+
+// sendMessage is like SendMessage, returning the time the packet of msg was written. Round
+// trip times are measured from it, leaving out the time msg waited in the queue.
+func (p *Peer) sendMessage(ctx context.Context, dst ed25519.PublicKey, addr netip.AddrPort, msg any) (time.Time, error) {
+	if len(dst) != ed25519.PublicKeySize {
+		return time.Time{}, ErrInvalidPubKey
+	}
+
+	if msg == nil {
+		return time.Time{}, errors.New("nil message")
+	}
+
+	if err := ctx.Err(); err != nil {
+		return time.Time{}, err
+	}
+
+	// invalid messages fail alone, instead of failing the packet they would be packed in
+	_, _, err := p.splitMessage(msg)
+	if err != nil {
+		return time.Time{}, err
+	}
+
+	dstID, err := p.computePeerID(dst)
+	if err != nil {
+		return time.Time{}, err
+	}
+
+	return p.queueMessage(ctx, dst, hex.EncodeToString(dstID[:]), addr, msg)
+}
+
+// sendPacket sends msgs to the peer with public key dst listening on addr. Messages are
+// packed in as many packets as needed, big messages are split in parts.
+func (p *Peer) sendPacket(dst ed25519.PublicKey, addr netip.AddrPort, msgs ...any) error {
+	packets, err := p.packMessages(msgs)
+	if err != nil {
+		return err
+	}
+
+	for _, pktMsgs := range packets {
+		err := p.sendSinglePacket(dst, addr, pktMsgs)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// sendSinglePacket sends msgs in a single packet. Packets are sent through the channel with
+// the peer once is ready, otherwise the first packet format is used asking the peer for
+// the creation of the channel. Read doc/adnl/adnl-udp.md for more details.
+func (p *Peer) sendSinglePacket(dst ed25519.PublicKey, addr netip.AddrPort, msgs []any) error {
+	dstID, err := p.computePeerID(dst)
+	if err != nil {
+		return err
+	}
+
+	dstIDStr := hex.EncodeToString(dstID[:])
+	p.mu.Lock()
+	state := p.peerState(dstIDStr, dst)
+	ch, err := p.peerChannel(state)
+	if err != nil {
+		p.mu.Unlock()
+		return err
+	}
+	seqnos := state.nextSeqnos()
+	seqnos.reinitDate = p.reinitDate
+	seqnos.recvAddrListVersion, seqnos.recvPriorityAddrListVersion = p.addrBook.versions(dstIDStr)
+	// working with a copy, the channel might be replaced meanwhile
+	chnInfo := *ch
+	hook := p.capture
+	p.mu.Unlock()
+
+	if chnInfo.ready {
+		var msg any
+		if len(msgs) == 1 {
+			msg, msgs = msgs[0], nil
+		}
+
+		data, err := p.buildChannelPacket(seqnos, msg, msgs)
+		if err != nil {
+			return err
+		}
+		capturePacket(hook, DirectionOut, dstID[:], dst, addr, true, data)
+
+		payload, err := encryptChannelPacket(&chnInfo, data)
+		if err != nil {
+			return err
+		}
+
+		return p.writeToPeer(dstIDStr, addr, payload)
+	}
+
+	if chnInfo.peerKey == nil {
+		createChn := tl.AdnlMessageCreateChannel{
+			Key:  chnInfo.ourPubKey(),
+			Date: chnInfo.date,
+		}
+		msgs = append([]any{createChn}, msgs...)
+	}
+
+	var msg any
+	if len(msgs) == 1 {
+		msg, msgs = msgs[0], nil
+	}
+
+	data, err := p.buildSignedPacket(seqnos, nil, msg, msgs)
+	if err != nil {
+		return err
+	}
+	capturePacket(hook, DirectionOut, dstID[:], dst, addr, false, data)
+
+	payload, err := p.encryptPacket(dst, data)
+	if err != nil {
+		return err
+	}
+
+	return p.writeToPeer(dstIDStr, addr, payload)
+}
+
+// encryptPacket encrypts the serialized packet data with the secret shared with dst,
+// returning the datagram framed as:
+// | DST KEY ID | OUR PUB KEY | SHA256 CONTENT HASH BEFORE ENCRYPTION | ENCRYPTED CONTENT OF THE PACKET |
+func (p *Peer) encryptPacket(dst ed25519.PublicKey, data []byte) ([]byte, error) {
+	return sealPacket(p.privKey, p.pubKey, dst, data)
+}
+
+// sealPacket encrypts data for dst in the first packet format, using the key pair privKey and pubKey.
+func sealPacket(privKey ed25519.PrivateKey, pubKey, dst ed25519.PublicKey, data []byte) ([]byte, error) {
+	checksum := sha256.Sum256(data)
+	sharedSecret, err := utils.GenerateSharedKey(privKey, dst)
+	if err != nil {
+		return nil, err
+	}
+
+	cipher, err := utils.BuildSharedCipher(sharedSecret, checksum[:])
+	if err != nil {
+		return nil, err
+	}
+
+	dstKeyID, err := utils.KeyIDEd25519(dst)
+	if err != nil {
+		return nil, err
+	}
+
+	payload := make([]byte, 96+len(data))
+	copy(payload, dstKeyID)
+	copy(payload[32:], pubKey)
+	copy(payload[64:], checksum[:])
+	cipher.XORKeyStream(payload[96:], data)
+
+	return payload, nil
+}
+
 func (p *Peer) computePeerID(pubKey []byte) ([32]byte, error) {
 	// register peer in known peers
-	d, err := p.tlH.Serialize(&tl.PublicKeyED25519{Key: pubKey}, true)
+	d, err := p.tlH.Serialize(tl.PublicKeyED25519{Key: pubKey}, true)
 	if err != nil {
 		return [32]byte{}, err
 	}
@@ -275,67 +916,44 @@ func (p *Peer) computePeerID(pubKey []byte) ([32]byte, error) {
 	return sha256.Sum256(d), nil
 }
 
-// TODO: Extend this method to compute flag on the fly
-func (p *Peer) buildSignedPacket(
-	fromIDShort []byte,
-	msg any, msgs []any,
-	addresses, pritorityAddresses []tl.AdnlAddressUDP,
-) ([]byte, error) {
-	date := time.Now().Unix()
+// buildSignedPacket builds an adnl.packetContents signed with our key, including our address list.
+func (p *Peer) buildSignedPacket(seqnos packetSeqnos, fromIDShort []byte, msg any, msgs []any) ([]byte, error) {
 	rand1, rand2 := utils.RandomBuff()
 
-	p.seqno.Add(1)
-
 	pkt := tl.AdnlPacketContent{
 		Rand1: rand1,
-		// initial flags has bytes 0, 6, 7, 8, 9, and 10 set
-		Flags: 0x7c1,
+		Flags: flagFrom | flagSeqno | flagConfirmSeqno | flagRecvAddrListVersion |
+			flagRecvPriorityAddrListVersion | flagReinitDate,
 		From: tl.PublicKeyED25519{
 			Key: p.pubKey,
 		},
-		Seqno:               p.seqno.Load(),
-		ConfirmSeqno:        p.confirmSeqno.Load(),
-		RecvAddrListVersion: date,
-		ReinitDate:          date,
-		DstReinitDate:       0,
-		Rand2:               rand2,
+		Seqno:                       seqnos.seqno,
+		ConfirmSeqno:                seqnos.confirmSeqno,
+		RecvAddrListVersion:         seqnos.recvAddrListVersion,
+		RecvPriorityAddrListVersion: seqnos.recvPriorityAddrListVersion,
+		ReinitDate:                  seqnos.reinitDate,
+		DstReinitDate:               seqnos.dstReinitDate,
+		Rand2:                       rand2,
 	}
 
 	if len(fromIDShort) > 0 {
-		pkt.Flags |= 0b11
-		pkt.FromIDShort = fromIDShort
+		pkt.Flags |= flagFromShort
+		pkt.FromIDShort = tl.AdnlIDShort{ID: fromIDShort}
 	}
 
 	if msg != nil {
-		pkt.Flags |= 0b111
+		pkt.Flags |= flagMessage
 		pkt.Message = msg
 	}
 
 	if len(msgs) > 0 {
-		pkt.Flags |= 0b1111
+		pkt.Flags |= flagMessages
 		pkt.Messages = msgs
 	}
 
-	if len(addresses) > 0 {
-		pkt.Flags |= 0b11111
-		pkt.AddressList = tl.AdnlAddressList{
-			Addresses:  addresses,
-			Version:    date,
-			ReinitDate: date,
-			Priority:   0,
-			ExpireAt:   0,
-		}
-	}
-
-	if len(pritorityAddresses) > 0 {
-		pkt.Flags |= 0b111111
-		pkt.PriorityAddressList = tl.AdnlAddressList{
-			Addresses:  pritorityAddresses,
-			Version:    date,
-			ReinitDate: date,
-			Priority:   0,
-			ExpireAt:   0,
-		}
+	if addrList, ok := p.ourAddressList(); ok {
+		pkt.Flags |= flagAddress
+		pkt.AddressList = addrList
 	}
 
 	data, err := p.tlH.Serialize(pkt, true)
@@ -344,7 +962,7 @@ func (p *Peer) buildSignedPacket(
 	}
 
 	pkt.Signature = ed25519.Sign(p.privKey, data)
-	pkt.Flags |= 0b111111111111
+	pkt.Flags |= flagSignature
 
 	// TODO: add signature avoiding the process of double serialization
 	return p.tlH.Serialize(pkt, true)
@@ -0,0 +1,479 @@
+package adnl
+
+import (
+	"bytes"
+	"context"
+	"crypto/ed25519"
+	"encoding/hex"
+	"errors"
+	"log/slog"
+	"net"
+	"net/netip"
+	"path/filepath"
+	"runtime"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/Gealber/dht/tl"
+)
+
+// newTestPeer starts a peer listening on a random loopback port, the peer is
+// shut down once the test finishes.
+func newTestPeer(t *testing.T) (*Peer, netip.AddrPort) {
+	t.Helper()
+
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return newTestPeerOn(t, conn)
+}
+
+// newTestPeerOn starts a peer serving on conn, the peer is shut down once the test finishes.
+func newTestPeerOn(t *testing.T, conn net.PacketConn) (*Peer, netip.AddrPort) {
+	t.Helper()
+
+	p, err := New(nil, nil, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return p, serveTestPeer(t, p, conn)
+}
+
+// serveTestPeer serves p on conn until the test finishes, returning the address of conn.
+func serveTestPeer(t *testing.T, p *Peer, conn net.PacketConn) netip.AddrPort {
+	t.Helper()
+
+	addr, err := addrPort(conn.LocalAddr())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	errChn := make(chan error, 1)
+	go func() {
+		errChn <- p.Serve(ctx, conn)
+	}()
+
+	t.Cleanup(func() {
+		cancel()
+		if err := <-errChn; err != nil {
+			t.Errorf("serve returned error: %s", err)
+		}
+	})
+
+	waitFor(t, time.Second, func() bool {
+		_, err := p.LocalAddr()
+		return err == nil
+	})
+
+	return addr
+}
+
+// waitFor polls cond until it's true or timeout is reached.
+func waitFor(t *testing.T, timeout time.Duration, cond func() bool) {
+	t.Helper()
+
+	deadline := time.Now().Add(timeout)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatal("timeout waiting for condition")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func (p *Peer) knowsPeer(id []byte) bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	_, ok := p.peers[hex.EncodeToString(id)]
+	return ok
+}
+
+// seqnos returns the seqno of the last packet sent to the peer with id peerID,
+// and the highest seqno received from it.
+func (p *Peer) seqnos(peerID []byte) (int64, int64) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	state, ok := p.peers[hex.EncodeToString(peerID)]
+	if !ok {
+		return 0, 0
+	}
+
+	return state.outSeqno, state.confirmSeqno
+}
+
+// confirmed returns true if a received the last packet sent by b.
+func confirmed(a, b *Peer) bool {
+	_, confirmSeqno := a.seqnos(b.id)
+	outSeqno, _ := b.seqnos(a.id)
+	return confirmSeqno == outSeqno
+}
+
+func TestPeerPingLoopback(t *testing.T) {
+	a, _ := newTestPeer(t)
+	b, bAddr := newTestPeer(t)
+
+	// the PONG is sent back to the source address of the PING
+	rtt, err := a.Ping(context.Background(), b.pubKey, bAddr)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if rtt <= 0 {
+		t.Fatalf("unexpected round trip time %s", rtt)
+	}
+
+	// b registers a when receiving the PING
+	if !b.knowsPeer(a.id) {
+		t.Fatal("b should know a")
+	}
+}
+
+func TestPeerClose(t *testing.T) {
+	p, err := New(nil, nil, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	errChn := make(chan error, 1)
+	go func() {
+		errChn <- p.Serve(context.Background(), conn)
+	}()
+
+	waitFor(t, time.Second, func() bool {
+		_, err := p.LocalAddr()
+		return err == nil
+	})
+
+	if err := p.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case err := <-errChn:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("serve didn't return after close")
+	}
+
+	err = p.Serve(context.Background(), conn)
+	if !errors.Is(err, ErrPeerClosed) {
+		t.Fatalf("unexpected error serving on closed peer: %v", err)
+	}
+}
+
+func TestPeerSendMessage(t *testing.T) {
+	a, aAddr := newTestPeer(t)
+	b, bAddr := newTestPeer(t)
+
+	ctx := context.Background()
+	for i := 0; i < 2; i++ {
+		err := a.SendMessage(ctx, b.pubKey, bAddr, tl.AdnlMessageNop{})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// b confirms the highest seqno received from a
+	waitFor(t, 2*time.Second, func() bool {
+		_, confirmSeqno := b.seqnos(a.id)
+		return confirmSeqno == 2
+	})
+
+	err := b.SendMessage(ctx, a.pubKey, aAddr, tl.Ping{Value: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// a receives the PING and answers with a PONG, at the end
+	// both peers confirm the last packet sent by the other one
+	waitFor(t, 2*time.Second, func() bool {
+		return confirmed(a, b) && confirmed(b, a)
+	})
+
+	canceled, cancel := context.WithCancel(ctx)
+	cancel()
+	err = a.SendMessage(canceled, b.pubKey, bAddr, tl.AdnlMessageNop{})
+	if !errors.Is(err, context.Canceled) {
+		t.Fatalf("expected context canceled error, got: %v", err)
+	}
+
+	err = a.SendMessage(ctx, b.pubKey[:16], bAddr, tl.AdnlMessageNop{})
+	if !errors.Is(err, ErrInvalidPubKey) {
+		t.Fatalf("expected invalid public key error, got: %v", err)
+	}
+}
+
+func TestPeerFailingMessage(t *testing.T) {
+	a, _ := newTestPeer(t)
+	b, bAddr := newTestPeer(t)
+
+	received := make(chan []byte, 1)
+	b.Handle(tl.Crc32(tl.TLPong), func(from ed25519.PublicKey, data []byte) ([]byte, error) {
+		received <- data
+		return nil, nil
+	})
+
+	pong, err := a.tlH.Serialize(tl.Pong{RandomID: 1}, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// messages without handler and answers to unknown queries fail alone
+	err = a.sendPacket(b.pubKey, bAddr,
+		tl.AdnlMessageCustom{Data: []byte{1, 2, 3, 4}},
+		tl.AdnlMessageAnswer{QueryID: make([]byte, 32), Answer: []byte{1}},
+		tl.AdnlMessageCustom{Data: pong},
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case data := <-received:
+		if !bytes.Equal(data, pong) {
+			t.Fatalf("unexpected custom message payload: %x", data)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("message following the failing ones not delivered")
+	}
+}
+
+func TestPeerLogger(t *testing.T) {
+	var logs lockedBuffer
+	p, err := New(nil, nil, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p.SetLogger(slog.New(slog.NewTextHandler(&logs, &slog.HandlerOptions{Level: slog.LevelDebug})))
+
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := serveTestPeer(t, p, conn)
+
+	// a datagram for us which can't be decrypted
+	sender, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sender.Close()
+
+	_, err = sender.WriteTo(append(bytes.Clone(p.id), bytes.Repeat([]byte{1}, 100)...), net.UDPAddrFromAddrPort(addr))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	waitFor(t, time.Second, func() bool {
+		return bytes.Contains(logs.Bytes(), []byte("failed opening packet"))
+	})
+
+	for _, attr := range []string{"level=DEBUG", "component=adnl-peer", "peer_id=" + hex.EncodeToString(p.id)} {
+		if !bytes.Contains(logs.Bytes(), []byte(attr)) {
+			t.Fatalf("record without %s: %s", attr, logs.Bytes())
+		}
+	}
+
+	// queries not answered are logged with their id
+	dst, _, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	_, err = p.Query(ctx, dst, sender.LocalAddr().(*net.UDPAddr).AddrPort(), []byte{1})
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("expected deadline exceeded got %v", err)
+	}
+
+	if !bytes.Contains(logs.Bytes(), []byte("msg=\"query not answered\"")) || !bytes.Contains(logs.Bytes(), []byte("query_id=")) {
+		t.Fatalf("query not logged: %s", logs.Bytes())
+	}
+}
+
+// loopbackAddr returns the loopback address of the socket p is listening on.
+func loopbackAddr(t *testing.T, p *Peer) netip.AddrPort {
+	t.Helper()
+
+	addr, err := p.LocalAddr()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return netip.AddrPortFrom(netip.MustParseAddr("127.0.0.1"), addr.Port())
+}
+
+func TestPeerShutdown(t *testing.T) {
+	goroutines := runtime.NumGoroutine()
+
+	a, err := New(nil, nil, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	b, err := New(nil, nil, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	store, err := NewFileStore(filepath.Join(t.TempDir(), "peers.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = b.SetPeerStore(store)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the query is being handled when b is shut down
+	started := make(chan struct{})
+	var handled atomic.Bool
+	b.SetQueryHandler(func(from ed25519.PublicKey, query []byte) ([]byte, error) {
+		close(started)
+		time.Sleep(100 * time.Millisecond)
+		handled.Store(true)
+		return query, nil
+	})
+
+	for _, p := range []*Peer{a, b} {
+		err = p.Start(context.Background())
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	bAddr := loopbackAddr(t, b)
+	queryErr := make(chan error, 1)
+	go func() {
+		_, err := a.Query(context.Background(), b.pubKey, bAddr, []byte{1})
+		queryErr <- err
+	}()
+
+	select {
+	case <-started:
+	case <-time.After(2 * time.Second):
+		t.Fatal("query not received")
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+
+	err = b.Shutdown(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !handled.Load() {
+		t.Fatal("shutdown returned before the query was handled")
+	}
+
+	records, err := store.Load(b.id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(records) != 1 || !bytes.Equal(records[0].Key.PeerID, a.id) {
+		t.Fatalf("unexpected stored peers %+v", records)
+	}
+
+	err = a.Shutdown(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the answer may be lost, the query fails at the latest once a is shut down
+	<-queryErr
+
+	if n := runtime.NumGoroutine(); n > goroutines {
+		buff := make([]byte, 1<<16)
+		t.Fatalf("%d goroutines leaked:\n%s", n-goroutines, buff[:runtime.Stack(buff, true)])
+	}
+
+	err = b.Start(context.Background())
+	if !errors.Is(err, ErrPeerClosed) {
+		t.Fatalf("unexpected error starting shut down peer: %v", err)
+	}
+}
+
+func TestPeerShutdownTimeout(t *testing.T) {
+	a, err := New(nil, nil, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer a.Close()
+
+	b, err := New(nil, nil, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	store, err := NewFileStore(filepath.Join(t.TempDir(), "peers.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = b.SetPeerStore(store)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the query is still being handled when the shutdown times out
+	started, release := make(chan struct{}), make(chan struct{})
+	b.SetQueryHandler(func(from ed25519.PublicKey, query []byte) ([]byte, error) {
+		close(started)
+		<-release
+		return query, nil
+	})
+
+	for _, p := range []*Peer{a, b} {
+		err = p.Start(context.Background())
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	go a.Query(context.Background(), b.pubKey, loopbackAddr(t, b), []byte{1})
+
+	select {
+	case <-started:
+	case <-time.After(2 * time.Second):
+		t.Fatal("query not received")
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+
+	err = b.Shutdown(ctx)
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("unexpected error %v", err)
+	}
+
+	// the peers are saved even though the handler didn't return
+	records, err := store.Load(b.id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(records) != 1 || !bytes.Equal(records[0].Key.PeerID, a.id) {
+		t.Fatalf("unexpected stored peers %+v", records)
+	}
+
+	close(release)
+	select {
+	case <-b.serving.done:
+	case <-time.After(2 * time.Second):
+		t.Fatal("serve loops didn't return once the handler did")
+	}
+}
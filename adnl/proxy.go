@@ -0,0 +1,124 @@
+package adnl
+
+import (
+	"bytes"
+	"net/netip"
+	"time"
+
+	"github.com/Gealber/dht/adnl/proxy"
+	"github.com/Gealber/dht/tl"
+)
+
+// SetProxy relays our packets through the fast proxy listening for clients on addr. Packets
+// are sent to the proxy, which forwards them from its public address, and packets received
+// by the proxy are forwarded to us. The public address of the proxy should be advertised
+// with SetAddressList. The proxy forgets clients that don't send packets, so we ping it and
+// register again periodically. A nil fast stops using the proxy.
+func (p *Peer) SetProxy(addr netip.AddrPort, fast *proxy.Fast) error {
+	p.mu.Lock()
+	p.proxy, p.proxyAddr, p.proxyPing = fast, addr, nil
+	p.mu.Unlock()
+
+	return p.registerProxy()
+}
+
+// registerProxy registers us in the proxy as the destination of the packets it receives,
+// nothing is done if we aren't behind a proxy or aren't listening yet.
+func (p *Peer) registerProxy() error {
+	p.mu.Lock()
+	conn := p.conn
+	fast, proxyAddr := p.proxy, p.proxyAddr
+	p.mu.Unlock()
+	if conn == nil || fast == nil {
+		return nil
+	}
+
+	// the proxy registers the address the packet comes from
+	packet, err := fast.RegisterPacket(netip.AddrPort{}, time.Now())
+	if err != nil {
+		return err
+	}
+
+	_, err = conn.WriteTo(packet, proxyAddr)
+	return err
+}
+
+// keepProxy registers us again in the proxy and pings it, so the proxy doesn't forget us.
+// A warning is logged in case the previous ping wasn't answered.
+func (p *Peer) keepProxy() error {
+	err := p.registerProxy()
+	if err != nil {
+		return err
+	}
+
+	p.mu.Lock()
+	conn := p.conn
+	fast, proxyAddr := p.proxy, p.proxyAddr
+	unanswered := p.proxyPing != nil
+	p.mu.Unlock()
+	if conn == nil || fast == nil {
+		return nil
+	}
+
+	if unanswered {
+		p.logger.Warn("proxy didn't answer the last ping", "addr", proxyAddr)
+	}
+
+	packet, id, err := fast.PingPacket(time.Now())
+	if err != nil {
+		return err
+	}
+
+	p.mu.Lock()
+	p.proxyPing = id
+	p.mu.Unlock()
+
+	_, err = conn.WriteTo(packet, proxyAddr)
+	return err
+}
+
+// handleProxyControl handles a control packet sent by the proxy, only pongs are expected.
+func (p *Peer) handleProxyControl(data []byte) {
+	obj, err := p.tlH.ParseBoxed(data)
+	if err != nil {
+		p.logger.Debug("invalid proxy control packet", "err", err)
+		return
+	}
+
+	pong, ok := obj.(tl.AdnlProxyControlPacketPong)
+	if !ok {
+		return
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if bytes.Equal(pong.ID, p.proxyPing) {
+		p.proxyPing = nil
+	}
+}
+
+// unwrapProxy returns the source and the packet relayed by our proxy when data comes from it,
+// otherwise src and data are returned as they are. Reports false if data should be dropped.
+func (p *Peer) unwrapProxy(src netip.AddrPort, data []byte) (netip.AddrPort, []byte, bool) {
+	p.mu.Lock()
+	fast, proxyAddr := p.proxy, p.proxyAddr
+	p.mu.Unlock()
+	if fast == nil || src != proxyAddr {
+		return src, data, true
+	}
+
+	relayedSrc, packet, err := fast.Decode(data, time.Now())
+	if err != nil {
+		p.logger.Debug("dropping packet relayed by proxy", "err", err)
+		return src, nil, false
+	}
+
+	// control packets, as pongs, don't carry adnl packets
+	if !relayedSrc.IsValid() {
+		p.handleProxyControl(packet)
+		return src, nil, false
+	}
+
+	return relayedSrc, packet, true
+}
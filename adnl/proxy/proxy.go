@@ -0,0 +1,235 @@
+// Package proxy implements the ADNL fast proxy, adnl.proxy.fast, which relays the packets of
+// peers without a public address. Read doc/adnl/adnl-proxy.md for more details.
+package proxy
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"net/netip"
+	"time"
+
+	"github.com/Gealber/dht/tl"
+)
+
+// maxDateSkew is the max difference tolerated between the date of a packet header and our clock
+const maxDateSkew = 60 * time.Second
+
+const (
+	// flagAddress the header includes ip and port
+	flagAddress uint32 = 1 << 0
+	// flagDate the header includes date
+	flagDate uint32 = 1 << 3
+)
+
+var (
+	ErrInvalidID          = errors.New("invalid proxy id")
+	ErrShortPacket        = errors.New("packet too short for a proxy header")
+	ErrUnknownProxy       = errors.New("packet header of another proxy")
+	ErrMissingDate        = errors.New("packet header without date")
+	ErrDateSkew           = errors.New("packet header date too far from our clock")
+	ErrInvalidSignature   = errors.New("packet header signature verification failed")
+	ErrUnsupportedAddress = errors.New("proxy headers only support IPv4 addresses")
+)
+
+// Fast wraps and unwraps the packets exchanged with a fast proxy, the headers are
+// authenticated with a secret shared between the proxy and its clients.
+type Fast struct {
+	id     []byte
+	secret []byte
+	tlH    *tl.TLHandler
+}
+
+// NewFast returns the fast proxy described by cfg.
+func NewFast(cfg tl.AdnlProxyFast) (*Fast, error) {
+	if len(cfg.ID) != 32 {
+		return nil, ErrInvalidID
+	}
+
+	tlH := tl.New()
+	tlH.Register(tl.DefaultTLModel)
+
+	return &Fast{
+		id:     bytes.Clone(cfg.ID),
+		secret: bytes.Clone(cfg.SharedSecret),
+		tlH:    tlH,
+	}, nil
+}
+
+// ID returns the id of the proxy, included in every packet header.
+func (f *Fast) ID() []byte {
+	return bytes.Clone(f.id)
+}
+
+// Encode wraps data in a signed header. addr is the destination of data when sent by a
+// client, or its source when sent by the proxy. Control packets don't include an address.
+func (f *Fast) Encode(addr netip.AddrPort, data []byte, now time.Time) ([]byte, error) {
+	header := tl.AdnlProxyPacketHeader{
+		ProxyID: f.id,
+		Flags:   flagDate,
+		Date:    now.Unix(),
+	}
+
+	if addr.IsValid() {
+		ip := addr.Addr().Unmap()
+		if !ip.Is4() {
+			return nil, ErrUnsupportedAddress
+		}
+
+		b := ip.As4()
+		header.Flags |= flagAddress
+		header.IP = int64(binary.BigEndian.Uint32(b[:]))
+		header.Port = int32(addr.Port())
+	}
+
+	var err error
+	header.Signature, err = f.signature(header, data)
+	if err != nil {
+		return nil, err
+	}
+
+	h, err := f.tlH.Serialize(header, true)
+	if err != nil {
+		return nil, err
+	}
+
+	return append(h, data...), nil
+}
+
+// Decode verifies the header of packet, returning the address included in it, invalid for
+// control packets, and the wrapped data.
+func (f *Fast) Decode(packet []byte, now time.Time) (netip.AddrPort, []byte, error) {
+	size, err := headerSize(packet)
+	if err != nil {
+		return netip.AddrPort{}, nil, err
+	}
+
+	var header tl.AdnlProxyPacketHeader
+	err = f.tlH.Parse(packet[:size], &header, true)
+	if err != nil {
+		return netip.AddrPort{}, nil, err
+	}
+	data := packet[size:]
+
+	if !bytes.Equal(header.ProxyID, f.id) {
+		return netip.AddrPort{}, nil, ErrUnknownProxy
+	}
+
+	if header.Flags&flagDate == 0 {
+		return netip.AddrPort{}, nil, ErrMissingDate
+	}
+
+	skew := now.Sub(time.Unix(header.Date, 0))
+	if skew > maxDateSkew || skew < -maxDateSkew {
+		return netip.AddrPort{}, nil, ErrDateSkew
+	}
+
+	signature, err := f.signature(header, data)
+	if err != nil {
+		return netip.AddrPort{}, nil, err
+	}
+
+	if !bytes.Equal(signature, header.Signature) {
+		return netip.AddrPort{}, nil, ErrInvalidSignature
+	}
+
+	var addr netip.AddrPort
+	if header.Flags&flagAddress != 0 {
+		var b [4]byte
+		binary.BigEndian.PutUint32(b[:], uint32(header.IP))
+		addr = netip.AddrPortFrom(netip.AddrFrom4(b), uint16(header.Port))
+	}
+
+	return addr, data, nil
+}
+
+// RegisterPacket returns the control packet registering a client in the proxy, a zero
+// addr registers the address the packet is received from.
+func (f *Fast) RegisterPacket(addr netip.AddrPort, now time.Time) ([]byte, error) {
+	var register tl.AdnlProxyControlPacketRegister
+	if addr.IsValid() {
+		ip := addr.Addr().Unmap()
+		if !ip.Is4() {
+			return nil, ErrUnsupportedAddress
+		}
+
+		b := ip.As4()
+		register.IP = int64(binary.BigEndian.Uint32(b[:]))
+		register.Port = int32(addr.Port())
+	}
+
+	data, err := f.tlH.Serialize(register, true)
+	if err != nil {
+		return nil, err
+	}
+
+	return f.Encode(netip.AddrPort{}, data, now)
+}
+
+// PingPacket returns a control packet checking the proxy is alive, it answers with a pong
+// including the same random id.
+func (f *Fast) PingPacket(now time.Time) ([]byte, []byte, error) {
+	id := make([]byte, 32)
+	_, err := rand.Read(id)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	data, err := f.tlH.Serialize(tl.AdnlProxyControlPacketPing{ID: id}, true)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	packet, err := f.Encode(netip.AddrPort{}, data, now)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return packet, id, nil
+}
+
+// signature is the hash of the boxed adnl.proxyToFastHash built from header and data.
+func (f *Fast) signature(header tl.AdnlProxyPacketHeader, data []byte) ([]byte, error) {
+	dataHash := sha256.Sum256(data)
+	obj, err := f.tlH.Serialize(tl.AdnlProxyToFastHash{
+		IP:           header.IP,
+		Port:         header.Port,
+		Date:         header.Date,
+		DataHash:     dataHash[:],
+		SharedSecret: f.secret,
+	}, true)
+	if err != nil {
+		return nil, err
+	}
+
+	hash := sha256.Sum256(obj)
+
+	return hash[:], nil
+}
+
+// headerSize returns the size of the boxed adnl.proxyPacketHeader at the start of packet,
+// which depends on the optional fields present.
+func headerSize(packet []byte) (int, error) {
+	// constructor id, proxy id and flags
+	size := 4 + 32 + 4
+	if len(packet) < size {
+		return 0, ErrShortPacket
+	}
+
+	flags := binary.LittleEndian.Uint32(packet[36:40])
+	for bit, fieldSize := range []int{8, 4, 8, 4} {
+		if flags&(1<<bit) != 0 {
+			size += fieldSize
+		}
+	}
+	// signature
+	size += 32
+
+	if len(packet) < size {
+		return 0, ErrShortPacket
+	}
+
+	return size, nil
+}
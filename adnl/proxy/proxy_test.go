@@ -0,0 +1,89 @@
+package proxy
+
+import (
+	"bytes"
+	"errors"
+	"net/netip"
+	"testing"
+	"time"
+
+	"github.com/Gealber/dht/tl"
+)
+
+func newTestFast(t *testing.T, secret string) *Fast {
+	t.Helper()
+
+	f, err := NewFast(tl.AdnlProxyFast{ID: bytes.Repeat([]byte{1}, 32), SharedSecret: []byte(secret)})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return f
+}
+
+func TestFastEncodeDecode(t *testing.T) {
+	f := newTestFast(t, "secret")
+	now := time.Now()
+	addr := netip.MustParseAddrPort("1.2.3.4:30303")
+	data := []byte("adnl packet")
+
+	packet, err := f.Encode(addr, data, now)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	gotAddr, gotData, err := f.Decode(packet, now)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if gotAddr != addr || !bytes.Equal(gotData, data) {
+		t.Fatalf("unexpected decoded packet %s %q", gotAddr, gotData)
+	}
+
+	// control packets don't include an address
+	control, err := f.Encode(netip.AddrPort{}, data, now)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	gotAddr, _, err = f.Decode(control, now)
+	if err != nil || gotAddr.IsValid() {
+		t.Fatalf("expected control packet without address, got %s err: %v", gotAddr, err)
+	}
+
+	_, err = f.Encode(netip.MustParseAddrPort("[::1]:1"), data, now)
+	if !errors.Is(err, ErrUnsupportedAddress) {
+		t.Fatalf("expected unsupported address error, got: %v", err)
+	}
+
+	tampered := bytes.Clone(packet)
+	tampered[len(tampered)-1] ^= 1
+
+	other, err := NewFast(tl.AdnlProxyFast{ID: bytes.Repeat([]byte{2}, 32), SharedSecret: []byte("secret")})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name     string
+		f        *Fast
+		packet   []byte
+		now      time.Time
+		expected error
+	}{
+		{name: "tampered data", f: f, packet: tampered, now: now, expected: ErrInvalidSignature},
+		{name: "another secret", f: newTestFast(t, "other"), packet: packet, now: now, expected: ErrInvalidSignature},
+		{name: "another proxy", f: other, packet: packet, now: now, expected: ErrUnknownProxy},
+		{name: "old date", f: f, packet: packet, now: now.Add(2 * maxDateSkew), expected: ErrDateSkew},
+		{name: "future date", f: f, packet: packet, now: now.Add(-2 * maxDateSkew), expected: ErrDateSkew},
+		{name: "short packet", f: f, packet: packet[:50], now: now, expected: ErrShortPacket},
+	}
+
+	for _, tt := range tests {
+		_, _, err := tt.f.Decode(tt.packet, tt.now)
+		if !errors.Is(err, tt.expected) {
+			t.Fatalf("%s: expected %v got %v", tt.name, tt.expected, err)
+		}
+	}
+}
@@ -0,0 +1,272 @@
+package proxy
+
+import (
+	"context"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/netip"
+	"sync"
+	"time"
+
+	"github.com/Gealber/dht/tl"
+	"github.com/Gealber/dht/utils"
+)
+
+// DefaultClientTimeout is the time without packets from the registered client after which
+// it's forgotten, clients keep their registration alive by pinging the proxy.
+const DefaultClientTimeout = time.Minute
+
+var ErrServerClosed = errors.New("proxy server closed")
+
+// Server is a fast proxy relaying the packets of a client. Packets sent by the client
+// are forwarded from the public address of the proxy, and packets received on the public
+// address are forwarded to the client, which registers its address with a control packet.
+type Server struct {
+	fast   *Fast
+	logger *slog.Logger
+	// client address the packets received on the public address are forwarded to,
+	// invalid until a client registers. It expires clientTimeout after clientSeen, the
+	// last time a packet was received from it
+	client        netip.AddrPort
+	clientSeen    time.Time
+	clientTimeout time.Duration
+	// mu protects client, clientSeen and clientTimeout
+	mu sync.Mutex
+
+	// closer is closed when the server is shut down
+	closer    chan struct{}
+	closeOnce sync.Once
+}
+
+// NewServer returns a proxy server authenticating its clients with fast.
+func NewServer(fast *Fast) *Server {
+	s := &Server{
+		fast:          fast,
+		clientTimeout: DefaultClientTimeout,
+		closer:        make(chan struct{}),
+	}
+	s.SetLogger(utils.NewLogger())
+
+	return s
+}
+
+// SetLogger sets the logger of the server, its records include the component and the proxy id.
+// It should be called before the server starts serving.
+func (s *Server) SetLogger(logger *slog.Logger) {
+	s.logger = utils.ComponentLogger(logger, "adnl-proxy").With("proxy_id", hex.EncodeToString(s.fast.id))
+}
+
+// SetClientTimeout sets the time without packets from the registered client after which
+// it's forgotten.
+func (s *Server) SetClientTimeout(timeout time.Duration) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.clientTimeout = timeout
+}
+
+// Client returns the address of the registered client, invalid if none registered yet or
+// its registration expired.
+func (s *Server) Client() netip.AddrPort {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if time.Since(s.clientSeen) > s.clientTimeout {
+		return netip.AddrPort{}
+	}
+
+	return s.client
+}
+
+// seen keeps alive the registration of the client at src, nothing is done in case it isn't
+// the registered client or its registration already expired.
+func (s *Server) seen(src netip.AddrPort) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := time.Now()
+	if s.client == netip.AddrPortFrom(src.Addr().Unmap(), src.Port()) && now.Sub(s.clientSeen) <= s.clientTimeout {
+		s.clientSeen = now
+	}
+}
+
+// Serve relays packets between clientConn, where clients send their wrapped packets, and
+// publicConn, the address exposed to the network, until ctx is done or the server is closed.
+// Serve takes ownership of both connections.
+func (s *Server) Serve(ctx context.Context, clientConn, publicConn net.PacketConn) error {
+	select {
+	case <-s.closer:
+		clientConn.Close()
+		publicConn.Close()
+		return ErrServerClosed
+	default:
+	}
+
+	done := make(chan struct{})
+	defer close(done)
+
+	// closing the connections is the only way to unblock pending reads
+	go func() {
+		select {
+		case <-ctx.Done():
+		case <-s.closer:
+		case <-done:
+		}
+		clientConn.Close()
+		publicConn.Close()
+	}()
+
+	errChn := make(chan error, 2)
+	go func() {
+		errChn <- s.serveClient(clientConn, publicConn)
+	}()
+	go func() {
+		errChn <- s.servePublic(clientConn, publicConn)
+	}()
+
+	// once a loop finishes the connections are closed, so the other one finishes as well
+	err := <-errChn
+	clientConn.Close()
+	publicConn.Close()
+	if err2 := <-errChn; err == nil {
+		err = err2
+	}
+
+	return err
+}
+
+// Close shuts down the server, closing its connections.
+func (s *Server) Close() error {
+	s.closeOnce.Do(func() {
+		close(s.closer)
+	})
+
+	return nil
+}
+
+// serveClient reads the packets sent by clients, forwarding them to their destination
+// or handling them when they are control packets.
+func (s *Server) serveClient(clientConn, publicConn net.PacketConn) error {
+	buff := make([]byte, 4096)
+	for {
+		n, addr, err := clientConn.ReadFrom(buff)
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return nil
+			}
+
+			return err
+		}
+
+		src, err := netip.ParseAddrPort(addr.String())
+		if err != nil {
+			continue
+		}
+
+		dst, data, err := s.fast.Decode(buff[:n], time.Now())
+		if err != nil {
+			s.logger.Debug("dropping client packet", "addr", src, "err", err)
+			continue
+		}
+		s.seen(src)
+
+		if !dst.IsValid() {
+			s.handleControl(clientConn, src, data)
+			continue
+		}
+
+		_, err = publicConn.WriteTo(data, net.UDPAddrFromAddrPort(dst))
+		if err != nil {
+			s.logger.Warn("failed forwarding packet", "addr", dst, "err", err)
+		}
+	}
+}
+
+// servePublic forwards the packets received on the public address to the registered client,
+// with a header including their source address.
+func (s *Server) servePublic(clientConn, publicConn net.PacketConn) error {
+	buff := make([]byte, 4096)
+	for {
+		n, addr, err := publicConn.ReadFrom(buff)
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return nil
+			}
+
+			return err
+		}
+
+		client := s.Client()
+		if !client.IsValid() {
+			continue
+		}
+
+		src, err := netip.ParseAddrPort(addr.String())
+		if err != nil {
+			continue
+		}
+		src = netip.AddrPortFrom(src.Addr().Unmap(), src.Port())
+
+		packet, err := s.fast.Encode(src, buff[:n], time.Now())
+		if err != nil {
+			s.logger.Debug("dropping public packet", "addr", src, "err", err)
+			continue
+		}
+
+		_, err = clientConn.WriteTo(packet, net.UDPAddrFromAddrPort(client))
+		if err != nil {
+			s.logger.Warn("failed forwarding packet to client", "addr", client, "err", err)
+		}
+	}
+}
+
+// handleControl handles a control packet sent by the client at src.
+func (s *Server) handleControl(clientConn net.PacketConn, src netip.AddrPort, data []byte) {
+	obj, err := s.fast.tlH.ParseBoxed(data)
+	if err != nil {
+		s.logger.Debug("invalid control packet", "addr", src, "err", err)
+		return
+	}
+
+	switch msg := obj.(type) {
+	case tl.AdnlProxyControlPacketPing:
+		pong, err := s.fast.tlH.Serialize(tl.AdnlProxyControlPacketPong{ID: msg.ID}, true)
+		if err != nil {
+			return
+		}
+
+		packet, err := s.fast.Encode(netip.AddrPort{}, pong, time.Now())
+		if err != nil {
+			return
+		}
+
+		_, err = clientConn.WriteTo(packet, net.UDPAddrFromAddrPort(src))
+		if err != nil {
+			s.logger.Warn("failed sending pong", "addr", src, "err", err)
+		}
+	case tl.AdnlProxyControlPacketRegister:
+		client := src
+		// a client behind a NAT doesn't know its address, the source of the packet is used
+		if msg.IP != 0 {
+			var b [4]byte
+			binary.BigEndian.PutUint32(b[:], uint32(msg.IP))
+			client = netip.AddrPortFrom(netip.AddrFrom4(b), uint16(msg.Port))
+		}
+
+		client = netip.AddrPortFrom(client.Addr().Unmap(), client.Port())
+		s.mu.Lock()
+		changed := s.client != client || time.Since(s.clientSeen) > s.clientTimeout
+		s.client, s.clientSeen = client, time.Now()
+		s.mu.Unlock()
+
+		if changed {
+			s.logger.Info("client registered", "addr", client)
+		}
+	default:
+		s.logger.Debug("unexpected control packet", "addr", src, "type", fmt.Sprintf("%T", obj))
+	}
+}
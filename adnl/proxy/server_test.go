@@ -0,0 +1,220 @@
+package proxy
+
+import (
+	"bytes"
+	"context"
+	"net"
+	"net/netip"
+	"testing"
+	"time"
+
+	"github.com/Gealber/dht/tl"
+)
+
+func listenUDP(t *testing.T) net.PacketConn {
+	t.Helper()
+
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+
+	return conn
+}
+
+func readFrom(t *testing.T, conn net.PacketConn) ([]byte, netip.AddrPort) {
+	t.Helper()
+
+	conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	buff := make([]byte, 4096)
+	n, addr, err := conn.ReadFrom(buff)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return buff[:n], netip.MustParseAddrPort(addr.String())
+}
+
+func TestServer(t *testing.T) {
+	f := newTestFast(t, "secret")
+	s := NewServer(f)
+
+	clientSide, publicSide := listenUDP(t), listenUDP(t)
+	proxyAddr := netip.MustParseAddrPort(clientSide.LocalAddr().String())
+	publicAddr := netip.MustParseAddrPort(publicSide.LocalAddr().String())
+
+	ctx, cancel := context.WithCancel(context.Background())
+	errChn := make(chan error, 1)
+	go func() {
+		errChn <- s.Serve(ctx, clientSide, publicSide)
+	}()
+	defer func() {
+		cancel()
+		if err := <-errChn; err != nil {
+			t.Errorf("serve returned error: %s", err)
+		}
+	}()
+
+	client, remote := listenUDP(t), listenUDP(t)
+	clientAddr := netip.MustParseAddrPort(client.LocalAddr().String())
+	remoteAddr := netip.MustParseAddrPort(remote.LocalAddr().String())
+	send := func(packet []byte) {
+		_, err := client.WriteTo(packet, net.UDPAddrFromAddrPort(proxyAddr))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// ping
+	ping, id, err := f.PingPacket(time.Now())
+	if err != nil {
+		t.Fatal(err)
+	}
+	send(ping)
+
+	packet, _ := readFrom(t, client)
+	_, data, err := f.Decode(packet, time.Now())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	pong, err := f.tlH.ParseBoxed(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if p, ok := pong.(tl.AdnlProxyControlPacketPong); !ok || !bytes.Equal(p.ID, id) {
+		t.Fatalf("unexpected pong %+v", pong)
+	}
+
+	// register and wait until the proxy knows us
+	register, err := f.RegisterPacket(netip.AddrPort{}, time.Now())
+	if err != nil {
+		t.Fatal(err)
+	}
+	send(register)
+
+	deadline := time.Now().Add(2 * time.Second)
+	for s.Client() != clientAddr {
+		if time.Now().After(deadline) {
+			t.Fatal("client not registered")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	// client -> remote through the public address
+	out, err := f.Encode(remoteAddr, []byte("outbound"), time.Now())
+	if err != nil {
+		t.Fatal(err)
+	}
+	send(out)
+
+	got, src := readFrom(t, remote)
+	if string(got) != "outbound" || src != publicAddr {
+		t.Fatalf("unexpected forwarded packet %q from %s", got, src)
+	}
+
+	// remote -> client with the source in the header
+	_, err = remote.WriteTo([]byte("inbound"), net.UDPAddrFromAddrPort(publicAddr))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	packet, _ = readFrom(t, client)
+	src, data, err = f.Decode(packet, time.Now())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if string(data) != "inbound" || src != remoteAddr {
+		t.Fatalf("unexpected relayed packet %q from %s", data, src)
+	}
+
+	// packets with an invalid signature are not forwarded
+	bad := newTestFast(t, "other")
+	out, err = bad.Encode(remoteAddr, []byte("forged"), time.Now())
+	if err != nil {
+		t.Fatal(err)
+	}
+	send(out)
+
+	remote.SetReadDeadline(time.Now().Add(200 * time.Millisecond))
+	_, _, err = remote.ReadFrom(make([]byte, 16))
+	if err == nil {
+		t.Fatal("forged packet shouldn't be forwarded")
+	}
+}
+
+func TestServerClientExpires(t *testing.T) {
+	f := newTestFast(t, "secret")
+	s := NewServer(f)
+	s.SetClientTimeout(200 * time.Millisecond)
+
+	clientSide, publicSide := listenUDP(t), listenUDP(t)
+	proxyAddr := netip.MustParseAddrPort(clientSide.LocalAddr().String())
+	publicAddr := netip.MustParseAddrPort(publicSide.LocalAddr().String())
+
+	ctx, cancel := context.WithCancel(context.Background())
+	errChn := make(chan error, 1)
+	go func() {
+		errChn <- s.Serve(ctx, clientSide, publicSide)
+	}()
+	defer func() {
+		cancel()
+		if err := <-errChn; err != nil {
+			t.Errorf("serve returned error: %s", err)
+		}
+	}()
+
+	client, remote := listenUDP(t), listenUDP(t)
+	clientAddr := netip.MustParseAddrPort(client.LocalAddr().String())
+	send := func(packet []byte, err error) {
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		_, err = client.WriteTo(packet, net.UDPAddrFromAddrPort(proxyAddr))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	waitClient := func(expected netip.AddrPort) {
+		deadline := time.Now().Add(2 * time.Second)
+		for s.Client() != expected {
+			if time.Now().After(deadline) {
+				t.Fatalf("expected client %s got %s", expected, s.Client())
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+
+	send(f.RegisterPacket(netip.AddrPort{}, time.Now()))
+	waitClient(clientAddr)
+
+	// the client is forgotten without packets from it
+	waitClient(netip.AddrPort{})
+
+	_, err := remote.WriteTo([]byte("inbound"), net.UDPAddrFromAddrPort(publicAddr))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	client.SetReadDeadline(time.Now().Add(200 * time.Millisecond))
+	_, _, err = client.ReadFrom(make([]byte, 4096))
+	if err == nil {
+		t.Fatal("packets shouldn't be forwarded to an expired client")
+	}
+
+	// pings don't revive an expired registration, registering again does
+	ping, _, err := f.PingPacket(time.Now())
+	send(ping, err)
+	readFrom(t, client)
+	if s.Client().IsValid() {
+		t.Fatal("ping shouldn't register the client again")
+	}
+
+	send(f.RegisterPacket(netip.AddrPort{}, time.Now()))
+	waitClient(clientAddr)
+}
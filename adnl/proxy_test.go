@@ -0,0 +1,177 @@
+package adnl
+
+import (
+	"bytes"
+	"context"
+	"crypto/ed25519"
+	"net"
+	"net/netip"
+	"testing"
+	"time"
+
+	"github.com/Gealber/dht/adnl/proxy"
+	"github.com/Gealber/dht/tl"
+)
+
+func TestPeerProxy(t *testing.T) {
+	fast, err := proxy.NewFast(tl.AdnlProxyFast{ID: bytes.Repeat([]byte{1}, 32), SharedSecret: []byte("secret")})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	listen := func() (net.PacketConn, netip.AddrPort) {
+		conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		addr, err := addrPort(conn.LocalAddr())
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		return conn, addr
+	}
+
+	clientSide, proxyAddr := listen()
+	publicSide, publicAddr := listen()
+
+	s := proxy.NewServer(fast)
+	ctx, cancel := context.WithCancel(context.Background())
+	errChn := make(chan error, 1)
+	go func() {
+		errChn <- s.Serve(ctx, clientSide, publicSide)
+	}()
+	defer func() {
+		cancel()
+		if err := <-errChn; err != nil {
+			t.Errorf("proxy serve returned error: %s", err)
+		}
+	}()
+
+	a, aAddr := newTestPeer(t)
+	b, bAddr := newTestPeer(t)
+
+	b.SetQueryHandler(func(from ed25519.PublicKey, query []byte) ([]byte, error) {
+		return query, nil
+	})
+
+	err = a.SetProxy(proxyAddr, fast)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	waitFor(t, 2*time.Second, func() bool {
+		return s.Client() == aAddr
+	})
+
+	err = a.SetAddressList(publicAddr)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	qctx, qcancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer qcancel()
+
+	answer, err := a.Query(qctx, b.pubKey, bAddr, []byte("through the proxy"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if string(answer) != "through the proxy" {
+		t.Fatalf("unexpected answer %q", answer)
+	}
+
+	// b only knows a by the public address of the proxy
+	seenFrom, err := b.Address(a.id)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if seenFrom != publicAddr {
+		t.Fatalf("expected a to be reachable at %s got %s", publicAddr, seenFrom)
+	}
+}
+
+func TestPeerProxyKeepalive(t *testing.T) {
+	fast, err := proxy.NewFast(tl.AdnlProxyFast{ID: bytes.Repeat([]byte{1}, 32), SharedSecret: []byte("secret")})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	clientSide, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	publicSide, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	proxyAddr, err := addrPort(clientSide.LocalAddr())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the proxy forgets clients quickly, a keeps its registration with its maintenance
+	s := proxy.NewServer(fast)
+	s.SetClientTimeout(300 * time.Millisecond)
+	ctx, cancel := context.WithCancel(context.Background())
+	errChn := make(chan error, 1)
+	go func() {
+		errChn <- s.Serve(ctx, clientSide, publicSide)
+	}()
+	defer func() {
+		cancel()
+		if err := <-errChn; err != nil {
+			t.Errorf("proxy serve returned error: %s", err)
+		}
+	}()
+
+	a, err := New(nil, nil, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	a.SetChannelPolicy(ChannelPolicy{KeepaliveInterval: 100 * time.Millisecond})
+
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	aAddr := serveTestPeer(t, a, conn)
+
+	b, bAddr := newTestPeer(t)
+	b.SetQueryHandler(func(from ed25519.PublicKey, query []byte) ([]byte, error) {
+		return query, nil
+	})
+
+	err = a.SetProxy(proxyAddr, fast)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	waitFor(t, 2*time.Second, func() bool {
+		return s.Client() == aAddr
+	})
+
+	// several times the client timeout later, answers still reach a through the proxy
+	time.Sleep(time.Second)
+	if s.Client() != aAddr {
+		t.Fatal("expected a to be registered in the proxy")
+	}
+
+	qctx, qcancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer qcancel()
+
+	_, err = a.Query(qctx, b.pubKey, bAddr, []byte("still registered"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the pings to the proxy are answered
+	waitFor(t, time.Second, func() bool {
+		a.mu.Lock()
+		defer a.mu.Unlock()
+
+		return a.proxyPing == nil
+	})
+}
@@ -0,0 +1,141 @@
+package adnl
+
+import (
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/netip"
+	"time"
+
+	"github.com/Gealber/dht/tl"
+)
+
+// DefaultQueryTimeout is the time we wait for an answer when the context
+// used for the query doesn't have a deadline.
+const DefaultQueryTimeout = 5 * time.Second
+
+var (
+	ErrNoQueryHandler   = errors.New("no query handler registered")
+	ErrUnexpectedAnswer = errors.New("answer received for an unknown query")
+)
+
+// QueryHandler answers a query sent by the peer with public key from. Query and answer are
+// serialized TL objects. In case an error is returned no answer is sent back.
+type QueryHandler func(from ed25519.PublicKey, query []byte) ([]byte, error)
+
+// SetQueryHandler sets the handler used for answering incomming adnl.message.query messages,
+// which payload doesn't have a handler registered with Handle.
+func (p *Peer) SetQueryHandler(handler QueryHandler) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.queryHandler = handler
+}
+
+// Query sends query to the peer with public key dst listening on addr, and waits for its answer.
+// The query is canceled once ctx is done, in case ctx doesn't have a deadline a timeout adapted
+// to the round trip time of the peer is used, DefaultQueryTimeout until it's measured.
+func (p *Peer) Query(ctx context.Context, dst ed25519.PublicKey, addr netip.AddrPort, query []byte) ([]byte, error) {
+	dstID, err := p.computePeerID(dst)
+	if err != nil {
+		return nil, err
+	}
+	dstIDStr := hex.EncodeToString(dstID[:])
+
+	if _, ok := ctx.Deadline(); !ok {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, p.queryTimeout(dstIDStr))
+		defer cancel()
+	}
+
+	queryID := make([]byte, 32)
+	_, err = rand.Read(queryID)
+	if err != nil {
+		return nil, err
+	}
+	queryIDStr := hex.EncodeToString(queryID)
+
+	// buffered, answers are delivered without waiting for us
+	answerChn := make(chan []byte, 1)
+	p.mu.Lock()
+	p.queries[queryIDStr] = answerChn
+	p.mu.Unlock()
+
+	defer func() {
+		p.mu.Lock()
+		delete(p.queries, queryIDStr)
+		p.mu.Unlock()
+	}()
+
+	written, err := p.sendMessage(ctx, dst, addr, tl.AdnlMessageQuery{
+		QueryID: queryID,
+		Query:   query,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	select {
+	case answer := <-answerChn:
+		p.observeQuery(dstIDStr, time.Since(written), true)
+		return answer, nil
+	case <-ctx.Done():
+		if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+			p.observeQuery(dstIDStr, 0, false)
+		}
+		p.logger.Debug("query not answered", "remote_id", dstIDStr, "query_id", queryIDStr, "err", ctx.Err())
+		return nil, ctx.Err()
+	case <-p.closer:
+		return nil, ErrPeerClosed
+	}
+}
+
+// handleQuery answers the query with the handler registered for the constructor
+// of its payload, falling back to the query handler.
+func (p *Peer) handleQuery(senderPubKey ed25519.PublicKey, msg tl.AdnlMessageQuery) (any, error) {
+	handler, err := p.route(msg.Query)
+	if errors.Is(err, ErrNoHandler) {
+		p.mu.Lock()
+		queryHandler := p.queryHandler
+		p.mu.Unlock()
+
+		if queryHandler == nil {
+			return nil, fmt.Errorf("%w: %w", ErrNoQueryHandler, err)
+		}
+		handler = Handler(queryHandler)
+	}
+
+	answer, err := handler(senderPubKey, msg.Query)
+	if err != nil {
+		p.logger.Debug("failed answering query", "query_id", hex.EncodeToString(msg.QueryID), "err", err)
+		return nil, err
+	}
+
+	return tl.AdnlMessageAnswer{
+		QueryID: msg.QueryID,
+		Answer:  answer,
+	}, nil
+}
+
+// handleAnswer delivers the answer to the pending query waiting for it.
+func (p *Peer) handleAnswer(msg tl.AdnlMessageAnswer) error {
+	queryIDStr := hex.EncodeToString(msg.QueryID)
+
+	p.mu.Lock()
+	answerChn, ok := p.queries[queryIDStr]
+	// only the first answer is delivered
+	delete(p.queries, queryIDStr)
+	p.mu.Unlock()
+
+	if !ok {
+		p.logger.Debug("unexpected answer", "query_id", queryIDStr)
+		return ErrUnexpectedAnswer
+	}
+
+	answerChn <- msg.Answer
+
+	return nil
+}
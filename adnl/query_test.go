@@ -0,0 +1,65 @@
+package adnl
+
+import (
+	"bytes"
+	"context"
+	"crypto/ed25519"
+	"errors"
+	"slices"
+	"testing"
+	"time"
+)
+
+func TestPeerQuery(t *testing.T) {
+	a, _ := newTestPeer(t)
+	b, bAddr := newTestPeer(t)
+
+	b.SetQueryHandler(func(from ed25519.PublicKey, query []byte) ([]byte, error) {
+		if !bytes.Equal(from, a.pubKey) {
+			return nil, errors.New("unexpected sender")
+		}
+
+		answer := slices.Clone(query)
+		slices.Reverse(answer)
+		return answer, nil
+	})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+
+	// first query goes in the first packet format, second one through the channel
+	for i := 0; i < 2; i++ {
+		answer, err := a.Query(ctx, b.pubKey, bAddr, []byte{1, 2, 3, 4})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if !bytes.Equal(answer, []byte{4, 3, 2, 1}) {
+			t.Fatalf("unexpected answer: %x", answer)
+		}
+	}
+}
+
+func TestPeerQueryTimeout(t *testing.T) {
+	a, _ := newTestPeer(t)
+	b, bAddr := newTestPeer(t)
+
+	b.SetQueryHandler(func(from ed25519.PublicKey, query []byte) ([]byte, error) {
+		return nil, errors.New("not answering")
+	})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancel()
+
+	_, err := a.Query(ctx, b.pubKey, bAddr, []byte{1, 2, 3, 4})
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("expected deadline exceeded, got: %v", err)
+	}
+
+	a.mu.Lock()
+	pending := len(a.queries)
+	a.mu.Unlock()
+	if pending != 0 {
+		t.Fatalf("expected no pending queries, got: %d", pending)
+	}
+}
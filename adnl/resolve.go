@@ -0,0 +1,214 @@
+package adnl
+
+import (
+	"context"
+	"crypto/ed25519"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/netip"
+	"slices"
+	"time"
+
+	"github.com/Gealber/dht/tl"
+)
+
+var (
+	ErrNoResolver = errors.New("no address resolver set")
+	ErrNoAnswer   = errors.New("peer didn't answer at any of its addresses")
+)
+
+// ResolvedAddress is the address list of a peer found by an AddressResolver.
+type ResolvedAddress struct {
+	PubKey ed25519.PublicKey
+	List   tl.AdnlAddressList
+	// Priority addresses tried before the ones of List, empty if the peer doesn't publish them
+	Priority tl.AdnlAddressList
+	// ExpireAt time the list stops being valid, it's cached until then
+	ExpireAt time.Time
+}
+
+// AddressResolver finds the address list published by the peer with an adnl id, usually in the
+// DHT. The resolver is responsible for verifying the list was signed by the peer.
+type AddressResolver interface {
+	ResolveAddress(ctx context.Context, id []byte) (ResolvedAddress, error)
+}
+
+// SetAddressResolver sets the resolver used for finding the addresses of the peers we don't
+// know fresh addresses of, by SendTo and QueryTo.
+func (p *Peer) SetAddressResolver(resolver AddressResolver) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.resolver = resolver
+}
+
+// SendTo is like SendMessage, sending msg to the peer with adnl id. The addresses of the peer
+// advertised to us are used, otherwise it's resolved with the address resolver. msg is sent to
+// the address the channel with the peer receives packets from, otherwise the addresses are
+// pinged in order, priority ones first, and msg is sent to the first one that answers.
+func (p *Peer) SendTo(ctx context.Context, id []byte, msg any) error {
+	pubKey, addrs, err := p.resolve(ctx, id)
+	if err != nil {
+		return err
+	}
+
+	idStr := hex.EncodeToString(id)
+	addr, ok := p.activeAddress(idStr)
+	if !ok || !slices.Contains(addrs, addr) {
+		addr, err = p.answeringAddress(ctx, idStr, pubKey, addrs)
+		if err != nil {
+			return err
+		}
+	}
+
+	return p.SendMessage(ctx, pubKey, addr, msg)
+}
+
+// QueryTo is like Query, sending query to the peer with adnl id. The addresses are resolved as in
+// SendTo, and they are tried in order until one answers, starting with the one the channel with
+// the peer receives packets from. Each attempt waits for the adaptive timeout of the peer, ctx
+// bounds all of them.
+func (p *Peer) QueryTo(ctx context.Context, id []byte, query []byte) ([]byte, error) {
+	pubKey, addrs, err := p.resolve(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+
+	idStr := hex.EncodeToString(id)
+	if addr, ok := p.activeAddress(idStr); ok {
+		if i := slices.Index(addrs, addr); i > 0 {
+			addrs = slices.Insert(slices.Delete(addrs, i, i+1), 0, addr)
+		}
+	}
+
+	for _, addr := range addrs {
+		attemptCtx, cancel := context.WithTimeout(ctx, p.queryTimeout(idStr))
+		var answer []byte
+		answer, err = p.Query(attemptCtx, pubKey, addr, query)
+		cancel()
+		if err == nil {
+			return answer, nil
+		}
+
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+
+		// only the addresses the peer doesn't answer at are skipped
+		if !errors.Is(err, context.DeadlineExceeded) {
+			return nil, err
+		}
+	}
+
+	return nil, fmt.Errorf("%w: %w", ErrNoAnswer, err)
+}
+
+// answeringAddress pings addrs in order, with the adaptive timeout of the peer with id idStr,
+// returning the first one it answers at.
+func (p *Peer) answeringAddress(ctx context.Context, idStr string, pubKey ed25519.PublicKey, addrs []netip.AddrPort) (netip.AddrPort, error) {
+	var err error
+	for _, addr := range addrs {
+		attemptCtx, cancel := context.WithTimeout(ctx, p.queryTimeout(idStr))
+		_, err = p.Ping(attemptCtx, pubKey, addr)
+		cancel()
+		if err == nil {
+			return addr, nil
+		}
+
+		if ctx.Err() != nil {
+			return netip.AddrPort{}, ctx.Err()
+		}
+
+		if !errors.Is(err, context.DeadlineExceeded) {
+			return netip.AddrPort{}, err
+		}
+	}
+
+	return netip.AddrPort{}, fmt.Errorf("%w: %w", ErrNoAnswer, err)
+}
+
+// activeAddress returns the address the ready channel with the peer with id idStr last
+// received a packet from, if any.
+func (p *Peer) activeAddress(idStr string) (netip.AddrPort, bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	state, ok := p.peers[idStr]
+	if !ok || state.chn == nil || !state.chn.ready || !state.chn.lastAddr.IsValid() {
+		return netip.AddrPort{}, false
+	}
+
+	return state.chn.lastAddr, true
+}
+
+// resolve returns the public key of the peer with id and the addresses it can be reached at,
+// priority ones first. The addresses advertised by the peer are preferred, otherwise the
+// ones found by the address resolver are used, cached until they expire.
+func (p *Peer) resolve(ctx context.Context, id []byte) (ed25519.PublicKey, []netip.AddrPort, error) {
+	idStr := hex.EncodeToString(id)
+	now := time.Now()
+
+	p.mu.Lock()
+	var pubKey ed25519.PublicKey
+	if state, ok := p.peers[idStr]; ok {
+		pubKey = state.pubKey
+	}
+	cached, ok := p.resolved[idStr]
+	if ok && !now.Before(cached.ExpireAt) {
+		delete(p.resolved, idStr)
+		ok = false
+	}
+	resolver := p.resolver
+	p.mu.Unlock()
+
+	if pubKey != nil {
+		addrs := p.addrBook.candidates(idStr, now, p.canReach)
+		if len(addrs) > 0 {
+			return pubKey, addrs, nil
+		}
+	}
+
+	if !ok {
+		if resolver == nil {
+			return nil, nil, fmt.Errorf("%w: %w", ErrNoAddress, ErrNoResolver)
+		}
+
+		var err error
+		cached, err = resolver.ResolveAddress(ctx, id)
+		if err != nil {
+			return nil, nil, fmt.Errorf("%w: %w", ErrNoAddress, err)
+		}
+
+		peerID, err := p.computePeerID(cached.PubKey)
+		if err != nil {
+			return nil, nil, err
+		}
+
+		if hex.EncodeToString(peerID[:]) != idStr {
+			return nil, nil, fmt.Errorf("%w: resolved key of another peer", ErrNoAddress)
+		}
+
+		for _, list := range []*tl.AdnlAddressList{&cached.Priority, &cached.List} {
+			if list.ExpireAt != 0 && list.ExpireAt < cached.ExpireAt.Unix() {
+				cached.ExpireAt = time.Unix(list.ExpireAt, 0)
+			}
+		}
+
+		p.mu.Lock()
+		p.resolved[idStr] = cached
+		p.mu.Unlock()
+	}
+
+	addrs := usableAddresses(&cached.Priority, now, p.canReach)
+	for _, addr := range usableAddresses(&cached.List, now, p.canReach) {
+		if !slices.Contains(addrs, addr) {
+			addrs = append(addrs, addr)
+		}
+	}
+	if len(addrs) == 0 {
+		return nil, nil, ErrNoAddress
+	}
+
+	return cached.PubKey, addrs, nil
+}
@@ -0,0 +1,198 @@
+package adnl
+
+import (
+	"bytes"
+	"context"
+	"crypto/ed25519"
+	"encoding/hex"
+	"errors"
+	"net/netip"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/Gealber/dht/tl"
+)
+
+// staticResolver resolves the address list of a single peer, counting the lookups.
+type staticResolver struct {
+	mu       sync.Mutex
+	resolved ResolvedAddress
+	lookups  int
+}
+
+func (r *staticResolver) ResolveAddress(ctx context.Context, id []byte) (ResolvedAddress, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.lookups++
+	return r.resolved, nil
+}
+
+func (r *staticResolver) count() int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	return r.lookups
+}
+
+// addressList returns an address list including addrs.
+func addressList(t *testing.T, addrs ...netip.AddrPort) tl.AdnlAddressList {
+	t.Helper()
+
+	list := tl.AdnlAddressList{Version: 1, ReinitDate: 1}
+	for _, addr := range addrs {
+		tlAddr, err := AddressFromAddrPort(addr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		list.Addresses = append(list.Addresses, tlAddr)
+	}
+
+	return list
+}
+
+func TestPeerQueryTo(t *testing.T) {
+	a, _ := newTestPeer(t)
+	b, bAddr := newTestPeer(t)
+	b.SetQueryHandler(func(from ed25519.PublicKey, query []byte) ([]byte, error) {
+		return query, nil
+	})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	_, err := a.QueryTo(ctx, b.id, []byte{1})
+	if !errors.Is(err, ErrNoResolver) {
+		t.Fatalf("expected no resolver got %v", err)
+	}
+
+	resolver := &staticResolver{resolved: ResolvedAddress{
+		PubKey:   b.pubKey,
+		List:     addressList(t, bAddr),
+		ExpireAt: time.Now().Add(200 * time.Millisecond),
+	}}
+	a.SetAddressResolver(resolver)
+
+	// the resolved address is cached until it expires
+	for range 2 {
+		_, err = a.QueryTo(ctx, b.id, []byte{1})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	err = a.SendTo(ctx, b.id, tl.AdnlMessageNop{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if n := resolver.count(); n != 1 {
+		t.Fatalf("address resolved %d times", n)
+	}
+
+	time.Sleep(200 * time.Millisecond)
+
+	// the next addresses are tried when the first one doesn't answer
+	resolver.mu.Lock()
+	resolver.resolved.List = addressList(t, netip.MustParseAddrPort("127.0.0.1:1"), bAddr)
+	resolver.resolved.ExpireAt = time.Now().Add(time.Hour)
+	resolver.mu.Unlock()
+
+	answer, err := a.QueryTo(ctx, b.id, []byte{2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(answer) != 1 || answer[0] != 2 {
+		t.Fatalf("unexpected answer %x", answer)
+	}
+
+	if n := resolver.count(); n != 2 {
+		t.Fatalf("address resolved %d times", n)
+	}
+
+	// addresses advertised by the peer are used without resolving them
+	c, cAddr := newTestPeer(t)
+	c.SetQueryHandler(func(from ed25519.PublicKey, query []byte) ([]byte, error) {
+		return query, nil
+	})
+
+	err = c.SetAddressList(cAddr)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = c.Ping(ctx, a.pubKey, loopbackAddr(t, a))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = a.QueryTo(ctx, c.id, []byte{3})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if n := resolver.count(); n != 2 {
+		t.Fatalf("address resolved %d times", n)
+	}
+}
+
+func TestPeerSendToPriority(t *testing.T) {
+	a, _ := newTestPeer(t)
+	b, bAddr := newTestPeer(t)
+
+	received := make(chan []byte, 2)
+	b.Handle(tl.Crc32(tl.TLPong), func(from ed25519.PublicKey, data []byte) ([]byte, error) {
+		received <- data
+		return nil, nil
+	})
+
+	pong, err := a.tlH.Serialize(tl.Pong{RandomID: 1}, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	// the priority address doesn't answer, the message goes to the next one that does
+	a.SetAddressResolver(&staticResolver{resolved: ResolvedAddress{
+		PubKey:   b.pubKey,
+		Priority: addressList(t, netip.MustParseAddrPort("127.0.0.1:1")),
+		List:     addressList(t, bAddr),
+		ExpireAt: time.Now().Add(time.Hour),
+	}})
+
+	for range 2 {
+		err = a.SendTo(ctx, b.id, tl.AdnlMessageCustom{Data: pong})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		select {
+		case data := <-received:
+			if !bytes.Equal(data, pong) {
+				t.Fatalf("unexpected custom message payload: %x", data)
+			}
+		case <-time.After(2 * time.Second):
+			t.Fatal("message not delivered")
+		}
+	}
+
+	// peers that don't answer at any address aren't sent to, each attempt waiting for the
+	// adaptive timeout of the peer
+	a.SetAddressResolver(&staticResolver{resolved: ResolvedAddress{
+		PubKey:   b.pubKey,
+		Priority: addressList(t, netip.MustParseAddrPort("127.0.0.1:1")),
+		List:     addressList(t, netip.MustParseAddrPort("127.0.0.1:2")),
+		ExpireAt: time.Now().Add(time.Hour),
+	}})
+	a.mu.Lock()
+	delete(a.resolved, hex.EncodeToString(b.id))
+	a.mu.Unlock()
+
+	err = a.SendTo(ctx, b.id, tl.AdnlMessageCustom{Data: pong})
+	if !errors.Is(err, ErrNoAnswer) {
+		t.Fatalf("expected no answer got %v", err)
+	}
+}
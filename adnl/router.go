@@ -0,0 +1,62 @@
+package adnl
+
+import (
+	"crypto/ed25519"
+	"encoding/binary"
+	"errors"
+	"fmt"
+
+	"github.com/Gealber/dht/tl"
+)
+
+var ErrNoHandler = errors.New("no handler registered for the message constructor")
+
+// Handler handles the payload of an adnl.message.custom or adnl.message.query sent by the peer
+// with public key from. The payload is a boxed TL object, prefixed by its constructor id. For
+// queries the returned data is sent back as the answer, for custom messages it's ignored.
+type Handler func(from ed25519.PublicKey, data []byte) ([]byte, error)
+
+// Handle registers handler for the custom messages and queries which payload is a boxed TL object
+// with constructor id constructorID, tl.Crc32 of its TL definition. Subsystems like DHT or overlays
+// register in this way the handlers of their own messages. A nil handler removes the registration.
+func (p *Peer) Handle(constructorID uint32, handler Handler) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if handler == nil {
+		delete(p.handlers, constructorID)
+		return
+	}
+
+	p.handlers[constructorID] = handler
+}
+
+// route returns the handler registered for the constructor of the boxed TL object in data.
+func (p *Peer) route(data []byte) (Handler, error) {
+	if len(data) < 4 {
+		return nil, fmt.Errorf("%w: payload without constructor id", ErrNoHandler)
+	}
+	constructorID := binary.LittleEndian.Uint32(data[:4])
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	handler, ok := p.handlers[constructorID]
+	if !ok {
+		return nil, fmt.Errorf("%w: %08x", ErrNoHandler, constructorID)
+	}
+
+	return handler, nil
+}
+
+// handleCustom dispatches the payload of a custom message to the handler of its constructor.
+func (p *Peer) handleCustom(senderPubKey ed25519.PublicKey, msg tl.AdnlMessageCustom) error {
+	handler, err := p.route(msg.Data)
+	if err != nil {
+		return err
+	}
+
+	_, err = handler(senderPubKey, msg.Data)
+
+	return err
+}
@@ -0,0 +1,118 @@
+package adnl
+
+import (
+	"bytes"
+	"context"
+	"crypto/ed25519"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/Gealber/dht/tl"
+)
+
+func TestPeerHandle(t *testing.T) {
+	a, _ := newTestPeer(t)
+	b, bAddr := newTestPeer(t)
+
+	pingID := tl.Crc32(tl.TLPing)
+	pongID := tl.Crc32(tl.TLPong)
+
+	received := make(chan []byte, 1)
+	b.Handle(pongID, func(from ed25519.PublicKey, data []byte) ([]byte, error) {
+		received <- data
+		return nil, nil
+	})
+	b.Handle(pingID, func(from ed25519.PublicKey, data []byte) ([]byte, error) {
+		return b.tlH.Serialize(tl.Pong{RandomID: 7}, true)
+	})
+	b.SetQueryHandler(func(from ed25519.PublicKey, query []byte) ([]byte, error) {
+		return []byte("fallback"), nil
+	})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+
+	// custom message routed by the constructor of its payload
+	pong, err := a.tlH.Serialize(tl.Pong{RandomID: 1}, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = a.SendMessage(ctx, b.pubKey, bAddr, tl.AdnlMessageCustom{Data: pong})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case data := <-received:
+		if !bytes.Equal(data, pong) {
+			t.Fatalf("unexpected custom message payload: %x", data)
+		}
+	case <-ctx.Done():
+		t.Fatal("custom message not delivered to its handler")
+	}
+
+	// query routed by the constructor of its payload
+	ping, err := a.tlH.Serialize(tl.Ping{Value: 1}, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	answer, err := a.Query(ctx, b.pubKey, bAddr, ping)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	got, err := a.tlH.ParseBoxed(answer)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if got != (tl.Pong{RandomID: 7}) {
+		t.Fatalf("unexpected answer: %+v", got)
+	}
+
+	// queries without a registered constructor go to the query handler
+	answer, err = a.Query(ctx, b.pubKey, bAddr, []byte{1, 2, 3, 4})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if string(answer) != "fallback" {
+		t.Fatalf("unexpected answer: %s", answer)
+	}
+
+	// once removed the query handler answers
+	b.Handle(pingID, nil)
+	answer, err = a.Query(ctx, b.pubKey, bAddr, ping)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if string(answer) != "fallback" {
+		t.Fatalf("unexpected answer: %s", answer)
+	}
+}
+
+func Test_route(t *testing.T) {
+	p, err := New(nil, nil, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = p.route([]byte{1, 2})
+	if !errors.Is(err, ErrNoHandler) {
+		t.Fatalf("expected no handler error, got: %v", err)
+	}
+
+	_, err = p.route([]byte{1, 2, 3, 4})
+	if !errors.Is(err, ErrNoHandler) {
+		t.Fatalf("expected no handler error, got: %v", err)
+	}
+
+	_, err = p.handleQuery(p.pubKey, tl.AdnlMessageQuery{Query: []byte{1, 2, 3, 4}})
+	if !errors.Is(err, ErrNoQueryHandler) {
+		t.Fatalf("expected no query handler error, got: %v", err)
+	}
+}
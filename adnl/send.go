@@ -0,0 +1,203 @@
+package adnl
+
+import (
+	"context"
+	"crypto/ed25519"
+	"net/netip"
+	"time"
+)
+
+// Batching configures the queues of the messages sent to each peer. Messages sent to a peer
+// within a window are packed in as few packets as possible, each one up to maxMessageSize.
+type Batching struct {
+	// Window time the first message queued for a peer waits for more messages, zero sends the
+	// messages right away, packing only the ones queued while the previous packet is sent
+	Window time.Duration
+	// QueueSize max amount of messages queued for each peer, SendMessage blocks while the
+	// queue of the peer is full
+	QueueSize int
+}
+
+// DefaultBatching is the batching used unless SetBatching is called.
+func DefaultBatching() Batching {
+	return Batching{
+		Window:    time.Millisecond,
+		QueueSize: 256,
+	}
+}
+
+// SetBatching sets the batching of the messages sent, the queues being flushed keep the window
+// they started with.
+func (p *Peer) SetBatching(batching Batching) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.batching = batching
+}
+
+// sendQueue keeps the messages waiting to be sent to a peer. A flusher goroutine is started once
+// a message is queued in an idle queue, it waits for the window and sends the queued messages
+// until the queue is empty, then the queue is removed. Senders only wait for their message to be
+// sent, or take it back from the queue once their context is done.
+type sendQueue struct {
+	msgs []queuedMessage
+	// pending amount of messages queued or being sent, bounded by the queue size
+	pending  int
+	flushing bool
+	// space is closed once messages are sent, waking up the senders waiting for the queue
+	space chan struct{}
+}
+
+// queuedMessage is a message waiting to be sent to addr, the result of sending it is written to done.
+type queuedMessage struct {
+	addr netip.AddrPort
+	msg  any
+	done chan sendResult
+}
+
+// sendResult is the result of sending a queued message, written is the time its packet was
+// written, excluding the time spent in the queue.
+type sendResult struct {
+	written time.Time
+	err     error
+}
+
+// queueMessage queues msg for the peer with public key dst and id dstIDStr, waiting until it's
+// sent and returning the time its packet was written. It blocks while the queue of the peer is
+// full, until ctx is done. Messages still queued once ctx is done aren't sent.
+func (p *Peer) queueMessage(ctx context.Context, dst ed25519.PublicKey, dstIDStr string, addr netip.AddrPort, msg any) (time.Time, error) {
+	done := make(chan sendResult, 1)
+	for {
+		p.mu.Lock()
+		select {
+		case <-p.closer:
+			p.mu.Unlock()
+			return time.Time{}, ErrPeerClosed
+		default:
+		}
+
+		q, ok := p.sendQueues[dstIDStr]
+		if !ok {
+			q = &sendQueue{space: make(chan struct{})}
+			p.sendQueues[dstIDStr] = q
+		}
+
+		if q.pending < max(p.batching.QueueSize, 1) {
+			q.msgs = append(q.msgs, queuedMessage{addr: addr, msg: msg, done: done})
+			q.pending++
+			if !q.flushing {
+				q.flushing = true
+				// closer is closed under the lock, so stop waits for this flush
+				p.sending.Add(1)
+				go p.flushQueue(q, dst, dstIDStr, p.batching.Window)
+			}
+			p.mu.Unlock()
+			break
+		}
+		space := q.space
+		p.mu.Unlock()
+
+		select {
+		case <-space:
+		case <-ctx.Done():
+			return time.Time{}, ctx.Err()
+		case <-p.closer:
+			return time.Time{}, ErrPeerClosed
+		}
+	}
+
+	select {
+	case res := <-done:
+		return res.written, res.err
+	case <-ctx.Done():
+		if p.unqueueMessage(dstIDStr, done) {
+			return time.Time{}, ctx.Err()
+		}
+
+		// the message is being sent already
+		res := <-done
+		return res.written, res.err
+	}
+}
+
+// unqueueMessage removes from the queue of the peer with id dstIDStr the message which result
+// is written to done, returning false in case it isn't queued anymore.
+func (p *Peer) unqueueMessage(dstIDStr string, done chan sendResult) bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	q, ok := p.sendQueues[dstIDStr]
+	if !ok {
+		return false
+	}
+
+	for i, m := range q.msgs {
+		if m.done == done {
+			q.msgs = append(q.msgs[:i], q.msgs[i+1:]...)
+			q.pending--
+			close(q.space)
+			q.space = make(chan struct{})
+			return true
+		}
+	}
+
+	return false
+}
+
+// flushQueue waits for window, unless the peer is closed meanwhile, then sends the messages of
+// q until it's empty, removing it from the queues of the peer with id dstIDStr. Messages to the
+// same address are packed together, keeping their order.
+func (p *Peer) flushQueue(q *sendQueue, dst ed25519.PublicKey, dstIDStr string, window time.Duration) {
+	defer p.sending.Done()
+
+	if window > 0 {
+		timer := time.NewTimer(window)
+		select {
+		case <-timer.C:
+		case <-p.closer:
+			timer.Stop()
+		}
+	}
+
+	for {
+		p.mu.Lock()
+		batch := q.msgs
+		q.msgs = nil
+		if len(batch) == 0 {
+			// idle queues are removed, the next message starts a new one
+			q.flushing = false
+			delete(p.sendQueues, dstIDStr)
+			p.mu.Unlock()
+			return
+		}
+		p.mu.Unlock()
+
+		for len(batch) > 0 {
+			// messages to the same address as the first one, usually all of them
+			addr := batch[0].addr
+			var msgs []any
+			var sent, rest []queuedMessage
+			for _, m := range batch {
+				if m.addr == addr {
+					msgs = append(msgs, m.msg)
+					sent = append(sent, m)
+				} else {
+					rest = append(rest, m)
+				}
+			}
+
+			written := time.Now()
+			err := p.sendPacket(dst, addr, msgs...)
+			for _, m := range sent {
+				m.done <- sendResult{written: written, err: err}
+			}
+			batch = rest
+
+			p.mu.Lock()
+			q.pending -= len(sent)
+			close(q.space)
+			q.space = make(chan struct{})
+			p.mu.Unlock()
+		}
+	}
+}
@@ -0,0 +1,254 @@
+package adnl
+
+import (
+	"context"
+	"crypto/ed25519"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/Gealber/dht/tl"
+)
+
+// customMessage returns a custom message which payload has constructor id constructorID.
+func customMessage(constructorID uint32, i int) tl.AdnlMessageCustom {
+	data := binary.LittleEndian.AppendUint32(nil, constructorID)
+	return tl.AdnlMessageCustom{Data: binary.LittleEndian.AppendUint32(data, uint32(i))}
+}
+
+// countMessages counts the custom messages with constructor id constructorID received by p.
+func countMessages(p *Peer, constructorID uint32) *atomic.Int64 {
+	var received atomic.Int64
+	p.Handle(constructorID, func(from ed25519.PublicKey, data []byte) ([]byte, error) {
+		received.Add(1)
+		return nil, nil
+	})
+
+	return &received
+}
+
+// queued returns the amount of messages waiting to be sent to the peer with id peerID.
+func (p *Peer) queued(peerID []byte) int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	q, ok := p.sendQueues[hex.EncodeToString(peerID)]
+	if !ok {
+		return 0
+	}
+
+	return len(q.msgs)
+}
+
+func TestPeerBatching(t *testing.T) {
+	a, _ := newTestPeer(t)
+	b, bAddr := newTestPeer(t)
+
+	a.SetBatching(Batching{Window: 50 * time.Millisecond, QueueSize: 64})
+	received := countMessages(b, 1)
+
+	var packets atomic.Int64
+	a.SetCaptureHook(func(rec CaptureRecord) {
+		if rec.Direction == DirectionOut {
+			packets.Add(1)
+		}
+	})
+
+	// messages sent within the window are packed together
+	const count = 20
+	errs := make(chan error, count)
+	for i := range count {
+		go func() {
+			errs <- a.SendMessage(context.Background(), b.pubKey, bAddr, customMessage(1, i))
+		}()
+	}
+
+	for range count {
+		if err := <-errs; err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	waitFor(t, 2*time.Second, func() bool {
+		return received.Load() == count
+	})
+
+	if n := packets.Load(); n > 2 {
+		t.Fatalf("%d messages sent in %d packets", count, n)
+	}
+
+	// invalid messages fail alone
+	err := a.SendMessage(context.Background(), b.pubKey, bAddr, struct{}{})
+	if err == nil {
+		t.Fatal("expected error sending invalid message")
+	}
+}
+
+func TestPeerSendQueueFull(t *testing.T) {
+	a, _ := newTestPeer(t)
+	b, bAddr := newTestPeer(t)
+
+	a.SetBatching(Batching{Window: 200 * time.Millisecond, QueueSize: 2})
+	received := countMessages(b, 1)
+
+	var wg sync.WaitGroup
+	for i := range 2 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			err := a.SendMessage(context.Background(), b.pubKey, bAddr, customMessage(1, i))
+			if err != nil {
+				t.Error(err)
+			}
+		}()
+	}
+
+	// the queue is full until the window ends
+	waitFor(t, time.Second, func() bool {
+		return a.queued(b.id) == 2
+	})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	err := a.SendMessage(ctx, b.pubKey, bAddr, customMessage(1, 2))
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("expected deadline exceeded got %v", err)
+	}
+
+	wg.Wait()
+	waitFor(t, 2*time.Second, func() bool {
+		return received.Load() == 2
+	})
+}
+
+func TestPeerSendQueueFlushOnClose(t *testing.T) {
+	a, _ := newTestPeer(t)
+	b, bAddr := newTestPeer(t)
+
+	a.SetBatching(Batching{Window: time.Hour, QueueSize: 16})
+	received := countMessages(b, 1)
+
+	errs := make(chan error, 1)
+	go func() {
+		errs <- a.SendMessage(context.Background(), b.pubKey, bAddr, customMessage(1, 0))
+	}()
+
+	waitFor(t, time.Second, func() bool {
+		return a.queued(b.id) == 1
+	})
+
+	err := a.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := <-errs; err != nil {
+		t.Fatal(err)
+	}
+
+	waitFor(t, 2*time.Second, func() bool {
+		return received.Load() == 1
+	})
+
+	err = a.SendMessage(context.Background(), b.pubKey, bAddr, customMessage(1, 1))
+	if !errors.Is(err, ErrPeerClosed) {
+		t.Fatalf("expected peer closed got %v", err)
+	}
+}
+
+func TestPeerSendQueueSteadyTraffic(t *testing.T) {
+	a, _ := newTestPeer(t)
+	b, bAddr := newTestPeer(t)
+
+	a.SetBatching(Batching{Window: 5 * time.Millisecond, QueueSize: 16})
+	received := countMessages(b, 1)
+
+	// other senders keep the queue busy meanwhile
+	stop := make(chan struct{})
+	var wg sync.WaitGroup
+	for i := range 4 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				select {
+				case <-stop:
+					return
+				default:
+				}
+
+				err := a.SendMessage(context.Background(), b.pubKey, bAddr, customMessage(2, i))
+				if err != nil {
+					t.Error(err)
+					return
+				}
+			}
+		}()
+	}
+	defer func() {
+		close(stop)
+		wg.Wait()
+	}()
+
+	for i := range 10 {
+		start := time.Now()
+		err := a.SendMessage(context.Background(), b.pubKey, bAddr, customMessage(1, i))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if elapsed := time.Since(start); elapsed > time.Second {
+			t.Fatalf("message sent after %s under steady traffic", elapsed)
+		}
+	}
+
+	waitFor(t, 2*time.Second, func() bool {
+		return received.Load() == 10
+	})
+}
+
+func TestPeerSendQueueCancel(t *testing.T) {
+	a, _ := newTestPeer(t)
+	b, bAddr := newTestPeer(t)
+
+	a.SetBatching(Batching{Window: 200 * time.Millisecond, QueueSize: 16})
+	canceled := countMessages(b, 1)
+	received := countMessages(b, 2)
+
+	errs := make(chan error, 1)
+	go func() {
+		errs <- a.SendMessage(context.Background(), b.pubKey, bAddr, customMessage(2, 0))
+	}()
+
+	// the message is taken back from the queue, it isn't sent within the window
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	err := a.SendMessage(ctx, b.pubKey, bAddr, customMessage(1, 0))
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("expected deadline exceeded got %v", err)
+	}
+
+	if err := <-errs; err != nil {
+		t.Fatal(err)
+	}
+
+	waitFor(t, 2*time.Second, func() bool {
+		return received.Load() == 1
+	})
+
+	if canceled.Load() != 0 {
+		t.Fatal("canceled message was sent")
+	}
+
+	// idle queues are removed
+	waitFor(t, time.Second, func() bool {
+		a.mu.Lock()
+		defer a.mu.Unlock()
+
+		return len(a.sendQueues) == 0
+	})
+}
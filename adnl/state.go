@@ -0,0 +1,205 @@
+package adnl
+
+import (
+	"crypto/ed25519"
+	"errors"
+	"slices"
+	"time"
+
+	"github.com/Gealber/dht/tl"
+)
+
+// seqnoWindowSize amount of seqnos, previous to the highest one received, that are tracked
+const seqnoWindowSize = 64
+
+var (
+	ErrDuplicatedSeqno     = errors.New("packet with duplicated seqno")
+	ErrSeqnoTooOld         = errors.New("packet seqno too old")
+	ErrInvalidSeqno        = errors.New("invalid packet seqno")
+	ErrConfirmSeqnoTooNew  = errors.New("packet confirm seqno is newer than our last sent seqno")
+	ErrReinitDateTooOld    = errors.New("packet reinit date is older than the last one received")
+	ErrDstReinitDateTooNew = errors.New("packet dst reinit date is newer than our reinit date")
+	ErrDstReinitDateTooOld = errors.New("packet dst reinit date is older than our reinit date")
+)
+
+// peerState keeps the state of the communication with a remote peer.
+type peerState struct {
+	pubKey ed25519.PublicKey
+	// chn channel with the peer, nil until one of the sides ask for its creation
+	chn *channel
+	// outSeqno seqno of the last packet sent to the peer
+	outSeqno int64
+	// confirmSeqno highest seqno received from the peer, confirmed in our packets
+	confirmSeqno int64
+	// in tracks the seqnos received in the first packet format
+	in seqnoWindow
+	// reinitDate of the peer, a newer one means the peer was restarted
+	reinitDate int64
+	// lastSeen unix date of the last valid packet received from the peer
+	lastSeen int64
+	// rtt round trip statistics of the pings and queries sent to the peer
+	rtt rttStats
+}
+
+// packetSeqnos are the seqnos, dates and versions included in a packet sent to a peer.
+type packetSeqnos struct {
+	seqno        int64
+	confirmSeqno int64
+	// reinitDate is ours, dstReinitDate the one of the peer known by us
+	reinitDate    int64
+	dstReinitDate int64
+	// versions of the address lists of the peer known by us
+	recvAddrListVersion         int64
+	recvPriorityAddrListVersion int64
+}
+
+// seqnoWindow tracks the seqnos received, rejecting duplicated seqnos and those
+// older than the last seqnoWindowSize seqnos.
+type seqnoWindow struct {
+	// highest seqno received
+	max int64
+	// i-th bit is set if seqno max-i was received
+	mask uint64
+}
+
+// check returns an error in case seqno should be rejected.
+func (w *seqnoWindow) check(seqno int64) error {
+	if seqno <= 0 {
+		return ErrInvalidSeqno
+	}
+
+	if seqno > w.max {
+		return nil
+	}
+
+	if w.max-seqno >= seqnoWindowSize {
+		return ErrSeqnoTooOld
+	}
+
+	if w.mask&(1<<(w.max-seqno)) != 0 {
+		return ErrDuplicatedSeqno
+	}
+
+	return nil
+}
+
+// mark registers seqno as received, seqno should be previously checked.
+func (w *seqnoWindow) mark(seqno int64) {
+	if seqno <= w.max {
+		w.mask |= 1 << (w.max - seqno)
+		return
+	}
+
+	shift := seqno - w.max
+	if shift >= seqnoWindowSize {
+		w.mask = 0
+	} else {
+		w.mask <<= shift
+	}
+	w.mask |= 1
+	w.max = seqno
+}
+
+// peerState returns the state of the peer with id peerIDStr, creating it in case it doesn't exist.
+// Should be used with p.mu locked.
+func (p *Peer) peerState(peerIDStr string, peerPubKey ed25519.PublicKey) *peerState {
+	state, ok := p.peers[peerIDStr]
+	if !ok {
+		state = &peerState{pubKey: slices.Clone(peerPubKey)}
+		p.peers[peerIDStr] = state
+	}
+
+	return state
+}
+
+// nextSeqnos increments the seqno of the packets sent to the peer,
+// returning the values to be used in the next packet.
+func (s *peerState) nextSeqnos() packetSeqnos {
+	s.outSeqno++
+
+	return packetSeqnos{
+		seqno:         s.outSeqno,
+		confirmSeqno:  s.confirmSeqno,
+		dstReinitDate: s.reinitDate,
+	}
+}
+
+// reinit updates the reinit date of the peer. When the peer already had a reinit date, it was
+// restarted, so the peer forgot our channel and the seqnos received from us. Our seqnos keep
+// growing, so the confirmations are still valid. Should be used with p.mu locked.
+func (p *Peer) reinit(state *peerState, reinitDate int64) {
+	restarted := state.reinitDate != 0
+	state.reinitDate = reinitDate
+	if !restarted {
+		return
+	}
+
+	state.confirmSeqno = 0
+	state.in = seqnoWindow{}
+	p.dropChannel(state)
+}
+
+// checkPacketState validates seqnos and dates of pkt against the state of the peer, pkt is
+// dropped in case of an error. ch is the channel the packet was received through, nil in case
+// the first packet format was used. Once validated, the packet is registered as received.
+func (p *Peer) checkPacketState(senderIDStr string, senderPubKey ed25519.PublicKey, ch *channel, pkt tl.AdnlPacketContent) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	state := p.peerState(senderIDStr, senderPubKey)
+
+	if pkt.Flags&flagReinitDate != 0 {
+		if pkt.DstReinitDate > p.reinitDate {
+			return ErrDstReinitDateTooNew
+		}
+
+		if pkt.ReinitDate < state.reinitDate {
+			return ErrReinitDateTooOld
+		}
+
+		if pkt.ReinitDate > state.reinitDate {
+			p.reinit(state, pkt.ReinitDate)
+		}
+
+		// the peer knows a previous instance of us
+		if pkt.DstReinitDate > 0 && pkt.DstReinitDate < p.reinitDate {
+			return ErrDstReinitDateTooOld
+		}
+	}
+
+	if pkt.Flags&flagConfirmSeqno != 0 && pkt.ConfirmSeqno > state.outSeqno {
+		return ErrConfirmSeqnoTooNew
+	}
+
+	window := &state.in
+	if ch != nil {
+		// the channel might be gone after a reinit
+		if state.chn != ch {
+			return ErrChannelNotReady
+		}
+		window = &ch.in
+	}
+
+	if pkt.Flags&flagSeqno != 0 {
+		if err := window.check(pkt.Seqno); err != nil {
+			return err
+		}
+
+		window.mark(pkt.Seqno)
+		state.confirmSeqno = max(state.confirmSeqno, pkt.Seqno)
+	}
+	state.lastSeen = time.Now().Unix()
+
+	return nil
+}
+
+// handleReinit handles adnl.message.reinit, used by the peer for announcing its reinit date.
+func (p *Peer) handleReinit(senderIDStr string, senderPubKey ed25519.PublicKey, msg tl.AdnlMessageReinit) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	state := p.peerState(senderIDStr, senderPubKey)
+	if msg.Date > state.reinitDate {
+		p.reinit(state, msg.Date)
+	}
+}
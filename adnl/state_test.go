@@ -0,0 +1,90 @@
+package adnl
+
+import (
+	"crypto/ed25519"
+	"errors"
+	"testing"
+
+	"github.com/Gealber/dht/tl"
+)
+
+func Test_seqnoWindow(t *testing.T) {
+	var w seqnoWindow
+
+	steps := []struct {
+		seqno int64
+		err   error
+	}{
+		{seqno: 0, err: ErrInvalidSeqno},
+		{seqno: 1},
+		{seqno: 1, err: ErrDuplicatedSeqno},
+		{seqno: 5},
+		{seqno: 3},
+		{seqno: 3, err: ErrDuplicatedSeqno},
+		{seqno: 2},
+		{seqno: 5 + seqnoWindowSize},
+		{seqno: 5, err: ErrSeqnoTooOld},
+		{seqno: 6},
+		{seqno: 6, err: ErrDuplicatedSeqno},
+		{seqno: 5 + seqnoWindowSize, err: ErrDuplicatedSeqno},
+	}
+
+	for i, step := range steps {
+		err := w.check(step.seqno)
+		if !errors.Is(err, step.err) {
+			t.Fatalf("step %d, seqno %d: expected error %v got %v", i, step.seqno, step.err, err)
+		}
+
+		if err == nil {
+			w.mark(step.seqno)
+		}
+	}
+}
+
+func Test_checkPacketState(t *testing.T) {
+	p, err := New(nil, nil, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	peerPub, _, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	peerIDStr := "peer"
+
+	pkt := func(seqno, confirmSeqno, reinitDate, dstReinitDate int64) tl.AdnlPacketContent {
+		return tl.AdnlPacketContent{
+			Flags:         flagSeqno | flagConfirmSeqno | flagReinitDate,
+			Seqno:         seqno,
+			ConfirmSeqno:  confirmSeqno,
+			ReinitDate:    reinitDate,
+			DstReinitDate: dstReinitDate,
+		}
+	}
+
+	tcs := []struct {
+		name string
+		pkt  tl.AdnlPacketContent
+		err  error
+	}{
+		{name: "first packet", pkt: pkt(1, 0, 100, 0)},
+		{name: "replayed packet", pkt: pkt(1, 0, 100, 0), err: ErrDuplicatedSeqno},
+		{name: "confirms a packet we never sent", pkt: pkt(2, 1, 100, 0), err: ErrConfirmSeqnoTooNew},
+		{name: "knows a future instance of us", pkt: pkt(2, 0, 100, p.reinitDate+1), err: ErrDstReinitDateTooNew},
+		{name: "knows a previous instance of us", pkt: pkt(2, 0, 100, p.reinitDate-1), err: ErrDstReinitDateTooOld},
+		{name: "knows our current instance", pkt: pkt(2, 0, 100, p.reinitDate)},
+		{name: "previous instance of the peer", pkt: pkt(3, 0, 99, 0), err: ErrReinitDateTooOld},
+		// a restarted peer starts again with its seqnos
+		{name: "peer restarted", pkt: pkt(1, 0, 101, 0)},
+	}
+
+	for _, tc := range tcs {
+		t.Run(tc.name, func(t *testing.T) {
+			err := p.checkPacketState(peerIDStr, peerPub, nil, tc.pkt)
+			if !errors.Is(err, tc.err) {
+				t.Fatalf("expected error %v got %v", tc.err, err)
+			}
+		})
+	}
+}
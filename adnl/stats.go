@@ -0,0 +1,260 @@
+package adnl
+
+import (
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"net/netip"
+	"time"
+
+	"github.com/Gealber/dht/tl"
+)
+
+const (
+	// minQueryTimeout is the lowest adaptive timeout used for the queries, DefaultQueryTimeout the highest one
+	minQueryTimeout = 500 * time.Millisecond
+	// healthRTT is the smoothed round trip time that halves the health score of a peer
+	healthRTT = 200 * time.Millisecond
+	// lossWeight is the weight of the newest sample in the loss rate
+	lossWeight = 0.125
+)
+
+var ErrUnexpectedPong = errors.New("pong received for an unknown ping")
+
+// PeerStats are the round trip statistics of a peer, measured with the pings and queries sent to it.
+type PeerStats struct {
+	ID []byte
+	// RTT last round trip time sample, SRTT the smoothed round trip time and RTTVar its variation
+	RTT    time.Duration
+	SRTT   time.Duration
+	RTTVar time.Duration
+	// Samples amount of answered pings and queries, Lost amount of the ones never answered
+	Samples uint64
+	Lost    uint64
+	// LossRate exponentially weighted rate of pings and queries without answer, between 0 and 1
+	LossRate float64
+	// Health score between 0 and 1, lower with higher loss rate and round trip time, zero
+	// until the first sample
+	Health float64
+	// QueryTimeout timeout used for the queries sent to the peer without deadline
+	QueryTimeout time.Duration
+}
+
+// pendingPing is a ping waiting for its pong, the time the pong is received is written to answered.
+type pendingPing struct {
+	sent     time.Time
+	answered chan time.Time
+}
+
+// rttStats tracks the round trip times and the losses of the pings and queries sent to a peer,
+// the round trip time is estimated as described in RFC 6298. Times are measured with the
+// monotonic clock.
+type rttStats struct {
+	// pings waiting for their pong, indexed by random id
+	pings   map[int64]*pendingPing
+	last    time.Duration
+	srtt    time.Duration
+	rttvar  time.Duration
+	samples uint64
+	lost    uint64
+	// lossRate exponentially weighted rate of pings and queries without answer
+	lossRate float64
+}
+
+// observe registers an answer received after rtt.
+func (s *rttStats) observe(rtt time.Duration) {
+	s.last = rtt
+	if s.samples == 0 {
+		s.srtt, s.rttvar = rtt, rtt/2
+	} else {
+		s.rttvar = (3*s.rttvar + (s.srtt - rtt).Abs()) / 4
+		s.srtt = (7*s.srtt + rtt) / 8
+	}
+	s.samples++
+	s.lossRate *= 1 - lossWeight
+}
+
+// loss registers a ping or query that was never answered.
+func (s *rttStats) loss() {
+	s.lost++
+	s.lossRate = s.lossRate*(1-lossWeight) + lossWeight
+}
+
+// timeout returns the time we wait for an answer, DefaultQueryTimeout until the first sample.
+func (s *rttStats) timeout() time.Duration {
+	if s.samples == 0 {
+		return DefaultQueryTimeout
+	}
+
+	return min(max(s.srtt+4*s.rttvar, minQueryTimeout), DefaultQueryTimeout)
+}
+
+// health returns a score between 0 and 1 for the peer, 0 until the first sample.
+func (s *rttStats) health() float64 {
+	if s.samples == 0 {
+		return 0
+	}
+
+	return (1 - s.lossRate) * float64(healthRTT) / float64(healthRTT+s.srtt)
+}
+
+// expirePings counts as lost the pings without pong after the timeout, returning the amount
+// of expired pings.
+func (s *rttStats) expirePings(now time.Time) int {
+	expired := 0
+	for id, ping := range s.pings {
+		if now.Sub(ping.sent) > s.timeout() {
+			delete(s.pings, id)
+			s.loss()
+			expired++
+		}
+	}
+
+	return expired
+}
+
+// Stats returns the round trip statistics of the peers we know.
+func (p *Peer) Stats() []PeerStats {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	stats := make([]PeerStats, 0, len(p.peers))
+	for peerIDStr, state := range p.peers {
+		id, _ := hex.DecodeString(peerIDStr)
+		s := &state.rtt
+		stats = append(stats, PeerStats{
+			ID:           id,
+			RTT:          s.last,
+			SRTT:         s.srtt,
+			RTTVar:       s.rttvar,
+			Samples:      s.samples,
+			Lost:         s.lost,
+			LossRate:     s.lossRate,
+			Health:       s.health(),
+			QueryTimeout: s.timeout(),
+		})
+	}
+
+	return stats
+}
+
+// Ping sends an adnl.ping to the peer with public key dst listening on addr, and waits for the pong
+// including the same random value. Returns the round trip time, measured since the ping is written.
+// In case ctx doesn't have a deadline the adaptive timeout of the peer is used, pings timing out are
+// counted as lost.
+func (p *Peer) Ping(ctx context.Context, dst ed25519.PublicKey, addr netip.AddrPort) (time.Duration, error) {
+	dstID, err := p.computePeerID(dst)
+	if err != nil {
+		return 0, err
+	}
+	dstIDStr := hex.EncodeToString(dstID[:])
+
+	buff := make([]byte, 8)
+	_, err = rand.Read(buff)
+	if err != nil {
+		return 0, err
+	}
+	value := int64(binary.LittleEndian.Uint64(buff))
+	ping := &pendingPing{sent: time.Now(), answered: make(chan time.Time, 1)}
+
+	p.mu.Lock()
+	state := p.peerState(dstIDStr, dst)
+	s := &state.rtt
+	if s.pings == nil {
+		s.pings = make(map[int64]*pendingPing)
+	}
+	p.expirePings(state, time.Now())
+	s.pings[value] = ping
+	timeout := s.timeout()
+	p.mu.Unlock()
+
+	if _, ok := ctx.Deadline(); !ok {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+
+	written, err := p.sendMessage(ctx, dst, addr, tl.Ping{Value: value})
+	if err != nil {
+		p.mu.Lock()
+		delete(s.pings, value)
+		p.mu.Unlock()
+		return 0, err
+	}
+
+	select {
+	case answered := <-ping.answered:
+		rtt := answered.Sub(written)
+		p.mu.Lock()
+		s.observe(rtt)
+		p.mu.Unlock()
+		return rtt, nil
+	case <-ctx.Done():
+		p.mu.Lock()
+		if _, ok := s.pings[value]; ok {
+			delete(s.pings, value)
+			// canceled pings aren't lost, only the ones timing out
+			if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+				p.registerLoss(state)
+			}
+		}
+		p.mu.Unlock()
+		return 0, ctx.Err()
+	case <-p.closer:
+		return 0, ErrPeerClosed
+	}
+}
+
+// handlePong matches a pong with the ping sent to the peer with id peerIDStr, delivering the time it was received.
+func (p *Peer) handlePong(peerIDStr string, pong tl.Pong) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	state, ok := p.peers[peerIDStr]
+	if !ok {
+		return ErrUnexpectedPong
+	}
+
+	ping, ok := state.rtt.pings[pong.RandomID]
+	if !ok {
+		return ErrUnexpectedPong
+	}
+	delete(state.rtt.pings, pong.RandomID)
+	ping.answered <- time.Now()
+
+	return nil
+}
+
+// queryTimeout returns the adaptive timeout for the queries sent to the peer with id peerIDStr.
+func (p *Peer) queryTimeout(peerIDStr string) time.Duration {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	state, ok := p.peers[peerIDStr]
+	if !ok {
+		return DefaultQueryTimeout
+	}
+
+	return state.rtt.timeout()
+}
+
+// observeQuery registers the round trip time of a query answered by the peer with id peerIDStr,
+// or its loss in case it wasn't answered.
+func (p *Peer) observeQuery(peerIDStr string, rtt time.Duration, answered bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	state, ok := p.peers[peerIDStr]
+	if !ok {
+		return
+	}
+
+	if answered {
+		state.rtt.observe(rtt)
+		return
+	}
+	p.registerLoss(state)
+}
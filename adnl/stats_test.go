@@ -0,0 +1,143 @@
+package adnl
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"net/netip"
+	"testing"
+	"time"
+)
+
+func Test_rttStats(t *testing.T) {
+	var s rttStats
+	if s.timeout() != DefaultQueryTimeout || s.health() != 0 {
+		t.Fatal("without samples the default timeout and a zero health are expected")
+	}
+
+	s.observe(100 * time.Millisecond)
+	if s.srtt != 100*time.Millisecond || s.rttvar != 50*time.Millisecond {
+		t.Fatalf("unexpected first estimation srtt %s rttvar %s", s.srtt, s.rttvar)
+	}
+
+	s.observe(200 * time.Millisecond)
+	// rttvar = 3/4 * 50ms + 1/4 * |100ms - 200ms|, srtt = 7/8 * 100ms + 1/8 * 200ms
+	if s.rttvar != 62500*time.Microsecond || s.srtt != 112500*time.Microsecond {
+		t.Fatalf("unexpected estimation srtt %s rttvar %s", s.srtt, s.rttvar)
+	}
+
+	s.observe(900 * time.Millisecond)
+	// srtt + 4 * rttvar
+	if s.timeout() != s.srtt+4*s.rttvar || s.timeout() <= minQueryTimeout {
+		t.Fatalf("unexpected timeout %s", s.timeout())
+	}
+
+	healthy := s.health()
+	s.loss()
+	if s.lost != 1 || s.lossRate != lossWeight {
+		t.Fatalf("unexpected loss rate %f", s.lossRate)
+	}
+
+	if s.health() >= healthy {
+		t.Fatal("losses should lower the health score")
+	}
+
+	// timeouts are bounded
+	s.observe(time.Millisecond)
+	for range 20 {
+		s.observe(time.Millisecond)
+	}
+	if s.timeout() != minQueryTimeout {
+		t.Fatalf("expected min timeout got %s", s.timeout())
+	}
+
+	for range 20 {
+		s.observe(time.Minute)
+	}
+	if s.timeout() != DefaultQueryTimeout {
+		t.Fatalf("expected max timeout got %s", s.timeout())
+	}
+
+	// expired pings are lost
+	s.pings = map[int64]*pendingPing{1: {sent: time.Now().Add(-time.Hour)}}
+	lost := s.lost
+	s.expirePings(time.Now())
+	if len(s.pings) != 0 || s.lost != lost+1 {
+		t.Fatal("expired ping should be counted as lost")
+	}
+}
+
+func TestPeerStats(t *testing.T) {
+	a, _ := newTestPeer(t)
+	b, bAddr := newTestPeer(t)
+
+	for range 3 {
+		_, err := a.Ping(context.Background(), b.pubKey, bAddr)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// nothing answers on this address
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	_, err := a.Ping(ctx, b.pubKey, netip.MustParseAddrPort("127.0.0.1:1"))
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("expected deadline exceeded, got: %v", err)
+	}
+
+	var stats *PeerStats
+	for _, s := range a.Stats() {
+		if bytes.Equal(s.ID, b.id) {
+			stats = &s
+		}
+	}
+
+	if stats == nil {
+		t.Fatal("stats of b not found")
+	}
+
+	if stats.Samples != 3 || stats.Lost != 1 || stats.SRTT <= 0 {
+		t.Fatalf("unexpected stats %+v", stats)
+	}
+
+	if stats.Health <= 0 || stats.Health >= 1 {
+		t.Fatalf("unexpected health %f", stats.Health)
+	}
+
+	// loopback round trips are fast, the timeout is adapted to them
+	if stats.QueryTimeout != minQueryTimeout {
+		t.Fatalf("expected query timeout %s got %s", minQueryTimeout, stats.QueryTimeout)
+	}
+}
+
+func TestPeerPingRTT(t *testing.T) {
+	a, _ := newTestPeer(t)
+	b, bAddr := newTestPeer(t)
+
+	// the time waiting for the batching window isn't part of the round trip
+	window := 300 * time.Millisecond
+	a.SetBatching(Batching{Window: window, QueueSize: DefaultBatching().QueueSize})
+	rtt, err := a.Ping(context.Background(), b.pubKey, bAddr)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if rtt >= window {
+		t.Fatalf("expected round trip time without the batching window, got %s", rtt)
+	}
+
+	// canceled pings aren't lost
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(50*time.Millisecond, cancel)
+	_, err = a.Ping(ctx, b.pubKey, netip.MustParseAddrPort("127.0.0.1:1"))
+	if !errors.Is(err, context.Canceled) {
+		t.Fatalf("expected context canceled, got: %v", err)
+	}
+
+	for _, s := range a.Stats() {
+		if bytes.Equal(s.ID, b.id) && (s.Lost != 0 || s.Samples != 1) {
+			t.Fatalf("unexpected stats %+v", s)
+		}
+	}
+}
@@ -0,0 +1,383 @@
+package adnl
+
+import (
+	"bytes"
+	"cmp"
+	"crypto/ed25519"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/Gealber/dht/tl"
+)
+
+const (
+	// peersSaveInterval is the interval the peers which address list changed are saved at
+	peersSaveInterval = time.Minute
+	// defaultMaxRecords is the max amount of records kept by a FileStore
+	defaultMaxRecords = 10000
+)
+
+var ErrCorruptedStore = errors.New("corrupted peer store")
+
+// PeerRecord is a peer persisted in a PeerStore, in the adnl.db.node format.
+type PeerRecord struct {
+	Key   tl.AdnlDBNodeKey
+	Value tl.AdnlDBNodeValue
+}
+
+// PeerStore persists the peers known by a Peer, so they are known again after a restart.
+type PeerStore interface {
+	// Save stores records, replacing the ones stored with the same key.
+	Save(records []PeerRecord) error
+	// Load returns the records of the peers known by the peer with id localID.
+	Load(localID []byte) ([]PeerRecord, error)
+}
+
+// PeerInfo describes a peer known by us.
+type PeerInfo struct {
+	ID     []byte
+	PubKey ed25519.PublicKey
+	// Addr best known address of the peer, invalid in case we don't know any
+	Addr netip.AddrPort
+	// LastSeen date of the last packet received from the peer, zero in case we never received one
+	LastSeen time.Time
+}
+
+// SetPeerStore sets the store where known peers are persisted, loading the peers stored in it.
+// Peers advertising a new address list are saved periodically, and all of them when the peer
+// is closed.
+func (p *Peer) SetPeerStore(store PeerStore) error {
+	records, err := store.Load(p.id)
+	if err != nil {
+		return err
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.store = store
+	for _, record := range records {
+		pubKey := ed25519.PublicKey(record.Value.ID.Key)
+		peerID, err := p.computePeerID(pubKey)
+		if err != nil || !bytes.Equal(peerID[:], record.Key.PeerID) {
+			p.logger.Warn("ignoring stored peer with mismatching id", "remote_id", hex.EncodeToString(record.Key.PeerID))
+			continue
+		}
+
+		peerIDStr := hex.EncodeToString(peerID[:])
+		state := p.peerState(peerIDStr, pubKey)
+		state.lastSeen = max(state.lastSeen, record.Value.Date)
+		p.addrBook.restore(peerIDStr, record.Value.AddrList, record.Value.PriorityAddrList)
+	}
+
+	return nil
+}
+
+// KnownPeers returns the peers we know, either because we exchanged packets with them
+// or because they were loaded from the peer store.
+func (p *Peer) KnownPeers() []PeerInfo {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	peers := make([]PeerInfo, 0, len(p.peers))
+	for peerIDStr, state := range p.peers {
+		id, _ := hex.DecodeString(peerIDStr)
+		info := PeerInfo{
+			ID:     id,
+			PubKey: state.pubKey,
+		}
+
+		if state.lastSeen > 0 {
+			info.LastSeen = time.Unix(state.lastSeen, 0)
+		}
+
+		addr, err := p.addrBook.best(peerIDStr, time.Now(), func(netip.Addr) bool { return true })
+		if err == nil {
+			info.Addr = addr
+		}
+
+		peers = append(peers, info)
+	}
+
+	return peers
+}
+
+// markDirty marks the peer with id peerIDStr to be saved by the next flushPeers.
+func (p *Peer) markDirty(peerIDStr string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.store != nil {
+		p.dirty[peerIDStr] = struct{}{}
+	}
+}
+
+// flushPeers persists the peers marked as dirty since the last save.
+func (p *Peer) flushPeers() error {
+	p.mu.Lock()
+	peerIDStrs := make([]string, 0, len(p.dirty))
+	for peerIDStr := range p.dirty {
+		peerIDStrs = append(peerIDStrs, peerIDStr)
+	}
+	p.mu.Unlock()
+
+	if len(peerIDStrs) == 0 {
+		return nil
+	}
+
+	return p.savePeers(peerIDStrs...)
+}
+
+// savePeers persists the peers with ids peerIDStrs, all the known peers in case none is given.
+// Saved peers aren't dirty anymore.
+func (p *Peer) savePeers(peerIDStrs ...string) error {
+	p.mu.Lock()
+	store := p.store
+	if store == nil {
+		p.mu.Unlock()
+		return nil
+	}
+
+	if len(peerIDStrs) == 0 {
+		for peerIDStr := range p.peers {
+			peerIDStrs = append(peerIDStrs, peerIDStr)
+		}
+	}
+
+	for _, peerIDStr := range peerIDStrs {
+		delete(p.dirty, peerIDStr)
+	}
+
+	records := make([]PeerRecord, 0, len(peerIDStrs))
+	for _, peerIDStr := range peerIDStrs {
+		state, ok := p.peers[peerIDStr]
+		if !ok {
+			continue
+		}
+
+		peerID, err := hex.DecodeString(peerIDStr)
+		if err != nil {
+			continue
+		}
+
+		list, priority := p.addrBook.lists(peerIDStr)
+		records = append(records, PeerRecord{
+			Key: tl.AdnlDBNodeKey{LocalID: p.id, PeerID: peerID},
+			Value: tl.AdnlDBNodeValue{
+				Date:             state.lastSeen,
+				ID:               tl.PublicKeyED25519{Key: state.pubKey},
+				AddrList:         list,
+				PriorityAddrList: priority,
+			},
+		})
+	}
+	p.mu.Unlock()
+
+	if len(records) == 0 {
+		return nil
+	}
+
+	return store.Save(records)
+}
+
+// FileStore is a PeerStore that keeps the records in a file. Each record is
+// stored as its boxed key and value, both prefixed by their 4 bytes size. Once
+// the store is full the records of the peers seen least recently are dropped.
+type FileStore struct {
+	path string
+	tlH  *tl.TLHandler
+	// records indexed by serialized key, up to maxRecords
+	records    map[string]PeerRecord
+	maxRecords int
+	// mu protects records and the file
+	mu sync.Mutex
+}
+
+// NewFileStore returns a store persisting the records in the file at path,
+// the records already stored in the file are loaded.
+func NewFileStore(path string) (*FileStore, error) {
+	tlH := tl.New()
+	tlH.Register(tl.DefaultTLModel)
+
+	s := &FileStore{
+		path:       path,
+		tlH:        tlH,
+		records:    make(map[string]PeerRecord),
+		maxRecords: defaultMaxRecords,
+	}
+
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return s, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	err = s.decode(data)
+	if err != nil {
+		return nil, err
+	}
+
+	return s, nil
+}
+
+// Save stores records, rewriting the file with all the records.
+func (s *FileStore) Save(records []PeerRecord) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, record := range records {
+		key, err := s.tlH.Serialize(record.Key, true)
+		if err != nil {
+			return err
+		}
+
+		s.records[string(key)] = record
+	}
+	s.evict()
+
+	data, err := s.encode()
+	if err != nil {
+		return err
+	}
+
+	// replacing the file at once, a crash while writing doesn't corrupt the store
+	tmp, err := os.CreateTemp(filepath.Dir(s.path), filepath.Base(s.path)+".tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	_, err = tmp.Write(data)
+	if err == nil {
+		// the data must be on disk before the file replaces the previous one
+		err = tmp.Sync()
+	}
+	if err != nil {
+		tmp.Close()
+		return err
+	}
+
+	err = tmp.Close()
+	if err != nil {
+		return err
+	}
+
+	return os.Rename(tmp.Name(), s.path)
+}
+
+// Load returns the records of the peers known by the peer with id localID.
+func (s *FileStore) Load(localID []byte) ([]PeerRecord, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	records := make([]PeerRecord, 0)
+	for _, record := range s.records {
+		if bytes.Equal(record.Key.LocalID, localID) {
+			records = append(records, record)
+		}
+	}
+
+	return records, nil
+}
+
+// evict drops the records of the peers seen least recently until there are at most
+// maxRecords. Should be used with s.mu locked.
+func (s *FileStore) evict() {
+	if len(s.records) <= s.maxRecords {
+		return
+	}
+
+	keys := make([]string, 0, len(s.records))
+	for key := range s.records {
+		keys = append(keys, key)
+	}
+	slices.SortFunc(keys, func(a, b string) int {
+		return cmp.Compare(s.records[a].Value.Date, s.records[b].Value.Date)
+	})
+
+	for _, key := range keys[:len(keys)-s.maxRecords] {
+		delete(s.records, key)
+	}
+}
+
+// encode serializes all the records, sorted by key so the content of the file is deterministic.
+func (s *FileStore) encode() ([]byte, error) {
+	keys := make([]string, 0, len(s.records))
+	for key := range s.records {
+		keys = append(keys, key)
+	}
+	slices.Sort(keys)
+
+	var buff bytes.Buffer
+	for _, key := range keys {
+		value, err := s.tlH.Serialize(s.records[key].Value, true)
+		if err != nil {
+			return nil, err
+		}
+
+		for _, b := range [][]byte{[]byte(key), value} {
+			binary.Write(&buff, binary.LittleEndian, uint32(len(b)))
+			buff.Write(b)
+		}
+	}
+
+	return buff.Bytes(), nil
+}
+
+// decode parses the records stored in data.
+func (s *FileStore) decode(data []byte) error {
+	r := bytes.NewReader(data)
+	next := func() ([]byte, error) {
+		var size uint32
+		err := binary.Read(r, binary.LittleEndian, &size)
+		if err != nil {
+			return nil, err
+		}
+
+		if int(size) > r.Len() {
+			return nil, ErrCorruptedStore
+		}
+
+		b := make([]byte, size)
+		_, err = io.ReadFull(r, b)
+		return b, err
+	}
+
+	for r.Len() > 0 {
+		key, err := next()
+		if err != nil {
+			return fmt.Errorf("%w: %w", ErrCorruptedStore, err)
+		}
+
+		value, err := next()
+		if err != nil {
+			return fmt.Errorf("%w: %w", ErrCorruptedStore, err)
+		}
+
+		var record PeerRecord
+		err = s.tlH.Parse(key, &record.Key, true)
+		if err != nil {
+			return fmt.Errorf("%w: %w", ErrCorruptedStore, err)
+		}
+
+		err = s.tlH.Parse(value, &record.Value, true)
+		if err != nil {
+			return fmt.Errorf("%w: %w", ErrCorruptedStore, err)
+		}
+
+		s.records[string(key)] = record
+	}
+
+	return nil
+}
@@ -0,0 +1,257 @@
+package adnl
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/Gealber/dht/tl"
+)
+
+func TestFileStore(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "peers.db")
+	localID := bytes.Repeat([]byte{1}, 32)
+	record := func(peer byte, date int64) PeerRecord {
+		return PeerRecord{
+			Key: tl.AdnlDBNodeKey{LocalID: localID, PeerID: bytes.Repeat([]byte{peer}, 32)},
+			Value: tl.AdnlDBNodeValue{
+				Date: date,
+				ID:   tl.PublicKeyED25519{Key: bytes.Repeat([]byte{peer}, 32)},
+				AddrList: tl.AdnlAddressList{
+					Addresses:  []any{tl.AdnlAddressUDP{IP: 0x7F000001, Port: int32(peer)}},
+					Version:    date,
+					ReinitDate: date,
+				},
+				PriorityAddrList: tl.AdnlAddressList{Addresses: []any{}},
+			},
+		}
+	}
+
+	s, err := NewFileStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = s.Save([]PeerRecord{record(2, 10), record(3, 10)})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// same key replaces the stored record
+	err = s.Save([]PeerRecord{record(2, 20)})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	reopened, err := NewFileStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	records, err := reopened.Load(localID)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(records) != 2 {
+		t.Fatalf("expected 2 records got %d", len(records))
+	}
+
+	for _, r := range records {
+		expected := record(r.Key.PeerID[0], 10)
+		if r.Key.PeerID[0] == 2 {
+			expected = record(2, 20)
+		}
+
+		if r.Value.Date != expected.Value.Date || r.Value.AddrList.Addresses[0] != expected.Value.AddrList.Addresses[0] {
+			t.Fatalf("unexpected record %+v", r)
+		}
+	}
+
+	records, err = reopened.Load(bytes.Repeat([]byte{9}, 32))
+	if err != nil || len(records) != 0 {
+		t.Fatalf("expected no records for another local id, got %d err: %v", len(records), err)
+	}
+
+	// once full, the records of the peers seen least recently are dropped
+	reopened.maxRecords = 2
+	err = reopened.Save([]PeerRecord{record(4, 15)})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	records, err = reopened.Load(localID)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(records) != 2 {
+		t.Fatalf("expected 2 records got %d", len(records))
+	}
+
+	for _, r := range records {
+		if r.Key.PeerID[0] == 3 {
+			t.Fatal("expected the record seen least recently to be dropped")
+		}
+	}
+
+	err = os.WriteFile(path, []byte{1, 2, 3}, 0o600)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = NewFileStore(path)
+	if !errors.Is(err, ErrCorruptedStore) {
+		t.Fatalf("expected corrupted store error, got: %v", err)
+	}
+}
+
+func TestPeerStoreRestart(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "peers.db")
+
+	a, aAddr := newTestPeer(t)
+	b, bAddr := newTestPeer(t)
+
+	store, err := NewFileStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = b.SetPeerStore(store)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = a.SetAddressList(aAddr)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = a.SendMessage(context.Background(), b.pubKey, bAddr, tl.AdnlMessageNop{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	waitFor(t, 2*time.Second, func() bool {
+		_, err := b.Address(a.id)
+		return err == nil
+	})
+
+	err = b.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// same identity started again, a is known through the store
+	restarted, err := New(b.privKey, b.pubKey, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	store, err = NewFileStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = restarted.SetPeerStore(store)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	peers := restarted.KnownPeers()
+	if len(peers) != 1 {
+		t.Fatalf("expected 1 known peer got %d", len(peers))
+	}
+
+	if !bytes.Equal(peers[0].ID, a.id) || !bytes.Equal(peers[0].PubKey, a.pubKey) {
+		t.Fatal("known peer should be a")
+	}
+
+	if peers[0].Addr != aAddr {
+		t.Fatalf("expected address %s got %s", aAddr, peers[0].Addr)
+	}
+
+	if peers[0].LastSeen.IsZero() {
+		t.Fatal("last seen date should be restored")
+	}
+}
+
+// countingStore is a PeerStore counting the records saved.
+type countingStore struct {
+	mu    sync.Mutex
+	saved int
+}
+
+func (s *countingStore) Save(records []PeerRecord) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.saved += len(records)
+	return nil
+}
+
+func (s *countingStore) Load(localID []byte) ([]PeerRecord, error) {
+	return nil, nil
+}
+
+func (s *countingStore) count() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.saved
+}
+
+func TestPeerStoreDirty(t *testing.T) {
+	a, aAddr := newTestPeer(t)
+	b, bAddr := newTestPeer(t)
+
+	store := &countingStore{}
+	err := b.SetPeerStore(store)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = a.SetAddressList(aAddr)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = a.SendMessage(context.Background(), b.pubKey, bAddr, tl.AdnlMessageNop{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	waitFor(t, 2*time.Second, func() bool {
+		_, err := b.Address(a.id)
+		return err == nil
+	})
+
+	// new address lists aren't saved while receiving the packets
+	if n := store.count(); n != 0 {
+		t.Fatalf("expected no saved records got %d", n)
+	}
+
+	err = b.flushPeers()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if n := store.count(); n != 1 {
+		t.Fatalf("expected 1 saved record got %d", n)
+	}
+
+	// peers aren't saved again until their address list changes
+	err = b.flushPeers()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if n := store.count(); n != 1 {
+		t.Fatalf("expected 1 saved record got %d", n)
+	}
+}
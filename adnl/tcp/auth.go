@@ -0,0 +1,93 @@
+package tcp
+
+import (
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"errors"
+
+	"github.com/Gealber/dht/tl"
+)
+
+// authNonceSize size of the nonces chosen by each side for the authentication
+const authNonceSize = 32
+
+// Authenticate proves to the server that we own privKey, the server can identify us by its
+// public key from now on. Both sides choose a nonce, and we sign them with privKey.
+func (c *Conn) Authenticate(ctx context.Context, privKey ed25519.PrivateKey) error {
+	if len(privKey) != ed25519.PrivateKeySize {
+		return ErrInvalidKey
+	}
+
+	clientNonce := make([]byte, authNonceSize)
+	_, err := rand.Read(clientNonce)
+	if err != nil {
+		return err
+	}
+
+	err = c.send(tl.TCPAuthentificate{Nonce: clientNonce})
+	if err != nil {
+		return err
+	}
+
+	var serverNonce []byte
+	select {
+	case serverNonce = <-c.authNonces:
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-c.closer:
+		return ErrClosed
+	}
+
+	signature := ed25519.Sign(privKey, append(clientNonce, serverNonce...))
+
+	return c.send(tl.TCPAuthentificationComplete{
+		Key:       tl.PublicKeyED25519{Key: privKey.Public().(ed25519.PublicKey)},
+		Signature: signature,
+	})
+}
+
+// handleAuthentificate answers the client starting its authentication with our nonce.
+func (c *Conn) handleAuthentificate(msg tl.TCPAuthentificate) error {
+	if !c.server {
+		return errors.New("authentication requested by the server")
+	}
+
+	if len(msg.Nonce) == 0 || len(msg.Nonce) > authNonceSize {
+		return ErrAuthFailed
+	}
+
+	serverNonce := make([]byte, authNonceSize)
+	_, err := rand.Read(serverNonce)
+	if err != nil {
+		return err
+	}
+
+	c.mu.Lock()
+	c.authNonce = append(append([]byte{}, msg.Nonce...), serverNonce...)
+	c.mu.Unlock()
+
+	return c.send(tl.TCPAuthentificationNonce{Nonce: serverNonce})
+}
+
+// handleAuthentificationComplete verifies the signature of the client over both nonces.
+func (c *Conn) handleAuthentificationComplete(msg tl.TCPAuthentificationComplete) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	nonce := c.authNonce
+	// a nonce is never used twice
+	c.authNonce = nil
+
+	if !c.server || nonce == nil {
+		return ErrAuthFailed
+	}
+
+	if len(msg.Key.Key) != ed25519.PublicKeySize || !ed25519.Verify(msg.Key.Key, nonce, msg.Signature) {
+		return ErrAuthFailed
+	}
+
+	c.remoteKey = ed25519.PublicKey(msg.Key.Key)
+
+	return nil
+}
@@ -0,0 +1,440 @@
+// Package tcp implements the TCP variant of the ADNL protocol, used by liteservers.
+// Read doc/adnl/adnl-tcp.md for more details.
+package tcp
+
+import (
+	"bytes"
+	"context"
+	"crypto/cipher"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/Gealber/dht/tl"
+	"github.com/Gealber/dht/utils"
+)
+
+const (
+	// DefaultQueryTimeout is the time we wait for an answer when the context
+	// used for the query doesn't have a deadline.
+	DefaultQueryTimeout = 5 * time.Second
+	// PingInterval is the interval between the tcp.ping sent by clients for keeping the connection alive
+	PingInterval = 5 * time.Second
+
+	// maxFrameSize is the max size of a frame, including its nonce and checksum
+	maxFrameSize = 1 << 24
+	// frameOverhead size of the nonce and the checksum included in every frame
+	frameOverhead = 64
+)
+
+var (
+	ErrClosed           = errors.New("adnl tcp connection closed")
+	ErrFrameSize        = errors.New("invalid adnl tcp frame size")
+	ErrFrameChecksum    = errors.New("adnl tcp frame checksum validation failed")
+	ErrUnexpectedAnswer = errors.New("answer received for an unknown query")
+	ErrAuthFailed       = errors.New("adnl tcp client authentication failed")
+)
+
+// QueryHandler answers a query received through the connection c. Query and answer are
+// serialized TL objects. In case an error is returned no answer is sent back.
+type QueryHandler func(c *Conn, query []byte) ([]byte, error)
+
+// Conn is an ADNL connection over TCP, once the handshake is done both sides
+// exchange frames encrypted with AES-CTR, each one carrying a TL object.
+type Conn struct {
+	conn   net.Conn
+	tlH    *tl.TLHandler
+	logger *slog.Logger
+
+	// rx decrypts incomming data and tx encrypts outgoing data, both are streams so frames
+	// must be read and written in order
+	rx cipher.Stream
+	tx cipher.Stream
+	// writeMu serializes the frames written
+	writeMu sync.Mutex
+
+	// handler answers the queries received, nil in client connections
+	handler QueryHandler
+	// server tells if we are the server side of the connection
+	server bool
+
+	// queries waiting for an answer, indexed by query id
+	queries map[string]chan []byte
+	// pings waiting for a pong, indexed by random id
+	pings map[int64]chan struct{}
+	// authNonce both nonces of the authentication in progress, the one chosen by the client
+	// followed by the one chosen by the server
+	authNonce []byte
+	// authNonces delivers the nonce chosen by the server to the client authenticating
+	authNonces chan []byte
+	// remoteKey key of the client, once it's authenticated
+	remoteKey ed25519.PublicKey
+	// mu protects logger, queries, pings, authNonce and remoteKey
+	mu sync.Mutex
+
+	// closer is closed when the connection is closed
+	closer    chan struct{}
+	closeOnce sync.Once
+}
+
+// newConn wraps conn, rxKey and rxIV are used for decrypting incomming data, txKey and txIV
+// for encrypting outgoing data.
+func newConn(conn net.Conn, rxKey, rxIV, txKey, txIV []byte) (*Conn, error) {
+	rx, err := utils.NewCipherCtr(rxKey, rxIV)
+	if err != nil {
+		return nil, err
+	}
+
+	tx, err := utils.NewCipherCtr(txKey, txIV)
+	if err != nil {
+		return nil, err
+	}
+
+	tlH := tl.New()
+	tlH.Register(tl.DefaultTLModel)
+
+	return &Conn{
+		conn:       conn,
+		tlH:        tlH,
+		logger:     utils.ComponentLogger(utils.NewLogger(), "adnl-tcp").With("addr", conn.RemoteAddr()),
+		rx:         rx,
+		tx:         tx,
+		queries:    make(map[string]chan []byte),
+		pings:      make(map[int64]chan struct{}),
+		authNonces: make(chan []byte, 1),
+		closer:     make(chan struct{}),
+	}, nil
+}
+
+// SetLogger sets the logger of the connection, its records include the component and the
+// address of the other side.
+func (c *Conn) SetLogger(logger *slog.Logger) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.logger = utils.ComponentLogger(logger, "adnl-tcp").With("addr", c.conn.RemoteAddr())
+}
+
+// log returns the logger of the connection.
+func (c *Conn) log() *slog.Logger {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.logger
+}
+
+// RemoteAddr returns the address of the other side of the connection.
+func (c *Conn) RemoteAddr() net.Addr {
+	return c.conn.RemoteAddr()
+}
+
+// RemoteKey returns the public key of the client in server side connections, once the
+// client is authenticated. Otherwise nil is returned.
+func (c *Conn) RemoteKey() ed25519.PublicKey {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.remoteKey
+}
+
+// Close closes the connection, pending queries and pings fail with ErrClosed.
+func (c *Conn) Close() error {
+	var err error
+	c.closeOnce.Do(func() {
+		close(c.closer)
+		err = c.conn.Close()
+	})
+
+	return err
+}
+
+// Done returns a channel that's closed when the connection is closed.
+func (c *Conn) Done() <-chan struct{} {
+	return c.closer
+}
+
+// writeFrame encrypts and writes payload as a single frame:
+// | SIZE (4 bytes) | NONCE (32 bytes) | PAYLOAD | SHA256 OF NONCE AND PAYLOAD |
+func (c *Conn) writeFrame(payload []byte) error {
+	if len(payload)+frameOverhead > maxFrameSize {
+		return ErrFrameSize
+	}
+
+	frame := make([]byte, 4+frameOverhead+len(payload))
+	binary.LittleEndian.PutUint32(frame, uint32(frameOverhead+len(payload)))
+
+	nonce := frame[4:36]
+	_, err := rand.Read(nonce)
+	if err != nil {
+		return err
+	}
+	copy(frame[36:], payload)
+
+	checksum := sha256.Sum256(frame[4 : 36+len(payload)])
+	copy(frame[36+len(payload):], checksum[:])
+
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+
+	c.tx.XORKeyStream(frame, frame)
+	_, err = c.conn.Write(frame)
+
+	return err
+}
+
+// readFrame reads and decrypts the next frame, returning its payload.
+func (c *Conn) readFrame() ([]byte, error) {
+	sizeBuff := make([]byte, 4)
+	_, err := io.ReadFull(c.conn, sizeBuff)
+	if err != nil {
+		return nil, err
+	}
+	c.rx.XORKeyStream(sizeBuff, sizeBuff)
+
+	size := binary.LittleEndian.Uint32(sizeBuff)
+	if size < frameOverhead || size > maxFrameSize {
+		return nil, fmt.Errorf("%w: %d", ErrFrameSize, size)
+	}
+
+	data := make([]byte, size)
+	_, err = io.ReadFull(c.conn, data)
+	if err != nil {
+		return nil, err
+	}
+	c.rx.XORKeyStream(data, data)
+
+	checksum := sha256.Sum256(data[:size-32])
+	if !bytes.Equal(checksum[:], data[size-32:]) {
+		return nil, ErrFrameChecksum
+	}
+
+	return data[32 : size-32], nil
+}
+
+// send writes msg boxed in a single frame.
+func (c *Conn) send(msg any) error {
+	data, err := c.tlH.Serialize(msg, true)
+	if err != nil {
+		return err
+	}
+
+	return c.writeFrame(data)
+}
+
+// readLoop reads frames until the connection is closed, handling the messages they carry.
+func (c *Conn) readLoop() {
+	defer c.Close()
+
+	for {
+		payload, err := c.readFrame()
+		if err != nil {
+			select {
+			case <-c.closer:
+			default:
+				if !errors.Is(err, io.EOF) {
+					c.log().Warn("failed reading frame", "err", err)
+				}
+			}
+			return
+		}
+
+		// empty frames are used for confirming the handshake
+		if len(payload) == 0 {
+			continue
+		}
+
+		msg, err := c.tlH.ParseBoxed(payload)
+		if err != nil {
+			c.log().Debug("failed parsing message", "err", err)
+			continue
+		}
+
+		err = c.handleMessage(msg)
+		if errors.Is(err, ErrAuthFailed) {
+			c.log().Info("closing connection", "err", err)
+			return
+		}
+
+		if err != nil {
+			c.log().Debug("failed handling message", "err", err)
+		}
+	}
+}
+
+func (c *Conn) handleMessage(msg any) error {
+	switch m := msg.(type) {
+	case tl.AdnlMessageQuery:
+		if c.handler == nil {
+			return errors.New("no query handler registered")
+		}
+
+		// queries are answered concurrently, a slow query doesn't block the connection
+		go func() {
+			answer, err := c.handler(c, m.Query)
+			if err != nil {
+				c.log().Debug("failed answering query", "query_id", hex.EncodeToString(m.QueryID), "err", err)
+				return
+			}
+
+			err = c.send(tl.AdnlMessageAnswer{QueryID: m.QueryID, Answer: answer})
+			if err != nil {
+				c.log().Warn("failed sending answer", "query_id", hex.EncodeToString(m.QueryID), "err", err)
+			}
+		}()
+
+		return nil
+	case tl.AdnlMessageAnswer:
+		queryIDStr := hex.EncodeToString(m.QueryID)
+
+		c.mu.Lock()
+		answerChn, ok := c.queries[queryIDStr]
+		delete(c.queries, queryIDStr)
+		c.mu.Unlock()
+
+		if !ok {
+			return ErrUnexpectedAnswer
+		}
+
+		answerChn <- m.Answer
+		return nil
+	case tl.TCPPing:
+		return c.send(tl.TCPPong{RandomID: m.RandomID})
+	case tl.TCPPong:
+		c.mu.Lock()
+		pongChn, ok := c.pings[m.RandomID]
+		delete(c.pings, m.RandomID)
+		c.mu.Unlock()
+
+		if ok {
+			close(pongChn)
+		}
+		return nil
+	case tl.TCPAuthentificate:
+		return c.handleAuthentificate(m)
+	case tl.TCPAuthentificationNonce:
+		select {
+		case c.authNonces <- m.Nonce:
+		default:
+			// nobody is waiting for it
+		}
+		return nil
+	case tl.TCPAuthentificationComplete:
+		return c.handleAuthentificationComplete(m)
+	default:
+		return fmt.Errorf("unsupported message type: %T", msg)
+	}
+}
+
+// Query sends query through the connection and waits for its answer. The query is
+// canceled once ctx is done, in case ctx doesn't have a deadline DefaultQueryTimeout is used.
+func (c *Conn) Query(ctx context.Context, query []byte) ([]byte, error) {
+	if _, ok := ctx.Deadline(); !ok {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, DefaultQueryTimeout)
+		defer cancel()
+	}
+
+	queryID := make([]byte, 32)
+	_, err := rand.Read(queryID)
+	if err != nil {
+		return nil, err
+	}
+	queryIDStr := hex.EncodeToString(queryID)
+
+	// buffered, answers are delivered without waiting for us
+	answerChn := make(chan []byte, 1)
+	c.mu.Lock()
+	c.queries[queryIDStr] = answerChn
+	c.mu.Unlock()
+
+	defer func() {
+		c.mu.Lock()
+		delete(c.queries, queryIDStr)
+		c.mu.Unlock()
+	}()
+
+	err = c.send(tl.AdnlMessageQuery{QueryID: queryID, Query: query})
+	if err != nil {
+		return nil, err
+	}
+
+	select {
+	case answer := <-answerChn:
+		return answer, nil
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	case <-c.closer:
+		return nil, ErrClosed
+	}
+}
+
+// Ping sends a tcp.ping and waits for its tcp.pong, returning the round trip time.
+func (c *Conn) Ping(ctx context.Context) (time.Duration, error) {
+	buff := make([]byte, 8)
+	_, err := rand.Read(buff)
+	if err != nil {
+		return 0, err
+	}
+	randomID := int64(binary.LittleEndian.Uint64(buff))
+
+	pongChn := make(chan struct{})
+	c.mu.Lock()
+	c.pings[randomID] = pongChn
+	c.mu.Unlock()
+
+	defer func() {
+		c.mu.Lock()
+		delete(c.pings, randomID)
+		c.mu.Unlock()
+	}()
+
+	start := time.Now()
+	err = c.send(tl.TCPPing{RandomID: randomID})
+	if err != nil {
+		return 0, err
+	}
+
+	select {
+	case <-pongChn:
+		return time.Since(start), nil
+	case <-ctx.Done():
+		return 0, ctx.Err()
+	case <-c.closer:
+		return 0, ErrClosed
+	}
+}
+
+// keepalive pings the server every PingInterval, the connection is closed
+// once a pong doesn't arrive before the next ping is due.
+func (c *Conn) keepalive() {
+	ticker := time.NewTicker(PingInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-c.closer:
+			return
+		case <-ticker.C:
+		}
+
+		ctx, cancel := context.WithTimeout(context.Background(), PingInterval)
+		_, err := c.Ping(ctx)
+		cancel()
+		if err != nil {
+			if !errors.Is(err, ErrClosed) {
+				c.log().Info("closing connection, ping failed", "err", err)
+			}
+			c.Close()
+			return
+		}
+	}
+}
@@ -0,0 +1,226 @@
+package tcp
+
+import (
+	"bytes"
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"errors"
+	"net"
+	"testing"
+	"time"
+)
+
+// newTestServer starts a server listening on a random loopback port, answering queries
+// with handler. The server is shut down once the test finishes.
+func newTestServer(t *testing.T, handler QueryHandler) (*Server, string, ed25519.PublicKey) {
+	t.Helper()
+
+	pub, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s, err := NewServer(priv)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.SetQueryHandler(handler)
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	errChn := make(chan error, 1)
+	go func() {
+		errChn <- s.Serve(ctx, ln)
+	}()
+
+	t.Cleanup(func() {
+		cancel()
+		if err := <-errChn; err != nil {
+			t.Errorf("serve returned error: %s", err)
+		}
+	})
+
+	return s, ln.Addr().String(), pub
+}
+
+func echo(c *Conn, query []byte) ([]byte, error) {
+	return query, nil
+}
+
+func TestDialQuery(t *testing.T) {
+	_, addr, serverKey := newTestServer(t, echo)
+
+	ctx := context.Background()
+	c, err := Dial(ctx, addr, serverKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	for _, size := range []int{1, 1024, 1 << 20} {
+		query := make([]byte, size)
+		rand.Read(query)
+
+		answer, err := c.Query(ctx, query)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if !bytes.Equal(answer, query) {
+			t.Fatalf("unexpected answer for query of size %d", size)
+		}
+	}
+
+	_, err = c.Ping(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestDialUnknownKey(t *testing.T) {
+	_, addr, _ := newTestServer(t, echo)
+
+	otherKey, _, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+
+	_, err = Dial(ctx, addr, otherKey)
+	if err == nil {
+		t.Fatal("handshake for an unknown key should fail")
+	}
+}
+
+func TestAuthenticate(t *testing.T) {
+	// the server answers with the key of the client
+	_, addr, serverKey := newTestServer(t, func(c *Conn, query []byte) ([]byte, error) {
+		return c.RemoteKey(), nil
+	})
+
+	clientPub, clientPriv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx := context.Background()
+	c, err := Dial(ctx, addr, serverKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	answer, err := c.Query(ctx, []byte{1})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(answer) != 0 {
+		t.Fatal("client shouldn't be authenticated yet")
+	}
+
+	err = c.Authenticate(ctx, clientPriv)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// frames are handled in order, the authentication is completed before the query arrives
+	answer, err = c.Query(ctx, []byte{1})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !bytes.Equal(answer, clientPub) {
+		t.Fatal("client should be authenticated with its key")
+	}
+}
+
+func TestServerClose(t *testing.T) {
+	s, addr, serverKey := newTestServer(t, echo)
+
+	c, err := Dial(context.Background(), addr, serverKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	err = s.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case <-c.Done():
+	case <-time.After(time.Second):
+		t.Fatal("connection should be closed once the server is closed")
+	}
+
+	_, err = c.Query(context.Background(), []byte{1})
+	if err == nil {
+		t.Fatal("query through a closed connection should fail")
+	}
+}
+
+func Test_readFrame(t *testing.T) {
+	key, iv := make([]byte, 32), make([]byte, 16)
+	rand.Read(key)
+	rand.Read(iv)
+
+	a, b := net.Pipe()
+	defer a.Close()
+	defer b.Close()
+
+	writer, err := newConn(a, key, iv, key, iv)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	reader, err := newConn(b, key, iv, key, iv)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	go func() {
+		writer.writeFrame([]byte("first"))
+		writer.writeFrame(nil)
+	}()
+
+	payload, err := reader.readFrame()
+	if err != nil || string(payload) != "first" {
+		t.Fatalf("unexpected frame %q err: %v", payload, err)
+	}
+
+	payload, err = reader.readFrame()
+	if err != nil || len(payload) != 0 {
+		t.Fatalf("expected empty frame got %q err: %v", payload, err)
+	}
+
+	// tampering a byte of the encrypted frame
+	go func() {
+		tampered := &tamperConn{Conn: a}
+		writer.conn = tampered
+		writer.writeFrame([]byte("second"))
+	}()
+
+	_, err = reader.readFrame()
+	if !errors.Is(err, ErrFrameChecksum) {
+		t.Fatalf("expected checksum error, got: %v", err)
+	}
+}
+
+// tamperConn flips the last byte of every write.
+type tamperConn struct {
+	net.Conn
+}
+
+func (c *tamperConn) Write(b []byte) (int, error) {
+	b[len(b)-1] ^= 1
+	return c.Conn.Write(b)
+}
@@ -0,0 +1,170 @@
+package tcp
+
+import (
+	"bytes"
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/sha256"
+	"errors"
+	"io"
+	"net"
+	"time"
+
+	"github.com/Gealber/dht/utils"
+)
+
+const (
+	// handshakeSize size of the handshake packet sent by the client
+	handshakeSize = 256
+	// handshakeTimeout is the time we wait for the handshake to finish
+	handshakeTimeout = 5 * time.Second
+)
+
+var (
+	ErrInvalidKey       = errors.New("invalid ed25519 public key size")
+	ErrUnknownServerKey = errors.New("handshake for an unknown server key")
+	ErrInvalidHandshake = errors.New("invalid adnl tcp handshake")
+)
+
+// Dial connects to the ADNL server with public key serverKey listening on addr. The
+// connection is kept alive with a tcp.ping every PingInterval, until it's closed.
+func Dial(ctx context.Context, addr string, serverKey ed25519.PublicKey) (*Conn, error) {
+	if len(serverKey) != ed25519.PublicKeySize {
+		return nil, ErrInvalidKey
+	}
+
+	var d net.Dialer
+	nc, err := d.DialContext(ctx, "tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+
+	c, err := clientHandshake(ctx, nc, serverKey)
+	if err != nil {
+		nc.Close()
+		return nil, err
+	}
+
+	go c.readLoop()
+	go c.keepalive()
+
+	return c, nil
+}
+
+// clientHandshake sends the handshake packet, which shares with the server the random
+// nonce used for deriving the keys of the connection ciphers:
+// | SERVER KEY ID | OUR TEMPORARY PUB KEY | SHA256 OF NONCE | ENCRYPTED NONCE (160 bytes) |
+// The nonce is encrypted with the secret shared between the server key and our temporary key.
+func clientHandshake(ctx context.Context, nc net.Conn, serverKey ed25519.PublicKey) (*Conn, error) {
+	nonce := make([]byte, 160)
+	_, err := rand.Read(nonce)
+	if err != nil {
+		return nil, err
+	}
+
+	ourPub, ourKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+
+	sharedSecret, err := utils.GenerateSharedKey(ourKey, serverKey)
+	if err != nil {
+		return nil, err
+	}
+
+	checksum := sha256.Sum256(nonce)
+	cipher, err := utils.BuildSharedCipher(sharedSecret, checksum[:])
+	if err != nil {
+		return nil, err
+	}
+
+	serverID, err := utils.KeyIDEd25519(serverKey)
+	if err != nil {
+		return nil, err
+	}
+
+	packet := make([]byte, handshakeSize)
+	copy(packet, serverID)
+	copy(packet[32:], ourPub)
+	copy(packet[64:], checksum[:])
+	cipher.XORKeyStream(packet[96:], nonce)
+
+	// the server uses the same keys, swapping the ones for reading and writing
+	c, err := newConn(nc, nonce[0:32], nonce[64:80], nonce[32:64], nonce[80:96])
+	if err != nil {
+		return nil, err
+	}
+
+	deadline, ok := ctx.Deadline()
+	if !ok {
+		deadline = time.Now().Add(handshakeTimeout)
+	}
+	nc.SetDeadline(deadline)
+	defer nc.SetDeadline(time.Time{})
+
+	_, err = nc.Write(packet)
+	if err != nil {
+		return nil, err
+	}
+
+	// the server confirms the handshake with an empty frame
+	payload, err := c.readFrame()
+	if err != nil {
+		return nil, err
+	}
+
+	if len(payload) != 0 {
+		return nil, ErrInvalidHandshake
+	}
+
+	return c, nil
+}
+
+// serverHandshake reads the handshake packet sent by the client, the connection is
+// confirmed to the client with an empty frame.
+func serverHandshake(nc net.Conn, privKey ed25519.PrivateKey, id []byte) (*Conn, error) {
+	nc.SetDeadline(time.Now().Add(handshakeTimeout))
+	defer nc.SetDeadline(time.Time{})
+
+	packet := make([]byte, handshakeSize)
+	_, err := io.ReadFull(nc, packet)
+	if err != nil {
+		return nil, err
+	}
+
+	if !bytes.Equal(packet[:32], id) {
+		return nil, ErrUnknownServerKey
+	}
+
+	sharedSecret, err := utils.GenerateSharedKey(privKey, packet[32:64])
+	if err != nil {
+		return nil, err
+	}
+
+	checksum := packet[64:96]
+	cipher, err := utils.BuildSharedCipher(sharedSecret, checksum)
+	if err != nil {
+		return nil, err
+	}
+
+	nonce := packet[96:]
+	cipher.XORKeyStream(nonce, nonce)
+	localChecksum := sha256.Sum256(nonce)
+	if !bytes.Equal(localChecksum[:], checksum) {
+		return nil, ErrInvalidHandshake
+	}
+
+	c, err := newConn(nc, nonce[32:64], nonce[80:96], nonce[0:32], nonce[64:80])
+	if err != nil {
+		return nil, err
+	}
+	c.server = true
+
+	err = c.writeFrame(nil)
+	if err != nil {
+		return nil, err
+	}
+
+	return c, nil
+}
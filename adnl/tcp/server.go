@@ -0,0 +1,192 @@
+package tcp
+
+import (
+	"context"
+	"crypto/ed25519"
+	"encoding/hex"
+	"errors"
+	"log/slog"
+	"net"
+	"sync"
+
+	"github.com/Gealber/dht/utils"
+)
+
+var (
+	ErrServerClosed   = errors.New("adnl tcp server closed")
+	ErrAlreadyServing = errors.New("adnl tcp server is already serving a listener")
+)
+
+// Server accepts ADNL connections over TCP addressed to its key, answering the
+// queries received through them with the registered query handler.
+type Server struct {
+	privKey ed25519.PrivateKey
+	// id of the server key, clients include it in the handshake
+	id     []byte
+	logger *slog.Logger
+
+	handler QueryHandler
+	ln      net.Listener
+	// conns accepted and not closed yet
+	conns map[*Conn]struct{}
+	// mu protects handler, ln and conns
+	mu sync.Mutex
+
+	// closer is closed when the server is shut down
+	closer    chan struct{}
+	closeOnce sync.Once
+}
+
+// NewServer creates a server for the key privKey.
+func NewServer(privKey ed25519.PrivateKey) (*Server, error) {
+	if len(privKey) != ed25519.PrivateKeySize {
+		return nil, ErrInvalidKey
+	}
+
+	id, err := utils.KeyIDEd25519(privKey.Public().(ed25519.PublicKey))
+	if err != nil {
+		return nil, err
+	}
+
+	s := &Server{
+		privKey: privKey,
+		id:      id,
+		conns:   make(map[*Conn]struct{}),
+		closer:  make(chan struct{}),
+	}
+	s.SetLogger(utils.NewLogger())
+
+	return s, nil
+}
+
+// SetLogger sets the logger of the server, its records include the component and the id of the
+// server key. The connections accepted use it as well. It should be called before the server
+// starts serving.
+func (s *Server) SetLogger(logger *slog.Logger) {
+	s.logger = utils.ComponentLogger(logger, "adnl-tcp-server").With("server_id", hex.EncodeToString(s.id))
+}
+
+// SetQueryHandler sets the handler used for answering the queries received by the server.
+func (s *Server) SetQueryHandler(handler QueryHandler) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.handler = handler
+}
+
+// Listen opens a TCP socket on addr and serves incomming connections
+// until ctx is done or the server is closed.
+func (s *Server) Listen(ctx context.Context, addr string) error {
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+
+	return s.Serve(ctx, ln)
+}
+
+// Serve accepts connections from ln, performing the handshake and serving each of them in
+// its own goroutine. Serve takes ownership of ln, which is closed once ctx is done or the
+// server is closed, together with all the connections accepted.
+func (s *Server) Serve(ctx context.Context, ln net.Listener) error {
+	s.mu.Lock()
+	select {
+	case <-s.closer:
+		s.mu.Unlock()
+		ln.Close()
+		return ErrServerClosed
+	default:
+	}
+	if s.ln != nil {
+		s.mu.Unlock()
+		return ErrAlreadyServing
+	}
+	s.ln = ln
+	s.mu.Unlock()
+
+	go func() {
+		select {
+		case <-ctx.Done():
+			s.Close()
+		case <-s.closer:
+		}
+	}()
+
+	for {
+		nc, err := ln.Accept()
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return nil
+			}
+
+			return err
+		}
+
+		go s.serveConn(nc)
+	}
+}
+
+// Addr returns the address the server is listening on, nil if it's not listening yet.
+func (s *Server) Addr() net.Addr {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.ln == nil {
+		return nil
+	}
+
+	return s.ln.Addr()
+}
+
+// Close shuts down the server, closing the listener and all the connections accepted.
+func (s *Server) Close() error {
+	var err error
+	s.closeOnce.Do(func() {
+		close(s.closer)
+
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		if s.ln != nil {
+			err = s.ln.Close()
+			if errors.Is(err, net.ErrClosed) {
+				err = nil
+			}
+		}
+
+		for c := range s.conns {
+			c.Close()
+		}
+	})
+
+	return err
+}
+
+// serveConn performs the handshake with the client connected through nc, and reads its frames.
+func (s *Server) serveConn(nc net.Conn) {
+	c, err := serverHandshake(nc, s.privKey, s.id)
+	if err != nil {
+		s.logger.Debug("failed handshake", "addr", nc.RemoteAddr(), "err", err)
+		nc.Close()
+		return
+	}
+
+	s.mu.Lock()
+	select {
+	case <-s.closer:
+		s.mu.Unlock()
+		c.Close()
+		return
+	default:
+	}
+	c.handler = s.handler
+	s.conns[c] = struct{}{}
+	c.mu.Lock()
+	c.logger = s.logger.With("addr", nc.RemoteAddr())
+	c.mu.Unlock()
+	s.mu.Unlock()
+
+	c.readLoop()
+
+	s.mu.Lock()
+	delete(s.conns, c)
+	s.mu.Unlock()
+}
@@ -0,0 +1,65 @@
+package adnl
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/netip"
+)
+
+var ErrUnexpectedAddress = errors.New("datagram from unexpected address")
+
+// Transport sends and receives the datagrams of a peer. Implementations must be safe for
+// concurrent use, and ReadFrom must return an error wrapping net.ErrClosed once Close is called.
+// Read adnl/memnet for an in-memory implementation.
+type Transport interface {
+	// ReadFrom reads a datagram into b, returning its size and the address it comes from.
+	// An error wrapping ErrUnexpectedAddress only drops that datagram.
+	ReadFrom(b []byte) (int, netip.AddrPort, error)
+	// WriteTo writes b as a single datagram to addr.
+	WriteTo(b []byte, addr netip.AddrPort) (int, error)
+	// LocalAddr returns the address the transport is listening on.
+	LocalAddr() netip.AddrPort
+	Close() error
+}
+
+// udpTransport is a Transport over a net.PacketConn, usually an UDP socket.
+type udpTransport struct {
+	conn net.PacketConn
+}
+
+// NewUDPTransport returns a Transport sending and receiving the datagrams through conn.
+func NewUDPTransport(conn net.PacketConn) Transport {
+	return &udpTransport{conn: conn}
+}
+
+func (t *udpTransport) ReadFrom(b []byte) (int, netip.AddrPort, error) {
+	n, addr, err := t.conn.ReadFrom(b)
+	if err != nil {
+		return 0, netip.AddrPort{}, err
+	}
+
+	src, err := addrPort(addr)
+	if err != nil {
+		return 0, netip.AddrPort{}, fmt.Errorf("%w: %s", ErrUnexpectedAddress, err)
+	}
+
+	return n, src, nil
+}
+
+func (t *udpTransport) WriteTo(b []byte, addr netip.AddrPort) (int, error) {
+	return t.conn.WriteTo(b, net.UDPAddrFromAddrPort(addr))
+}
+
+func (t *udpTransport) LocalAddr() netip.AddrPort {
+	addr, err := addrPort(t.conn.LocalAddr())
+	if err != nil {
+		return netip.AddrPort{}
+	}
+
+	return addr
+}
+
+func (t *udpTransport) Close() error {
+	return t.conn.Close()
+}
@@ -0,0 +1,96 @@
+package adnl
+
+import (
+	"bytes"
+	"context"
+	"crypto/ed25519"
+	"errors"
+	"net/netip"
+	"testing"
+	"time"
+
+	"github.com/Gealber/dht/adnl/memnet"
+)
+
+var _ Transport = (*memnet.Conn)(nil)
+
+// newMemPeer starts a peer serving on a transport of n listening on addr, the peer is shut
+// down once the test finishes.
+func newMemPeer(t *testing.T, n *memnet.Network, addr string) (*Peer, netip.AddrPort) {
+	t.Helper()
+
+	conn, err := n.Listen(netip.MustParseAddrPort(addr))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	p, err := New(nil, nil, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	errChn := make(chan error, 1)
+	go func() {
+		errChn <- p.ServeTransport(ctx, conn)
+	}()
+
+	t.Cleanup(func() {
+		cancel()
+		if err := <-errChn; err != nil {
+			t.Errorf("serve returned error: %s", err)
+		}
+	})
+
+	waitFor(t, time.Second, func() bool {
+		_, err := p.LocalAddr()
+		return err == nil
+	})
+
+	return p, conn.LocalAddr()
+}
+
+func TestPeerMemTransport(t *testing.T) {
+	n := memnet.New(memnet.Config{
+		Latency:   5 * time.Millisecond,
+		Duplicate: 0.3,
+		Reorder:   0.3,
+	}, 42)
+	a, aAddr := newMemPeer(t, n, "10.0.0.1:3000")
+	b, bAddr := newMemPeer(t, n, "10.0.0.2:3000")
+
+	if local, err := a.LocalAddr(); err != nil || local != aAddr {
+		t.Fatalf("got local address %s err %v want %s", local, err, aAddr)
+	}
+
+	b.SetQueryHandler(func(from ed25519.PublicKey, query []byte) ([]byte, error) {
+		return query, nil
+	})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	for i := range 10 {
+		answer, err := a.Query(ctx, b.pubKey, bAddr, []byte{byte(i)})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if !bytes.Equal(answer, []byte{byte(i)}) {
+			t.Fatalf("unexpected answer: %x", answer)
+		}
+	}
+
+	if stats := n.Stats(); stats.Duplicated == 0 || stats.Reordered == 0 {
+		t.Errorf("expected duplicated and reordered datagrams, got stats %+v", stats)
+	}
+
+	n.Partition([]netip.AddrPort{aAddr}, []netip.AddrPort{bAddr})
+	ctx, cancel = context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancel()
+
+	_, err := a.Query(ctx, b.pubKey, bAddr, []byte{1})
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("expected deadline exceeded, got: %v", err)
+	}
+}
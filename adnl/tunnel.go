@@ -0,0 +1,217 @@
+package adnl
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"net/netip"
+	"time"
+
+	"github.com/Gealber/dht/tl"
+	"github.com/Gealber/dht/utils"
+)
+
+const (
+	// flagTunnelFrom the tunnel packet includes from_ip and from_port
+	flagTunnelFrom uint32 = 1 << 0
+	// flagTunnelMessage the tunnel packet includes message
+	flagTunnelMessage uint32 = 1 << 1
+)
+
+var (
+	ErrTunnelKey            = errors.New("tunnel key can't be the key of the peer")
+	ErrTunnelWithoutMessage = errors.New("tunnel packet without message")
+	ErrTunnelSource         = errors.New("tunnel packet source not reported by the previous hop")
+	ErrNestedTunnel         = errors.New("tunnel packet inside a tunnel packet")
+)
+
+// tunnel is a tunnel key we receive packets for, read doc/adnl/adnl-tunnel.md for more details.
+type tunnel struct {
+	privKey ed25519.PrivateKey
+	// nextKey tunnel key of the next hop, inner datagrams are forwarded to next encrypted
+	// for nextKey. nil when we are the endpoint of the tunnel
+	nextKey ed25519.PublicKey
+	next    netip.AddrPort
+	// prev address of the previous hop, the only one trusted to report the source of the
+	// datagrams. Invalid when we are the first hop
+	prev netip.AddrPort
+}
+
+// AddTunnelEndpoint makes us the endpoint of the tunnel with key privKey. Datagrams received
+// through the tunnel are handled as if received from the address included by the mid-node
+// listening on mid, packets from other addresses including a source are dropped. The key of a
+// tunnel should be different from the key of the peer.
+func (p *Peer) AddTunnelEndpoint(privKey ed25519.PrivateKey, mid netip.AddrPort) error {
+	if !mid.IsValid() {
+		return ErrUnsupportedAddress
+	}
+
+	// sources of the received datagrams are unmapped
+	mid = netip.AddrPortFrom(mid.Addr().Unmap(), mid.Port())
+
+	return p.addTunnel(privKey, &tunnel{privKey: privKey, prev: mid})
+}
+
+// AddTunnelMidpoint makes us a mid-node of the tunnel with key privKey. Datagrams received through
+// the tunnel are forwarded to next, in a tunnel packet encrypted for nextKey including their source.
+func (p *Peer) AddTunnelMidpoint(privKey ed25519.PrivateKey, nextKey ed25519.PublicKey, next netip.AddrPort) error {
+	if len(nextKey) != ed25519.PublicKeySize {
+		return ErrInvalidPubKey
+	}
+
+	return p.addTunnel(privKey, &tunnel{privKey: privKey, nextKey: nextKey, next: next})
+}
+
+func (p *Peer) addTunnel(privKey ed25519.PrivateKey, t *tunnel) error {
+	id, err := utils.KeyIDEd25519(privKey.Public().(ed25519.PublicKey))
+	if err != nil {
+		return err
+	}
+
+	idStr := hex.EncodeToString(id)
+	if idStr == hex.EncodeToString(p.id) {
+		return ErrTunnelKey
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.tunnels[idStr] = t
+
+	return nil
+}
+
+// SetTunnelAddress advertises hop as our only address, peers reach us through the tunnel mid-node
+// with id hop.To encrypting their packets for the tunnel key hop.PubKey. Only inbound packets go
+// through the tunnel, the packets we send leave our socket directly, so the peers we send to
+// learn our address.
+func (p *Peer) SetTunnelAddress(hop tl.AdnlAddressTunnel) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.addrListVersion = max(time.Now().Unix(), p.addrListVersion+1)
+	p.addrs = []any{hop}
+}
+
+// processTunnelPacket decrypts a packet received through the tunnel t from src, forwarding
+// its datagram to the next hop or handling it when we are the endpoint.
+func (p *Peer) processTunnelPacket(src netip.AddrPort, t *tunnel, data []byte) {
+	_, data, err := openPacket(t.privKey, data)
+	if err != nil {
+		p.logger.Debug("failed opening tunnel packet", "addr", src, "err", err)
+		return
+	}
+
+	var pkt tl.AdnlTunnelPacketContents
+	err = p.tlH.Parse(data, &pkt, true)
+	if err != nil {
+		p.logger.Debug("failed parsing tunnel packet", "addr", src, "err", err)
+		return
+	}
+
+	if pkt.Flags&flagTunnelMessage == 0 {
+		p.logger.Debug("dropping tunnel packet", "addr", src, "err", ErrTunnelWithoutMessage)
+		return
+	}
+
+	// the source of the datagram is the one reported by the previous hop, if any. Nobody
+	// else is trusted with it, otherwise anybody could make us answer to the address of a victim
+	from := src
+	if pkt.Flags&flagTunnelFrom != 0 {
+		if !t.prev.IsValid() || src != t.prev {
+			p.logger.Debug("dropping tunnel packet", "addr", src, "err", ErrTunnelSource)
+			return
+		}
+
+		var b [4]byte
+		binary.BigEndian.PutUint32(b[:], uint32(pkt.FromIP))
+		from = netip.AddrPortFrom(netip.AddrFrom4(b), uint16(pkt.FromPort))
+	}
+
+	if t.nextKey != nil {
+		payload, err := p.sealTunnelPacket(t.nextKey, from, pkt.Message)
+		if err != nil {
+			p.logger.Warn("failed building tunnel packet", "err", err)
+			return
+		}
+
+		err = p.writeTo(t.next, payload)
+		if err != nil {
+			p.logger.Warn("failed forwarding tunnel packet", "addr", t.next, "err", err)
+		}
+		return
+	}
+
+	d, _, ok := p.classify(from, pkt.Message)
+	if !ok {
+		p.logger.Debug("dropping datagram received through tunnel", "addr", from)
+		return
+	}
+
+	if d.tunnel != nil {
+		p.logger.Debug("dropping datagram received through tunnel", "addr", from, "err", ErrNestedTunnel)
+		return
+	}
+
+	p.processDatagram(d)
+}
+
+// sealTunnelPacket wraps datagram in a tunnel packet encrypted for the tunnel key dst, with a
+// temporary key so mid-nodes don't learn who sent it. from is the source of the datagram,
+// only included when valid.
+func (p *Peer) sealTunnelPacket(dst ed25519.PublicKey, from netip.AddrPort, datagram []byte) ([]byte, error) {
+	rand1, rand2 := utils.RandomBuff()
+	pkt := tl.AdnlTunnelPacketContents{
+		Rand1:   rand1,
+		Flags:   flagTunnelMessage,
+		Message: datagram,
+		Rand2:   rand2,
+	}
+
+	if from.IsValid() {
+		ip := from.Addr().Unmap()
+		if !ip.Is4() {
+			return nil, ErrUnsupportedAddress
+		}
+
+		b := ip.As4()
+		pkt.Flags |= flagTunnelFrom
+		pkt.FromIP = int64(binary.BigEndian.Uint32(b[:]))
+		pkt.FromPort = int32(from.Port())
+	}
+
+	data, err := p.tlH.Serialize(pkt, true)
+	if err != nil {
+		return nil, err
+	}
+
+	pubKey, privKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+
+	return sealPacket(privKey, pubKey, dst, data)
+}
+
+// writeToPeer writes datagram to the peer with id peerIDStr, through the tunnel advertised
+// by the peer if any, otherwise directly to addr.
+func (p *Peer) writeToPeer(peerIDStr string, addr netip.AddrPort, datagram []byte) error {
+	hop, ok := p.addrBook.tunnel(peerIDStr, time.Now())
+	if !ok {
+		return p.writeTo(addr, datagram)
+	}
+
+	hopAddr, err := p.Address(hop.To)
+	if err != nil {
+		return err
+	}
+
+	payload, err := p.sealTunnelPacket(hop.PubKey.Key, netip.AddrPort{}, datagram)
+	if err != nil {
+		return err
+	}
+
+	return p.writeTo(hopAddr, payload)
+}
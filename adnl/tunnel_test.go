@@ -0,0 +1,187 @@
+package adnl
+
+import (
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"net"
+	"net/netip"
+	"testing"
+	"time"
+
+	"github.com/Gealber/dht/tl"
+)
+
+func TestPeerTunnel(t *testing.T) {
+	a, aAddr := newTestPeer(t)
+	mid, midAddr := newTestPeer(t)
+	hidden, hiddenAddr := newTestPeer(t)
+
+	midPub, midPriv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	endPub, endPriv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = hidden.AddTunnelEndpoint(endPriv, midAddr)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = mid.AddTunnelMidpoint(midPriv, endPub, hiddenAddr)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	hidden.SetTunnelAddress(tl.AdnlAddressTunnel{To: mid.id, PubKey: tl.PublicKeyED25519{Key: midPub}})
+	hidden.SetQueryHandler(func(from ed25519.PublicKey, query []byte) ([]byte, error) {
+		return query, nil
+	})
+
+	err = mid.SetAddressList(midAddr)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// a learns the address lists of the mid-node and the hidden peer
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+
+	for _, p := range []*Peer{mid, hidden} {
+		err = p.SendMessage(ctx, a.pubKey, aAddr, tl.AdnlMessageNop{})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	waitFor(t, 2*time.Second, func() bool {
+		_, ok := a.addrBook.tunnel(hex.EncodeToString(hidden.id), time.Now())
+		_, err := a.Address(mid.id)
+		return ok && err == nil
+	})
+
+	// nothing listens on the address used for the hidden peer, the query only
+	// arrives through the tunnel
+	unused := netip.MustParseAddrPort("127.0.0.1:1")
+	answer, err := a.Query(ctx, hidden.pubKey, unused, []byte("tunneled"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if string(answer) != "tunneled" {
+		t.Fatalf("unexpected answer %q", answer)
+	}
+
+	err = hidden.AddTunnelEndpoint(hidden.privKey, midAddr)
+	if !errors.Is(err, ErrTunnelKey) {
+		t.Fatalf("expected tunnel key error, got: %v", err)
+	}
+}
+
+func TestPeerTunnelSource(t *testing.T) {
+	hidden, _ := newTestPeer(t)
+	atk, _ := newTestPeer(t)
+	hidden.SetQueryHandler(func(from ed25519.PublicKey, query []byte) ([]byte, error) {
+		return query, nil
+	})
+
+	endPub, endPriv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the mid-node of hidden listens on an address nobody else uses
+	err = hidden.AddTunnelEndpoint(endPriv, netip.MustParseAddrPort("127.0.0.1:1"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	hiddenAddr, err := hidden.LocalAddr()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	listen := func() (net.PacketConn, netip.AddrPort) {
+		conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { conn.Close() })
+
+		addr, err := addrPort(conn.LocalAddr())
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		return conn, addr
+	}
+
+	sink, sinkAddr := listen()
+	victim, victimAddr := listen()
+
+	// query returns a datagram with a query of atk for hidden, read from sink
+	buff := make([]byte, maxDatagramSize)
+	query := func() []byte {
+		queryID := make([]byte, 32)
+		rand.Read(queryID)
+
+		err := atk.sendPacket(hidden.pubKey, sinkAddr, tl.AdnlMessageQuery{QueryID: queryID, Query: []byte("q")})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		sink.SetReadDeadline(time.Now().Add(2 * time.Second))
+		n, _, err := sink.ReadFrom(buff)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		return append([]byte(nil), buff[:n]...)
+	}
+
+	sendTunnel := func(from netip.AddrPort, datagram []byte) {
+		payload, err := atk.sealTunnelPacket(endPub, from, datagram)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		_, err = sink.WriteTo(payload, net.UDPAddrFromAddrPort(hiddenAddr))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	received := func(conn net.PacketConn) bool {
+		conn.SetReadDeadline(time.Now().Add(300 * time.Millisecond))
+		_, _, err := conn.ReadFrom(buff)
+		return err == nil
+	}
+
+	// without a source the datagram comes from the sender, which gets the answer
+	sendTunnel(netip.AddrPort{}, query())
+	if !received(sink) {
+		t.Fatal("expected an answer to the tunneled query")
+	}
+
+	// a source not reported by the mid-node isn't trusted, hidden doesn't answer to it
+	sendTunnel(victimAddr, query())
+	if received(victim) {
+		t.Fatal("answer sent to a source reported by somebody else than the mid-node")
+	}
+
+	// tunnel packets inside tunnel packets are dropped
+	nested, err := atk.sealTunnelPacket(endPub, netip.AddrPort{}, query())
+	if err != nil {
+		t.Fatal(err)
+	}
+	sendTunnel(netip.AddrPort{}, nested)
+	if received(sink) {
+		t.Fatal("nested tunnel packet shouldn't be handled")
+	}
+}
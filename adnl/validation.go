@@ -0,0 +1,173 @@
+package adnl
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"errors"
+	"time"
+
+	"github.com/Gealber/dht/tl"
+)
+
+// maxClockSkew is the max difference tolerated between the dates included in
+// the packets of a peer and our clock
+const maxClockSkew = 60 * time.Second
+
+var (
+	ErrNoSender             = errors.New("packet without from neither from_short")
+	ErrFromMismatch         = errors.New("packet from doesn't match the sender public key")
+	ErrFromShortMismatch    = errors.New("packet from_short doesn't match the sender id")
+	ErrMissingSignature     = errors.New("packet without signature")
+	ErrInvalidSignature     = errors.New("packet signature verification failed")
+	ErrMessageAndMessages   = errors.New("packet can't include message and messages at the same time")
+	ErrAddrListVersion      = errors.New("address list version is in the future")
+	ErrAddrListReinitDate   = errors.New("address list reinit date is in the future")
+	ErrAddrListExpired      = errors.New("address list expired")
+	ErrPacketReinitDateSkew = errors.New("packet reinit date is in the future")
+)
+
+// validationErrors are the errors returned by packetContentValidation,
+// each one has its own counter in Peer.ValidationErrors
+var validationErrors = []error{
+	ErrNoSender,
+	ErrFromMismatch,
+	ErrFromShortMismatch,
+	ErrMissingSignature,
+	ErrInvalidSignature,
+	ErrMessageAndMessages,
+	ErrAddrListVersion,
+	ErrAddrListReinitDate,
+	ErrAddrListExpired,
+	ErrPacketReinitDateSkew,
+}
+
+// ValidationErrors returns the amount of packets dropped for each of the validation rules, indexed by
+// the error returned when the rule is violated, ErrInvalidSignature for example.
+func (p *Peer) ValidationErrors() map[error]uint64 {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	counters := make(map[error]uint64, len(p.validationErrs))
+	for err, n := range p.validationErrs {
+		counters[err] = n
+	}
+
+	return counters
+}
+
+// countValidationError increments the counter of the validation rule violated, if any.
+func (p *Peer) countValidationError(err error) {
+	for _, validationErr := range validationErrors {
+		if errors.Is(err, validationErr) {
+			p.mu.Lock()
+			p.validationErrs[validationErr]++
+			p.mu.Unlock()
+			return
+		}
+	}
+}
+
+// packetContentValidation enforces the rules of adnl.packetContents on pkt, sent by the peer
+// with public key senderPubKey through the channel ch, nil in case the first packet format was
+// used. Packets sent outside a channel must identify its sender and be signed by it.
+func (p *Peer) packetContentValidation(senderPubKey ed25519.PublicKey, ch *channel, pkt tl.AdnlPacketContent) error {
+	err := p.validatePacket(senderPubKey, ch, pkt)
+	if err != nil {
+		p.countValidationError(err)
+	}
+
+	return err
+}
+
+func (p *Peer) validatePacket(senderPubKey ed25519.PublicKey, ch *channel, pkt tl.AdnlPacketContent) error {
+	if pkt.Flags&flagMessage != 0 && pkt.Flags&flagMessages != 0 {
+		return ErrMessageAndMessages
+	}
+
+	hasFrom := pkt.Flags&flagFrom != 0
+	hasFromShort := pkt.Flags&flagFromShort != 0
+	if ch == nil && !hasFrom && !hasFromShort {
+		return ErrNoSender
+	}
+
+	if hasFrom && !bytes.Equal(pkt.From.Key, senderPubKey) {
+		return ErrFromMismatch
+	}
+
+	if hasFromShort {
+		senderID, err := p.computePeerID(senderPubKey)
+		if err != nil {
+			return err
+		}
+
+		if !bytes.Equal(pkt.FromIDShort.ID, senderID[:]) {
+			return ErrFromShortMismatch
+		}
+	}
+
+	now := time.Now()
+	if pkt.Flags&flagReinitDate != 0 && pkt.ReinitDate > now.Add(maxClockSkew).Unix() {
+		return ErrPacketReinitDateSkew
+	}
+
+	if pkt.Flags&flagAddress != 0 {
+		if err := validateAddressList(pkt.AddressList, now); err != nil {
+			return err
+		}
+	}
+
+	if pkt.Flags&flagPriorityAddress != 0 {
+		if err := validateAddressList(pkt.PriorityAddressList, now); err != nil {
+			return err
+		}
+	}
+
+	if pkt.Flags&flagSignature == 0 {
+		// packets sent through a channel are authenticated by the channel keys
+		if ch == nil {
+			return ErrMissingSignature
+		}
+
+		return nil
+	}
+
+	return p.verifyPacketSignature(senderPubKey, pkt)
+}
+
+// verifyPacketSignature checks the signature of pkt, which is computed over
+// the packet serialized without the signature.
+func (p *Peer) verifyPacketSignature(senderPubKey ed25519.PublicKey, pkt tl.AdnlPacketContent) error {
+	signature := pkt.Signature
+	pkt.Signature = nil
+	pkt.Flags &^= flagSignature
+
+	data, err := p.tlH.Serialize(pkt, true)
+	if err != nil {
+		return err
+	}
+
+	if len(senderPubKey) != ed25519.PublicKeySize || !ed25519.Verify(senderPubKey, data, signature) {
+		return ErrInvalidSignature
+	}
+
+	return nil
+}
+
+// validateAddressList checks the dates of an address list against our clock.
+func validateAddressList(list tl.AdnlAddressList, now time.Time) error {
+	limit := now.Add(maxClockSkew).Unix()
+	if list.Version > limit {
+		return ErrAddrListVersion
+	}
+
+	if list.ReinitDate > limit {
+		return ErrAddrListReinitDate
+	}
+
+	// zero means the list never expires
+	if list.ExpireAt != 0 && list.ExpireAt < now.Unix() {
+		return ErrAddrListExpired
+	}
+
+	return nil
+}
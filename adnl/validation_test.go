@@ -0,0 +1,146 @@
+package adnl
+
+import (
+	"crypto/ed25519"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/Gealber/dht/tl"
+)
+
+func Test_packetContentValidation(t *testing.T) {
+	sender, err := New(nil, nil, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	receiver, err := New(nil, nil, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	otherPub, _, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	senderID, err := sender.computePeerID(sender.pubKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	data, err := sender.buildSignedPacket(packetSeqnos{seqno: 1, reinitDate: sender.reinitDate}, senderID[:], tl.Ping{Value: 1}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var signed tl.AdnlPacketContent
+	err = receiver.tlH.Parse(data, &signed, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	now := time.Now().Unix()
+	tcs := []struct {
+		name   string
+		sender ed25519.PublicKey
+		ch     *channel
+		modify func(pkt *tl.AdnlPacketContent)
+		err    error
+	}{
+		{
+			name:   "valid signed packet",
+			sender: sender.pubKey,
+		},
+		{
+			name:   "from of another peer",
+			sender: otherPub,
+			err:    ErrFromMismatch,
+		},
+		{
+			name:   "from_short of another peer",
+			sender: sender.pubKey,
+			modify: func(pkt *tl.AdnlPacketContent) { pkt.FromIDShort.ID = otherPub },
+			err:    ErrFromShortMismatch,
+		},
+		{
+			name:   "without sender",
+			sender: sender.pubKey,
+			modify: func(pkt *tl.AdnlPacketContent) { pkt.Flags &^= flagFrom | flagFromShort },
+			err:    ErrNoSender,
+		},
+		{
+			name:   "without signature",
+			sender: sender.pubKey,
+			modify: func(pkt *tl.AdnlPacketContent) { pkt.Flags &^= flagSignature },
+			err:    ErrMissingSignature,
+		},
+		{
+			name:   "without signature through a channel",
+			sender: sender.pubKey,
+			ch:     &channel{},
+			modify: func(pkt *tl.AdnlPacketContent) { pkt.Flags &^= flagSignature },
+		},
+		{
+			name:   "tampered packet",
+			sender: sender.pubKey,
+			modify: func(pkt *tl.AdnlPacketContent) { pkt.Seqno++ },
+			err:    ErrInvalidSignature,
+		},
+		{
+			name:   "message and messages",
+			sender: sender.pubKey,
+			modify: func(pkt *tl.AdnlPacketContent) {
+				pkt.Flags |= flagMessages
+				pkt.Messages = []any{tl.Ping{Value: 2}}
+			},
+			err: ErrMessageAndMessages,
+		},
+		{
+			name:   "reinit date in the future",
+			sender: sender.pubKey,
+			modify: func(pkt *tl.AdnlPacketContent) { pkt.ReinitDate = now + 3600 },
+			err:    ErrPacketReinitDateSkew,
+		},
+		{
+			name:   "address list version in the future",
+			sender: sender.pubKey,
+			modify: func(pkt *tl.AdnlPacketContent) {
+				pkt.Flags |= flagAddress
+				pkt.AddressList = tl.AdnlAddressList{Version: now + 3600}
+			},
+			err: ErrAddrListVersion,
+		},
+		{
+			name:   "expired priority address list",
+			sender: sender.pubKey,
+			modify: func(pkt *tl.AdnlPacketContent) {
+				pkt.Flags |= flagPriorityAddress
+				pkt.PriorityAddressList = tl.AdnlAddressList{Version: now, ExpireAt: now - 1}
+			},
+			err: ErrAddrListExpired,
+		},
+	}
+
+	for _, tc := range tcs {
+		t.Run(tc.name, func(t *testing.T) {
+			pkt := signed
+			if tc.modify != nil {
+				tc.modify(&pkt)
+			}
+
+			err := receiver.packetContentValidation(tc.sender, tc.ch, pkt)
+			if !errors.Is(err, tc.err) {
+				t.Fatalf("expected error %v got %v", tc.err, err)
+			}
+		})
+	}
+
+	counters := receiver.ValidationErrors()
+	for _, tc := range tcs {
+		if tc.err != nil && counters[tc.err] != 1 {
+			t.Fatalf("expected a single packet dropped with error %v, got %d", tc.err, counters[tc.err])
+		}
+	}
+}
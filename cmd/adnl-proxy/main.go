@@ -0,0 +1,78 @@
+// Command adnl-proxy runs a fast ADNL proxy, relaying the packets of a peer without
+// a public address. Read doc/adnl/adnl-proxy.md for more details.
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"flag"
+	"fmt"
+	"log"
+	"log/slog"
+	"net"
+	"os"
+	"os/signal"
+
+	"github.com/Gealber/dht/adnl/proxy"
+	"github.com/Gealber/dht/tl"
+)
+
+func main() {
+	clientAddr := flag.String("client-addr", ":3300", "address where the client sends its packets")
+	publicAddr := flag.String("public-addr", ":3301", "public address advertised by the client")
+	secretHex := flag.String("secret", "", "hex encoded secret shared with the client")
+	idHex := flag.String("id", "", "hex encoded 32 bytes proxy id, sha256 of the secret by default")
+	debug := flag.Bool("debug", false, "log every packet dropped")
+	flag.Parse()
+
+	err := run(*clientAddr, *publicAddr, *secretHex, *idHex, *debug)
+	if err != nil {
+		log.Fatal(err)
+	}
+}
+
+func run(clientAddr, publicAddr, secretHex, idHex string, debug bool) error {
+	secret, err := hex.DecodeString(secretHex)
+	if err != nil || len(secret) == 0 {
+		return fmt.Errorf("invalid secret: %q", secretHex)
+	}
+
+	id, err := hex.DecodeString(idHex)
+	if err != nil {
+		return fmt.Errorf("invalid id: %q", idHex)
+	}
+
+	if len(id) == 0 {
+		hash := sha256.Sum256(secret)
+		id = hash[:]
+	}
+
+	fast, err := proxy.NewFast(tl.AdnlProxyFast{ID: id, SharedSecret: secret})
+	if err != nil {
+		return err
+	}
+
+	clientConn, err := net.ListenPacket("udp", clientAddr)
+	if err != nil {
+		return err
+	}
+
+	publicConn, err := net.ListenPacket("udp", publicAddr)
+	if err != nil {
+		clientConn.Close()
+		return err
+	}
+
+	log.Printf("proxy %x relaying %s <-> %s\n", id, clientConn.LocalAddr(), publicConn.LocalAddr())
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+
+	s := proxy.NewServer(fast)
+	if debug {
+		s.SetLogger(slog.New(slog.NewTextHandler(os.Stdout, &slog.HandlerOptions{Level: slog.LevelDebug})))
+	}
+
+	return s.Serve(ctx, clientConn, publicConn)
+}
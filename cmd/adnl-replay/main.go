@@ -0,0 +1,155 @@
+// Command adnl-replay prints the packets of a capture file written by adnl.Peer.Capture, dissected
+// through their TL definitions, or replays them into a new peer, printing the packets it processes
+// and the answers it sends back. Captures allow reproducing interop bugs offline.
+package main
+
+import (
+	"bufio"
+	"context"
+	"crypto/ed25519"
+	"encoding/hex"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"net/netip"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/Gealber/dht/adnl"
+	"github.com/Gealber/dht/adnl/memnet"
+	"github.com/Gealber/dht/tl"
+)
+
+func main() {
+	replay := flag.Bool("replay", false, "replay the capture into a new peer instead of printing it")
+	seedHex := flag.String("key", "", "hex encoded 32 bytes ed25519 seed of the replaying peer, random by default")
+	echo := flag.Bool("echo", false, "answer the replayed queries with their own payload")
+	flag.Usage = func() {
+		fmt.Fprintf(flag.CommandLine.Output(), "usage: %s [-replay [-key seed] [-echo]] capture-file\n", os.Args[0])
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+
+	if flag.NArg() != 1 {
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	err := run(flag.Arg(0), *replay, *seedHex, *echo)
+	if err != nil {
+		log.Fatal(err)
+	}
+}
+
+func run(path string, replay bool, seedHex string, echo bool) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	r, err := adnl.NewCaptureReader(bufio.NewReader(f))
+	if err != nil {
+		return err
+	}
+
+	tlH := tl.New()
+	tlH.Register(tl.DefaultTLModel)
+
+	header := r.Header()
+	fmt.Printf("capture of peer %x reinit date %d\n\n", []byte(header.PubKey), header.ReinitDate)
+
+	if replay {
+		return replayCapture(r, tlH, seedHex, echo)
+	}
+
+	for {
+		rec, err := r.Next()
+		if errors.Is(err, io.EOF) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		printRecord(tlH, rec)
+	}
+}
+
+// replayCapture feeds the capture into a peer served on an in-memory network, the answers
+// of the peer are printed but aren't delivered to anyone. The peer doesn't have handlers
+// for the queries, unless echo is set.
+func replayCapture(r *adnl.CaptureReader, tlH *tl.TLHandler, seedHex string, echo bool) error {
+	var privKey ed25519.PrivateKey
+	var pubKey ed25519.PublicKey
+	if seedHex != "" {
+		seed, err := hex.DecodeString(seedHex)
+		if err != nil || len(seed) != ed25519.SeedSize {
+			return fmt.Errorf("invalid key: %q", seedHex)
+		}
+
+		privKey = ed25519.NewKeyFromSeed(seed)
+		pubKey = privKey.Public().(ed25519.PublicKey)
+	}
+
+	p, err := adnl.New(privKey, pubKey, 0)
+	if err != nil {
+		return err
+	}
+
+	// the captured packets were sent to the reinit date of the captured peer
+	p.SetReinitDate(r.Header().ReinitDate)
+
+	if echo {
+		p.SetQueryHandler(func(from ed25519.PublicKey, query []byte) ([]byte, error) {
+			return query, nil
+		})
+	}
+
+	conn, err := memnet.New(memnet.Config{}, time.Now().UnixNano()).Listen(netip.MustParseAddrPort("127.0.0.1:0"))
+	if err != nil {
+		return err
+	}
+
+	// answers can be sent once the peer is serving
+	err = p.StartTransport(context.Background(), conn)
+	if err != nil {
+		return err
+	}
+	defer p.Shutdown(context.Background())
+
+	// the hook is called from the goroutines processing the packets
+	var mu sync.Mutex
+	p.SetCaptureHook(func(rec adnl.CaptureRecord) {
+		mu.Lock()
+		defer mu.Unlock()
+
+		printRecord(tlH, rec)
+	})
+
+	n, err := p.Replay(r)
+	fmt.Printf("%d records replayed\n", n)
+
+	return err
+}
+
+// printRecord prints the packet of rec, dissected in case it can be parsed.
+func printRecord(tlH *tl.TLHandler, rec adnl.CaptureRecord) {
+	format := "first packet format"
+	if rec.Channel {
+		format = "channel"
+	}
+
+	fmt.Printf("%s %-3s peer %x %s %s\n", rec.Time.UTC().Format(time.RFC3339Nano), rec.Direction, rec.PeerID, rec.Addr, format)
+
+	dissected, err := tlH.Dissect(rec.Data)
+	if err != nil {
+		fmt.Printf("failed dissecting packet err: %s\n%x\n\n", err, rec.Data)
+		return
+	}
+
+	fmt.Println(dissected)
+}
@@ -1,9 +1,18 @@
 package config
 
 import (
+	"encoding/binary"
 	"encoding/json"
+	"fmt"
 	"io"
 	"net/http"
+	"net/netip"
+)
+
+// types of the addresses included in the address lists
+const (
+	AddressUDP  = "adnl.address.udp"
+	AddressUDP6 = "adnl.address.udp6"
 )
 
 type Config struct {
@@ -77,10 +86,60 @@ type NodeConfig struct {
 
 type Address struct {
 	Type string `json:"@type"`
-	IP   int    `json:"ip"`
+	// IP of adnl.address.udp addresses, a big endian 32-bit integer
+	IP int `json:"ip"`
+	// IP6 of adnl.address.udp6 addresses, encoded as base64 in the config
+	IP6  []byte `json:"-"`
 	Port int    `json:"port"`
 }
 
+// UnmarshalJSON decodes the ip of the address according to its type,
+// adnl.address.udp uses an integer while adnl.address.udp6 uses base64.
+func (a *Address) UnmarshalJSON(data []byte) error {
+	var raw struct {
+		Type string          `json:"@type"`
+		IP   json.RawMessage `json:"ip"`
+		Port int             `json:"port"`
+	}
+	err := json.Unmarshal(data, &raw)
+	if err != nil {
+		return err
+	}
+
+	*a = Address{Type: raw.Type, Port: raw.Port}
+	if len(raw.IP) == 0 {
+		return nil
+	}
+
+	if raw.Type == AddressUDP6 {
+		return json.Unmarshal(raw.IP, &a.IP6)
+	}
+
+	return json.Unmarshal(raw.IP, &a.IP)
+}
+
+// AddrPort converts the address into a netip.AddrPort.
+func (a Address) AddrPort() (netip.AddrPort, error) {
+	if a.Port <= 0 || a.Port > 0xFFFF {
+		return netip.AddrPort{}, fmt.Errorf("invalid port: %d", a.Port)
+	}
+
+	switch a.Type {
+	case AddressUDP:
+		var ip [4]byte
+		binary.BigEndian.PutUint32(ip[:], uint32(a.IP))
+		return netip.AddrPortFrom(netip.AddrFrom4(ip), uint16(a.Port)), nil
+	case AddressUDP6:
+		ip, ok := netip.AddrFromSlice(a.IP6)
+		if !ok || !ip.Is6() {
+			return netip.AddrPort{}, fmt.Errorf("invalid IPv6 address: %x", a.IP6)
+		}
+		return netip.AddrPortFrom(ip, uint16(a.Port)), nil
+	default:
+		return netip.AddrPort{}, fmt.Errorf("unsupported address type: %s", a.Type)
+	}
+}
+
 type AddressList struct {
 	Type       string    `json:"@type"`
 	Addrs      []Address `json:"addrs"`
@@ -0,0 +1,31 @@
+package config
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+func TestAddressAddrPort(t *testing.T) {
+	data := `[
+		{"@type": "adnl.address.udp", "ip": -1185526389, "port": 14395},
+		{"@type": "adnl.address.udp6", "ip": "IAENuAAAAAAAAAAAAAAAAQ==", "port": 30303}
+	]`
+
+	var addrs []Address
+	err := json.Unmarshal([]byte(data), &addrs)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := []string{"185.86.77.139:14395", "[2001:db8::1]:30303"}
+	for i, addr := range addrs {
+		ap, err := addr.AddrPort()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if ap.String() != expected[i] {
+			t.Fatalf("expected %s got %s", expected[i], ap)
+		}
+	}
+}
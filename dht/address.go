@@ -0,0 +1,117 @@
+package dht
+
+import (
+	"context"
+	"crypto/ed25519"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/Gealber/dht/adnl"
+	"github.com/Gealber/dht/tl"
+	"github.com/Gealber/dht/utils"
+)
+
+var ErrInvalidAddressList = errors.New("invalid address list value")
+
+// addressName name of the key the adnl peers store their address list with
+const addressName = "address"
+
+// AddressKey returns the key the adnl peer with id stores its address list with.
+func AddressKey(id []byte) tl.DHTKey {
+	return tl.DHTKey{ID: id, Name: []byte(addressName), Idx: 0}
+}
+
+// PriorityAddressKey returns the key the adnl peer with id stores its priority address list with,
+// the addresses it prefers to be reached at.
+func PriorityAddressKey(id []byte) tl.DHTKey {
+	return tl.DHTKey{ID: id, Name: []byte(addressName), Idx: 1}
+}
+
+// StoreAddress stores list as the address list of the adnl peer with key privKey, valid until
+// expireAt. Returns the amount of nodes that stored it.
+func (n *Node) StoreAddress(ctx context.Context, privKey ed25519.PrivateKey, list tl.AdnlAddressList, expireAt time.Time) (int, LookupStats, error) {
+	return n.storeAddressList(ctx, AddressKey, privKey, list, expireAt)
+}
+
+// StorePriorityAddress is like StoreAddress, storing list as the priority address list of the
+// adnl peer.
+func (n *Node) StorePriorityAddress(ctx context.Context, privKey ed25519.PrivateKey, list tl.AdnlAddressList, expireAt time.Time) (int, LookupStats, error) {
+	return n.storeAddressList(ctx, PriorityAddressKey, privKey, list, expireAt)
+}
+
+func (n *Node) storeAddressList(ctx context.Context, key func([]byte) tl.DHTKey, privKey ed25519.PrivateKey, list tl.AdnlAddressList, expireAt time.Time) (int, LookupStats, error) {
+	id, err := utils.KeyIDEd25519(privKey.Public().(ed25519.PublicKey))
+	if err != nil {
+		return 0, LookupStats{}, err
+	}
+
+	data, err := tlH.Serialize(list, true)
+	if err != nil {
+		return 0, LookupStats{}, err
+	}
+
+	value, err := SignValue(tl.DHTValue{
+		Key:   tl.DHTKeyDescription{Key: key(id)},
+		Value: data,
+		TTL:   expireAt.Unix(),
+	}, privKey)
+	if err != nil {
+		return 0, LookupStats{}, err
+	}
+
+	return n.Store(ctx, value)
+}
+
+// ResolveAddress looks up the address lists stored by the adnl peer with id, it implements
+// adnl.AddressResolver. The priority list is optional, only lists signed by the peer are accepted.
+func (n *Node) ResolveAddress(ctx context.Context, id []byte) (adnl.ResolvedAddress, error) {
+	list, pubKey, expireAt, err := n.findAddressList(ctx, AddressKey(id))
+	if err != nil {
+		return adnl.ResolvedAddress{}, err
+	}
+
+	resolved := adnl.ResolvedAddress{PubKey: pubKey, List: list, ExpireAt: expireAt}
+
+	priority, _, priorityExpireAt, err := n.findAddressList(ctx, PriorityAddressKey(id))
+	switch {
+	case errors.Is(err, ErrValueNotFound):
+	case err != nil:
+		return adnl.ResolvedAddress{}, err
+	default:
+		resolved.Priority = priority
+		if priorityExpireAt.Before(resolved.ExpireAt) {
+			resolved.ExpireAt = priorityExpireAt
+		}
+	}
+
+	return resolved, nil
+}
+
+// findAddressList looks up the address list stored with key, returning it with the key of the
+// peer that signed it and the time it expires at.
+func (n *Node) findAddressList(ctx context.Context, key tl.DHTKey) (tl.AdnlAddressList, ed25519.PublicKey, time.Time, error) {
+	keyID, err := ValueKey(key)
+	if err != nil {
+		return tl.AdnlAddressList{}, nil, time.Time{}, err
+	}
+
+	value, _, err := n.FindValue(ctx, keyID)
+	if err != nil {
+		return tl.AdnlAddressList{}, nil, time.Time{}, err
+	}
+
+	// the signature was verified when the value was received, and the key of a signed value
+	// is the key of its owner
+	if _, ok := value.Key.UpdateRule.(tl.DHTUpdateRuleSignature); !ok {
+		return tl.AdnlAddressList{}, nil, time.Time{}, fmt.Errorf("%w: update rule %T", ErrInvalidAddressList, value.Key.UpdateRule)
+	}
+
+	var list tl.AdnlAddressList
+	err = tlH.Parse(value.Value, &list, true)
+	if err != nil {
+		return tl.AdnlAddressList{}, nil, time.Time{}, fmt.Errorf("%w: %w", ErrInvalidAddressList, err)
+	}
+
+	return list, ed25519.PublicKey(value.Key.ID.Key), time.Unix(value.TTL, 0), nil
+}
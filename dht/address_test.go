@@ -0,0 +1,110 @@
+package dht
+
+import (
+	"bytes"
+	"context"
+	"crypto/ed25519"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/Gealber/dht/adnl"
+	"github.com/Gealber/dht/tl"
+	"github.com/Gealber/dht/utils"
+)
+
+func TestResolveAddress(t *testing.T) {
+	a, b, c := startTestNode(t), startTestNode(t), startTestNode(t)
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	for _, tn := range []testNode{a, b, c} {
+		err := tn.node.Start(context.Background())
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer tn.shutdown(ctx)
+	}
+
+	bRemote, err := NewRemote(b.node.PubKey(), b.node.Addr())
+	if err != nil {
+		t.Fatal(err)
+	}
+	a.node.mu.Lock()
+	a.node.addNode(bRemote)
+	a.node.mu.Unlock()
+
+	// c publishes its address through a, it's stored by b
+	cAddr, err := adnl.AddressFromAddrPort(c.node.Addr())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	list := tl.AdnlAddressList{Addresses: []any{cAddr}, Version: 1, ReinitDate: 1}
+	stored, _, err := a.node.StoreAddress(ctx, c.privKey, list, time.Now().Add(time.Hour))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stored != 1 {
+		t.Fatalf("address stored by %d nodes", stored)
+	}
+
+	cID, err := utils.KeyIDEd25519(c.node.PubKey())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	resolved, err := a.node.ResolveAddress(ctx, cID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !resolved.PubKey.Equal(c.node.PubKey()) || len(resolved.List.Addresses) != 1 || len(resolved.Priority.Addresses) != 0 {
+		t.Fatalf("unexpected resolved address %+v", resolved)
+	}
+
+	// the priority list is resolved along the address list
+	stored, _, err = a.node.StorePriorityAddress(ctx, c.privKey, list, time.Now().Add(time.Minute))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stored != 1 {
+		t.Fatalf("priority address stored by %d nodes", stored)
+	}
+
+	resolved, err = a.node.ResolveAddress(ctx, cID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(resolved.Priority.Addresses) != 1 || resolved.ExpireAt.After(time.Now().Add(time.Minute)) {
+		t.Fatalf("unexpected resolved address %+v", resolved)
+	}
+
+	// a queries c knowing only its adnl id
+	c.peer.SetQueryHandler(func(from ed25519.PublicKey, query []byte) ([]byte, error) {
+		return query, nil
+	})
+	a.peer.SetAddressResolver(a.node)
+
+	answer, err := a.peer.QueryTo(ctx, cID, []byte{1, 2, 3})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(answer, []byte{1, 2, 3}) {
+		t.Fatalf("unexpected answer %x", answer)
+	}
+
+	// ids without a stored address list aren't resolved
+	_, privKey, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	unknownID, err := utils.KeyIDEd25519(privKey.Public().(ed25519.PublicKey))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = a.node.ResolveAddress(ctx, unknownID)
+	if !errors.Is(err, ErrValueNotFound) {
+		t.Fatalf("expected value not found got %v", err)
+	}
+}
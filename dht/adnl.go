@@ -0,0 +1,162 @@
+package dht
+
+import (
+	"context"
+	"crypto/ed25519"
+	"errors"
+	"net/netip"
+	"sync"
+	"time"
+
+	"github.com/Gealber/dht/adnl"
+	"github.com/Gealber/dht/tl"
+	"github.com/Gealber/dht/utils"
+)
+
+// receiveQueueSize amount of queries PeerADNL buffers until the node reads them
+const receiveQueueSize = 1024
+
+var (
+	ErrADNLClosed = errors.New("dht adnl closed")
+	ErrNoAnswer   = errors.New("query not answered by the node")
+)
+
+// queries received by the nodes, dht.query prefixes them with the description of the sender
+var queries = []string{tl.TLDHTQuery, tl.TLDHTPing, tl.TLDHTStore, tl.TLDHTFindNode, tl.TLDHTFindValue}
+
+// Message is a query received from Src, a structure serialized with TL including
+// its 4-byte prefix(a boxed scheme) indicating the scheme ID.
+type Message struct {
+	Src  *Node
+	Data []byte
+	// Answer sends back the answer of the query, it's called once with nil in case the
+	// query isn't answered. Can be nil if the sender doesn't wait for an answer
+	Answer func(answer []byte)
+}
+
+// answer sends back answer, if the sender waits for it.
+func (m Message) answer(answer []byte) {
+	if m.Answer != nil {
+		m.Answer(answer)
+	}
+}
+
+// ADNL is the transport layer used by the nodes to communicate.
+type ADNL interface {
+	// Query sends data to dst, waiting for its answer until ctx is done
+	Query(ctx context.Context, dst *Node, data []byte) ([]byte, error)
+	// Receive return a channel of the queries received from other nodes
+	Receive() <-chan Message
+}
+
+// PeerADNL implements ADNL over an adnl.Peer, the messages are sent as adnl.message.query.
+type PeerADNL struct {
+	peer *adnl.Peer
+	msgs chan Message
+	// done is closed with msgs, releasing the handlers waiting for an answer
+	done chan struct{}
+	// mu protects msgs from being written once closed
+	mu     sync.Mutex
+	closed bool
+}
+
+// NewPeerADNL registers in peer the handlers of the dht queries, which are delivered
+// through Receive until Close is called.
+func NewPeerADNL(peer *adnl.Peer) *PeerADNL {
+	a := &PeerADNL{
+		peer: peer,
+		msgs: make(chan Message, receiveQueueSize),
+		done: make(chan struct{}),
+	}
+
+	for _, query := range queries {
+		peer.Handle(tl.Crc32(query), a.handle)
+	}
+
+	return a
+}
+
+// Query sends data to dst through the peer, in case ctx doesn't have a deadline the
+// adaptive timeout of the peer is used.
+func (a *PeerADNL) Query(ctx context.Context, dst *Node, data []byte) ([]byte, error) {
+	return a.peer.Query(ctx, dst.PubKey(), dst.addr, data)
+}
+
+// Receive returns the channel of the received queries, closed once Close is called.
+func (a *PeerADNL) Receive() <-chan Message {
+	return a.msgs
+}
+
+// Close removes the handlers from the peer and closes the channel of the received queries,
+// the queries not answered yet fail.
+func (a *PeerADNL) Close() error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	if a.closed {
+		return ErrADNLClosed
+	}
+	a.closed = true
+
+	for _, query := range queries {
+		a.peer.Handle(tl.Crc32(query), nil)
+	}
+	close(a.msgs)
+	close(a.done)
+
+	return nil
+}
+
+// handle queues a query received by the peer and waits for its answer, the query is
+// dropped when the queue is full.
+func (a *PeerADNL) handle(from ed25519.PublicKey, data []byte) ([]byte, error) {
+	src, err := NewRemote(from, a.senderAddr(from))
+	if err != nil {
+		return nil, err
+	}
+
+	answerChn := make(chan []byte, 1)
+	msg := Message{
+		Src:    src,
+		Data:   data,
+		Answer: func(answer []byte) { answerChn <- answer },
+	}
+
+	a.mu.Lock()
+	if a.closed {
+		a.mu.Unlock()
+		return nil, ErrADNLClosed
+	}
+
+	select {
+	case a.msgs <- msg:
+	default:
+		a.mu.Unlock()
+		return nil, ErrQueueFull
+	}
+	a.mu.Unlock()
+
+	select {
+	case answer := <-answerChn:
+		if answer == nil {
+			return nil, ErrNoAnswer
+		}
+		return answer, nil
+	case <-a.done:
+		return nil, ErrADNLClosed
+	case <-time.After(adnl.DefaultQueryTimeout):
+		return nil, ErrNoAnswer
+	}
+}
+
+// senderAddr returns the address the sender advertised to the peer, if any.
+func (a *PeerADNL) senderAddr(from ed25519.PublicKey) netip.AddrPort {
+	id, err := utils.KeyIDEd25519(from)
+	if err != nil {
+		return netip.AddrPort{}
+	}
+
+	addr, _ := a.peer.Address(id)
+
+	return addr
+}
@@ -0,0 +1,179 @@
+package dht
+
+import (
+	"context"
+	"encoding/hex"
+	"math/big"
+	"sync"
+
+	"github.com/Gealber/dht/tl"
+)
+
+// LookupStats describes the work done by a lookup.
+type LookupStats struct {
+	// Hops amount of rounds of parallel queries until the lookup finished
+	Hops int
+	// Queries amount of queries sent, Failed the ones without answer
+	Queries int
+	Failed  int
+}
+
+// lookupResult is the answer of a node queried during a lookup.
+type lookupResult struct {
+	nodes []*Node
+	value *tl.DHTValue
+	err   error
+}
+
+// lookup keeps the candidates of an iterative lookup, sorted by distance to the target.
+type lookup struct {
+	self       *Node
+	target     *big.Int
+	candidates []*Node
+	// state of the candidates, indexed by their dht address
+	seen     map[string]bool
+	queried  map[string]bool
+	failed   map[string]bool
+	answered map[string]bool
+}
+
+func newLookup(self *Node, target *big.Int) *lookup {
+	return &lookup{
+		self:     self,
+		target:   target,
+		seen:     make(map[string]bool),
+		queried:  make(map[string]bool),
+		failed:   make(map[string]bool),
+		answered: make(map[string]bool),
+	}
+}
+
+// add adds the nodes not seen yet to the candidates.
+func (l *lookup) add(nodes ...*Node) {
+	for _, nd := range nodes {
+		id := nd.semiPermanentAddress.Text(16)
+		if l.seen[id] || nd.semiPermanentAddress.Cmp(l.self.semiPermanentAddress) == 0 {
+			continue
+		}
+
+		l.seen[id] = true
+		l.candidates = append(l.candidates, nd)
+	}
+
+	sortByDistance(l.candidates, l.target)
+}
+
+// next returns up to count candidates to query, the nearest ones not queried yet among the
+// K nearest candidates that didn't fail. None are returned once all of them answered.
+func (l *lookup) next(count int) []*Node {
+	var nodes []*Node
+	considered := 0
+	for _, nd := range l.candidates {
+		if considered == K || len(nodes) == count {
+			break
+		}
+
+		id := nd.semiPermanentAddress.Text(16)
+		if l.failed[id] {
+			continue
+		}
+		considered++
+
+		if !l.queried[id] {
+			nodes = append(nodes, nd)
+		}
+	}
+
+	return nodes
+}
+
+// nearest returns the K nearest candidates which answered.
+func (l *lookup) nearest() []*Node {
+	nodes := make([]*Node, 0, K)
+	for _, nd := range l.candidates {
+		if len(nodes) == K {
+			break
+		}
+
+		if l.answered[nd.semiPermanentAddress.Text(16)] {
+			nodes = append(nodes, nd)
+		}
+	}
+
+	return nodes
+}
+
+// FindNode looks up the K nearest nodes to key, querying in each round the alpha nearest
+// nodes not queried yet until the K nearest known ones answered.
+func (n *Node) FindNode(ctx context.Context, key []byte) ([]*Node, LookupStats, error) {
+	nodes, _, stats, err := n.lookup(ctx, key, false)
+	return nodes, stats, err
+}
+
+// lookup performs an iterative lookup of key, in case findValue is true it finishes
+// as soon as a node answers with the value stored with key.
+func (n *Node) lookup(ctx context.Context, key []byte, findValue bool) ([]*Node, *tl.DHTValue, LookupStats, error) {
+	var stats LookupStats
+	target := new(big.Int).SetBytes(key)
+
+	n.mu.Lock()
+	start := n.selectKNearestNodes(target, K, nil)
+	n.mu.Unlock()
+	if len(start) == 0 {
+		return nil, nil, stats, ErrNoNodes
+	}
+
+	l := newLookup(n, target)
+	l.add(start...)
+
+	for {
+		round := l.next(alpha)
+		if len(round) == 0 {
+			break
+		}
+		stats.Hops++
+		stats.Queries += len(round)
+
+		results := make([]lookupResult, len(round))
+		var wg sync.WaitGroup
+		for i, dst := range round {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				var res lookupResult
+				if findValue {
+					res.value, res.nodes, res.err = n.SendFindValue(ctx, dst, key, K)
+				} else {
+					res.nodes, res.err = n.SendFindNode(ctx, dst, key, K)
+				}
+				results[i] = res
+			}()
+		}
+		wg.Wait()
+
+		if err := ctx.Err(); err != nil {
+			return nil, nil, stats, err
+		}
+
+		for i, res := range results {
+			id := round[i].semiPermanentAddress.Text(16)
+			l.queried[id] = true
+			if res.err != nil {
+				l.failed[id] = true
+				stats.Failed++
+				continue
+			}
+			l.answered[id] = true
+
+			if res.value != nil {
+				return l.nearest(), res.value, stats, nil
+			}
+
+			l.add(res.nodes...)
+		}
+	}
+	n.logger.Debug("lookup finished", "key", hex.EncodeToString(key), "hops", stats.Hops,
+		"queries", stats.Queries, "failed", stats.Failed)
+
+	return l.nearest(), nil, stats, nil
+}
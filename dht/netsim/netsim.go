@@ -0,0 +1,808 @@
+// Package netsim simulates in-process a network of DHT nodes, hundreds to thousands of them, for
+// checking that lookups converge. Queries are delivered by calling the query handler of the
+// destination node, applying the latency, loss, churn and partitions of the simulation, or through
+// adnl peers over a memnet network for smaller networks. Time is given by a clock controlled by
+// the simulation, advanced by the round trip of the queries.
+package netsim
+
+import (
+	"context"
+	"crypto/ed25519"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+	"math/big"
+	"math/rand"
+	"net/netip"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Gealber/dht/adnl"
+	"github.com/Gealber/dht/adnl/memnet"
+	"github.com/Gealber/dht/dht"
+	"github.com/Gealber/dht/tl"
+)
+
+// tlH parses the prefix of the queries for the metrics
+var tlH = func() *tl.TLHandler {
+	h := tl.New()
+	h.Register(tl.DefaultTLModel)
+	return h
+}()
+
+const (
+	// port every node of the simulation listens on
+	port = 30303
+	// bootstrapAttempts amount of seeds a node tries until one of them answers
+	bootstrapAttempts = 3
+)
+
+var (
+	ErrOffline     = errors.New("node is offline")
+	ErrUnreachable = errors.New("no online node at the address")
+	ErrPartitioned = errors.New("node is in another partition")
+	ErrLost        = errors.New("query lost")
+	ErrTimeout     = errors.New("query timed out")
+)
+
+// Config describes the simulated network.
+type Config struct {
+	// Nodes amount of nodes started by New
+	Nodes int
+	// Seed of the random decisions of the simulation, including the keys of the nodes
+	Seed int64
+	// Latency round trip time of a query, plus a random delay up to Jitter
+	Latency time.Duration
+	Jitter  time.Duration
+	// Loss probability of a query being lost, between 0 and 1
+	Loss float64
+	// QueryTimeout queries with a round trip time above it fail, zero means 2 seconds
+	QueryTimeout time.Duration
+	// ADNL runs the nodes over adnl peers on a memnet network, instead of calling the query
+	// handlers directly. Latency, jitter and loss are applied by memnet in real time, so it's
+	// meant for networks of tens of nodes. The peers are stopped by Close
+	ADNL bool
+}
+
+// Clock is the time of the simulation, it moves forward with the round trip of the queries
+// and when Advance is called.
+type Clock struct {
+	mu  sync.Mutex
+	now time.Time
+}
+
+// NewClock returns a clock starting at start.
+func NewClock(start time.Time) *Clock {
+	return &Clock{now: start}
+}
+
+// Now returns the current time of the simulation.
+func (c *Clock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.now
+}
+
+// Advance moves the clock forward by d.
+func (c *Clock) Advance(d time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.now = c.now.Add(d)
+}
+
+// AdvanceTo moves the clock forward to t, unless it's already past it. Queries sent at the same
+// time advance the clock by the slowest of them.
+func (c *Clock) AdvanceTo(t time.Time) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if t.After(c.now) {
+		c.now = t
+	}
+}
+
+// Metrics of the queries and lookups done in the simulation.
+type Metrics struct {
+	// Lookups amount of lookups done through the simulation, Succeeded the ones that found the
+	// nearest reachable node to the key, or the value looked up
+	Lookups   int
+	Succeeded int
+	// Hops total amount of rounds of the lookups
+	Hops int
+	// Messages amount of queries sent, indexed by their TL constructor name, dht.findNode for example
+	Messages map[string]uint64
+	// Failed amount of queries without answer, indexed by the reason, ErrLost for example
+	Failed map[error]uint64
+}
+
+// SuccessRate returns the rate of lookups that succeeded, between 0 and 1.
+func (m Metrics) SuccessRate() float64 {
+	if m.Lookups == 0 {
+		return 0
+	}
+
+	return float64(m.Succeeded) / float64(m.Lookups)
+}
+
+// AvgHops returns the average amount of rounds of the lookups.
+func (m Metrics) AvgHops() float64 {
+	if m.Lookups == 0 {
+		return 0
+	}
+
+	return float64(m.Hops) / float64(m.Lookups)
+}
+
+// TotalMessages returns the amount of queries sent.
+func (m Metrics) TotalMessages() uint64 {
+	var total uint64
+	for _, count := range m.Messages {
+		total += count
+	}
+
+	return total
+}
+
+// simNode is a node of the simulation.
+type simNode struct {
+	node *dht.Node
+	// remote the node as known by other nodes
+	remote  *dht.Node
+	privKey ed25519.PrivateKey
+	addr    netip.AddrPort
+	online  bool
+	// latency extra round trip time of the queries sent to the node or by it
+	latency time.Duration
+	// peer and adnl the node talks through, nil unless the simulation runs over ADNL
+	peer *adnl.Peer
+	adnl *dht.PeerADNL
+}
+
+// Sim is a simulated network of DHT nodes, identified by their index.
+type Sim struct {
+	mu     sync.Mutex
+	cfg    Config
+	clock  *Clock
+	rnd    *rand.Rand
+	nodes  []*simNode
+	byAddr map[netip.AddrPort]*simNode
+	// net the adnl peers are listening on, nil unless the simulation runs over ADNL
+	net *memnet.Network
+	// group of each partitioned node, nodes in different groups can't reach each other
+	groups map[*simNode]int
+	// names of the queries indexed by their constructor id
+	names   map[uint32]string
+	metrics Metrics
+}
+
+// New starts a simulation of cfg.Nodes nodes, which aren't bootstrapped yet.
+func New(cfg Config) (*Sim, error) {
+	if cfg.QueryTimeout == 0 {
+		cfg.QueryTimeout = 2 * time.Second
+	}
+
+	s := &Sim{
+		cfg:    cfg,
+		clock:  NewClock(time.Unix(1700000000, 0)),
+		rnd:    rand.New(rand.NewSource(cfg.Seed)),
+		byAddr: make(map[netip.AddrPort]*simNode),
+		groups: make(map[*simNode]int),
+		names:  make(map[uint32]string),
+		metrics: Metrics{
+			Messages: make(map[string]uint64),
+			Failed:   make(map[error]uint64),
+		},
+	}
+
+	if cfg.ADNL {
+		// latency and jitter of each datagram, and its loss, given the ones of a query and its answer
+		s.net = memnet.New(memnet.Config{
+			Latency: cfg.Latency / 2,
+			Jitter:  cfg.Jitter / 2,
+			Loss:    1 - math.Sqrt(1-cfg.Loss),
+		}, cfg.Seed)
+	}
+
+	for _, def := range []string{tl.TLDHTPing, tl.TLDHTStore, tl.TLDHTFindNode, tl.TLDHTFindValue} {
+		s.names[tl.Crc32(def)] = strings.Fields(def)[0]
+	}
+
+	for range cfg.Nodes {
+		_, err := s.Join()
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return s, nil
+}
+
+// Join adds a new online node to the simulation, returning its index. The node isn't bootstrapped.
+func (s *Sim) Join() (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	seed := make([]byte, ed25519.SeedSize)
+	s.rnd.Read(seed)
+	privKey := ed25519.NewKeyFromSeed(seed)
+
+	// nodes listen on 10.0.0.0/8, one address each
+	var ip [4]byte
+	binary.BigEndian.PutUint32(ip[:], 10<<24|uint32(len(s.nodes)+1))
+	sn := &simNode{
+		privKey: privKey,
+		addr:    netip.AddrPortFrom(netip.AddrFrom4(ip), port),
+		online:  true,
+	}
+
+	node, err := dht.New(privKey, sn.addr, &transport{sim: s, self: sn})
+	if err != nil {
+		return 0, err
+	}
+	node.SetClock(s.clock.Now)
+	sn.node = node
+
+	if s.net != nil {
+		err = s.startPeer(sn)
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	sn.remote, err = dht.NewRemote(node.PubKey(), sn.addr)
+	if err != nil {
+		return 0, err
+	}
+
+	s.nodes = append(s.nodes, sn)
+	s.byAddr[sn.addr] = sn
+
+	return len(s.nodes) - 1, nil
+}
+
+// startPeer starts the adnl peer of sn on the memnet network, and the node answering the
+// queries received through it. Should be used with s.mu.
+func (s *Sim) startPeer(sn *simNode) error {
+	conn, err := s.net.Listen(sn.addr)
+	if err != nil {
+		return err
+	}
+
+	pubKey := sn.privKey.Public().(ed25519.PublicKey)
+	peer, err := adnl.New(sn.privKey, pubKey, 0)
+	if err != nil {
+		return err
+	}
+
+	// the nodes learn the address of the senders from their address list
+	err = peer.SetAddressList(sn.addr)
+	if err != nil {
+		return err
+	}
+
+	err = peer.StartTransport(context.Background(), conn)
+	if err != nil {
+		return err
+	}
+	sn.peer = peer
+	sn.adnl = dht.NewPeerADNL(peer)
+
+	return sn.node.Start(context.Background())
+}
+
+// Close stops the nodes and their adnl peers, when the simulation runs over ADNL.
+func (s *Sim) Close() error {
+	s.mu.Lock()
+	nodes := s.nodes
+	s.mu.Unlock()
+
+	ctx := context.Background()
+	var errs []error
+	for _, sn := range nodes {
+		if sn.peer == nil {
+			continue
+		}
+
+		errs = append(errs, sn.peer.Shutdown(ctx), sn.adnl.Close(), sn.node.Shutdown(ctx))
+	}
+
+	return errors.Join(errs...)
+}
+
+// Len returns the amount of nodes of the simulation, online or not.
+func (s *Sim) Len() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return len(s.nodes)
+}
+
+// Node returns the i-th node.
+func (s *Sim) Node(i int) *dht.Node {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.nodes[i].node
+}
+
+// PrivKey returns the private key of the i-th node.
+func (s *Sim) PrivKey(i int) ed25519.PrivateKey {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.nodes[i].privKey
+}
+
+// Clock returns the clock of the simulation.
+func (s *Sim) Clock() *Clock {
+	return s.clock
+}
+
+// Online returns the indexes of the online nodes.
+func (s *Sim) Online() []int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var online []int
+	for i, sn := range s.nodes {
+		if sn.online {
+			online = append(online, i)
+		}
+	}
+
+	return online
+}
+
+// Random returns the index of a random online node, -1 if all of them are offline.
+func (s *Sim) Random() int {
+	online := s.Online()
+	if len(online) == 0 {
+		return -1
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return online[s.rnd.Intn(len(online))]
+}
+
+// RandomKey returns a random key.
+func (s *Sim) RandomKey() []byte {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	key := make([]byte, 32)
+	s.rnd.Read(key)
+
+	return key
+}
+
+// Bootstrap bootstraps every online node, one after the other, from the first node.
+func (s *Sim) Bootstrap(ctx context.Context) error {
+	for _, i := range s.Online() {
+		err := s.BootstrapNode(ctx, i)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// BootstrapNode bootstraps the i-th node from the first online node other than itself, the next
+// ones are tried in case it doesn't answer.
+func (s *Sim) BootstrapNode(ctx context.Context, i int) error {
+	s.mu.Lock()
+	var seeds []*dht.Node
+	for j, sn := range s.nodes {
+		if j != i && sn.online {
+			seeds = append(seeds, sn.remote)
+		}
+
+		if len(seeds) == bootstrapAttempts {
+			break
+		}
+	}
+	s.mu.Unlock()
+
+	// a lonely node doesn't have anyone to bootstrap from
+	if len(seeds) == 0 {
+		return nil
+	}
+
+	// the queries to a seed might be lost, the next one is tried
+	var err error
+	for _, seed := range seeds {
+		err = s.Node(i).Bootstrap(ctx, seed)
+		if !errors.Is(err, dht.ErrNoNodes) {
+			break
+		}
+	}
+
+	if err != nil {
+		return fmt.Errorf("bootstrapping node %d: %w", i, err)
+	}
+
+	return nil
+}
+
+// Stop takes the i-th node offline, it doesn't answer nor send queries until it's restarted.
+func (s *Sim) Stop(i int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.nodes[i].online = false
+	s.updateNet(s.nodes[i])
+}
+
+// Restart takes the i-th node back online, with the state it had.
+func (s *Sim) Restart(i int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.nodes[i].online = true
+	s.updateNet(s.nodes[i])
+}
+
+// updateNet applies to the datagrams sent to and from sn its latency, or drops them while it's
+// offline, when the simulation runs over ADNL. Should be used with s.mu.
+func (s *Sim) updateNet(sn *simNode) {
+	switch {
+	case s.net == nil:
+	case !sn.online:
+		s.net.SetNodeConfig(sn.addr, memnet.Config{Loss: 1})
+	case sn.latency > 0:
+		s.net.SetNodeConfig(sn.addr, memnet.Config{
+			Latency: (s.cfg.Latency + sn.latency) / 2,
+			Jitter:  s.cfg.Jitter / 2,
+			Loss:    1 - math.Sqrt(1-s.cfg.Loss),
+		})
+	default:
+		s.net.ResetNodeConfig(sn.addr)
+	}
+}
+
+// Churn takes offline a fraction, between 0 and 1, of the online nodes chosen at random,
+// and joins count new nodes bootstrapped from the remaining ones. Returns the indexes of
+// the nodes taken offline.
+func (s *Sim) Churn(ctx context.Context, fraction float64, count int) ([]int, error) {
+	online := s.Online()
+
+	s.mu.Lock()
+	s.rnd.Shuffle(len(online), func(i, j int) { online[i], online[j] = online[j], online[i] })
+	stopped := online[:int(fraction*float64(len(online)))]
+	for _, i := range stopped {
+		s.nodes[i].online = false
+		s.updateNet(s.nodes[i])
+	}
+	s.mu.Unlock()
+
+	for range count {
+		i, err := s.Join()
+		if err != nil {
+			return nil, err
+		}
+
+		err = s.BootstrapNode(ctx, i)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	sort.Ints(stopped)
+
+	return stopped, nil
+}
+
+// Partition splits the network, nodes in different groups can't reach each other. Nodes
+// not included in any group reach everyone. Replaces any previous partition.
+func (s *Sim) Partition(groups ...[]int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.groups = make(map[*simNode]int)
+	addrs := make([][]netip.AddrPort, len(groups))
+	for g, group := range groups {
+		for _, i := range group {
+			s.groups[s.nodes[i]] = g
+			addrs[g] = append(addrs[g], s.nodes[i].addr)
+		}
+	}
+
+	if s.net != nil {
+		s.net.Partition(addrs...)
+	}
+}
+
+// Heal removes the partition of the network.
+func (s *Sim) Heal() {
+	s.Partition()
+}
+
+// SetLatency sets the extra round trip time of the queries sent to and by the i-th node, a
+// slow node. Queries slower than the query timeout fail.
+func (s *Sim) SetLatency(i int, latency time.Duration) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.nodes[i].latency = latency
+	s.updateNet(s.nodes[i])
+}
+
+// Metrics returns the metrics of the simulation so far.
+func (s *Sim) Metrics() Metrics {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	m := s.metrics
+	m.Messages = make(map[string]uint64, len(s.metrics.Messages))
+	for name, count := range s.metrics.Messages {
+		m.Messages[name] = count
+	}
+
+	m.Failed = make(map[error]uint64, len(s.metrics.Failed))
+	for err, count := range s.metrics.Failed {
+		m.Failed[err] = count
+	}
+
+	return m
+}
+
+// ResetMetrics sets to zero the metrics of the simulation.
+func (s *Sim) ResetMetrics() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.metrics = Metrics{
+		Messages: make(map[string]uint64),
+		Failed:   make(map[error]uint64),
+	}
+}
+
+// FindNode looks up key from the i-th node. The lookup succeeds if the nearest node to key
+// reachable from the i-th node is the nearest one found.
+func (s *Sim) FindNode(ctx context.Context, i int, key []byte) (bool, error) {
+	nodes, stats, err := s.Node(i).FindNode(ctx, key)
+	if err != nil && !errors.Is(err, dht.ErrNoNodes) {
+		return false, err
+	}
+
+	want := s.nearestReachable(i, key)
+	ok := want != nil && len(nodes) > 0 && string(nodes[0].ID()) == string(want.ID())
+	s.recordLookup(stats, ok)
+
+	return ok, nil
+}
+
+// Store stores value from the i-th node, returning the amount of nodes that stored it.
+func (s *Sim) Store(ctx context.Context, i int, value tl.DHTValue) (int, error) {
+	stored, stats, err := s.Node(i).Store(ctx, value)
+	s.recordLookup(stats, err == nil)
+
+	return stored, err
+}
+
+// FindValue looks up from the i-th node the value stored with key. The lookup succeeds
+// if the value is found.
+func (s *Sim) FindValue(ctx context.Context, i int, key []byte) (tl.DHTValue, bool) {
+	value, stats, err := s.Node(i).FindValue(ctx, key)
+	s.recordLookup(stats, err == nil)
+
+	return value, err == nil
+}
+
+// recordLookup adds a lookup to the metrics.
+func (s *Sim) recordLookup(stats dht.LookupStats, succeeded bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.metrics.Lookups++
+	s.metrics.Hops += stats.Hops
+	if succeeded {
+		s.metrics.Succeeded++
+	}
+}
+
+// nearestReachable returns the nearest node to key, other than the i-th node, which the
+// i-th node can reach.
+func (s *Sim) nearestReachable(i int, key []byte) *dht.Node {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	target := new(big.Int).SetBytes(key)
+	from := s.nodes[i]
+
+	var nearest *dht.Node
+	var best *big.Int
+	for j, sn := range s.nodes {
+		if j == i || s.reachable(from, sn) != nil {
+			continue
+		}
+
+		d := new(big.Int).Xor(new(big.Int).SetBytes(sn.node.ID()), target)
+		if best == nil || d.Cmp(best) < 0 {
+			nearest, best = sn.node, d
+		}
+	}
+
+	return nearest
+}
+
+// reachable returns why to can't answer the queries of from, nil if it can.
+// Should be used with s.mu.
+func (s *Sim) reachable(from, to *simNode) error {
+	if !from.online {
+		return ErrOffline
+	}
+
+	if !to.online {
+		return ErrUnreachable
+	}
+
+	fromGroup, fromOK := s.groups[from]
+	toGroup, toOK := s.groups[to]
+	if fromOK && toOK && fromGroup != toGroup {
+		return ErrPartitioned
+	}
+
+	// jitter aside, the query is too slow
+	if s.cfg.Latency+from.latency+to.latency > s.cfg.QueryTimeout {
+		return ErrTimeout
+	}
+
+	return nil
+}
+
+// queryName returns the name of the query in data, skipping the description of the sender
+// prefixing it.
+func queryName(names map[uint32]string, data []byte) string {
+	if len(data) >= 4 && binary.LittleEndian.Uint32(data) == tl.Crc32(tl.TLDHTQuery) {
+		_, rest, err := tlH.ParseBoxedPrefix(data)
+		if err != nil {
+			return ""
+		}
+		data = rest
+	}
+
+	if len(data) < 4 {
+		return ""
+	}
+
+	return names[binary.LittleEndian.Uint32(data)]
+}
+
+// query delivers the query data sent by from to the node at dst, advancing the clock by its
+// round trip. Queries without answer advance it by the query timeout.
+func (s *Sim) query(ctx context.Context, from *simNode, dst *dht.Node, data []byte) ([]byte, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	start := s.clock.Now()
+	s.mu.Lock()
+	s.metrics.Messages[queryName(s.names, data)]++
+
+	if s.net != nil {
+		s.mu.Unlock()
+		return s.queryADNL(ctx, start, from, dst, data)
+	}
+
+	rtt, err := s.deliver(from, dst)
+	if err != nil {
+		s.metrics.Failed[err]++
+		s.mu.Unlock()
+
+		// offline nodes don't send the query, otherwise we wait for the answer until the timeout
+		if !errors.Is(err, ErrOffline) {
+			s.clock.AdvanceTo(start.Add(s.cfg.QueryTimeout))
+		}
+		return nil, err
+	}
+
+	to := s.byAddr[dst.Addr()]
+	s.mu.Unlock()
+
+	answer, err := to.node.HandleQuery(from.remote, data)
+	s.clock.AdvanceTo(start.Add(rtt))
+
+	return answer, err
+}
+
+// queryADNL sends the query data through the adnl peer of from to the node at dst, advancing
+// the clock by the time it takes since start. The reason of the failed queries is taken from
+// the state of the simulation, the ones reaching the other node are counted as lost.
+func (s *Sim) queryADNL(ctx context.Context, start time.Time, from *simNode, dst *dht.Node, data []byte) ([]byte, error) {
+	s.mu.Lock()
+	online := from.online
+	s.mu.Unlock()
+
+	if !online {
+		s.fail(ErrOffline)
+		return nil, ErrOffline
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, s.cfg.QueryTimeout)
+	defer cancel()
+
+	sent := time.Now()
+	answer, err := from.adnl.Query(ctx, dst, data)
+	s.clock.AdvanceTo(start.Add(time.Since(sent)))
+	if err == nil {
+		return answer, nil
+	}
+
+	s.mu.Lock()
+	reason := ErrLost
+	if to, ok := s.byAddr[dst.Addr()]; !ok {
+		reason = ErrUnreachable
+	} else if unreachable := s.reachable(from, to); unreachable != nil {
+		reason = unreachable
+	}
+	s.mu.Unlock()
+	s.fail(reason)
+
+	return nil, fmt.Errorf("%w: %w", reason, err)
+}
+
+// fail adds to the metrics a query failed because of reason.
+func (s *Sim) fail(reason error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.metrics.Failed[reason]++
+}
+
+// deliver decides if the query of from reaches the node at dst, returning its round trip time.
+// Should be used with s.mu.
+func (s *Sim) deliver(from *simNode, dst *dht.Node) (time.Duration, error) {
+	to, ok := s.byAddr[dst.Addr()]
+	if !ok {
+		return 0, ErrUnreachable
+	}
+
+	err := s.reachable(from, to)
+	if err != nil {
+		return 0, err
+	}
+
+	if s.rnd.Float64() < s.cfg.Loss {
+		return 0, ErrLost
+	}
+
+	rtt := s.cfg.Latency + from.latency + to.latency
+	if s.cfg.Jitter > 0 {
+		rtt += time.Duration(s.rnd.Int63n(int64(s.cfg.Jitter)))
+	}
+
+	if rtt > s.cfg.QueryTimeout {
+		return 0, ErrTimeout
+	}
+
+	return rtt, nil
+}
+
+// transport delivers the queries of a node through the simulation, it implements dht.ADNL.
+type transport struct {
+	sim  *Sim
+	self *simNode
+}
+
+func (t *transport) Query(ctx context.Context, dst *dht.Node, data []byte) ([]byte, error) {
+	return t.sim.query(ctx, t.self, dst, data)
+}
+
+// Receive returns the queries received by the adnl peer of the node. Without ADNL the channel
+// never delivers queries, they are handled by calling the query handler of the node, so nodes
+// don't need to Run.
+func (t *transport) Receive() <-chan dht.Message {
+	if t.self.adnl == nil {
+		return nil
+	}
+
+	return t.self.adnl.Receive()
+}
@@ -0,0 +1,288 @@
+package netsim
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/Gealber/dht/dht"
+	"github.com/Gealber/dht/tl"
+	"github.com/Gealber/dht/utils"
+)
+
+// newBootstrappedSim starts a simulation of n nodes and bootstraps them, the simulation is
+// closed once the test finishes. The scenarios take a while, they are skipped in short mode.
+func newBootstrappedSim(t *testing.T, cfg Config) *Sim {
+	t.Helper()
+
+	if testing.Short() {
+		t.Skip("skipping network simulation in short mode")
+	}
+
+	s, err := New(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		err := s.Close()
+		if err != nil {
+			t.Error(err)
+		}
+	})
+
+	err = s.Bootstrap(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return s
+}
+
+// findNodes looks up count random keys from random online nodes, skipping the ones
+// for which skip returns true, returning the metrics of the lookups.
+func findNodes(t *testing.T, s *Sim, count int, skip func(i int) bool) Metrics {
+	t.Helper()
+
+	s.ResetMetrics()
+	for range count {
+		i := s.Random()
+		for skip != nil && skip(i) {
+			i = s.Random()
+		}
+
+		_, err := s.FindNode(context.Background(), i, s.RandomKey())
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	return s.Metrics()
+}
+
+// newValue returns a signed value stored with name by the i-th node, and its key.
+func newValue(t *testing.T, s *Sim, i int, name string, ttl time.Duration) (tl.DHTValue, []byte) {
+	t.Helper()
+
+	privKey := s.PrivKey(i)
+	ownerID, err := utils.KeyIDEd25519(privKey[32:])
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	value, err := dht.SignValue(tl.DHTValue{
+		Key: tl.DHTKeyDescription{
+			Key: tl.DHTKey{ID: ownerID, Name: []byte(name)},
+		},
+		Value: []byte("value of " + name),
+		TTL:   s.Clock().Now().Add(ttl).Unix(),
+	}, privKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	key, err := dht.ValueKey(value.Key.Key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return value, key
+}
+
+func TestBootstrap(t *testing.T) {
+	cfg := Config{Nodes: 500, Seed: 1, Latency: 50 * time.Millisecond}
+	s := newBootstrappedSim(t, cfg)
+
+	start := s.Clock().Now()
+	m := findNodes(t, s, 200, nil)
+	if m.SuccessRate() < 0.95 {
+		t.Errorf("got success rate %.2f want at least 0.95", m.SuccessRate())
+	}
+
+	if m.AvgHops() > 8 {
+		t.Errorf("got %.2f hops per lookup want at most 8", m.AvgHops())
+	}
+
+	if m.Messages["dht.findNode"] == 0 || m.Messages["dht.findNode"] != m.TotalMessages() {
+		t.Errorf("unexpected messages %v", m.Messages)
+	}
+
+	// every lookup takes at least the round trip of a query
+	if elapsed := s.Clock().Now().Sub(start); elapsed < time.Duration(m.Lookups)*cfg.Latency {
+		t.Errorf("clock advanced %s by %d lookups", elapsed, m.Lookups)
+	}
+	t.Logf("success rate %.3f, %.2f hops and %.1f messages per lookup", m.SuccessRate(), m.AvgHops(), float64(m.TotalMessages())/float64(m.Lookups))
+}
+
+func TestStoreFindValue(t *testing.T) {
+	s := newBootstrappedSim(t, Config{Nodes: 300, Seed: 2, Loss: 0.05})
+
+	keys := make([][]byte, 0, 20)
+	for i := range 20 {
+		value, key := newValue(t, s, s.Random(), fmt.Sprintf("value-%d", i), time.Hour)
+		stored, err := s.Store(context.Background(), s.Random(), value)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if stored < dht.K/2 {
+			t.Errorf("value stored by %d nodes want at least %d", stored, dht.K/2)
+		}
+		keys = append(keys, key)
+	}
+
+	s.ResetMetrics()
+	for i, key := range keys {
+		value, ok := s.FindValue(context.Background(), s.Random(), key)
+		if ok && string(value.Value) != fmt.Sprintf("value of value-%d", i) {
+			t.Errorf("unexpected value %q", value.Value)
+		}
+	}
+
+	m := s.Metrics()
+	if m.SuccessRate() < 0.95 {
+		t.Errorf("got success rate %.2f want at least 0.95", m.SuccessRate())
+	}
+
+	if m.Failed[ErrLost] == 0 {
+		t.Error("expected lost queries")
+	}
+
+	// values aren't found once expired
+	s.Clock().Advance(2 * time.Hour)
+	s.ResetMetrics()
+	for _, key := range keys {
+		s.FindValue(context.Background(), s.Random(), key)
+	}
+
+	if m := s.Metrics(); m.Succeeded != 0 {
+		t.Errorf("%d expired values found", m.Succeeded)
+	}
+}
+
+func TestChurnRecovery(t *testing.T) {
+	s := newBootstrappedSim(t, Config{Nodes: 300, Seed: 3})
+
+	// the queries to the nodes which left wait for the timeout, the values outlive the recovery
+	keys := make([][]byte, 0, 20)
+	for i := range 20 {
+		value, key := newValue(t, s, s.Random(), fmt.Sprintf("value-%d", i), 24*time.Hour)
+		_, err := s.Store(context.Background(), s.Random(), value)
+		if err != nil {
+			t.Fatal(err)
+		}
+		keys = append(keys, key)
+	}
+
+	stopped, err := s.Churn(context.Background(), 0.3, 30)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(stopped) != 90 || len(s.Online()) != 240 {
+		t.Fatalf("got %d nodes stopped and %d online want 90 and 240", len(stopped), len(s.Online()))
+	}
+
+	// lookups remove the nodes which left from the routing tables
+	findNodes(t, s, 200, nil)
+	m := findNodes(t, s, 200, nil)
+	if m.SuccessRate() < 0.95 {
+		t.Errorf("got success rate %.2f after churn want at least 0.95", m.SuccessRate())
+	}
+
+	s.ResetMetrics()
+	for _, key := range keys {
+		s.FindValue(context.Background(), s.Random(), key)
+	}
+
+	m = s.Metrics()
+	if m.SuccessRate() < 0.95 {
+		t.Errorf("got values success rate %.2f after churn want at least 0.95", m.SuccessRate())
+	}
+}
+
+func TestPartitionAndSlowNodes(t *testing.T) {
+	s := newBootstrappedSim(t, Config{Nodes: 200, Seed: 4, Latency: 100 * time.Millisecond, QueryTimeout: time.Second})
+
+	var left, right []int
+	for i := range s.Len() {
+		if i%2 == 0 {
+			left = append(left, i)
+		} else {
+			right = append(right, i)
+		}
+	}
+
+	// nodes only find the nearest node of their own side
+	s.Partition(left, right)
+	m := findNodes(t, s, 100, nil)
+	if m.Failed[ErrPartitioned] == 0 {
+		t.Error("expected queries failed because of the partition")
+	}
+
+	if m.SuccessRate() < 0.95 {
+		t.Errorf("got success rate %.2f within the partition want at least 0.95", m.SuccessRate())
+	}
+
+	s.Heal()
+	m = findNodes(t, s, 100, nil)
+	if m.SuccessRate() < 0.95 {
+		t.Errorf("got success rate %.2f after healing want at least 0.95", m.SuccessRate())
+	}
+
+	// slow nodes can't answer before the timeout, lookups go around them. The lookups are
+	// started by the other nodes, as the slow ones can't reach any node
+	for i := 0; i < s.Len(); i += 10 {
+		s.SetLatency(i, 2*time.Second)
+	}
+
+	m = findNodes(t, s, 100, func(i int) bool { return i%10 == 0 })
+	if m.Failed[ErrTimeout] == 0 {
+		t.Error("expected queries timed out because of the slow nodes")
+	}
+
+	if m.SuccessRate() < 0.95 {
+		t.Errorf("got success rate %.2f with slow nodes want at least 0.95", m.SuccessRate())
+	}
+}
+
+func TestADNL(t *testing.T) {
+	s := newBootstrappedSim(t, Config{Nodes: 20, Seed: 5, Latency: 10 * time.Millisecond, QueryTimeout: 200 * time.Millisecond, ADNL: true})
+
+	start := s.Clock().Now()
+	m := findNodes(t, s, 20, nil)
+	if m.SuccessRate() < 0.95 {
+		t.Errorf("got success rate %.2f want at least 0.95", m.SuccessRate())
+	}
+
+	if !s.Clock().Now().After(start) {
+		t.Error("clock didn't advance with the queries")
+	}
+
+	value, key := newValue(t, s, s.Random(), "value", time.Hour)
+	_, err := s.Store(context.Background(), s.Random(), value)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	found, ok := s.FindValue(context.Background(), s.Random(), key)
+	if !ok || string(found.Value) != string(value.Value) {
+		t.Errorf("value not found through adnl, got %q", found.Value)
+	}
+
+	// queries to the other side of the partition go through memnet, which drops them
+	var left, right []int
+	for i := range s.Len() {
+		if i%2 == 0 {
+			left = append(left, i)
+		} else {
+			right = append(right, i)
+		}
+	}
+
+	s.Partition(left, right)
+	m = findNodes(t, s, 5, nil)
+	if m.Failed[ErrPartitioned] == 0 {
+		t.Error("expected queries failed because of the partition")
+	}
+}
@@ -1,340 +1,707 @@
 package dht
 
 import (
+	"context"
+	"crypto/ed25519"
 	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
 	"encoding/hex"
+	"errors"
 	"fmt"
-	"log"
-	"math"
+	"log/slog"
 	"math/big"
-	"net"
-	"os"
+	"net/netip"
 	"sort"
 	"sync"
 	"time"
 
-	gealberTL "github.com/Gealber/dht/tl"
-	"github.com/xssnick/tonutils-go/tl"
+	"github.com/Gealber/dht/adnl"
+	"github.com/Gealber/dht/tl"
+	"github.com/Gealber/dht/utils"
 )
 
-var (
-	PingID      = gealberTL.SchemeID("dht.ping random_id:long = dht.Pong")
-	PongID      = gealberTL.SchemeID("dht.pong random_id:long = dht.Pong")
-	StoreID     = gealberTL.SchemeID("dht.store value:dht.value = dht.Stored")
-	FindNodeID  = gealberTL.SchemeID("dht.findNode key:int256 k:int = dht.Nodes")
-	FindValueID = gealberTL.SchemeID("dht.findValue key:int256 k:int = dht.ValueResult")
+const (
+	// K max amount of nodes kept in each bucket of the routing table, and amount of nodes
+	// returned by the lookups and asked to store a value
+	K = 10
+	// alpha amount of nodes queried in parallel in each round of a lookup
+	alpha = 3
+	// maxFailures consecutive queries without answer after which a node is removed from the routing table
+	maxFailures = 2
+	// maxVerifiedNodes amount of verified node descriptions remembered by a node
+	maxVerifiedNodes = 4096
 )
 
-type adnlMsg struct {
-	src  *Node
-	data []byte
-}
+var (
+	ErrQueueFull        = errors.New("receive queue is full")
+	ErrRateLimited      = errors.New("source exceeded its rate limit")
+	ErrUnknownQuery     = errors.New("unknown query")
+	ErrUnexpectedAnswer = errors.New("unexpected answer")
+	ErrNoNodes          = errors.New("no known nodes")
+	ErrAlreadyStarted   = errors.New("node already started")
+	ErrInvalidNode      = errors.New("invalid node description")
+)
 
-type adnl interface {
-	Send(dst *Node, data []byte)
-	// Receive return a channel of data that is assumed to be
-	// a structure serialized with TL, including 4-byte prefix(a boxed scheme)
-	// indicating the scheme ID
-	Receive() <-chan adnlMsg
-}
+// tlH serializes and parses the messages exchanged between the nodes, it's safe for concurrent use
+var tlH = func() *tl.TLHandler {
+	h := tl.New()
+	h.Register(tl.DefaultTLModel)
+	return h
+}()
 
 type storage interface {
 	Get(key *big.Int) ([]byte, bool)
 	Set(key *big.Int, value []byte) error
+	// Range calls f with each key and value stored
+	Range(f func(key *big.Int, value []byte))
 }
 
 type bucket []*nodeDescription
 
 type nodeDescription struct {
 	id PublicKeyED25519
-	// ip address of the node
-	ip net.IP
-	// port of node
-	port int
+	// addr ip address, either IPv4 or IPv6, and port of the node
+	addr netip.AddrPort
 	// "semi permanent" address of the node or dht address
 	semiPermanentAddress *big.Int
 	// last ping timestamp
 	lastPingTs int64
-	// delay in seconds of the latest ping response
-	delay int64
+	// delay of the latest ping response
+	delay time.Duration
+	// failures amount of consecutive queries the node didn't answer
+	failures int
+	// signed description of the node shared with other nodes, nil until the node shares it
+	signed *tl.DHTNode
 }
 
 func (nd *nodeDescription) ToNode() *Node {
 	return &Node{
 		id:                   nd.id,
-		ip:                   nd.ip,
-		port:                 nd.port,
+		addr:                 nd.addr,
 		semiPermanentAddress: nd.semiPermanentAddress,
+		signed:               nd.signed,
 	}
 }
 
 type Node struct {
 	id PublicKeyED25519
 	// values table stores key-values in the distributed hash table(dht)
-	// using temporary storage just for demonstration
 	table storage
 
 	// routing table, i-th bucket contains known nodes that lie
-	// at a Kademlia distance from 2*i to 2**(i+1) - 1, from the node address
+	// at a Kademlia distance from 2**i to 2**(i+1) - 1, from the node address
 	// "best" nodes should be first, defining by "best" those which round trip delay is smaller
 	routeTable [256]bucket
 
 	// TON DHT uses ADNL as the transport layer to communicate between nodes
-	adnl adnl
+	adnl ADNL
 
-	// ip address of the node
-	ip net.IP
-	// port of node
-	port int
-	// "semi permanent" address of the node or dht address
+	// addr ip address, either IPv4 or IPv6, and port of the node
+	addr netip.AddrPort
+	// "semi permanent" address of the node or dht address, the short id of its key
 	semiPermanentAddress *big.Int
-
-	logger *log.Logger
-	// availabilityTracker tracks the PING/PONG response delays with other nodes
-	// storing id:timestamp
-	availabilityTracker map[int64]int64
-	// idxMap keeps track of node.id:idx in routing table, to avoid re-computing this index
-	idxMap map[*big.Int]int
+	// signed description of the node, nil in case it's unknown. Only nodes with a signed
+	// description are shared with other nodes
+	signed *tl.DHTNode
+
+	logger *slog.Logger
+	// now returns the current time, used for the expiration of the values
+	now func() time.Time
+
+	// limits applied to the received messages, drops amount of messages dropped by each limit
+	limits Limits
+	drops  map[error]uint64
+	// store where the routing table and values are persisted, nil in case they aren't
+	store NodeStore
+	// verifier of the descriptions of the nodes received
+	verifier nodeVerifier
+
+	// stop cancels the loop started by Start, done is closed once it returns
+	stop context.CancelFunc
+	done chan struct{}
 
 	mu sync.Mutex
 }
 
-// New initialize a new node
-func New() *Node {
-	logger := log.New(os.Stdout, "[dht-node]", log.Lshortfile)
+// Limits bounds the resources used for processing the received messages.
+type Limits struct {
+	// Workers amount of goroutines processing the received messages
+	Workers int
+	// QueueSize max amount of messages waiting for a worker, messages received while the queue
+	// is full are dropped
+	QueueSize int
+	// SourceRate messages per second accepted from each source address, with bursts of up to
+	// SourceBurst messages. Zero disables the limit
+	SourceRate  float64
+	SourceBurst int
+}
+
+// DefaultLimits are the limits used unless SetLimits is called.
+func DefaultLimits() Limits {
+	return Limits{
+		Workers:     32,
+		QueueSize:   1024,
+		SourceRate:  100,
+		SourceBurst: 200,
+	}
+}
+
+// New initialize a new node with key privKey reachable at addr, which communicates with the
+// other nodes through transport. The queries sent by the node are prefixed with its description
+// signed with privKey, so the nodes receiving them can share it.
+func New(privKey ed25519.PrivateKey, addr netip.AddrPort, transport ADNL) (*Node, error) {
+	if len(privKey) != ed25519.PrivateKeySize {
+		return nil, adnl.ErrInvalidPrivKey
+	}
+
+	n, err := NewRemote(privKey.Public().(ed25519.PublicKey), addr)
+	if err != nil {
+		return nil, err
+	}
+
+	// nodes without an address can't be reached, there's nothing to share
+	if addr.IsValid() {
+		signed, err := SignNode(privKey, addr, time.Now().Unix())
+		if err != nil {
+			return nil, err
+		}
+		n.signed = &signed
+	}
+
+	n.table = newMemStorage()
+	n.adnl = transport
+	n.SetLogger(utils.NewLogger())
+	n.now = time.Now
+	n.limits = DefaultLimits()
+	n.drops = make(map[error]uint64)
+
+	return n, nil
+}
+
+// NewRemote returns a node, known by its public key and address, to which queries can be sent.
+func NewRemote(pubKey ed25519.PublicKey, addr netip.AddrPort) (*Node, error) {
+	shortID, err := utils.KeyIDEd25519(pubKey)
+	if err != nil {
+		return nil, err
+	}
+
 	return &Node{
-		logger: logger,
+		id:                   PublicKeyED25519{Key: new(big.Int).SetBytes(pubKey)},
+		addr:                 addr,
+		semiPermanentAddress: new(big.Int).SetBytes(shortID),
+	}, nil
+}
+
+// PubKey returns the public key of the node.
+func (n *Node) PubKey() ed25519.PublicKey {
+	pubKey := make([]byte, ed25519.PublicKeySize)
+	n.id.Key.FillBytes(pubKey)
+
+	return pubKey
+}
+
+// Addr returns the address the node is reachable at.
+func (n *Node) Addr() netip.AddrPort {
+	return n.addr
+}
+
+// ID returns the dht address of the node, the short id of its public key.
+func (n *Node) ID() []byte {
+	return n.semiPermanentAddress.FillBytes(make([]byte, 32))
+}
+
+// SetLogger sets the logger of the node, its records include the component and the dht address
+// of the node. It should be called before the node is used.
+func (n *Node) SetLogger(logger *slog.Logger) {
+	n.logger = utils.ComponentLogger(logger, "dht-node").With("node_id", hex.EncodeToString(n.ID()))
+}
+
+// SetLimits sets the limits applied by the next call to Run.
+func (n *Node) SetLimits(limits Limits) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	n.limits = limits
+}
+
+// SetClock replaces time.Now as the source of the current time, used for the expiration
+// of the values. Should be called before the node is used.
+func (n *Node) SetClock(now func() time.Time) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	n.now = now
+}
+
+// Drops returns the amount of messages dropped because of the limits, indexed by
+// the reason, ErrQueueFull for example.
+func (n *Node) Drops() map[error]uint64 {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	counters := make(map[error]uint64, len(n.drops))
+	for err, count := range n.drops {
+		counters[err] = count
 	}
+
+	return counters
 }
 
-// Run node listenning on incomming requests from other peers in the network.
+// countDrop increments the counter of messages dropped for reason.
+func (n *Node) countDrop(reason error) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	n.drops[reason]++
+}
+
+// Run node listenning on incomming requests from other peers in the network,
+// until the channel of received messages is closed.
 func (n *Node) Run() {
-	// listen on port
+	n.run(context.Background())
+}
 
-	// dipatch boot
-	n.boot()
+// Start runs the node in background, until ctx is done, Shutdown is called or the channel of
+// received messages is closed.
+func (n *Node) Start(ctx context.Context) error {
+	n.mu.Lock()
+	defer n.mu.Unlock()
 
-	errChn := make(chan error, 1)
-	// process errors
-	go func(<-chan error) {
-		for err := range errChn {
-			if err != nil {
-				n.logger.Printf("error: %s\n", err)
-			}
+	if n.stop != nil {
+		return ErrAlreadyStarted
+	}
+
+	ctx, n.stop = context.WithCancel(ctx)
+	n.done = make(chan struct{})
+	go func(done chan struct{}) {
+		defer close(done)
+		n.run(ctx)
+	}(n.done)
+
+	return nil
+}
+
+// Shutdown stops receiving queries and waits for the ones being handled to be answered, then
+// the routing table and values are saved in the node store, if any. In case ctx is done first
+// its error is returned, and the state isn't saved. The transport isn't closed, queries still
+// queued in it aren't answered, so the adnl peer should be shut down first.
+func (n *Node) Shutdown(ctx context.Context) error {
+	n.mu.Lock()
+	stop, done := n.stop, n.done
+	n.mu.Unlock()
+
+	if stop != nil {
+		stop()
+
+		select {
+		case <-done:
+		case <-ctx.Done():
+			return ctx.Err()
 		}
+	}
 
-	}(errChn)
+	return n.saveState()
+}
+
+// run is like Run, returning as well once ctx is done. The queries already queued for
+// the workers are handled before returning.
+func (n *Node) run(ctx context.Context) {
+	n.mu.Lock()
+	limits, transport := n.limits, n.adnl
+	n.mu.Unlock()
+
+	// messages are processed by a fixed amount of workers
+	queue := make(chan Message, max(limits.QueueSize, 0))
+	var workers sync.WaitGroup
+	workers.Add(max(limits.Workers, 1))
+	for range max(limits.Workers, 1) {
+		go func() {
+			defer workers.Done()
+			for msg := range queue {
+				n.handleReceivedCMD(msg)
+			}
+		}()
+	}
+	defer workers.Wait()
+	defer close(queue)
 
 	// listen on incomming messages
-	for data := range n.adnl.Receive() {
-		go n.handleReceivedCMD(data, errChn)
+	sources := utils.NewRateLimiter(limits.SourceRate, limits.SourceBurst)
+	for {
+		var data Message
+		var ok bool
+		select {
+		case data, ok = <-transport.Receive():
+		case <-ctx.Done():
+			return
+		}
+		if !ok {
+			return
+		}
+
+		var source string
+		if data.Src != nil {
+			source = data.Src.addr.Addr().String()
+		}
+
+		if !sources.Allow(source, time.Now()) {
+			n.countDrop(ErrRateLimited)
+			n.logger.Debug("dropping query", "addr", source, "err", ErrRateLimited)
+			data.answer(nil)
+			continue
+		}
+
+		select {
+		case queue <- data:
+		default:
+			n.countDrop(ErrQueueFull)
+			n.logger.Debug("dropping query", "addr", source, "err", ErrQueueFull)
+			data.answer(nil)
+		}
 	}
 }
 
-func (n *Node) handleReceivedCMD(msg adnlMsg, errChn chan<- error) {
-	if len(msg.data) < 4 {
-		return
+func (n *Node) handleReceivedCMD(msg Message) {
+	answer, err := n.HandleQuery(msg.Src, msg.Data)
+	msg.answer(answer)
+	if err != nil {
+		var remoteID string
+		if msg.Src != nil {
+			remoteID = hex.EncodeToString(msg.Src.ID())
+		}
+		n.logger.Debug("failed answering query", "remote_id", remoteID, "err", err)
 	}
+}
 
-	// read first four bytes from data to identify command scheme ID
-	cmdID := hex.EncodeToString(msg.data[:4])
-	switch cmdID {
-	case PingID:
-		errChn <- n.ReceivePing(msg.src, msg.data)
-	case PongID:
-		errChn <- n.ReceivePong(msg.src, msg.data)
-	case FindNodeID:
-		errChn <- n.ReceiveFindNode(msg.src, msg.data)
-	case FindValueID:
-		errChn <- n.ReceiveFindValue(msg.src, msg.data)
-	case StoreID:
-		errChn <- n.ReceiveStore(msg.src, msg.data)
-	default:
-		errChn <- fmt.Errorf("unknown cmd received with data: %x", msg.data)
+// HandleQuery answers the query in data sent by src, a boxed dht.ping, dht.findNode,
+// dht.findValue or dht.store, which may be prefixed by a dht.query with the signed description
+// of src. The boxed answer is returned. src is added to the routing table.
+func (n *Node) HandleQuery(src *Node, data []byte) ([]byte, error) {
+	query, rest, err := tlH.ParseBoxedPrefix(data)
+	if err != nil {
+		return nil, err
 	}
-}
 
-// boot populates node routing table by looking up it's own address.
-// Identifying in this process the s nearest nodes to itself. Downloading
-// from them the key-value they store.
-func (n *Node) boot() {}
+	// the query may be prefixed with the signed description of the sender
+	if prefix, ok := query.(tl.DHTQuery); ok {
+		if src != nil {
+			src, err = n.senderNode(src, prefix.Node)
+			if err != nil {
+				return nil, err
+			}
+		}
 
-// SendPing performs a PING command to a given node.
-func (n *Node) SendPing(dst *Node) error {
-	id, _ := rand.Int(rand.Reader, big.NewInt(math.MaxInt64))
-	ping := Ping{
-		ID: id.Int64(),
+		query, err = tlH.ParseBoxed(rest)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if src != nil {
+		n.mu.Lock()
+		n.addNode(src)
+		n.mu.Unlock()
+	}
+
+	var answer any
+	switch q := query.(type) {
+	case tl.DHTPing:
+		answer = n.ReceivePing(src, q)
+	case tl.DHTFindNode:
+		answer = n.ReceiveFindNode(src, q)
+	case tl.DHTFindValue:
+		answer = n.ReceiveFindValue(src, q)
+	case tl.DHTStore:
+		answer, err = n.ReceiveStore(src, q)
+	default:
+		return nil, fmt.Errorf("%w: %T", ErrUnknownQuery, query)
 	}
-	data, err := tl.Serialize(&ping, true)
 	if err != nil {
-		return err
+		return nil, err
 	}
 
-	// send ping command to dst
-	go n.adnl.Send(dst, data)
+	return tlH.Serialize(answer, true)
+}
 
+// Bootstrap populates node routing table by looking up it's own address, starting from the
+// seeds. Identifying in this process the nearest nodes to itself, then the buckets farther
+// than them are refreshed. ErrNoNodes is returned in case no node answered.
+func (n *Node) Bootstrap(ctx context.Context, seeds ...*Node) error {
 	n.mu.Lock()
-	defer n.mu.Unlock()
+	for _, seed := range seeds {
+		n.addNode(seed)
+	}
+	n.mu.Unlock()
 
-	// save availability tracker
-	ts := time.Now().Unix()
-	n.availabilityTracker[id.Int64()] = ts
-	// update lastPingTs in route table
-	n.updateNodeLastPingTs(dst, ts)
+	nearest, _, err := n.FindNode(ctx, n.ID())
+	if err != nil {
+		return err
+	}
 
-	return nil
+	if len(nearest) == 0 {
+		return ErrNoNodes
+	}
+
+	return n.Refresh(ctx)
 }
 
-// SendPong sends a PONG response to dst.
-func (n *Node) SendPong(dst *Node, id int64) error {
-	pong := Pong{
-		ID: id,
+// Refresh looks up a random key in each bucket, farther than the nearest known node, which isn't full.
+func (n *Node) Refresh(ctx context.Context) error {
+	n.mu.Lock()
+	first := -1
+	var refresh []int
+	for i, b := range n.routeTable {
+		if len(b) > 0 && first == -1 {
+			first = i
+		}
+
+		if first != -1 && len(b) < K {
+			refresh = append(refresh, i)
+		}
 	}
-	respData, err := tl.Serialize(&pong, true)
-	if err != nil {
-		return err
+	n.mu.Unlock()
+
+	if first == -1 {
+		return ErrNoNodes
 	}
 
-	// respond with received id
-	n.adnl.Send(dst, respData)
+	for _, i := range refresh {
+		_, _, err := n.FindNode(ctx, n.randomKey(i))
+		if err != nil && !errors.Is(err, ErrNoNodes) {
+			return err
+		}
+	}
 
 	return nil
 }
 
-// SendStore send STORE command to dst key-value on value table.
-func (n *Node) SendStore(dst *Node, key *big.Int, val []byte) {
-	data := make([]byte, 0)
-	// send ping command to dst
-	n.adnl.Send(dst, data)
-}
+// randomKey returns a random key which lies in the i-th bucket of the routing table.
+func (n *Node) randomKey(i int) []byte {
+	// distance between 2**i and 2**(i+1) - 1
+	low := new(big.Int).Lsh(big.NewInt(1), uint(i))
+	d, _ := rand.Int(rand.Reader, low)
+	d.Add(d, low)
 
-// SendFindNode asks the node to return l Kademlia-nearest
-// known nodes (from its Kademlia routing table) to key.
-func (n *Node) SendFindNode(dst *Node, key *big.Int, l int) {
-	data := make([]byte, 0)
-	// send ping command to dst
-	n.adnl.Send(dst, data)
+	return KademliaDistance(n.semiPermanentAddress, d).FillBytes(make([]byte, 32))
 }
 
-// SendFindValue asks dst for value of key, in case dst doesn't knows
-// dst will ask to its known nodes.
-func (n *Node) SendFindValue(dst *Node, key *big.Int) {
-	data := make([]byte, 0)
-	// send ping command to dst
-	n.adnl.Send(dst, data)
-}
+// query sends q to dst, prefixed with our signed description if any, returning its parsed
+// answer. dst is removed from the routing table after maxFailures queries without answer.
+func (n *Node) query(ctx context.Context, dst *Node, q any) (any, error) {
+	data, err := tlH.Serialize(q, true)
+	if err != nil {
+		return nil, err
+	}
 
-// ReceivePing handle PING command from src node.
-func (n *Node) ReceivePing(src *Node, data []byte) error {
-	// parse ping command
-	var cmd Ping
-	_, err := tl.Parse(&cmd, data, true)
+	if n.signed != nil {
+		prefix, err := tlH.Serialize(tl.DHTQuery{Node: *n.signed}, true)
+		if err != nil {
+			return nil, err
+		}
+		data = append(prefix, data...)
+	}
+
+	answer, err := n.adnl.Query(ctx, dst, data)
 	if err != nil {
-		return err
+		// the node isn't blamed when we are the ones giving up
+		if ctx.Err() == nil {
+			n.mu.Lock()
+			n.markFailed(dst)
+			n.mu.Unlock()
+		}
+
+		return nil, err
 	}
 
-	return n.SendPong(src, cmd.ID)
+	n.mu.Lock()
+	n.addNode(dst)
+	n.mu.Unlock()
+
+	return tlH.ParseBoxed(answer)
 }
 
-// ReceivePong handle PONG response from src node.
-func (n *Node) ReceivePong(src *Node, data []byte) error {
-	// parse pong command
-	var cmd Pong
-	_, err := tl.Parse(&cmd, data, true)
+// SendPing performs a PING command to a given node, returning the round trip time.
+func (n *Node) SendPing(ctx context.Context, dst *Node) (time.Duration, error) {
+	buff := make([]byte, 8)
+	_, err := rand.Read(buff)
 	if err != nil {
-		return err
+		return 0, err
+	}
+	ping := tl.DHTPing{RandomID: int64(binary.LittleEndian.Uint64(buff))}
+
+	start := time.Now()
+	answer, err := n.query(ctx, dst, ping)
+	if err != nil {
+		return 0, err
+	}
+	delay := time.Since(start)
+
+	pong, ok := answer.(tl.Pong)
+	if !ok || pong.RandomID != ping.RandomID {
+		return 0, fmt.Errorf("%w: %T", ErrUnexpectedAnswer, answer)
 	}
 
 	n.mu.Lock()
 	defer n.mu.Unlock()
 
-	// update availability track of nodes
-	lastTs := n.availabilityTracker[cmd.ID]
-	delay := time.Now().Unix() - lastTs
-	delete(n.availabilityTracker, cmd.ID)
-	n.updateNodeDelay(src, delay)
+	n.updateNodeLastPingTs(dst, start.Unix())
+	n.updateNodeDelay(dst, delay)
 
-	return nil
+	return delay, nil
 }
 
-// ReceiveStore handle incomming STORE key-value on value table.
-func (n *Node) ReceiveStore(src *Node, data []byte) error {
-	// parse STORE command
-	var cmd Store
-	_, err := tl.Parse(&cmd, data, true)
+// SendStore asks dst to store value.
+func (n *Node) SendStore(ctx context.Context, dst *Node, value tl.DHTValue) error {
+	answer, err := n.query(ctx, dst, tl.DHTStore{Value: value})
 	if err != nil {
 		return err
 	}
 
-	// TODO: implement receive STORE mechanism
+	if _, ok := answer.(tl.DHTStored); !ok {
+		return fmt.Errorf("%w: %T", ErrUnexpectedAnswer, answer)
+	}
+
 	return nil
 }
 
-// ReceiveFindNode handle FIND_NODE command.
-func (n *Node) ReceiveFindNode(src *Node, data []byte) error {
-	// parse FindNode command
-	var cmd FindNode
-	_, err := tl.Parse(&cmd, data, true)
+// SendFindNode asks the node to return k Kademlia-nearest
+// known nodes (from its Kademlia routing table) to key.
+func (n *Node) SendFindNode(ctx context.Context, dst *Node, key []byte, k int) ([]*Node, error) {
+	answer, err := n.query(ctx, dst, tl.DHTFindNode{Key: key, K: int32(k)})
 	if err != nil {
-		return err
+		return nil, err
 	}
 
-	// TODO: implement receive FIND_NODE mechanism
-	return nil
+	nodes, ok := answer.(tl.DHTNodes)
+	if !ok {
+		return nil, fmt.Errorf("%w: %T", ErrUnexpectedAnswer, answer)
+	}
+
+	return n.nodesFromTL(nodes), nil
 }
 
-// ReceiveFindValue handle FIND_VALUE command.
-func (n *Node) ReceiveFindValue(src *Node, data []byte) error {
-	// parse FindValue command
-	var cmd FindValue
-	_, err := tl.Parse(&cmd, data, true)
+// SendFindValue asks dst for value of key, in case dst doesn't knows
+// it returns its k Kademlia-nearest known nodes to key.
+func (n *Node) SendFindValue(ctx context.Context, dst *Node, key []byte, k int) (*tl.DHTValue, []*Node, error) {
+	answer, err := n.query(ctx, dst, tl.DHTFindValue{Key: key, K: int32(k)})
 	if err != nil {
-		return err
+		return nil, nil, err
 	}
 
-	// TODO: implement FIND_VALUE mechanism
-	// look find value in our storage
-	value, ok := n.table.Get(cmd.Key)
-	if !ok {
-		// pass request to nearest K nodes
-		nearestNodes := n.selectKNearestNodes(cmd.Key, cmd.K)
-		// send this nodes to src
-		v := ValueResult{
-			Nodes: nearestNodes,
-		}
-
-		// TODO: check if this model should be boxed
-		d, err := tl.Serialize(&v, false)
+	switch a := answer.(type) {
+	case tl.DHTValueFound:
+		err := n.checkValue(a.Value, key)
 		if err != nil {
-			return err
+			return nil, nil, err
 		}
 
-		go n.adnl.Send(src, d)
+		return &a.Value, nil, nil
+	case tl.DHTValueNotFound:
+		return nil, n.nodesFromTL(a.Nodes), nil
+	default:
+		return nil, nil, fmt.Errorf("%w: %T", ErrUnexpectedAnswer, answer)
+	}
+}
+
+// ReceivePing handle PING command from src node.
+func (n *Node) ReceivePing(src *Node, ping tl.DHTPing) tl.Pong {
+	return tl.Pong{RandomID: ping.RandomID}
+}
+
+// ReceiveStore handle incomming STORE key-value on value table.
+func (n *Node) ReceiveStore(src *Node, store tl.DHTStore) (tl.DHTStored, error) {
+	return tl.DHTStored{}, n.storeValue(store.Value)
+}
+
+// ReceiveFindNode handle FIND_NODE command, answering with the k nearest known nodes to the key.
+func (n *Node) ReceiveFindNode(src *Node, findNode tl.DHTFindNode) tl.DHTNodes {
+	n.mu.Lock()
+	defer n.mu.Unlock()
 
-		return nil
+	key := new(big.Int).SetBytes(findNode.Key)
+	return nodesToTL(n.selectKNearestNodes(key, clampK(findNode.K), src))
+}
+
+// ReceiveFindValue handle FIND_VALUE command, answering with the value in case we store it,
+// otherwise with the k nearest known nodes to the key.
+func (n *Node) ReceiveFindValue(src *Node, findValue tl.DHTFindValue) any {
+	if value, ok := n.getValue(findValue.Key); ok {
+		return tl.DHTValueFound{Value: value}
 	}
 
-	res := ValueResult{
-		Value: &Value{
-			Values: value,
-		},
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	key := new(big.Int).SetBytes(findValue.Key)
+	return tl.DHTValueNotFound{Nodes: nodesToTL(n.selectKNearestNodes(key, clampK(findValue.K), src))}
+}
+
+// clampK limits the amount of nodes asked by other nodes.
+func clampK(k int32) int {
+	return int(min(max(k, 1), K))
+}
+
+// addNode adds m to the routing table, or marks it as alive in case it's already known. When
+// its bucket is full m replaces a node which didn't answer its last query, if any.
+// should be used with a mutex
+func (n *Node) addNode(m *Node) {
+	if m.semiPermanentAddress.Cmp(n.semiPermanentAddress) == 0 || !m.addr.IsValid() {
+		return
 	}
 
-	resData, err := tl.Serialize(&res, false)
-	if err != nil {
-		return err
+	idx, bIdx := n.findNodeInRouteTable(m)
+	if bIdx != -1 {
+		nd := n.routeTable[idx][bIdx]
+		nd.addr = m.addr
+		nd.failures = 0
+		// the description with the highest version is the most recent one
+		if m.signed != nil && (nd.signed == nil || m.signed.Version >= nd.signed.Version) {
+			nd.signed = m.signed
+		}
+		return
+	}
+
+	nd := &nodeDescription{
+		id:                   m.id,
+		addr:                 m.addr,
+		semiPermanentAddress: m.semiPermanentAddress,
+		signed:               m.signed,
 	}
 
-	n.adnl.Send(src, resData)
+	if len(n.routeTable[idx]) < K {
+		n.routeTable[idx] = append(n.routeTable[idx], nd)
+		return
+	}
 
-	return nil
+	for i, old := range n.routeTable[idx] {
+		if old.failures > 0 {
+			n.routeTable[idx][i] = nd
+			return
+		}
+	}
+}
+
+// markFailed registers a query m didn't answer, removing it from the routing table after maxFailures.
+// should be used with a mutex
+func (n *Node) markFailed(m *Node) {
+	idx, bIdx := n.findNodeInRouteTable(m)
+	if bIdx == -1 {
+		return
+	}
+
+	nd := n.routeTable[idx][bIdx]
+	nd.failures++
+	if nd.failures >= maxFailures {
+		n.routeTable[idx] = append(n.routeTable[idx][:bIdx], n.routeTable[idx][bIdx+1:]...)
+	}
 }
 
 // updateNodeDelay given a known node m, update its delay information in the routing table.
 // should be used with a write mutex
-func (n *Node) updateNodeDelay(m *Node, delay int64) {
+func (n *Node) updateNodeDelay(m *Node, delay time.Duration) {
 	idx, bIdx := n.findNodeInRouteTable(m)
-	if idx == -1 || bIdx == -1 {
+	if bIdx == -1 {
 		return
 	}
 
@@ -342,7 +709,7 @@ func (n *Node) updateNodeDelay(m *Node, delay int64) {
 	// if the new delay is "best" than previous elements in bucket
 	// then should be replace in the right position
 	// re-sorting the bucket according to their delays
-	sort.Slice(n.routeTable[idx], func(i, j int) bool {
+	sort.SliceStable(n.routeTable[idx], func(i, j int) bool {
 		return n.routeTable[idx][i].delay < n.routeTable[idx][j].delay
 	})
 }
@@ -351,49 +718,207 @@ func (n *Node) updateNodeDelay(m *Node, delay int64) {
 // should be used with a mutex
 func (n *Node) updateNodeLastPingTs(m *Node, lastTs int64) {
 	idx, bIdx := n.findNodeInRouteTable(m)
-	if idx == -1 || bIdx == -1 {
+	if bIdx == -1 {
 		return
 	}
 
 	n.routeTable[idx][bIdx].lastPingTs = lastTs
 }
 
-// findNodeInRouteTable finds a node m, routeTable index and bucket index.
+// findNodeInRouteTable finds a node m, routeTable index and bucket index. The bucket
+// index is -1 in case the node isn't in the routing table.
 func (n *Node) findNodeInRouteTable(m *Node) (int, int) {
-	idx, ok := n.idxMap[m.id.Key]
-	if !ok {
-		d := KademliaDistance(n.id.Key, m.id.Key)
-		idx = DistanceIdx(d)
-	}
+	d := KademliaDistance(n.semiPermanentAddress, m.semiPermanentAddress)
+	idx := DistanceIdx(d)
 
-	b := n.routeTable[idx]
-	// find node in bucket to update the delay,
-	// using binary search for finding this node
-	// bucket b needs to be sorted
-	bIdx := sort.Search(len(b), func(i int) bool {
-		return b[i].id.Key.Cmp(m.id.Key) == 0
-	})
+	// buckets are sorted by delay, and small enough for a linear search
+	for bIdx, nd := range n.routeTable[idx] {
+		if nd.semiPermanentAddress.Cmp(m.semiPermanentAddress) == 0 {
+			return idx, bIdx
+		}
+	}
 
-	return idx, bIdx
+	return idx, -1
 }
 
 // selectKNearestNodes select from known nodes the k nearest nodes
-// to Key
-func (n *Node) selectKNearestNodes(Key *big.Int, k int) []*Node {
-	knownNodes := make([]*Node, 0)
+// to Key, exclude is left out in case it's known.
+// should be used with a mutex
+func (n *Node) selectKNearestNodes(Key *big.Int, k int, exclude *Node) []*Node {
+	type candidate struct {
+		nd *nodeDescription
+		d  *big.Int
+	}
+
+	candidates := make([]candidate, 0)
 	for _, b := range n.routeTable {
 		for _, nd := range b {
-			knownNodes = append(knownNodes, nd.ToNode())
+			if exclude != nil && nd.semiPermanentAddress.Cmp(exclude.semiPermanentAddress) == 0 {
+				continue
+			}
+
+			candidates = append(candidates, candidate{nd: nd, d: KademliaDistance(nd.semiPermanentAddress, Key)})
 		}
 	}
 
-	// sort nodes according to nearest to Key
-	sort.Slice(knownNodes, func(i, j int) bool {
-		di := KademliaDistance(knownNodes[i].id.Key, Key)
-		dj := KademliaDistance(knownNodes[j].id.Key, Key)
+	sort.Slice(candidates, func(i, j int) bool {
+		return candidates[i].d.Cmp(candidates[j].d) < 0
+	})
 
-		return di.Cmp(dj) < 0
+	nodes := make([]*Node, 0, min(k, len(candidates)))
+	for _, c := range candidates[:min(k, len(candidates))] {
+		nodes = append(nodes, c.nd.ToNode())
+	}
+
+	return nodes
+}
+
+// sortByDistance sort nodes according to nearest to Key.
+func sortByDistance(nodes []*Node, Key *big.Int) {
+	distances := make(map[*Node]*big.Int, len(nodes))
+	for _, nd := range nodes {
+		distances[nd] = KademliaDistance(nd.semiPermanentAddress, Key)
+	}
+
+	sort.Slice(nodes, func(i, j int) bool {
+		return distances[nodes[i]].Cmp(distances[nodes[j]]) < 0
 	})
+}
+
+// SignNode returns the description of the node with key privKey reachable at addr, signed with
+// privKey. Nodes keep the description with the highest version.
+func SignNode(privKey ed25519.PrivateKey, addr netip.AddrPort, version int64) (tl.DHTNode, error) {
+	tlAddr, err := adnl.AddressFromAddrPort(addr)
+	if err != nil {
+		return tl.DHTNode{}, err
+	}
+
+	nd := tl.DHTNode{
+		ID:        tl.PublicKeyED25519{Key: privKey.Public().(ed25519.PublicKey)},
+		AddrList:  tl.AdnlAddressList{Addresses: []any{tlAddr}, Version: version, ReinitDate: version},
+		Version:   version,
+		Signature: []byte{},
+	}
+
+	data, err := tlH.Serialize(nd, true)
+	if err != nil {
+		return tl.DHTNode{}, err
+	}
+	nd.Signature = ed25519.Sign(privKey, data)
+
+	return nd, nil
+}
+
+// nodeVerifier verifies the signatures of node descriptions, remembering the ones verified so
+// the descriptions relayed by many nodes are verified once. It's safe for concurrent use.
+type nodeVerifier struct {
+	mu sync.Mutex
+	// digests of the descriptions verified, reset once it holds maxVerifiedNodes
+	verified map[[sha256.Size]byte]struct{}
+}
+
+// verify reports whether signature is the signature of data by key.
+func (v *nodeVerifier) verify(key ed25519.PublicKey, data, signature []byte) bool {
+	h := sha256.New()
+	h.Write(data)
+	h.Write(signature)
+	var digest [sha256.Size]byte
+	h.Sum(digest[:0])
+
+	v.mu.Lock()
+	_, ok := v.verified[digest]
+	v.mu.Unlock()
+	if ok {
+		return true
+	}
+
+	if !ed25519.Verify(key, data, signature) {
+		return false
+	}
+
+	v.mu.Lock()
+	if v.verified == nil || len(v.verified) >= maxVerifiedNodes {
+		v.verified = make(map[[sha256.Size]byte]struct{})
+	}
+	v.verified[digest] = struct{}{}
+	v.mu.Unlock()
+
+	return true
+}
+
+// nodeFromTL returns the node described by nd, once its signature is verified. The node is
+// reachable at the first address of the description.
+func (n *Node) nodeFromTL(nd tl.DHTNode) (*Node, error) {
+	if len(nd.ID.Key) != ed25519.PublicKeySize || len(nd.AddrList.Addresses) == 0 {
+		return nil, ErrInvalidNode
+	}
+
+	signature := nd.Signature
+	nd.Signature = []byte{}
+	data, err := tlH.Serialize(nd, true)
+	if err != nil {
+		return nil, err
+	}
+
+	if !n.verifier.verify(ed25519.PublicKey(nd.ID.Key), data, signature) {
+		return nil, fmt.Errorf("%w: signature verification failed", ErrInvalidNode)
+	}
+	nd.Signature = signature
+
+	addr, err := adnl.AddrPortFromAddress(nd.AddrList.Addresses[0])
+	if err != nil {
+		return nil, fmt.Errorf("%w: %w", ErrInvalidNode, err)
+	}
+
+	node, err := NewRemote(nd.ID.Key, addr)
+	if err != nil {
+		return nil, err
+	}
+	node.signed = &nd
+
+	return node, nil
+}
+
+// senderNode returns the node described by nd, the description the sender of a query prefixed
+// it with, which must be the description of src.
+func (n *Node) senderNode(src *Node, nd tl.DHTNode) (*Node, error) {
+	node, err := n.nodeFromTL(nd)
+	if err != nil {
+		return nil, err
+	}
+
+	if node.semiPermanentAddress.Cmp(src.semiPermanentAddress) != 0 {
+		return nil, fmt.Errorf("%w: description of another node", ErrInvalidNode)
+	}
+
+	return node, nil
+}
+
+// nodesToTL converts nodes into their dht.nodes representation, only the nodes which signed
+// description we know are included.
+func nodesToTL(nodes []*Node) tl.DHTNodes {
+	list := tl.DHTNodes{Nodes: make([]tl.DHTNode, 0, len(nodes))}
+	for _, nd := range nodes {
+		if nd.signed != nil {
+			list.Nodes = append(list.Nodes, *nd.signed)
+		}
+	}
+
+	return list
+}
+
+// nodesFromTL converts a dht.nodes into nodes, the ones which description isn't valid or isn't
+// signed by the node are skipped.
+func (n *Node) nodesFromTL(list tl.DHTNodes) []*Node {
+	nodes := make([]*Node, 0, len(list.Nodes))
+	for _, nd := range list.Nodes {
+		node, err := n.nodeFromTL(nd)
+		if err != nil {
+			continue
+		}
+
+		nodes = append(nodes, node)
+	}
 
-	return knownNodes[:k]
+	return nodes
 }
@@ -0,0 +1,259 @@
+package dht
+
+import (
+	"context"
+	"crypto/ed25519"
+	"errors"
+	"net"
+	"net/netip"
+	"runtime"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/Gealber/dht/adnl"
+	"github.com/Gealber/dht/tl"
+	"github.com/Gealber/dht/utils"
+)
+
+// memNodeStore is a NodeStore keeping the state in memory.
+type memNodeStore struct {
+	mu     sync.Mutex
+	nodes  []NodeRecord
+	values []tl.DHTValue
+}
+
+func (s *memNodeStore) Save(nodes []NodeRecord, values []tl.DHTValue) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.nodes, s.values = nodes, values
+	return nil
+}
+
+func (s *memNodeStore) Load() ([]NodeRecord, []tl.DHTValue, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.nodes, s.values, nil
+}
+
+// testNode is a node running over an adnl peer served on a loopback socket.
+type testNode struct {
+	node    *Node
+	peer    *adnl.Peer
+	adnl    *PeerADNL
+	privKey ed25519.PrivateKey
+}
+
+func startTestNode(t *testing.T) testNode {
+	t.Helper()
+
+	pubKey, privKey, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	peer, err := adnl.New(privKey, pubKey, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = peer.StartTransport(context.Background(), adnl.NewUDPTransport(conn))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the nodes learn the address of the senders from their address list
+	addr := conn.LocalAddr().(*net.UDPAddr).AddrPort()
+	err = peer.SetAddressList(addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	a := NewPeerADNL(peer)
+	node, err := New(privKey, addr, a)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return testNode{node: node, peer: peer, adnl: a, privKey: privKey}
+}
+
+// shutdown shuts down the peer first, so the queries it's handling are answered by the node.
+func (tn testNode) shutdown(ctx context.Context) error {
+	err := tn.peer.Shutdown(ctx)
+	if err != nil {
+		return err
+	}
+
+	err = tn.adnl.Close()
+	if err != nil {
+		return err
+	}
+
+	return tn.node.Shutdown(ctx)
+}
+
+func TestNodeShutdown(t *testing.T) {
+	goroutines := runtime.NumGoroutine()
+
+	a, b := startTestNode(t), startTestNode(t)
+
+	store := &memNodeStore{}
+	err := b.node.SetNodeStore(store)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tn := range []testNode{a, b} {
+		err = tn.node.Start(context.Background())
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	_, privKey, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ownerID, err := utils.KeyIDEd25519(privKey.Public().(ed25519.PublicKey))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	value, err := SignValue(tl.DHTValue{
+		Key:   tl.DHTKeyDescription{Key: tl.DHTKey{ID: ownerID, Name: []byte("name")}},
+		Value: []byte("value"),
+		TTL:   time.Now().Add(time.Hour).Unix(),
+	}, privKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	bRemote, err := NewRemote(b.node.PubKey(), b.node.Addr())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// b learns about a when receiving the query
+	err = a.node.SendStore(context.Background(), bRemote, value)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	for _, tn := range []testNode{a, b} {
+		err = tn.shutdown(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if n := runtime.NumGoroutine(); n > goroutines {
+		buff := make([]byte, 1<<16)
+		t.Fatalf("%d goroutines leaked:\n%s", n-goroutines, buff[:runtime.Stack(buff, true)])
+	}
+
+	// the description a prefixed the query with is stored, so it's shared after a restart
+	if len(store.nodes) != 1 || !store.nodes[0].PubKey.Equal(a.node.PubKey()) || store.nodes[0].Addr != a.node.Addr() ||
+		store.nodes[0].Node == nil {
+		t.Fatalf("unexpected stored nodes %+v", store.nodes)
+	}
+
+	// the state is known again after a restart
+	restarted, err := New(b.privKey, netip.AddrPort{}, b.adnl)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = restarted.SetNodeStore(store)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	key, err := ValueKey(value.Key.Key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	found, _, err := restarted.FindValue(context.Background(), key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(found.Value) != "value" {
+		t.Fatalf("unexpected value %q", found.Value)
+	}
+
+	nearest := restarted.selectKNearestNodes(a.node.semiPermanentAddress, K, nil)
+	if len(nearest) != 1 || nearest[0].addr != a.node.Addr() {
+		t.Fatalf("a not restored in the routing table %+v", nearest)
+	}
+}
+
+func TestNodesFromTL(t *testing.T) {
+	_, privKey, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, otherKey, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	addr := netip.MustParseAddrPort("10.0.0.1:3000")
+	signed, err := SignNode(privKey, addr, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// description of privKey signed by another key
+	forged, err := SignNode(otherKey, addr, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	forged.ID = signed.ID
+
+	// address changed after signing
+	tampered, err := SignNode(privKey, addr, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tampered.AddrList.Addresses[0], err = adnl.AddressFromAddrPort(netip.MustParseAddrPort("10.0.0.2:3000"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	unsigned := signed
+	unsigned.Signature = []byte{}
+
+	var n Node
+	nodes := n.nodesFromTL(tl.DHTNodes{Nodes: []tl.DHTNode{forged, tampered, unsigned, signed}})
+	if len(nodes) != 1 || !nodes[0].PubKey().Equal(privKey.Public()) || nodes[0].Addr() != addr {
+		t.Fatalf("unexpected nodes %+v", nodes)
+	}
+
+	// the node is shared with the description it signed, nodes without it aren't shared
+	remote, err := NewRemote(otherKey.Public().(ed25519.PublicKey), addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	list := nodesToTL([]*Node{remote, nodes[0]})
+	if len(list.Nodes) != 1 || string(list.Nodes[0].Signature) != string(signed.Signature) {
+		t.Fatalf("unexpected dht.nodes %+v", list)
+	}
+
+	// the description prefixing a query must be the one of the sender
+	_, err = n.senderNode(remote, signed)
+	if !errors.Is(err, ErrInvalidNode) {
+		t.Fatalf("expected ErrInvalidNode, got %v", err)
+	}
+}
@@ -0,0 +1,97 @@
+package dht
+
+import (
+	"crypto/ed25519"
+	"math/big"
+	"net/netip"
+
+	"github.com/Gealber/dht/tl"
+)
+
+// NodeRecord is a node of the routing table persisted in a NodeStore.
+type NodeRecord struct {
+	PubKey ed25519.PublicKey
+	Addr   netip.AddrPort
+	// Node is the signed description of the node, nil in case it's unknown
+	Node *tl.DHTNode
+}
+
+// NodeStore persists the routing table and the values stored by a Node, so they are known
+// again after a restart.
+type NodeStore interface {
+	// Save stores the nodes of the routing table and the values, replacing the ones stored.
+	Save(nodes []NodeRecord, values []tl.DHTValue) error
+	// Load returns the nodes and values stored.
+	Load() ([]NodeRecord, []tl.DHTValue, error)
+}
+
+// SetNodeStore sets the store where the routing table and the values are persisted, loading
+// the nodes and values stored in it. Values expired or not valid anymore are skipped. The
+// state is saved when the node is shut down.
+func (n *Node) SetNodeStore(store NodeStore) error {
+	records, values, err := store.Load()
+	if err != nil {
+		return err
+	}
+
+	for _, value := range values {
+		err := n.storeValue(value)
+		if err != nil {
+			n.logger.Debug("ignoring stored value", "err", err)
+		}
+	}
+
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	n.store = store
+	for _, record := range records {
+		var m *Node
+		if record.Node != nil {
+			m, err = n.nodeFromTL(*record.Node)
+		} else {
+			m, err = NewRemote(record.PubKey, record.Addr)
+		}
+		if err != nil {
+			n.logger.Warn("ignoring stored node", "err", err)
+			continue
+		}
+
+		n.addNode(m)
+	}
+
+	return nil
+}
+
+// saveState persists the routing table and the values not expired, in case there's a store.
+func (n *Node) saveState() error {
+	n.mu.Lock()
+	store, now := n.store, n.now()
+	if store == nil {
+		n.mu.Unlock()
+		return nil
+	}
+
+	var records []NodeRecord
+	for _, b := range n.routeTable {
+		for _, nd := range b {
+			pubKey := make([]byte, ed25519.PublicKeySize)
+			nd.id.Key.FillBytes(pubKey)
+			records = append(records, NodeRecord{PubKey: pubKey, Addr: nd.addr, Node: nd.signed})
+		}
+	}
+	n.mu.Unlock()
+
+	var values []tl.DHTValue
+	n.table.Range(func(key *big.Int, data []byte) {
+		var value tl.DHTValue
+		err := tlH.Parse(data, &value, true)
+		if err != nil || value.TTL <= now.Unix() {
+			return
+		}
+
+		values = append(values, value)
+	})
+
+	return store.Save(records, values)
+}
@@ -10,17 +10,9 @@ func KademliaDistance(x, y *big.Int) *big.Int {
 
 // DistanceIdx given a distance d, find i such as 2**i <= d <= 2**(i+1)-1
 func DistanceIdx(d *big.Int) int {
-	i := 0
-	p := big.NewInt(1)
-
-	for p.Cmp(d) < 0 {
-		p.Lsh(p, 1)
-		i++
-	}
-
-	if i >= 256 {
-		return 255
+	if d.Sign() <= 0 {
+		return 0
 	}
 
-	return i
+	return min(d.BitLen()-1, 255)
 }
@@ -0,0 +1,271 @@
+package dht
+
+import (
+	"bytes"
+	"context"
+	"crypto/ed25519"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"math/big"
+	"sync"
+
+	"github.com/Gealber/dht/tl"
+	"github.com/Gealber/dht/utils"
+)
+
+var (
+	ErrValueNotFound    = errors.New("value not found")
+	ErrValueNotStored   = errors.New("no node stored the value")
+	ErrExpiredValue     = errors.New("value expired")
+	ErrInvalidKey       = errors.New("value key doesn't match")
+	ErrInvalidSignature = errors.New("value signature verification failed")
+	ErrUnsupportedRule  = errors.New("unsupported value update rule")
+)
+
+// memStorage keeps the values in memory, indexed by their key.
+type memStorage struct {
+	mu     sync.Mutex
+	values map[string][]byte
+}
+
+func newMemStorage() *memStorage {
+	return &memStorage{values: make(map[string][]byte)}
+}
+
+func (s *memStorage) Get(key *big.Int) ([]byte, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	value, ok := s.values[key.Text(16)]
+	return value, ok
+}
+
+func (s *memStorage) Set(key *big.Int, value []byte) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.values[key.Text(16)] = value
+	return nil
+}
+
+func (s *memStorage) Range(f func(key *big.Int, value []byte)) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for k, value := range s.values {
+		key, _ := new(big.Int).SetString(k, 16)
+		f(key, value)
+	}
+}
+
+// ValueKey returns the key the values described by key are stored with, the hash of the boxed dht.key.
+func ValueKey(key tl.DHTKey) ([]byte, error) {
+	data, err := tlH.Serialize(key, true)
+	if err != nil {
+		return nil, err
+	}
+
+	hash := sha256.Sum256(data)
+
+	return hash[:], nil
+}
+
+// SignValue completes the key description of value with the public key of privKey and the
+// signature update rule, then signs both key description and value. The id of the key
+// must be the short id of the public key.
+func SignValue(value tl.DHTValue, privKey ed25519.PrivateKey) (tl.DHTValue, error) {
+	pubKey := privKey.Public().(ed25519.PublicKey)
+	value.Key.ID = tl.PublicKeyED25519{Key: pubKey}
+	value.Key.UpdateRule = tl.DHTUpdateRuleSignature{}
+	value.Key.Signature = []byte{}
+	value.Signature = []byte{}
+
+	data, err := tlH.Serialize(value.Key, true)
+	if err != nil {
+		return tl.DHTValue{}, err
+	}
+	value.Key.Signature = ed25519.Sign(privKey, data)
+
+	data, err = tlH.Serialize(value, true)
+	if err != nil {
+		return tl.DHTValue{}, err
+	}
+	value.Signature = ed25519.Sign(privKey, data)
+
+	return value, nil
+}
+
+// checkValue verifies value can be stored with key according to its update rule.
+func (n *Node) checkValue(value tl.DHTValue, key []byte) error {
+	n.mu.Lock()
+	now := n.now()
+	n.mu.Unlock()
+
+	if value.TTL <= now.Unix() {
+		return ErrExpiredValue
+	}
+
+	valueKey, err := ValueKey(value.Key.Key)
+	if err != nil {
+		return err
+	}
+
+	if !bytes.Equal(valueKey, key) {
+		return ErrInvalidKey
+	}
+
+	switch value.Key.UpdateRule.(type) {
+	case tl.DHTUpdateRuleAnybody:
+		return nil
+	case tl.DHTUpdateRuleSignature:
+		return verifyValue(value)
+	default:
+		return fmt.Errorf("%w: %T", ErrUnsupportedRule, value.Key.UpdateRule)
+	}
+}
+
+// verifyValue verifies the signatures of a value, made by the owner of its key.
+func verifyValue(value tl.DHTValue) error {
+	pubKey := ed25519.PublicKey(value.Key.ID.Key)
+	ownerID, err := utils.KeyIDEd25519(pubKey)
+	if err != nil {
+		return err
+	}
+
+	if !bytes.Equal(ownerID, value.Key.Key.ID) {
+		return ErrInvalidKey
+	}
+
+	signature := value.Signature
+	value.Signature = []byte{}
+	data, err := tlH.Serialize(value, true)
+	if err != nil {
+		return err
+	}
+
+	if !ed25519.Verify(pubKey, data, signature) {
+		return ErrInvalidSignature
+	}
+
+	desc := value.Key
+	desc.Signature = []byte{}
+	data, err = tlH.Serialize(desc, true)
+	if err != nil {
+		return err
+	}
+
+	if !ed25519.Verify(pubKey, data, value.Key.Signature) {
+		return ErrInvalidSignature
+	}
+
+	return nil
+}
+
+// storeValue stores value in our table, unless we store already one which expires later.
+func (n *Node) storeValue(value tl.DHTValue) error {
+	key, err := ValueKey(value.Key.Key)
+	if err != nil {
+		return err
+	}
+
+	err = n.checkValue(value, key)
+	if err != nil {
+		return err
+	}
+
+	if current, ok := n.getValue(key); ok && current.TTL > value.TTL {
+		return nil
+	}
+
+	// serializing gives us a copy of the value, parsed values share memory with the query
+	data, err := tlH.Serialize(value, true)
+	if err != nil {
+		return err
+	}
+
+	return n.table.Set(new(big.Int).SetBytes(key), data)
+}
+
+// getValue returns the value we store with key, in case it hasn't expired.
+func (n *Node) getValue(key []byte) (tl.DHTValue, bool) {
+	data, ok := n.table.Get(new(big.Int).SetBytes(key))
+	if !ok {
+		return tl.DHTValue{}, false
+	}
+
+	var value tl.DHTValue
+	err := tlH.Parse(data, &value, true)
+	if err != nil {
+		return tl.DHTValue{}, false
+	}
+
+	n.mu.Lock()
+	now := n.now()
+	n.mu.Unlock()
+
+	return value, value.TTL > now.Unix()
+}
+
+// Store stores value in the K nearest nodes to its key, returning the amount of nodes that stored it.
+func (n *Node) Store(ctx context.Context, value tl.DHTValue) (int, LookupStats, error) {
+	key, err := ValueKey(value.Key.Key)
+	if err != nil {
+		return 0, LookupStats{}, err
+	}
+
+	err = n.checkValue(value, key)
+	if err != nil {
+		return 0, LookupStats{}, err
+	}
+
+	nodes, stats, err := n.FindNode(ctx, key)
+	if err != nil {
+		return 0, stats, err
+	}
+
+	errs := make([]error, len(nodes))
+	var wg sync.WaitGroup
+	for i, nd := range nodes {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			errs[i] = n.SendStore(ctx, nd, value)
+		}()
+	}
+	wg.Wait()
+
+	stored := 0
+	for _, err := range errs {
+		if err == nil {
+			stored++
+		}
+	}
+	stats.Queries += len(nodes)
+	stats.Failed += len(nodes) - stored
+
+	if stored == 0 {
+		return 0, stats, fmt.Errorf("%w: %s", ErrValueNotStored, hex.EncodeToString(key))
+	}
+
+	return stored, stats, nil
+}
+
+// FindValue looks up the value stored with key, the key of a value is given by ValueKey.
+func (n *Node) FindValue(ctx context.Context, key []byte) (tl.DHTValue, LookupStats, error) {
+	if value, ok := n.getValue(key); ok {
+		return value, LookupStats{}, nil
+	}
+
+	_, value, stats, err := n.lookup(ctx, key, true)
+	if err != nil {
+		return tl.DHTValue{}, stats, err
+	}
+
+	if value == nil {
+		return tl.DHTValue{}, stats, ErrValueNotFound
+	}
+
+	return *value, stats, nil
+}
@@ -37,6 +37,9 @@ func FromBytes(data []byte) ([]byte, error) {
 	offset := 1
 	ln := int(data[0])
 	if ln == 0xFE {
+		if len(data) < 4 {
+			return nil, errors.New("failed to load length, too short data")
+		}
 		ln = int(binary.LittleEndian.Uint32(data)) >> 8
 		offset = 4
 	}
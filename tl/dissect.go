@@ -0,0 +1,118 @@
+package tl
+
+import (
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"math/big"
+	"reflect"
+	"strings"
+)
+
+// Dissect parses the boxed object in data and returns a readable description of it, one field
+// per line and nested objects indented. Bytes fields holding a boxed object registered in the
+// handler, like the payload of a query, are dissected as well.
+func (t *TLHandler) Dissect(data []byte) (string, error) {
+	obj, _, err := t.parseBoxed(data)
+	if err != nil {
+		return "", err
+	}
+
+	var b strings.Builder
+	t.dissectValue(&b, obj, 0)
+
+	return b.String(), nil
+}
+
+// dissectValue writes the description of v at the given depth, the line of v is expected
+// to be already started.
+func (t *TLHandler) dissectValue(b *strings.Builder, v reflect.Value, depth int) {
+	if v.Kind() == reflect.Interface || v.Kind() == reflect.Pointer {
+		if v.IsNil() {
+			b.WriteString("nil\n")
+			return
+		}
+		v = v.Elem()
+	}
+
+	if n, ok := v.Interface().(big.Int); ok {
+		fmt.Fprintf(b, "%s\n", n.String())
+		return
+	}
+
+	switch v.Kind() {
+	case reflect.Struct:
+		t.dissectStruct(b, v, depth)
+	case reflect.Slice:
+		if v.Type().Elem().Kind() == reflect.Uint8 {
+			t.dissectBytes(b, v.Bytes(), depth)
+			return
+		}
+
+		fmt.Fprintf(b, "vector[%d]\n", v.Len())
+		for i := 0; i < v.Len(); i++ {
+			fmt.Fprintf(b, "%s- ", indent(depth+1))
+			t.dissectValue(b, v.Index(i), depth+1)
+		}
+	case reflect.String:
+		fmt.Fprintf(b, "%q\n", v.String())
+	default:
+		fmt.Fprintf(b, "%v\n", v.Interface())
+	}
+}
+
+// dissectStruct writes the constructor of the registered struct v followed by its fields,
+// the optional fields not present according to the flags are skipped.
+func (t *TLHandler) dissectStruct(b *strings.Builder, v reflect.Value, depth int) {
+	tlDef, ok := t.register[v.Type().String()]
+	if !ok {
+		fmt.Fprintf(b, "%+v\n", v.Interface())
+		return
+	}
+	b.WriteString(getConstructor(tlDef) + "\n")
+
+	names, types := extractNames(tlDef), extractTypes(tlDef)
+	if len(names) != v.NumField() || len(types) != v.NumField() {
+		return
+	}
+
+	var flags int64 = -1
+	for i, name := range names {
+		field := v.Field(i)
+		if types[i] == "#" {
+			switch {
+			case field.CanInt():
+				flags = field.Int()
+			case field.CanUint():
+				flags = int64(field.Uint())
+			}
+		}
+
+		bitPos, _ := extractBitPosition(types[i])
+		if bitPos != -1 && flags != -1 && (flags>>bitPos)&1 == 0 {
+			continue
+		}
+
+		fmt.Fprintf(b, "%s%s: ", indent(depth+1), name)
+		t.dissectValue(b, field, depth+1)
+	}
+}
+
+// dissectBytes writes data in hex, or dissected in case it's a boxed object registered in the handler.
+func (t *TLHandler) dissectBytes(b *strings.Builder, data []byte, depth int) {
+	if len(data) >= 4 {
+		if _, ok := t.tregister[binary.LittleEndian.Uint32(data)]; ok {
+			obj, consumed, err := t.parseBoxed(data)
+			if err == nil && consumed == len(data) {
+				t.dissectValue(b, obj, depth)
+				return
+			}
+		}
+	}
+
+	fmt.Fprintf(b, "%s\n", hex.EncodeToString(data))
+}
+
+func indent(depth int) string {
+	return strings.Repeat("  ", depth)
+}
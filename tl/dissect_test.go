@@ -0,0 +1,51 @@
+package tl
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestDissect(t *testing.T) {
+	h := New()
+	h.Register(DefaultTLModel)
+
+	ping, err := h.Serialize(DHTPing{RandomID: 7}, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	data, err := h.Serialize(AdnlPacketContent{
+		Rand1:   []byte{1, 2},
+		Flags:   1<<2 | 1<<6,
+		Message: AdnlMessageQuery{QueryID: bytes.Repeat([]byte{0xab}, 32), Query: ping},
+		Seqno:   3,
+		Rand2:   []byte{},
+	}, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	got, err := h.Dissect(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := `adnl.packetContents
+  rand1: 0102
+  flags: 68
+  message: adnl.message.query
+    query_id: abababababababababababababababababababababababababababababababab
+    query: dht.ping
+      random_id: 7
+  seqno: 3
+  rand2: 
+`
+	if got != want {
+		t.Fatalf("want:\n%s\ngot:\n%s", want, got)
+	}
+
+	_, err = h.Dissect([]byte{1, 2, 3, 4})
+	if err == nil {
+		t.Fatal("expected error dissecting unregistered object")
+	}
+}
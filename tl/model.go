@@ -1,34 +1,112 @@
 package tl
 
-import (
-	"net"
-)
-
 const (
 	TLCreateChannel     = "adnl.message.createChannel key:int256 date:int = adnl.Message"
+	TLConfirmChannel    = "adnl.message.confirmChannel key:int256 peer_key:int256 date:int = adnl.Message"
 	TLSignedAddressList = "dht.getSignedAddressList = dht.Node"
 	TLMessageQuery      = "adnl.message.query query_id:int256 query:bytes = adnl.Message"
+	TLMessageAnswer     = "adnl.message.answer query_id:int256 answer:bytes = adnl.Message"
 	TLAddressUDP        = "adnl.address.udp ip:int port:int = adnl.Address"
+	TLAddressUDP6       = "adnl.address.udp6 ip:int128 port:int = adnl.Address"
+	TLAddressTunnel     = "adnl.address.tunnel to:int256 pubkey:PublicKey = adnl.Address"
 	TLAddressList       = "adnl.addressList addrs:(vector adnl.Address) version:int reinit_date:int priority:int expire_at:int = adnl.AddressList"
 	TLPublicKeyEd25519  = "pub.ed25519 key:int256 = PublicKey"
 	TLPublicKeyAES      = "pub.aes key:int256 = PublicKey"
+	TLAdnlIDShort       = "adnl.id.short id:int256 = adnl.id.Short"
 	TLPacketContents    = `adnl.packetContents rand1:bytes flags:# from:flags.0?PublicKey from_short:flags.1?adnl.id.short message:flags.2?adnl.Message messages:flags.3?(vector adnl.Message) address:flags.4?adnl.addressList priority_address:flags.5?adnl.addressList seqno:flags.6?long confirm_seqno:flags.7?long recv_addr_list_version:flags.8?int recv_priority_addr_list_version:flags.9?int reinit_date:flags.10?int dst_reinit_date:flags.10?int signature:flags.11?bytes rand2:bytes = adnl.PacketContents`
 	TLPing              = "adnl.ping value:long = adnl.Pong"
 	TLPong              = "dht.pong random_id:long = dht.Pong;"
+	TLMessageCustom     = "adnl.message.custom data:bytes = adnl.Message"
+	TLMessageNop        = "adnl.message.nop = adnl.Message"
+	TLMessagePart       = "adnl.message.part hash:int256 total_size:int offset:int data:bytes = adnl.Message"
+	TLMessageReinit     = "adnl.message.reinit date:int = adnl.Message"
+	TLTunnelPacket      = "adnl.tunnelPacketContents rand1:bytes flags:# from_ip:flags.0?int from_port:flags.0?int message:flags.1?bytes statistics:flags.2?bytes payment:flags.3?bytes rand2:bytes = adnl.TunnelPacketContents"
+
+	TLDBNodeKey   = "adnl.db.node.key local_id:int256 peer_id:int256 = adnl.db.Key"
+	TLDBNodeValue = "adnl.db.node.value date:int id:PublicKey addr_list:adnl.addressList priority_addr_list:adnl.addressList = adnl.db.node.Value"
+
+	TLTCPPing                     = "tcp.ping random_id:long = tcp.Pong"
+	TLTCPPong                     = "tcp.pong random_id:long = tcp.Pong"
+	TLTCPAuthentificate           = "tcp.authentificate nonce:bytes = tcp.Message"
+	TLTCPAuthentificationNonce    = "tcp.authentificationNonce nonce:bytes = tcp.Message"
+	TLTCPAuthentificationComplete = "tcp.authentificationComplete key:PublicKey signature:bytes = tcp.Message"
+
+	TLProxyNone                  = "adnl.proxy.none id:int256 = adnl.Proxy"
+	TLProxyFast                  = "adnl.proxy.fast id:int256 shared_secret:bytes = adnl.Proxy"
+	TLProxyToFastHash            = "adnl.proxyToFastHash ip:int port:int date:int data_hash:int256 shared_secret:bytes = adnl.ProxyTo"
+	TLProxyPacketHeader          = "adnl.proxyPacketHeader proxy_id:int256 flags:# ip:flags.0?int port:flags.0?int adnl_start_time:flags.1?int seqno:flags.2?long date:flags.3?int signature:int256 = adnl.ProxyPacketHeader"
+	TLProxyControlPacketPing     = "adnl.proxyControlPacketPing id:int256 = adnl.ProxyControlPacket"
+	TLProxyControlPacketPong     = "adnl.proxyControlPacketPong id:int256 = adnl.ProxyControlPacket"
+	TLProxyControlPacketRegister = "adnl.proxyControlPacketRegister ip:int port:int = adnl.ProxyControlPacket"
+
+	TLDHTNode                = "dht.node id:PublicKey addr_list:adnl.addressList version:int signature:bytes = dht.Node"
+	TLDHTNodes               = "dht.nodes nodes:(vector dht.node) = dht.Nodes"
+	TLDHTKey                 = "dht.key id:int256 name:bytes idx:int = dht.Key"
+	TLDHTUpdateRuleSignature = "dht.updateRule.signature = dht.UpdateRule"
+	TLDHTUpdateRuleAnybody   = "dht.updateRule.anybody = dht.UpdateRule"
+	TLDHTKeyDescription      = "dht.keyDescription key:dht.key id:PublicKey update_rule:dht.UpdateRule signature:bytes = dht.KeyDescription"
+	TLDHTValue               = "dht.value key:dht.keyDescription value:bytes ttl:int signature:bytes = dht.Value"
+	TLDHTValueNotFound       = "dht.valueNotFound nodes:dht.nodes = dht.ValueResult"
+	TLDHTValueFound          = "dht.valueFound value:dht.Value = dht.ValueResult"
+	TLDHTStored              = "dht.stored = dht.Stored"
+	TLDHTPing                = "dht.ping random_id:long = dht.Pong"
+	TLDHTStore               = "dht.store value:dht.value = dht.Stored"
+	TLDHTFindNode            = "dht.findNode key:int256 k:int = dht.Nodes"
+	TLDHTFindValue           = "dht.findValue key:int256 k:int = dht.ValueResult"
+	TLDHTQuery               = "dht.query node:dht.node = True"
 )
 
 var (
 	DefaultTLModel = []ModelRegister{
 		{T: AdnlMessageCreateChannel{}, Def: TLCreateChannel},
+		{T: AdnlMessageConfirmChannel{}, Def: TLConfirmChannel},
 		{T: GetSignedAddressList{}, Def: TLSignedAddressList},
-		{T: Query{}, Def: TLMessageQuery},
+		{T: AdnlMessageQuery{}, Def: TLMessageQuery},
+		{T: AdnlMessageAnswer{}, Def: TLMessageAnswer},
 		{T: AdnlAddressUDP{}, Def: TLAddressUDP},
+		{T: AdnlAddressUDP6{}, Def: TLAddressUDP6},
+		{T: AdnlAddressTunnel{}, Def: TLAddressTunnel},
 		{T: AdnlAddressList{}, Def: TLAddressList},
 		{T: PublicKeyED25519{}, Def: TLPublicKeyEd25519},
 		{T: PublicKeyAES{}, Def: TLPublicKeyAES},
+		{T: AdnlIDShort{}, Def: TLAdnlIDShort},
 		{T: AdnlPacketContent{}, Def: TLPacketContents},
 		{T: Ping{}, Def: TLPing},
 		{T: Pong{}, Def: TLPong},
+		{T: AdnlMessageCustom{}, Def: TLMessageCustom},
+		{T: AdnlMessageNop{}, Def: TLMessageNop},
+		{T: AdnlMessagePart{}, Def: TLMessagePart},
+		{T: AdnlMessageReinit{}, Def: TLMessageReinit},
+		{T: AdnlTunnelPacketContents{}, Def: TLTunnelPacket},
+		{T: AdnlDBNodeKey{}, Def: TLDBNodeKey},
+		{T: AdnlDBNodeValue{}, Def: TLDBNodeValue},
+		{T: TCPPing{}, Def: TLTCPPing},
+		{T: TCPPong{}, Def: TLTCPPong},
+		{T: TCPAuthentificate{}, Def: TLTCPAuthentificate},
+		{T: TCPAuthentificationNonce{}, Def: TLTCPAuthentificationNonce},
+		{T: TCPAuthentificationComplete{}, Def: TLTCPAuthentificationComplete},
+		{T: AdnlProxyNone{}, Def: TLProxyNone},
+		{T: AdnlProxyFast{}, Def: TLProxyFast},
+		{T: AdnlProxyToFastHash{}, Def: TLProxyToFastHash},
+		{T: AdnlProxyPacketHeader{}, Def: TLProxyPacketHeader},
+		{T: AdnlProxyControlPacketPing{}, Def: TLProxyControlPacketPing},
+		{T: AdnlProxyControlPacketPong{}, Def: TLProxyControlPacketPong},
+		{T: AdnlProxyControlPacketRegister{}, Def: TLProxyControlPacketRegister},
+		{T: DHTNode{}, Def: TLDHTNode},
+		{T: DHTNodes{}, Def: TLDHTNodes},
+		{T: DHTKey{}, Def: TLDHTKey},
+		{T: DHTUpdateRuleSignature{}, Def: TLDHTUpdateRuleSignature},
+		{T: DHTUpdateRuleAnybody{}, Def: TLDHTUpdateRuleAnybody},
+		{T: DHTKeyDescription{}, Def: TLDHTKeyDescription},
+		{T: DHTValue{}, Def: TLDHTValue},
+		{T: DHTValueNotFound{}, Def: TLDHTValueNotFound},
+		{T: DHTValueFound{}, Def: TLDHTValueFound},
+		{T: DHTStored{}, Def: TLDHTStored},
+		{T: DHTPing{}, Def: TLDHTPing},
+		{T: DHTStore{}, Def: TLDHTStore},
+		{T: DHTFindNode{}, Def: TLDHTFindNode},
+		{T: DHTFindValue{}, Def: TLDHTFindValue},
+		{T: DHTQuery{}, Def: TLDHTQuery},
 	}
 )
 
@@ -48,18 +126,33 @@ type Query struct {
 }
 
 type AdnlAddressList struct {
-	Addresses  []AdnlAddressUDP `tl:"vector struct boxed"`
-	Version    int64            `tl:"int"`
-	ReinitDate int64            `tl:"int"`
-	Priority   int64            `tl:"int"`
-	ExpireAt   int64            `tl:"int"`
+	// Addresses either AdnlAddressUDP, AdnlAddressUDP6 or AdnlAddressTunnel
+	Addresses  []any `tl:"vector adnl.Address"`
+	Version    int64 `tl:"int"`
+	ReinitDate int64 `tl:"int"`
+	Priority   int64 `tl:"int"`
+	ExpireAt   int64 `tl:"int"`
 }
 
+// AdnlAddressUDP is an IPv4 address, the ip is encoded as a big endian 32-bit integer
 type AdnlAddressUDP struct {
-	IP   net.IP `tl:"int"`
+	IP   int64 `tl:"int"`
+	Port int32 `tl:"int"`
+}
+
+// AdnlAddressUDP6 is an IPv6 address, the ip is the 16 bytes of the address in network order
+type AdnlAddressUDP6 struct {
+	IP   []byte `tl:"int128"`
 	Port int32  `tl:"int"`
 }
 
+// AdnlAddressTunnel is reached through the tunnel mid-node with id To, packets are
+// encrypted for the tunnel key PubKey
+type AdnlAddressTunnel struct {
+	To     []byte           `tl:"int256"`
+	PubKey PublicKeyED25519 `tl:"PublicKey"`
+}
+
 // Public keys definitions
 type PublicKeyUnenc struct {
 	Data []byte `tl:"bytes"`
@@ -77,18 +170,23 @@ type PublicKeyOverlay struct {
 	Name []byte `tl:"bytes"`
 }
 
+// AdnlIDShort is the short id of a peer, the hash of its boxed public key
+type AdnlIDShort struct {
+	ID []byte `tl:"int256"`
+}
+
 type AdnlPacketContent struct {
 	Rand1                       []byte           `tl:"bytes"`
 	Flags                       uint32           `tl:"flags"`
 	From                        PublicKeyED25519 `tl:"?0 PublicKey"`
-	FromIDShort                 []byte           `tl:"?1 adnl.id.short"`
+	FromIDShort                 AdnlIDShort      `tl:"?1 adnl.id.short"`
 	Message                     any              `tl:"?2 adnl.Message"`
 	Messages                    []any            `tl:"?3 vector adnl.Message"`
 	AddressList                 AdnlAddressList  `tl:"?4 adnl.addressList"`
 	PriorityAddressList         AdnlAddressList  `tl:"?5 adnl.addressList"`
 	Seqno                       int64            `tl:"?6 long"`
 	ConfirmSeqno                int64            `tl:"?7 long"`
-	RecvAddrListVersion         int64            `tl:"?7 int"`
+	RecvAddrListVersion         int64            `tl:"?8 int"`
 	RecvPriorityAddrListVersion int64            `tl:"?9 int"`
 	ReinitDate                  int64            `tl:"?10 int"`
 	DstReinitDate               int64            `tl:"?10 int"`
@@ -96,14 +194,16 @@ type AdnlPacketContent struct {
 	Rand2                       []byte           `tl:"bytes"`
 }
 
+// AdnlTunnelPacketContents wraps a datagram sent through a tunnel, from_ip and from_port
+// are the source of the datagram when forwarded by a tunnel mid-node
 type AdnlTunnelPacketContents struct {
 	Rand1      []byte `tl:"bytes"`
 	Flags      uint32 `tl:"flags"`
-	FromIP     int    `tl:"flags.0?int"`
-	FromPort   int    `tl:"flags.0?int"`
-	Message    []byte `tl:"flags.1?bytes"`
-	Statistics []byte `tl:"flags.2?bytes"`
-	Payment    []byte `tl:"flags.3?bytes"`
+	FromIP     int64  `tl:"?0 int"`
+	FromPort   int32  `tl:"?0 int"`
+	Message    []byte `tl:"?1 bytes"`
+	Statistics []byte `tl:"?2 bytes"`
+	Payment    []byte `tl:"?3 bytes"`
 	Rand2      []byte `tl:"bytes"`
 }
 
@@ -122,6 +222,12 @@ type AdnlMessageCustom struct {
 	Data []byte `tl:"bytes"`
 }
 
+type AdnlMessageNop struct{}
+
+type AdnlMessageReinit struct {
+	Date int64 `tl:"int"`
+}
+
 type AdnlMessageQuery struct {
 	QueryID []byte `tl:"int256"`
 	Query   []byte `tl:"bytes"`
@@ -138,3 +244,163 @@ type AdnlMessagePart struct {
 	Offset    int    `tl:"int"`
 	Data      []byte `tl:"bytes"`
 }
+
+// AdnlDBNodeKey is the key of a peer persisted in the peer database, local id is our own id
+type AdnlDBNodeKey struct {
+	LocalID []byte `tl:"int256"`
+	PeerID  []byte `tl:"int256"`
+}
+
+// AdnlDBNodeValue is a peer persisted in the peer database, date is when the peer was last seen
+type AdnlDBNodeValue struct {
+	Date             int64            `tl:"int"`
+	ID               PublicKeyED25519 `tl:"PublicKey"`
+	AddrList         AdnlAddressList  `tl:"adnl.addressList"`
+	PriorityAddrList AdnlAddressList  `tl:"adnl.addressList"`
+}
+
+// TCPPing is used for keeping alive ADNL connections over TCP
+type TCPPing struct {
+	RandomID int64 `tl:"long"`
+}
+
+type TCPPong struct {
+	RandomID int64 `tl:"long"`
+}
+
+// TCPAuthentificate starts the authentication of the client, nonce is chosen by the client
+type TCPAuthentificate struct {
+	Nonce []byte `tl:"bytes"`
+}
+
+// TCPAuthentificationNonce is the nonce chosen by the server for the authentication of the client
+type TCPAuthentificationNonce struct {
+	Nonce []byte `tl:"bytes"`
+}
+
+// TCPAuthentificationComplete includes the client key and its signature of both nonces
+type TCPAuthentificationComplete struct {
+	Key       PublicKeyED25519 `tl:"PublicKey"`
+	Signature []byte           `tl:"bytes"`
+}
+
+// AdnlProxyNone is a proxy that forwards packets as they are
+type AdnlProxyNone struct {
+	ID []byte `tl:"int256"`
+}
+
+// AdnlProxyFast is a proxy that forwards packets authenticated with a secret shared with its clients
+type AdnlProxyFast struct {
+	ID           []byte `tl:"int256"`
+	SharedSecret []byte `tl:"bytes"`
+}
+
+// AdnlProxyToFastHash is the object hashed for building the signature of a fast proxy packet header
+type AdnlProxyToFastHash struct {
+	IP           int64  `tl:"int"`
+	Port         int32  `tl:"int"`
+	Date         int64  `tl:"int"`
+	DataHash     []byte `tl:"int256"`
+	SharedSecret []byte `tl:"bytes"`
+}
+
+// AdnlProxyPacketHeader precedes the packets exchanged between a proxy and its clients
+type AdnlProxyPacketHeader struct {
+	ProxyID       []byte `tl:"int256"`
+	Flags         uint32 `tl:"flags"`
+	IP            int64  `tl:"?0 int"`
+	Port          int32  `tl:"?0 int"`
+	AdnlStartTime int64  `tl:"?1 int"`
+	Seqno         int64  `tl:"?2 long"`
+	Date          int64  `tl:"?3 int"`
+	Signature     []byte `tl:"int256"`
+}
+
+type AdnlProxyControlPacketPing struct {
+	ID []byte `tl:"int256"`
+}
+
+type AdnlProxyControlPacketPong struct {
+	ID []byte `tl:"int256"`
+}
+
+type AdnlProxyControlPacketRegister struct {
+	IP   int64 `tl:"int"`
+	Port int32 `tl:"int"`
+}
+
+// DHTNode is a node of the DHT reachable at the addresses of its address list, the signature
+// is made by the node with its key
+type DHTNode struct {
+	ID        PublicKeyED25519 `tl:"PublicKey"`
+	AddrList  AdnlAddressList  `tl:"adnl.addressList"`
+	Version   int64            `tl:"int"`
+	Signature []byte           `tl:"bytes"`
+}
+
+type DHTNodes struct {
+	Nodes []DHTNode `tl:"vector dht.node"`
+}
+
+// DHTKey identifies a value stored in the DHT, id is the short id of its owner
+type DHTKey struct {
+	ID   []byte `tl:"int256"`
+	Name []byte `tl:"bytes"`
+	Idx  int32  `tl:"int"`
+}
+
+// DHTUpdateRuleSignature values can only be updated by the owner of the key, who signs them
+type DHTUpdateRuleSignature struct{}
+
+// DHTUpdateRuleAnybody values can be updated by anybody, they aren't signed
+type DHTUpdateRuleAnybody struct{}
+
+// DHTKeyDescription describes the key of a value, UpdateRule is either DHTUpdateRuleSignature
+// or DHTUpdateRuleAnybody
+type DHTKeyDescription struct {
+	Key        DHTKey           `tl:"dht.key"`
+	ID         PublicKeyED25519 `tl:"PublicKey"`
+	UpdateRule any              `tl:"dht.UpdateRule"`
+	Signature  []byte           `tl:"bytes"`
+}
+
+// DHTValue is a value stored in the DHT until the unix time TTL
+type DHTValue struct {
+	Key       DHTKeyDescription `tl:"dht.keyDescription"`
+	Value     []byte            `tl:"bytes"`
+	TTL       int64             `tl:"int"`
+	Signature []byte            `tl:"bytes"`
+}
+
+type DHTValueNotFound struct {
+	Nodes DHTNodes `tl:"dht.nodes"`
+}
+
+type DHTValueFound struct {
+	Value DHTValue `tl:"dht.Value"`
+}
+
+type DHTStored struct{}
+
+type DHTPing struct {
+	RandomID int64 `tl:"long"`
+}
+
+type DHTStore struct {
+	Value DHTValue `tl:"dht.value"`
+}
+
+type DHTFindNode struct {
+	Key []byte `tl:"int256"`
+	K   int32  `tl:"int"`
+}
+
+type DHTFindValue struct {
+	Key []byte `tl:"int256"`
+	K   int32  `tl:"int"`
+}
+
+// DHTQuery prefixes the queries sent to the nodes with the signed description of the sender.
+type DHTQuery struct {
+	Node DHTNode `tl:"dht.node"`
+}
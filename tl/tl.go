@@ -48,15 +48,12 @@ type TLHandler struct {
 	// <go type %T,full definition> map
 	register  map[string]string
 	tregister map[uint32]reflect.Type
-	// flagsRegister keeps track of flags set on models
-	flagsRegister map[string]int
 }
 
 func New() *TLHandler {
 	return &TLHandler{
-		register:      make(map[string]string),
-		tregister:     make(map[uint32]reflect.Type),
-		flagsRegister: make(map[string]int),
+		register:  make(map[string]string),
+		tregister: make(map[uint32]reflect.Type),
 	}
 }
 
@@ -72,6 +69,13 @@ func (t *TLHandler) Register(models []ModelRegister) {
 // into it's binary representation. In case boxed is true,
 // obj MUST be previously registered with Register method.
 func (t *TLHandler) Serialize(obj any, boxed bool) ([]byte, error) {
+	if v := reflect.ValueOf(obj); v.Kind() == reflect.Pointer {
+		if v.IsNil() {
+			return nil, errors.New("nil pointer can't be serialized")
+		}
+		obj = v.Elem().Interface()
+	}
+
 	data := make([]byte, 0)
 	if boxed {
 		def, ok := t.register[fmt.Sprintf("%T", obj)]
@@ -91,8 +95,10 @@ func (t *TLHandler) Serialize(obj any, boxed bool) ([]byte, error) {
 	// check each fields tag
 	st := reflect.TypeOf(obj)
 	v := reflect.ValueOf(obj)
+	// flags value of this object, -1 while the 'flags' field hasn't been serialized
+	flags := -1
 	for i := 0; i < st.NumField(); i++ {
-		d, err := t.serializeField(st, v, i)
+		d, err := t.serializeField(st, v, i, &flags)
 		if err != nil {
 			return nil, err
 		}
@@ -107,7 +113,7 @@ func (t *TLHandler) Serialize(obj any, boxed bool) ([]byte, error) {
 	return data, nil
 }
 
-func (t *TLHandler) serializeField(st reflect.Type, v reflect.Value, idx int) ([]byte, error) {
+func (t *TLHandler) serializeField(st reflect.Type, v reflect.Value, idx int, flags *int) ([]byte, error) {
 	field := st.Field(idx)
 
 	tagVal := field.Tag.Get("tl")
@@ -122,10 +128,10 @@ func (t *TLHandler) serializeField(st reflect.Type, v reflect.Value, idx int) ([
 		buff := make([]byte, 4)
 		if fieldKind >= reflect.Int && fieldKind <= reflect.Int64 {
 			binary.LittleEndian.PutUint32(buff, uint32(fieldValue.Int()))
-			t.flagsRegister[st.String()] = int(fieldValue.Int())
+			*flags = int(uint32(fieldValue.Int()))
 		} else if fieldKind >= reflect.Uint && fieldKind <= reflect.Uint64 {
 			binary.LittleEndian.PutUint32(buff, uint32(fieldValue.Uint()))
-			t.flagsRegister[st.String()] = int(fieldValue.Uint())
+			*flags = int(uint32(fieldValue.Uint()))
 		} else {
 			return nil, errors.New("invalid field type for 'flags'")
 		}
@@ -154,13 +160,12 @@ func (t *TLHandler) serializeField(st reflect.Type, v reflect.Value, idx int) ([
 		}
 
 		// check if this bit in flag is set
-		flags, ok := t.flagsRegister[st.String()]
-		if !ok {
+		if *flags == -1 {
 			return nil, errors.New("'flags' should be previously defined")
 		}
 
 		// if bit in bitPos is not set in flags value, we don't process this field
-		if flags&(1<<bitPos) == 0 {
+		if *flags&(1<<bitPos) == 0 {
 			return nil, nil
 		}
 
@@ -233,9 +238,9 @@ func (t *TLHandler) serializeSimpleField(fieldKind reflect.Kind, fieldValue refl
 	case "long":
 		buff := make([]byte, 8)
 		if fieldKind >= reflect.Int && fieldKind <= reflect.Int64 {
-			binary.LittleEndian.PutUint32(buff, uint32(fieldValue.Int()))
+			binary.LittleEndian.PutUint64(buff, uint64(fieldValue.Int()))
 		} else if fieldKind >= reflect.Uint && fieldKind <= reflect.Uint64 {
-			binary.LittleEndian.PutUint32(buff, uint32(fieldValue.Uint()))
+			binary.LittleEndian.PutUint64(buff, fieldValue.Uint())
 		} else {
 			return nil, errors.New("invalid field type for TL type 'long'")
 		}
@@ -275,6 +280,19 @@ func (t *TLHandler) serializeSimpleField(fieldKind reflect.Kind, fieldValue refl
 		}
 
 		return b, nil
+	case "int128":
+		if fieldKind != reflect.Slice {
+			return nil, errors.New("only []byte can be used for int128")
+		}
+
+		b := fieldValue.Bytes()
+		if len(b) > 16 {
+			return nil, errors.New("int128 bytes should be 16 bytes in size no more than that")
+		}
+
+		buff := make([]byte, 16)
+		copy(buff[16-len(b):], b)
+		return buff, nil
 	case "bool":
 		if fieldKind == reflect.Bool {
 			buff := make([]byte, 4)
@@ -295,12 +313,14 @@ func (t *TLHandler) serializeSimpleField(fieldKind reflect.Kind, fieldValue refl
 			return nil, errors.New("invalid field type for TL type 'bytes'")
 		}
 	default:
-		if fieldKind == reflect.Interface && !fieldValue.IsNil() {
-			// try to check the underlaying type of it
-			fV := fieldValue.Elem()
-			fK := fV.Kind()
+		if fieldKind == reflect.Interface {
+			if fieldValue.IsNil() {
+				return nil, fmt.Errorf("nil value for polymorphic TL type '%s'", tagVal)
+			}
 
-			return t.serializeSimpleField(fK, fV, tagVal, insideVector)
+			// polymorphic fields are always boxed, the scheme id is the one
+			// telling the receiver which is the underlaying type
+			return t.Serialize(fieldValue.Elem().Interface(), true)
 		}
 
 		// in case is a custom type, check if is previously registered
@@ -339,12 +359,42 @@ func (t *TLHandler) Parse(data []byte, obj any, boxed bool) error {
 	return err
 }
 
+// ParseBoxed parses a boxed object, which type is identified by the scheme id prefixed in data.
+// The type of the object MUST be previously registered with Register method.
+func (t *TLHandler) ParseBoxed(data []byte) (any, error) {
+	if len(data) == 0 {
+		return nil, errors.New("empty data")
+	}
+
+	v, _, err := t.parseBoxed(data)
+	if err != nil {
+		return nil, err
+	}
+
+	return v.Interface(), nil
+}
+
+// ParseBoxedPrefix is like ParseBoxed, parsing the boxed object at the start of data. The data
+// following the object is returned as well.
+func (t *TLHandler) ParseBoxedPrefix(data []byte) (any, []byte, error) {
+	if len(data) == 0 {
+		return nil, nil, errors.New("empty data")
+	}
+
+	v, consumed, err := t.parseBoxed(data)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return v.Interface(), data[consumed:], nil
+}
+
 // TODO: refactor to make it a smaller method
 func (t *TLHandler) parse(data []byte, objValue reflect.Value, boxed bool) (int, error) {
 	pos := 0
 	var flags uint32 = 0xffffffff // assuming all the bits are set
 	// check if schemeID correspond to one registered
-	registerKey := fmt.Sprintf("%s", reflect.Indirect(objValue).Type().String())
+	registerKey := reflect.Indirect(objValue).Type().String()
 	tlDef, ok := t.register[registerKey]
 	if !ok {
 		return pos, fmt.Errorf("obj %s not registered", reflect.Indirect(objValue).Type().String())
@@ -358,6 +408,10 @@ func (t *TLHandler) parse(data []byte, objValue reflect.Value, boxed bool) (int,
 	}
 
 	if boxed {
+		if err := checkSize(data, pos, 4); err != nil {
+			return pos, err
+		}
+
 		// parse the 4-bytes scheme id
 		schemeID := data[:4]
 		if hex.EncodeToString(schemeID) != SchemeID(tlDef) {
@@ -401,41 +455,54 @@ func (t *TLHandler) parse(data []byte, objValue reflect.Value, boxed bool) (int,
 			fieldT = fieldT[spaceIdx+1:]
 
 			// reading first 4 bytes as size of slice
+			if err := checkSize(data, pos, 4); err != nil {
+				return 0, err
+			}
 			vectorLen := binary.LittleEndian.Uint32(data[pos : pos+4])
 			pos += 4
+			// each element takes at least its 4 bytes scheme id, this avoid
+			// allocating huge slices from malformed data
+			if err := checkSize(data, pos, 4*int(vectorLen)); err != nil {
+				return 0, err
+			}
 			// we should allocate a slice with vectorLen and type
-			fieldValue = reflect.MakeSlice(fieldValue.Type(), 0, int(vectorLen))
+			sliceValue := reflect.MakeSlice(fieldValue.Type(), 0, int(vectorLen))
 			for i := 0; i < int(vectorLen); i++ {
-				// get scheme id in order to assign the correct type
-				id := binary.LittleEndian.Uint32(data[pos : pos+4])
-				elemT, ok := t.tregister[id]
-				if !ok {
-					return 0, fmt.Errorf("unregisterd type id: %d", id)
-				}
-				pos += 4
-
-				obj := reflect.New(elemT)
-
-				// passed as not boxed because we already consumed the id previously
-				consumedPos, err := t.parse(data[pos:], obj, false)
+				elem, consumedPos, err := t.parseBoxed(data[pos:])
 				if err != nil {
 					return 0, err
 				}
-				fieldValue = reflect.Append(fieldValue, obj)
+
+				if !elem.Type().AssignableTo(sliceValue.Type().Elem()) {
+					return 0, fmt.Errorf("vector element of type %s can't be assigned to %s", elem.Type(), sliceValue.Type())
+				}
+				sliceValue = reflect.Append(sliceValue, elem)
 				pos += consumedPos
 			}
+			fieldValue.Set(sliceValue)
 			continue
 		}
 
 		switch fieldT {
 		case "#":
+			if err := checkSize(data, pos, 4); err != nil {
+				return pos, err
+			}
+
+			flags = binary.LittleEndian.Uint32(data[pos : pos+4])
 			if fieldKind >= reflect.Int && fieldKind <= reflect.Int64 {
-				flags = binary.LittleEndian.Uint32(data[pos : pos+4])
+				fieldValue.SetInt(int64(flags))
+			} else if fieldKind >= reflect.Uint && fieldKind <= reflect.Uint64 {
+				fieldValue.SetUint(uint64(flags))
 			} else {
 				return pos, errors.New("unexpected field type for '#' TL type")
 			}
 			pos += 4
 		case "int":
+			if err := checkSize(data, pos, 4); err != nil {
+				return pos, err
+			}
+
 			n := binary.LittleEndian.Uint32(data[pos : pos+4])
 			if fieldKind >= reflect.Int && fieldKind <= reflect.Int64 {
 				fieldValue.SetInt(int64(n))
@@ -446,13 +513,17 @@ func (t *TLHandler) parse(data []byte, objValue reflect.Value, boxed bool) (int,
 			}
 			pos += 4
 		case "long":
-			n := binary.LittleEndian.Uint32(data[pos : pos+8])
+			if err := checkSize(data, pos, 8); err != nil {
+				return pos, err
+			}
+
+			n := binary.LittleEndian.Uint64(data[pos : pos+8])
 			if fieldKind >= reflect.Int && fieldKind <= reflect.Int64 {
 				fieldValue.SetInt(int64(n))
 			} else if fieldKind >= reflect.Uint && fieldKind <= reflect.Uint64 {
-				fieldValue.SetUint(uint64(n))
+				fieldValue.SetUint(n)
 			} else {
-				return pos, errors.New("unexpected field type for 'int' TL type")
+				return pos, errors.New("unexpected field type for 'long' TL type")
 			}
 			pos += 8
 		case "double":
@@ -468,24 +539,12 @@ func (t *TLHandler) parse(data []byte, objValue reflect.Value, boxed bool) (int,
 			}
 			fieldValue.SetString(string(val))
 
-			offset := func() int {
-				var result int
-				if len(val) < 0xFE {
-					result = 1
-				} else {
-					result = 4
-				}
-				round := (len(val) + result) % 4
-
-				if round != 0 {
-					result += 4 - round
-				}
-
-				return result
-			}()
-
-			pos += len(val) + offset
+			pos += len(val) + bytesOffset(len(val))
 		case "int256":
+			if err := checkSize(data, pos, 32); err != nil {
+				return pos, err
+			}
+
 			b := data[pos : pos+32]
 			if fieldKind == reflect.Slice {
 				fieldValue.SetBytes(b)
@@ -496,11 +555,26 @@ func (t *TLHandler) parse(data []byte, objValue reflect.Value, boxed bool) (int,
 			}
 
 			pos += 32
+		case "int128":
+			if fieldKind != reflect.Slice {
+				return pos, errors.New("only []byte can be used for int128")
+			}
+
+			if err := checkSize(data, pos, 16); err != nil {
+				return pos, err
+			}
+
+			fieldValue.SetBytes(data[pos : pos+16])
+			pos += 16
 		case "bool":
 			if fieldKind != reflect.Bool {
 				return pos, errors.New("invalid field type for 'bool' TL type")
 			}
 
+			if err := checkSize(data, pos, 4); err != nil {
+				return pos, err
+			}
+
 			boolTCrc32 := hex.EncodeToString(data[pos : pos+4])
 			if boolTCrc32 == BoolTrueHexID {
 				fieldValue.SetBool(true)
@@ -523,25 +597,21 @@ func (t *TLHandler) parse(data []byte, objValue reflect.Value, boxed bool) (int,
 
 			fieldValue.SetBytes(val)
 
-			offset := func() int {
-				var result int
-				if len(val) < 0xFE {
-					result = 1
-				} else {
-					result = 4
+			pos += len(val) + bytesOffset(len(val))
+		default:
+			if fieldKind == reflect.Interface {
+				// polymorphic field, the scheme id tells us the underlaying type
+				elem, consumed, err := t.parseBoxed(data[pos:])
+				if err != nil {
+					return pos, err
 				}
-				round := (len(val) + result) % 4
 
-				if round != 0 {
-					result += 4 - round
+				if !elem.Type().AssignableTo(fieldValue.Type()) {
+					return pos, fmt.Errorf("type %s can't be assigned to field of type %s", elem.Type(), fieldValue.Type())
 				}
-
-				return result
-			}()
-
-			pos += len(val) + offset
-		default:
-			if tlDef, ok := t.register[fieldValue.Type().String()]; ok {
+				fieldValue.Set(elem)
+				pos += consumed
+			} else if tlDef, ok := t.register[fieldValue.Type().String()]; ok {
 				combinator, constructor := getCombinator(tlDef), getConstructor(tlDef)
 				if fieldT != combinator && fieldT != constructor {
 					return pos, errors.New("your tag definition doesn't correspond with the combinator or constructor in the registered definition")
@@ -553,6 +623,7 @@ func (t *TLHandler) parse(data []byte, objValue reflect.Value, boxed bool) (int,
 				if err != nil {
 					return pos, err
 				}
+				fieldValue.Set(objField.Elem())
 				pos += consumed
 			} else {
 				return pos, errors.New("unregistered custom type as field")
@@ -562,3 +633,54 @@ func (t *TLHandler) parse(data []byte, objValue reflect.Value, boxed bool) (int,
 
 	return pos, nil
 }
+
+// parseBoxed parses a boxed object, which type is identified by the 4-bytes scheme id
+// prefixed in data. Returns the parsed value and the amount of bytes consumed.
+func (t *TLHandler) parseBoxed(data []byte) (reflect.Value, int, error) {
+	if err := checkSize(data, 0, 4); err != nil {
+		return reflect.Value{}, 0, err
+	}
+
+	// get scheme id in order to assign the correct type
+	id := binary.LittleEndian.Uint32(data[:4])
+	elemT, ok := t.tregister[id]
+	if !ok {
+		return reflect.Value{}, 0, fmt.Errorf("unregisterd type id: %d", id)
+	}
+
+	obj := reflect.New(elemT)
+	// passed as not boxed because we already consumed the id previously
+	consumed, err := t.parse(data[4:], obj, false)
+	if err != nil {
+		return reflect.Value{}, 0, err
+	}
+
+	return obj.Elem(), consumed + 4, nil
+}
+
+// checkSize makes sure data contains at least n bytes from pos.
+func checkSize(data []byte, pos, n int) error {
+	if n < 0 || pos+n > len(data) {
+		return fmt.Errorf("failed to read %d bytes at position %d, too short data", n, pos)
+	}
+
+	return nil
+}
+
+// bytesOffset computes the amount of bytes used by the length prefix and
+// padding of a TL 'bytes' or 'string' of size n.
+func bytesOffset(n int) int {
+	var result int
+	if n < 0xFE {
+		result = 1
+	} else {
+		result = 4
+	}
+	round := (n + result) % 4
+
+	if round != 0 {
+		result += 4 - round
+	}
+
+	return result
+}
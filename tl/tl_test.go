@@ -19,6 +19,7 @@ const (
 	testAdnlMessageCreateChannelTL = "adnl.message.createChannel key:int256 date:int = adnl.Message"
 	testAdnlMessageQueryTL         = "adnl.message.query query_id:int256 query:bytes = adnl.Message"
 	testAdnlAddressUDP             = "adnl.address.udp ip:int port:int = adnl.Address"
+	testAdnlAddressUDP6            = "adnl.address.udp6 ip:int128 port:int = adnl.Address"
 	testAdnlAddressListTL          = "adnl.addressList addrs:(vector adnl.Address) version:int reinit_date:int priority:int expire_at:int = adnl.AddressList"
 )
 
@@ -225,6 +226,12 @@ type TestAdnlAddressUDP struct {
 	Port int   `tl:"int"`
 }
 
+// TL def: adnl.address.udp6 ip:int128 port:int = adnl.Address
+type TestAdnlAddressUDP6 struct {
+	IP   []byte `tl:"int128"`
+	Port int    `tl:"int"`
+}
+
 // TL def: adnl.addressList addrs:(vector adnl.Address) version:int reinit_date:int priority:int expire_at:int = adnl.AddressList
 type TestAdnlAddressList struct {
 	Addresses  []TestAdnlAddressUDP `tl:"vector adnl.Address"`
@@ -394,6 +401,20 @@ func genSerializeTCs() []serializeTestCase {
 			boxed:           true,
 			expectedDataHex: "89cd42d10f4e0e7dd6d0c5646c204573bc47e567d9050000c6b41348afc46336dd352049b366c7fd3fc1b143a518f0d02d9faef896cb0155488915d602000000bbc373e6d59d8e3991be20b54dde8b78b3af18b379a62fa30e64af361c75452f6af019d7555c87637af98bb4d7be82afbc80516ebca39784b8e2209886a69601251571444514b7f17fcd887504ed4879a900000000000000555c8763555c8763000000000000000001000000000000000000000000000000555c8763555c8763000000000f2b6a8c0509f85da9f3c7e11c86ba22",
 		},
+		{
+			name: "int128 type, adnl.address.udp6",
+			obj: TestAdnlAddressUDP6{
+				// ::1
+				IP:   []byte{0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 1},
+				Port: 30303,
+			},
+			boxed: true,
+			tlDef: ModelRegister{
+				T:   TestAdnlAddressUDP6{},
+				Def: testAdnlAddressUDP6,
+			},
+			expectedDataHex: "fa631de3000000000000000000000000000000015f760000",
+		},
 	}
 }
 
@@ -523,3 +544,41 @@ func genOptionalParseTCs() []parseOptionalTestCase {
 		},
 	}
 }
+
+func TestParseBoxedPrefix(t *testing.T) {
+	s := New()
+	s.Register(DefaultTLModel)
+
+	prefix, err := s.Serialize(DHTQuery{Node: DHTNode{
+		ID:        PublicKeyED25519{Key: make([]byte, 32)},
+		AddrList:  AdnlAddressList{Addresses: []any{AdnlAddressUDP{IP: 1, Port: 2}}},
+		Signature: []byte{1, 2, 3},
+	}}, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	query, err := s.Serialize(DHTPing{RandomID: 7}, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	obj, rest, err := s.ParseBoxedPrefix(append(prefix, query...))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	q, ok := obj.(DHTQuery)
+	if !ok || len(q.Node.Signature) != 3 || len(q.Node.AddrList.Addresses) != 1 {
+		t.Fatalf("unexpected prefix %+v", obj)
+	}
+
+	obj, err = s.ParseBoxed(rest)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if ping, ok := obj.(DHTPing); !ok || ping.RandomID != 7 {
+		t.Fatalf("unexpected query %+v", obj)
+	}
+}
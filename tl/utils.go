@@ -94,3 +94,28 @@ func extractBitPosition(t string) (int, string) {
 
 	return -1, ""
 }
+
+// extractNames extract the names of the fields in TL definition in the order they are defined.
+func extractNames(tlDef string) []string {
+	result := make([]string, 0)
+	start := 0
+	insideExpr := 0
+	for i := 0; i < len(tlDef); i++ {
+		switch tlDef[i] {
+		case '(':
+			insideExpr++
+		case ')':
+			insideExpr--
+		case ' ':
+			if insideExpr == 0 {
+				start = i + 1
+			}
+		case ':':
+			if insideExpr == 0 {
+				result = append(result, tlDef[start:i])
+			}
+		}
+	}
+
+	return result
+}
@@ -68,3 +68,17 @@ func Test_extractOptionalBitPosition(t *testing.T) {
 		t.Fatal("unexpected type definition")
 	}
 }
+
+func Test_extractNames(t *testing.T) {
+	names := extractNames(TLAddressList)
+	want := []string{"addrs", "version", "reinit_date", "priority", "expire_at"}
+	if len(names) != len(want) {
+		t.Fatalf("want: %v got: %v", want, names)
+	}
+
+	for i := range want {
+		if names[i] != want[i] {
+			t.Fatalf("want: %v got: %v", want, names)
+		}
+	}
+}
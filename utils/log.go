@@ -0,0 +1,105 @@
+package utils
+
+import (
+	"context"
+	"io"
+	"log/slog"
+	"os"
+	"sync"
+)
+
+const (
+	// logRate and logBurst limit each repeated warning or error to a record per second, with
+	// bursts of 10 records
+	logRate  = 1
+	logBurst = 10
+)
+
+// RateLimitedHandler is a slog.Handler dropping the warnings and errors repeated too often, the
+// records of lower levels aren't limited. Records are identified by their level and message. The
+// amount of records dropped is reported in the next one handled, as the attribute "suppressed".
+type RateLimitedHandler struct {
+	h       slog.Handler
+	limiter *RateLimiter
+	// suppressed shared with the handlers derived from this one
+	suppressed *suppressedRecords
+}
+
+// suppressedRecords counts the records dropped, indexed by level and message.
+type suppressedRecords struct {
+	counts map[string]int
+	mu     sync.Mutex
+}
+
+// NewRateLimitedHandler wraps h, limiting each repeated warning or error to rate records per
+// second with bursts of up to burst records.
+func NewRateLimitedHandler(h slog.Handler, rate float64, burst int) *RateLimitedHandler {
+	return &RateLimitedHandler{
+		h:          h,
+		limiter:    NewRateLimiter(rate, burst),
+		suppressed: &suppressedRecords{counts: make(map[string]int)},
+	}
+}
+
+// Enabled reports if the wrapped handler handles records of level.
+func (h *RateLimitedHandler) Enabled(ctx context.Context, level slog.Level) bool {
+	return h.h.Enabled(ctx, level)
+}
+
+// Handle passes r to the wrapped handler, unless it's a warning or error repeated too often.
+func (h *RateLimitedHandler) Handle(ctx context.Context, r slog.Record) error {
+	if r.Level < slog.LevelWarn {
+		return h.h.Handle(ctx, r)
+	}
+
+	key := r.Level.String() + " " + r.Message
+	h.suppressed.mu.Lock()
+	if !h.limiter.Allow(key, r.Time) {
+		h.suppressed.counts[key]++
+		h.suppressed.mu.Unlock()
+		return nil
+	}
+
+	suppressed := h.suppressed.counts[key]
+	delete(h.suppressed.counts, key)
+	h.suppressed.mu.Unlock()
+
+	if suppressed > 0 {
+		r = r.Clone()
+		r.AddAttrs(slog.Int("suppressed", suppressed))
+	}
+
+	return h.h.Handle(ctx, r)
+}
+
+// WithAttrs returns a handler with attrs, sharing the limits with h.
+func (h *RateLimitedHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return &RateLimitedHandler{h: h.h.WithAttrs(attrs), limiter: h.limiter, suppressed: h.suppressed}
+}
+
+// WithGroup returns a handler with the group name, sharing the limits with h.
+func (h *RateLimitedHandler) WithGroup(name string) slog.Handler {
+	return &RateLimitedHandler{h: h.h.WithGroup(name), limiter: h.limiter, suppressed: h.suppressed}
+}
+
+// NewLogger returns the logger used by the components until another one is set, it writes the
+// records of level info and above to stdout. The components label it with ComponentLogger when
+// it's set.
+func NewLogger() *slog.Logger {
+	return newLogger(os.Stdout)
+}
+
+// newLogger returns a logger writing the records of level info and above to w, limiting the
+// repeated warnings and errors.
+func newLogger(w io.Writer) *slog.Logger {
+	return slog.New(NewRateLimitedHandler(slog.NewTextHandler(w, nil), logRate, logBurst))
+}
+
+// ComponentLogger derives from logger the logger of component, limiting its repeated warnings and errors.
+func ComponentLogger(logger *slog.Logger, component string) *slog.Logger {
+	if _, ok := logger.Handler().(*RateLimitedHandler); !ok {
+		logger = slog.New(NewRateLimitedHandler(logger.Handler(), logRate, logBurst))
+	}
+
+	return logger.With("component", component)
+}
@@ -0,0 +1,75 @@
+package utils
+
+import (
+	"bytes"
+	"context"
+	"log/slog"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRateLimitedHandler(t *testing.T) {
+	var buff bytes.Buffer
+	h := NewRateLimitedHandler(slog.NewTextHandler(&buff, &slog.HandlerOptions{Level: slog.LevelDebug}), 1, 3)
+	logger := slog.New(h.WithAttrs([]slog.Attr{slog.String("component", "test")}))
+
+	now := time.Now()
+	for range 5 {
+		logger.Handler().Handle(context.Background(), slog.NewRecord(now, slog.LevelError, "failed", 0))
+		logger.Handler().Handle(context.Background(), slog.NewRecord(now, slog.LevelDebug, "noise", 0))
+		logger.Handler().Handle(context.Background(), slog.NewRecord(now, slog.LevelWarn, "other", 0))
+	}
+
+	lines := strings.Split(strings.TrimSpace(buff.String()), "\n")
+	count := func(msg string) int {
+		n := 0
+		for _, line := range lines {
+			if strings.Contains(line, "msg="+msg) {
+				n++
+			}
+		}
+		return n
+	}
+
+	if count("failed") != 3 || count("other") != 3 || count("noise") != 5 {
+		t.Fatalf("unexpected records:\n%s", buff.String())
+	}
+
+	if !strings.Contains(lines[0], "component=test") {
+		t.Fatalf("record without attributes: %s", lines[0])
+	}
+
+	// once a token is refilled the record reports the ones dropped
+	buff.Reset()
+	logger.Handler().Handle(context.Background(), slog.NewRecord(now.Add(time.Second), slog.LevelError, "failed", 0))
+	if !strings.Contains(buff.String(), "suppressed=2") {
+		t.Fatalf("expected suppressed records: %s", buff.String())
+	}
+}
+
+func TestNewLogger(t *testing.T) {
+	var buff bytes.Buffer
+	// the components set the default logger as any other, labeling it once
+	logger := ComponentLogger(newLogger(&buff), "adnl-peer")
+
+	logger.Info("hello")
+	if n := strings.Count(buff.String(), "component="); n != 1 {
+		t.Fatalf("component labeled %d times: %s", n, buff.String())
+	}
+}
+
+func TestComponentLogger(t *testing.T) {
+	var buff bytes.Buffer
+	logger := ComponentLogger(slog.New(slog.NewTextHandler(&buff, nil)), "adnl-peer")
+	logger = ComponentLogger(logger.With("peer_id", "ab"), "dht-node")
+
+	if _, ok := logger.Handler().(*RateLimitedHandler); !ok {
+		t.Fatalf("unexpected handler %T", logger.Handler())
+	}
+
+	logger.Info("started")
+	if !strings.Contains(buff.String(), "msg=started component=adnl-peer peer_id=ab component=dht-node") {
+		t.Fatalf("unexpected record: %s", buff.String())
+	}
+}
@@ -0,0 +1,82 @@
+package utils
+
+import (
+	"sync"
+	"time"
+)
+
+// rateLimiterSweep period after which buckets full of tokens are forgotten
+const rateLimiterSweep = time.Minute
+
+type tokenBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// RateLimiter is a set of token buckets indexed by key, each one refilled with rate tokens
+// per second up to burst tokens. A nil RateLimiter allows everything.
+type RateLimiter struct {
+	rate    float64
+	burst   float64
+	buckets map[string]*tokenBucket
+	// lastSweep date in which idle buckets were removed for the last time
+	lastSweep time.Time
+	mu        sync.Mutex
+}
+
+// NewRateLimiter returns a limiter allowing rate events per second for each key, with bursts
+// of up to burst events. Returns nil, no limit, in case rate isn't positive.
+func NewRateLimiter(rate float64, burst int) *RateLimiter {
+	if rate <= 0 {
+		return nil
+	}
+
+	return &RateLimiter{
+		rate:      rate,
+		burst:     float64(max(burst, 1)),
+		buckets:   make(map[string]*tokenBucket),
+		lastSweep: time.Now(),
+	}
+}
+
+// Allow reports if an event for key is allowed at now, consuming a token in that case.
+func (l *RateLimiter) Allow(key string, now time.Time) bool {
+	if l == nil {
+		return true
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if now.Sub(l.lastSweep) > rateLimiterSweep {
+		l.sweep(now)
+	}
+
+	b, ok := l.buckets[key]
+	if !ok {
+		b = &tokenBucket{tokens: l.burst, last: now}
+		l.buckets[key] = b
+	}
+
+	if elapsed := now.Sub(b.last).Seconds(); elapsed > 0 {
+		b.tokens = min(l.burst, b.tokens+elapsed*l.rate)
+		b.last = now
+	}
+
+	if b.tokens < 1 {
+		return false
+	}
+	b.tokens--
+
+	return true
+}
+
+// sweep removes the buckets that would be full at now, they behave as new ones.
+func (l *RateLimiter) sweep(now time.Time) {
+	for key, b := range l.buckets {
+		if b.tokens+now.Sub(b.last).Seconds()*l.rate >= l.burst {
+			delete(l.buckets, key)
+		}
+	}
+	l.lastSweep = now
+}
@@ -0,0 +1,44 @@
+package utils
+
+import (
+	"testing"
+	"time"
+)
+
+func TestRateLimiter(t *testing.T) {
+	now := time.Now()
+	l := NewRateLimiter(10, 3)
+
+	for i := 0; i < 3; i++ {
+		if !l.Allow("a", now) {
+			t.Fatalf("event %d of the burst should be allowed", i)
+		}
+	}
+
+	if l.Allow("a", now) {
+		t.Fatal("event exceeding the burst should be rejected")
+	}
+
+	// keys have their own bucket
+	if !l.Allow("b", now) {
+		t.Fatal("event of another key should be allowed")
+	}
+
+	// one token is refilled every 100ms
+	now = now.Add(100 * time.Millisecond)
+	if !l.Allow("a", now) || l.Allow("a", now) {
+		t.Fatal("only one event should be allowed after refilling one token")
+	}
+
+	// idle buckets are removed
+	now = now.Add(2 * rateLimiterSweep)
+	l.Allow("c", now)
+	if len(l.buckets) != 1 {
+		t.Fatalf("expected only the bucket of c, got %d buckets", len(l.buckets))
+	}
+
+	unlimited := NewRateLimiter(0, 0)
+	if !unlimited.Allow("a", now) {
+		t.Fatal("nil limiter should allow everything")
+	}
+}